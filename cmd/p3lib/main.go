@@ -0,0 +1,366 @@
+// p3lib is a command line tool to generate relay keys, build, decode and
+// process sphinx packets and run a local relay. It is meant to debug circuits
+// without writing Go code.
+//
+//	p3lib keygen  -out relay.key
+//	p3lib packet  -path path.json -payload "hello" -out packet.bin
+//	p3lib process -key relay.key -in packet.bin -out next.bin
+//	p3lib decode  -in packet.bin
+//	p3lib relay   -key relay.key -listen 127.0.0.1:9001
+//	p3lib vectors -out vectors.json
+//
+// Relay keys are stored encrypted with a passphrase in keystore files. The
+// passphrase is read from the file given with -passphrase-file or from the
+// P3LIB_PASSPHRASE environment variable. keygen -plaintext writes PEM encoded
+// keys instead, which are only meant for tests.
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	ec "crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/hashmatter/p3lib/keystore"
+	sphinx "github.com/hashmatter/p3lib/sphinx"
+	scrypto "github.com/hashmatter/p3lib/sphinx/crypto"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// environment variable with the passphrase of the key files, used when no
+// passphrase file is given
+const passphraseEnv = "P3LIB_PASSPHRASE"
+
+// upper bound of the size of a gob encoded packet, which is dominated by the
+// KEM ciphertexts of the hybrid suites. decoding stops after reading this many
+// bytes, so that peers cannot make the relay allocate arbitrarily large packets
+const maxPacketSize = 16 << 10
+
+const usage = `usage: p3lib <command> [flags]
+
+commands:
+  keygen    generates a relay key pair
+  packet    builds a sphinx packet from a path file and a payload
+  process   processes a packet with a relay key and prints the next hop
+  decode    decodes and prints a packet header
+  relay     runs a local relay
+  vectors   generates the sphinx test vectors
+
+run 'p3lib <command> -h' for the flags of each command
+`
+
+// PathFile is the format of the path files used to build packets. Relays are
+// ordered from the first to the last hop and the public keys are hex encoded.
+type PathFile struct {
+	Relays []struct {
+		Addr   string `json:"addr"`
+		PubKey string `json:"pubkey"`
+	} `json:"relays"`
+	Destination string `json:"destination"`
+}
+
+func main() {
+	err := run(os.Args[1:], os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "p3lib:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(out, usage)
+		return errors.New("a command must be provided")
+	}
+
+	cmds := map[string]func([]string, io.Writer) error{
+		"keygen":  keygen,
+		"packet":  packet,
+		"process": process,
+		"decode":  decode,
+		"relay":   relay,
+		"vectors": vectors,
+	}
+
+	cmd, ok := cmds[args[0]]
+	if !ok {
+		fmt.Fprint(out, usage)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	return cmd(args[1:], out)
+}
+
+func keygen(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	outFile := fs.String("out", "relay.key", "file to write the encrypted private key")
+	passFile := fs.String("passphrase-file", "", "file with the passphrase of the key (default $"+passphraseEnv+")")
+	plaintext := fs.Bool("plaintext", false, "write the private key PEM encoded, without encryption")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var pass []byte
+	if !*plaintext {
+		var err error
+		if pass, err = readPassphrase(*passFile); err != nil {
+			return err
+		}
+	}
+
+	priv, err := keystore.Generate()
+	if err != nil {
+		return err
+	}
+	defer scrypto.WipeECDSAKey(priv)
+	err = writeKey(*outFile, priv, pass)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "private key: %s\npublic key:  %s\n", *outFile,
+		encodePubKey(&priv.PublicKey))
+	return nil
+}
+
+func packet(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("packet", flag.ContinueOnError)
+	pathFile := fs.String("path", "path.json", "path file with the relays and destination")
+	payload := fs.String("payload", "", "payload of the packet")
+	payloadFile := fs.String("payload-file", "", "file with the payload of the packet")
+	outFile := fs.String("out", "packet.bin", "file to write the encoded packet")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	raw, err := ioutil.ReadFile(*pathFile)
+	if err != nil {
+		return err
+	}
+	var path PathFile
+	err = json.Unmarshal(raw, &path)
+	if err != nil {
+		return fmt.Errorf("parsing path file: %v", err)
+	}
+
+	pubKeys := make([]ecdsa.PublicKey, len(path.Relays))
+	addrs := make([][]byte, len(path.Relays))
+	for i, r := range path.Relays {
+		pub, err := decodePubKey(r.PubKey)
+		if err != nil {
+			return fmt.Errorf("relay %v: %v", i, err)
+		}
+		pubKeys[i] = *pub
+		addrs[i] = []byte(r.Addr)
+	}
+
+	p := []byte(*payload)
+	if *payloadFile != "" {
+		p, err = ioutil.ReadFile(*payloadFile)
+		if err != nil {
+			return err
+		}
+	}
+	if len(p) > sphinx.PayloadSize {
+		return fmt.Errorf("payload too large: max %v bytes, got %v",
+			sphinx.PayloadSize, len(p))
+	}
+	var pl [sphinx.PayloadSize]byte
+	copy(pl[:], p)
+
+	sessionKey, err := ecdsa.GenerateKey(ec.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	defer scrypto.WipeECDSAKey(sessionKey)
+	pkt, err := sphinx.NewPacket(sessionKey, pubKeys, []byte(path.Destination), addrs, pl)
+	if err != nil {
+		return err
+	}
+
+	err = writePacket(*outFile, pkt)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "packet: %s\nfirst hop: %s\n", *outFile, path.Relays[0].Addr)
+	return nil
+}
+
+func process(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("process", flag.ContinueOnError)
+	keyFile := fs.String("key", "relay.key", "private key of the relay")
+	passFile := fs.String("passphrase-file", "", "file with the passphrase of the key (default $"+passphraseEnv+")")
+	inFile := fs.String("in", "packet.bin", "encoded packet to process")
+	outFile := fs.String("out", "", "file to write the processed packet (optional)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	priv, err := readKey(*keyFile, *passFile)
+	if err != nil {
+		return err
+	}
+	pkt, err := readPacket(*inFile)
+	if err != nil {
+		return err
+	}
+
+	ctx := sphinx.NewRelayerCtx(priv)
+	nextAddr, next, err := ctx.ProcessPacket(pkt)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "next hop: %s\nis last:  %v\n", trimAddr(nextAddr[:]), next.IsLast())
+	if next.IsLast() {
+		fmt.Fprintf(out, "payload:  %q\n", bytes.TrimRight(next.Payload[:], "\x00"))
+	}
+
+	if *outFile != "" {
+		return writePacket(*outFile, next)
+	}
+	return nil
+}
+
+func decode(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("decode", flag.ContinueOnError)
+	inFile := fs.String("in", "packet.bin", "encoded packet to decode")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	pkt, err := readPacket(*inFile)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "version:          %v\n", pkt.Version)
+	fmt.Fprintf(out, "cipher suite:     %v\n", pkt.Header.Suite)
+	fmt.Fprintf(out, "group element:    %x\n", pkt.Header.GroupElement)
+	fmt.Fprintf(out, "routing info:     %x\n", pkt.Header.RoutingInfo)
+	fmt.Fprintf(out, "routing info mac: %x\n", pkt.Header.RoutingInfoMac)
+	fmt.Fprintf(out, "is last:          %v\n", pkt.IsLast())
+	fmt.Fprintf(out, "payload:          %x\n", pkt.Payload)
+	return nil
+}
+
+// writes the key encrypted with the passphrase in a keystore file, or PEM
+// encoded if there is no passphrase
+func writeKey(file string, priv *ecdsa.PrivateKey, passphrase []byte) error {
+	if passphrase != nil {
+		return keystore.Save(file, priv, passphrase)
+	}
+	der, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	return ioutil.WriteFile(file, pemKey, 0600)
+}
+
+// reads a PEM encoded key, or a keystore file which is decrypted with the
+// passphrase read from passFile
+func readKey(file, passFile string) (*ecdsa.PrivateKey, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	defer scrypto.Wipe(raw)
+	if block, _ := pem.Decode(raw); block != nil {
+		defer scrypto.Wipe(block.Bytes)
+		if block.Type != "EC PRIVATE KEY" {
+			return nil, fmt.Errorf("%s is not a PEM encoded EC private key", file)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	pass, err := readPassphrase(passFile)
+	if err != nil {
+		return nil, err
+	}
+	defer scrypto.Wipe(pass)
+	return keystore.Load(file, pass)
+}
+
+// reads the passphrase of the key files from passFile, or from the environment
+// if passFile is empty. trailing newlines of the file are ignored
+func readPassphrase(passFile string) ([]byte, error) {
+	if passFile == "" {
+		pass := os.Getenv(passphraseEnv)
+		if pass == "" {
+			return nil, fmt.Errorf("a passphrase must be given with -passphrase-file or $%v",
+				passphraseEnv)
+		}
+		return []byte(pass), nil
+	}
+	raw, err := ioutil.ReadFile(passFile)
+	if err != nil {
+		return nil, err
+	}
+	pass := bytes.TrimRight(raw, "\r\n")
+	if len(pass) == 0 {
+		return nil, fmt.Errorf("passphrase file %s is empty", passFile)
+	}
+	return pass, nil
+}
+
+// public keys are hex encoded compressed points
+func encodePubKey(pub *ecdsa.PublicKey) string {
+	return hex.EncodeToString(scrypto.P256PublicKey(pub))
+}
+
+func decodePubKey(s string) (*ecdsa.PublicKey, error) {
+	raw, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	// uncompressed points are accepted for compatibility with older path files
+	if len(raw) == 65 {
+		x, y := ec.Unmarshal(ec.P256(), raw)
+		if x == nil {
+			return nil, errors.New("public key is not a valid P-256 point")
+		}
+		return &ecdsa.PublicKey{Curve: ec.P256(), X: x, Y: y}, nil
+	}
+	pub, err := scrypto.P256ParsePublicKey(raw)
+	if err != nil {
+		return nil, errors.New("public key is not a valid P-256 point")
+	}
+	return pub, nil
+}
+
+func writePacket(file string, p *sphinx.Packet) error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(p)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, buf.Bytes(), 0644)
+}
+
+func readPacket(file string) (*sphinx.Packet, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var p sphinx.Packet
+	err = gob.NewDecoder(io.LimitReader(f, maxPacketSize)).Decode(&p)
+	if err != nil {
+		return nil, fmt.Errorf("decoding packet: %v", err)
+	}
+	return &p, nil
+}
+
+func trimAddr(addr []byte) string {
+	return string(bytes.TrimRight(addr, "\x00"))
+}
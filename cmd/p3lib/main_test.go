@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/gob"
+	"fmt"
+	"github.com/hashmatter/p3lib/keystore"
+	sphinx "github.com/hashmatter/p3lib/sphinx"
+	scrypto "github.com/hashmatter/p3lib/sphinx/crypto"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeygenPacketProcess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p3lib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	passFile := filepath.Join(dir, "passphrase")
+	ioutil.WriteFile(passFile, []byte("relay passphrase\n"), 0600)
+
+	numRelays := 3
+	relays := make([]string, numRelays)
+	for i := range relays {
+		keyFile := filepath.Join(dir, fmt.Sprintf("relay%v.key", i))
+		var out bytes.Buffer
+		err := run([]string{"keygen", "-out", keyFile, "-passphrase-file", passFile}, &out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub := strings.TrimSpace(strings.Split(out.String(), "public key:")[1])
+		relays[i] = fmt.Sprintf(`{"addr": "relay%v", "pubkey": "%s"}`, i, pub)
+	}
+
+	pathFile := filepath.Join(dir, "path.json")
+	path := fmt.Sprintf(`{"relays": [%s], "destination": "dest"}`,
+		strings.Join(relays, ","))
+	ioutil.WriteFile(pathFile, []byte(path), 0644)
+
+	packetFile := filepath.Join(dir, "packet.bin")
+	err = run([]string{"packet", "-path", pathFile, "-payload", "hello p3lib!",
+		"-out", packetFile}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	err = run([]string{"decode", "-in", packetFile}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "is last:          false") {
+		t.Errorf("Unexpected decoded packet:\n%s", out.String())
+	}
+
+	for i := 0; i < numRelays; i++ {
+		out.Reset()
+		keyFile := filepath.Join(dir, fmt.Sprintf("relay%v.key", i))
+		err = run([]string{"process", "-key", keyFile, "-passphrase-file", passFile,
+			"-in", packetFile, "-out", packetFile}, &out)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expNext := fmt.Sprintf("next hop: relay%v", i+1)
+		if i == numRelays-1 {
+			expNext = "next hop: dest"
+		}
+		if !strings.Contains(out.String(), expNext) {
+			t.Errorf("Expected %q, got:\n%s", expNext, out.String())
+		}
+	}
+
+	if !strings.Contains(out.String(), `payload:  "hello p3lib!"`) {
+		t.Errorf("Exit relay did not recover the payload:\n%s", out.String())
+	}
+}
+
+func TestEncryptedKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p3lib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer os.Unsetenv(passphraseEnv)
+	os.Setenv(passphraseEnv, "relay passphrase")
+
+	keyFile := filepath.Join(dir, "relay.key")
+	if err := run([]string{"keygen", "-out", keyFile}, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := ioutil.ReadFile(keyFile)
+	if bytes.Contains(raw, []byte("PRIVATE KEY")) {
+		t.Error("Key should not be written in plaintext")
+	}
+	if _, err := readKey(keyFile, ""); err != nil {
+		t.Errorf("Key should be decrypted with the passphrase of the environment: %v", err)
+	}
+
+	passFile := filepath.Join(dir, "passphrase")
+	ioutil.WriteFile(passFile, []byte("wrong passphrase"), 0600)
+	if _, err := readKey(keyFile, passFile); err != keystore.ErrWrongPassphrase {
+		t.Errorf("Expected %v, got %v", keystore.ErrWrongPassphrase, err)
+	}
+
+	os.Unsetenv(passphraseEnv)
+	if _, err := readKey(keyFile, ""); err == nil {
+		t.Error("Key should not be read without a passphrase")
+	}
+	if err := run([]string{"keygen", "-out", keyFile}, ioutil.Discard); err == nil {
+		t.Error("Key should not be generated without a passphrase")
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	if err := run([]string{"foo"}, ioutil.Discard); err == nil {
+		t.Error("Unknown command should return an error")
+	}
+	if err := run([]string{}, ioutil.Discard); err == nil {
+		t.Error("Missing command should return an error")
+	}
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLocalRelays(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p3lib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	numRelays := 2
+	out := &syncBuffer{}
+	relays := make([]string, numRelays)
+	addrs := make([]string, numRelays)
+	for i := range relays {
+		keyFile := filepath.Join(dir, fmt.Sprintf("relay%v.key", i))
+		var kout bytes.Buffer
+		run([]string{"keygen", "-out", keyFile, "-plaintext"}, &kout)
+		pub := strings.TrimSpace(strings.Split(kout.String(), "public key:")[1])
+		priv, _ := readKey(keyFile, "")
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		r := &localRelay{ctx: sphinx.NewRelayerCtx(priv), out: out}
+		go r.serve(l)
+
+		addrs[i] = l.Addr().String()
+		relays[i] = fmt.Sprintf(`{"addr": "%s", "pubkey": "%s"}`, addrs[i], pub)
+	}
+
+	pathFile := filepath.Join(dir, "path.json")
+	path := fmt.Sprintf(`{"relays": [%s], "destination": "dest"}`,
+		strings.Join(relays, ","))
+	ioutil.WriteFile(pathFile, []byte(path), 0644)
+
+	packetFile := filepath.Join(dir, "packet.bin")
+	err = run([]string{"packet", "-path", pathFile, "-payload", "hello relays!",
+		"-out", packetFile}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, _ := readPacket(packetFile)
+	err = forward(context.Background(), addrs[0], p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := `exit packet for dest, payload: "hello relays!"`
+	for i := 0; i < 50; i++ {
+		if strings.Contains(out.String(), exp) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Errorf("Expected %q in relays output:\n%s", exp, out.String())
+}
+
+// the published test vectors must match the output of the generator
+func TestVectorsUpToDate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p3lib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outFile := filepath.Join(dir, "vectors.json")
+	err = run([]string{"vectors", "-out", outFile}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generated, _ := ioutil.ReadFile(outFile)
+	published, err := ioutil.ReadFile("../../sphinx/testdata/vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(generated, published) {
+		t.Error("sphinx/testdata/vectors.json is outdated, regenerate it with " +
+			"`p3lib vectors -out sphinx/testdata/vectors.json`")
+	}
+}
+
+// packets of the suite with the largest headers must fit in maxPacketSize,
+// while larger inputs are rejected
+func TestMaxPacketSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p3lib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	suite := scrypto.P256MLKEM1024SHA256ChaCha20
+	pubKeys := make([][]byte, 5)
+	relayAddrs := make([][]byte, len(pubKeys))
+	for i := range pubKeys {
+		_, pubKeys[i], err = scrypto.GenerateKey(suite, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		relayAddrs[i] = bytes.Repeat([]byte{'a'}, sphinx.AddrSize)
+	}
+	sessionKey, _, _ := suite.Group().GenerateKey(rand.Reader)
+	p, err := sphinx.NewPacketWithSuite(suite, sessionKey, pubKeys,
+		bytes.Repeat([]byte{'d'}, sphinx.AddrSize), relayAddrs,
+		[sphinx.PayloadSize]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(p)
+	if buf.Len() > maxPacketSize {
+		t.Errorf("Encoded packet has %v bytes, more than maxPacketSize (%v)",
+			buf.Len(), maxPacketSize)
+	}
+	packetFile := filepath.Join(dir, "packet.bin")
+	ioutil.WriteFile(packetFile, buf.Bytes(), 0644)
+	if _, err := readPacket(packetFile); err != nil {
+		t.Fatal(err)
+	}
+
+	p.KEMInfo = make([]byte, maxPacketSize)
+	buf.Reset()
+	gob.NewEncoder(&buf).Encode(p)
+	ioutil.WriteFile(packetFile, buf.Bytes(), 0644)
+	_, err = readPacket(packetFile)
+	if err == nil || !strings.Contains(err.Error(), "EOF") {
+		t.Errorf("Decoding should stop at maxPacketSize, got %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"flag"
+	"fmt"
+	sphinx "github.com/hashmatter/p3lib/sphinx"
+	scrypto "github.com/hashmatter/p3lib/sphinx/crypto"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// runs a relay which accepts one gob encoded packet per TCP connection. relay
+// addresses in the packets are expected to be TCP addresses (host:port). if
+// the relay is the exit of the circuit, the payload is printed instead of
+// forwarded
+func relay(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("relay", flag.ContinueOnError)
+	keyFile := fs.String("key", "relay.key", "private key of the relay")
+	passFile := fs.String("passphrase-file", "", "file with the passphrase of the key (default $"+passphraseEnv+")")
+	listen := fs.String("listen", "127.0.0.1:9001", "TCP address to listen on")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	priv, err := readKey(*keyFile, *passFile)
+	if err != nil {
+		return err
+	}
+	defer scrypto.WipeECDSAKey(priv)
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	fmt.Fprintf(out, "relay listening on %s\npublic key: %s\n", l.Addr(),
+		encodePubKey(&priv.PublicKey))
+
+	r := &localRelay{ctx: sphinx.NewRelayerCtx(priv), out: out}
+	defer r.wipe()
+	return r.serve(l)
+}
+
+type localRelay struct {
+	mu  sync.Mutex
+	ctx *sphinx.RelayerCtx
+	out io.Writer
+}
+
+func (r *localRelay) serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go r.handle(conn)
+	}
+}
+
+// every packet is received, processed and forwarded within a single deadline
+func (r *localRelay) handle(conn net.Conn) {
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	var p sphinx.Packet
+	err := gob.NewDecoder(io.LimitReader(conn, maxPacketSize)).Decode(&p)
+	if err != nil {
+		r.logf("decoding packet from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	// the relayer context keeps state for replay protection
+	r.mu.Lock()
+	nextAddr, next, err := r.ctx.ProcessPacketContext(ctx, &p)
+	r.mu.Unlock()
+	if err != nil {
+		r.logf("processing packet from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	addr := trimAddr(nextAddr[:])
+	if next.IsLast() {
+		r.logf("exit packet for %s, payload: %q", addr,
+			bytes.TrimRight(next.Payload[:], "\x00"))
+		return
+	}
+
+	err = forward(ctx, addr, next)
+	if err != nil {
+		r.logf("forwarding packet to %s: %v", addr, err)
+		return
+	}
+	r.logf("packet forwarded to %s", addr)
+}
+
+// wipes the keys of the relayer context. packets still being handled fail to
+// be processed
+func (r *localRelay) wipe() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ctx.Wipe()
+}
+
+func forward(ctx context.Context, addr string, p *sphinx.Packet) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return gob.NewEncoder(conn).Encode(p)
+}
+
+func (r *localRelay) logf(format string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Fprintf(r.out, time.Now().Format(time.RFC3339)+" "+format+"\n", args...)
+}
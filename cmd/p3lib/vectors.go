@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	sphinx "github.com/hashmatter/p3lib/sphinx"
+	scrypto "github.com/hashmatter/p3lib/sphinx/crypto"
+	"io"
+	"io/ioutil"
+)
+
+// vectors generates the sphinx test vectors. All keys are derived from fixed
+// labels, so the output only changes if the packet format changes.
+func vectors(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("vectors", flag.ContinueOnError)
+	outFile := fs.String("out", "vectors.json", "file to write the JSON test vectors")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	vs, err := generateVectors()
+	if err != nil {
+		return err
+	}
+
+	raw, err := json.MarshalIndent(vs, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(*outFile, append(raw, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "%v test vectors written to %s\n", len(vs), *outFile)
+	return nil
+}
+
+func generateVectors() ([]*sphinx.TestVector, error) {
+	suites := []scrypto.CipherSuite{
+		scrypto.P256SHA256ChaCha20,
+		scrypto.X25519BLAKE2bAESCTR,
+	}
+	addrs := [][]byte{
+		[]byte("/ip4/127.0.0.1/udp/1234"),
+		[]byte("QmQV4LdB3jDKEZxB1EGoutUYyRSt8H8oW4B6DoBLB9z6b7"),
+		[]byte("/ip6/2607:f8b0:4003:c01::6a/udp/5678"),
+		[]byte("/ip4/120.120.0.2/tcp/1222"),
+		[]byte("/ip4/198.162.0.2/tcp/4321"),
+	}
+	dest := []byte("/ip4/127.0.0.1/udp/9999")
+
+	var payload [sphinx.PayloadSize]byte
+	copy(payload[:], []byte("p3lib sphinx test vector"))
+
+	var vs []*sphinx.TestVector
+	for _, suite := range suites {
+		for _, numHops := range []int{1, 3, len(addrs)} {
+			label := fmt.Sprintf("%s/%d", suite.Name(), numHops)
+			sessionKey := vectorKey(suite, label+"/session")
+			hopKeys := make([][]byte, numHops)
+			for i := range hopKeys {
+				hopKeys[i] = vectorKey(suite, fmt.Sprintf("%s/hop-%d", label, i))
+			}
+
+			v, err := sphinx.NewTestVector(suite, sessionKey, hopKeys, dest,
+				addrs[:numHops], payload)
+			if err != nil {
+				return nil, err
+			}
+			vs = append(vs, v)
+		}
+	}
+	return vs, nil
+}
+
+// derives a deterministic private key from a label
+func vectorKey(suite scrypto.CipherSuite, label string) []byte {
+	k := suite.KDF().Hash([]byte("p3lib-sphinx-vectors " + label))
+	return k[:]
+}
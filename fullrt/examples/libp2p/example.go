@@ -20,8 +20,8 @@ import (
 	pstore "github.com/libp2p/go-libp2p-peerstore"
 	proto "github.com/libp2p/go-libp2p-protocol"
 	"io"
+	"io/ioutil"
 	"log"
-	"os"
 	"time"
 )
 
@@ -184,13 +184,7 @@ func startNodeB() {
 
 func reloadIdentityFromFile() (crypto.PrivKey, error) {
 	var emptyPk crypto.PrivKey
-	privRaw := make([]byte, 1196)
-	f, err := os.Open("priv.byte")
-	if err != nil {
-		return emptyPk, err
-	}
-	defer f.Close()
-	_, err = f.Read(privRaw)
+	privRaw, err := ioutil.ReadFile("priv.byte")
 	if err != nil {
 		return emptyPk, err
 	}
@@ -1,6 +1,7 @@
 package fullrt
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -28,6 +29,16 @@ func NewRTProvider(rt interface{}) *RTProvider {
 }
 
 func (rtp *RTProvider) GetFullRoutingTable() (error, []byte) {
+	return rtp.GetFullRoutingTableContext(context.Background())
+}
+
+// GetFullRoutingTableContext is like GetFullRoutingTable, but stops translating
+// the routing table and returns the context error once the context is done
+func (rtp *RTProvider) GetFullRoutingTableContext(ctx context.Context) (error, []byte) {
+	if err := ctx.Err(); err != nil {
+		return err, []byte("")
+	}
+
 	rt := rtp.routingTable
 	rtr := RoutingTableRaw{}
 
@@ -40,6 +51,9 @@ func (rtp *RTProvider) GetFullRoutingTable() (error, []byte) {
 	// translate libp2p routing table to raw registry expected by the protocol.
 	case *kb.RoutingTable:
 		for _, pid := range r.ListPeers() {
+			if err := ctx.Err(); err != nil {
+				return err, []byte("")
+			}
 			rtr = append(rtr, peer.IDB58Encode(pid))
 		}
 
@@ -1,6 +1,7 @@
 package fullrt
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	kb "github.com/libp2p/go-libp2p-kbucket"
@@ -64,3 +65,15 @@ func TestReqFullRoutingTable(t *testing.T) {
 	}
 
 }
+
+func TestGetFullRoutingTableContext(t *testing.T) {
+	rt := kb.NewRoutingTable(10, kb.ConvertPeerID("test"),
+		time.Duration(time.Second*1), pstore.NewMetrics())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err, _ := NewRTProvider(rt).GetFullRoutingTableContext(ctx)
+	if err != context.Canceled {
+		t.Errorf("Routing table request should be cancelled, got %v", err)
+	}
+}
@@ -5,8 +5,10 @@ go 1.12
 require (
 	github.com/Roasbeef/go-go-gadget-paillier v0.0.0-20181009074315-14f1f86b6000
 	github.com/aead/chacha20 v0.0.0-20180709150244-8b13a72661da
+	github.com/libp2p/go-libp2p-crypto v0.0.1
 	github.com/libp2p/go-libp2p-kbucket v0.1.1
 	github.com/libp2p/go-libp2p-peer v0.0.1
 	github.com/libp2p/go-libp2p-peerstore v0.0.1
+	golang.org/x/crypto v0.0.0-20190225124518-7f87c0fbb88b
 	golang.org/x/sys v0.0.0-20190502175342-a43fa875dd82 // indirect
 )
@@ -0,0 +1,265 @@
+// Package keystore generates, stores and loads relay identity keys. Keys are
+// stored encrypted with a passphrase, using a memory-hard key derivation
+// function (Argon2id) and an AEAD cipher (ChaCha20-Poly1305), in a versioned
+// JSON file format readable only by its owner.
+package keystore
+
+import (
+	"crypto/ecdsa"
+	ec "crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	scrypto "github.com/hashmatter/p3lib/sphinx/crypto"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+const (
+	// version of the keystore file format
+	Version = 1
+
+	kdfName    = "argon2id"
+	cipherName = "chacha20-poly1305"
+	curveName  = "P-256"
+	saltSize   = 32
+
+	// bounds of the KDF parameters, so that key files cannot make Load use
+	// unbounded memory or time before the key file is authenticated
+	maxTime   = 64
+	maxMemory = 4 << 20 // 4 GiB
+)
+
+var (
+	ErrWrongPassphrase     = errors.New("keystore: wrong passphrase or corrupted key file")
+	ErrInsecurePermissions = errors.New("keystore: key file must not be accessible by group or others")
+	ErrUnsupportedVersion  = errors.New("keystore: unsupported key file version")
+)
+
+// Params are the Argon2id parameters used to derive the encryption key from
+// the passphrase. Memory is in KiB.
+type Params struct {
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+}
+
+// DefaultParams follow the recommendations of the Argon2 RFC draft for
+// interactive use
+var DefaultParams = Params{Time: 1, Memory: 64 * 1024, Threads: 4}
+
+// validate checks that the parameters are accepted by Argon2id and within the
+// bounds of the keystore
+func (p Params) validate() error {
+	if p.Time < 1 || p.Time > maxTime {
+		return fmt.Errorf("keystore: KDF time must be between 1 and %v, got %v", maxTime, p.Time)
+	}
+	if p.Threads < 1 {
+		return errors.New("keystore: KDF threads must be at least 1")
+	}
+	if p.Memory < 8*uint32(p.Threads) || p.Memory > maxMemory {
+		return fmt.Errorf("keystore: KDF memory must be between %v and %v KiB, got %v",
+			8*uint32(p.Threads), maxMemory, p.Memory)
+	}
+	return nil
+}
+
+// keyFile is the on-disk format of an encrypted key
+type keyFile struct {
+	Version   int    `json:"version"`
+	Curve     string `json:"curve"`
+	PublicKey string `json:"public_key"`
+	KDF       struct {
+		Name string `json:"name"`
+		Salt string `json:"salt"`
+		Params
+	} `json:"kdf"`
+	Cipher struct {
+		Name  string `json:"name"`
+		Nonce string `json:"nonce"`
+	} `json:"cipher"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+// Generate generates a new relay key
+func Generate() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(ec.P256(), rand.Reader)
+}
+
+// Save encrypts the key with the passphrase and writes it to path with the
+// default parameters. The file is only readable and writable by its owner.
+func Save(path string, key *ecdsa.PrivateKey, passphrase []byte) error {
+	return SaveWithParams(path, key, passphrase, DefaultParams)
+}
+
+func SaveWithParams(path string, key *ecdsa.PrivateKey, passphrase []byte, params Params) error {
+	raw, err := Encrypt(key, passphrase, params)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	// writes to a temporary file first, so that an existing key is never left
+	// half written
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, raw, 0600)
+	if err == nil {
+		// the file may have existed with more permissive permissions
+		err = os.Chmod(tmp, 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// Load reads and decrypts the key stored in path. Files accessible by the
+// group or by others are rejected.
+func Load(path string, passphrase []byte) (*ecdsa.PrivateKey, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return nil, ErrInsecurePermissions
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Decrypt(raw, passphrase)
+}
+
+// Encrypt encrypts the key with the passphrase and returns the encoded key
+// file
+func Encrypt(key *ecdsa.PrivateKey, passphrase []byte, params Params) ([]byte, error) {
+	if key.Curve != ec.P256() {
+		return nil, fmt.Errorf("keystore: unsupported curve %v", key.Curve.Params().Name)
+	}
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	defer scrypto.Wipe(der)
+
+	var kf keyFile
+	kf.Version = Version
+	kf.Curve = curveName
+	kf.PublicKey = hex.EncodeToString(ec.Marshal(key.Curve, key.X, key.Y))
+
+	salt := make([]byte, saltSize)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	kf.KDF.Name = kdfName
+	kf.KDF.Salt = hex.EncodeToString(salt)
+	kf.KDF.Params = params
+
+	aead, err := chacha20poly1305.New(deriveKey(passphrase, salt, params))
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	kf.Cipher.Name = cipherName
+	kf.Cipher.Nonce = hex.EncodeToString(nonce)
+
+	ct := aead.Seal(nil, nonce, der, additionalData(&kf))
+	kf.Ciphertext = hex.EncodeToString(ct)
+
+	return json.MarshalIndent(kf, "", "  ")
+}
+
+// Decrypt decodes and decrypts a key file
+func Decrypt(raw []byte, passphrase []byte) (*ecdsa.PrivateKey, error) {
+	var kf keyFile
+	err := json.Unmarshal(raw, &kf)
+	if err != nil {
+		return nil, fmt.Errorf("keystore: decoding key file: %v", err)
+	}
+
+	if kf.Version != Version {
+		return nil, ErrUnsupportedVersion
+	}
+	if kf.Curve != curveName || kf.KDF.Name != kdfName || kf.Cipher.Name != cipherName {
+		return nil, fmt.Errorf("keystore: unsupported key file algorithms (%v, %v, %v)",
+			kf.Curve, kf.KDF.Name, kf.Cipher.Name)
+	}
+	// the parameters are validated before deriving the key, since they are
+	// only authenticated once the key is derived
+	if err := kf.KDF.Params.validate(); err != nil {
+		return nil, err
+	}
+
+	salt, err := hex.DecodeString(kf.KDF.Salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hex.DecodeString(kf.Cipher.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	ct, err := hex.DecodeString(kf.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.New(deriveKey(passphrase, salt, kf.KDF.Params))
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, ErrWrongPassphrase
+	}
+
+	der, err := aead.Open(nil, nonce, ct, additionalData(&kf))
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	defer scrypto.Wipe(der)
+
+	key, err := x509.ParseECPrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	if key.Curve != ec.P256() {
+		return nil, fmt.Errorf("keystore: unsupported curve %v", key.Curve.Params().Name)
+	}
+	return key, nil
+}
+
+func deriveKey(passphrase, salt []byte, params Params) []byte {
+	return argon2.IDKey(passphrase, salt, params.Time, params.Memory, params.Threads,
+		chacha20poly1305.KeySize)
+}
+
+// the metadata of the key file is authenticated, so that it cannot be
+// tampered with (e.g. to swap the public key or weaken the KDF parameters)
+func additionalData(kf *keyFile) []byte {
+	return []byte(fmt.Sprintf("%d|%s|%s|%s|%s|%d|%d|%d|%s", kf.Version, kf.Curve,
+		kf.PublicKey, kf.KDF.Name, kf.KDF.Salt, kf.KDF.Time, kf.KDF.Memory,
+		kf.KDF.Threads, kf.Cipher.Name))
+}
@@ -0,0 +1,175 @@
+package keystore
+
+import (
+	crypto "github.com/libp2p/go-libp2p-crypto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// low cost KDF parameters to keep tests fast
+var testParams = Params{Time: 1, Memory: 64, Threads: 1}
+
+func TestSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "keys", "relay.json")
+	err = SaveWithParams(path, key, []byte("secret passphrase"), testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Key file permissions should be 0600, got %v", info.Mode().Perm())
+	}
+
+	loaded, err := Load(path, []byte("secret passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.D.Cmp(key.D) != 0 || loaded.X.Cmp(key.X) != 0 {
+		t.Error("Loaded key does not match the saved key")
+	}
+
+	_, err = Load(path, []byte("wrong passphrase"))
+	if err != ErrWrongPassphrase {
+		t.Errorf("Expected ErrWrongPassphrase, got %v", err)
+	}
+
+	os.Chmod(path, 0644)
+	_, err = Load(path, []byte("secret passphrase"))
+	if err != ErrInsecurePermissions {
+		t.Errorf("Expected ErrInsecurePermissions, got %v", err)
+	}
+}
+
+// a failed save must not leave the temporary file behind
+func TestSaveFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// renaming a file over a non empty directory fails
+	path := filepath.Join(dir, "relay.json")
+	os.MkdirAll(filepath.Join(path, "dir"), 0700)
+	err = SaveWithParams(path, key, []byte("secret passphrase"), testParams)
+	if err == nil {
+		t.Fatal("Saving over a directory should fail")
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Temporary key file should be removed, got %v", err)
+	}
+}
+
+func TestTamperedKeyFile(t *testing.T) {
+	key, _ := Generate()
+	raw, err := Encrypt(key, []byte("pass"), testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// weakening the KDF parameters must be detected
+	tampered := strings.Replace(string(raw), `"memory": 64`, `"memory": 8`, 1)
+	_, err = Decrypt([]byte(tampered), []byte("pass"))
+	if err != ErrWrongPassphrase {
+		t.Errorf("Tampered key file should not decrypt, got %v", err)
+	}
+
+	unsupported := strings.Replace(string(raw), `"version": 1`, `"version": 2`, 1)
+	_, err = Decrypt([]byte(unsupported), []byte("pass"))
+	if err != ErrUnsupportedVersion {
+		t.Errorf("Expected ErrUnsupportedVersion, got %v", err)
+	}
+}
+
+func TestInvalidParams(t *testing.T) {
+	key, _ := Generate()
+	for _, params := range []Params{
+		{},
+		{Time: 0, Memory: 64, Threads: 1},
+		{Time: 1, Memory: 64, Threads: 0},
+		{Time: 1, Memory: 7, Threads: 1},
+		{Time: 1, Memory: 64, Threads: 16},
+		{Time: maxTime + 1, Memory: 64, Threads: 1},
+		{Time: 1, Memory: maxMemory + 1, Threads: 1},
+	} {
+		if _, err := Encrypt(key, []byte("pass"), params); err == nil {
+			t.Errorf("Key should not be encrypted with parameters %+v", params)
+		}
+	}
+
+	// key files with invalid parameters are rejected before deriving the key
+	raw, err := Encrypt(key, []byte("pass"), testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []struct{ old, new string }{
+		{`"time": 1`, `"time": 0`},
+		{`"threads": 1`, `"threads": 0`},
+		{`"memory": 64`, `"memory": 4294967295`},
+		{`"time": 1`, `"time": 4294967295`},
+	} {
+		tampered := strings.Replace(string(raw), r.old, r.new, 1)
+		if _, err := Decrypt([]byte(tampered), []byte("pass")); err == nil || err == ErrWrongPassphrase {
+			t.Errorf("Expected invalid parameters error for %v, got %v", r.new, err)
+		}
+	}
+}
+
+func TestLibp2pImportExport(t *testing.T) {
+	key, _ := Generate()
+
+	raw, err := ExportLibp2p(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// exported key must be readable by libp2p
+	lpriv, err := crypto.UnmarshalPrivateKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported, err := FromLibp2p(lpriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.D.Cmp(key.D) != 0 {
+		t.Error("Imported key does not match the exported key")
+	}
+
+	imported, err = ImportLibp2p(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.D.Cmp(key.D) != 0 {
+		t.Error("Imported key does not match the exported key")
+	}
+
+	edKey, _, _ := crypto.GenerateKeyPair(crypto.Ed25519, 0)
+	if _, err := FromLibp2p(edKey); err != ErrNotECDSAKey {
+		t.Errorf("Expected ErrNotECDSAKey, got %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package keystore
+
+import (
+	"crypto/ecdsa"
+	ec "crypto/elliptic"
+	"crypto/x509"
+	"errors"
+	crypto "github.com/libp2p/go-libp2p-crypto"
+	pb "github.com/libp2p/go-libp2p-crypto/pb"
+)
+
+var ErrNotECDSAKey = errors.New("keystore: libp2p key is not a P-256 ECDSA key")
+
+// ToLibp2p converts a relay key to a libp2p private key, so that the same
+// identity can be used by a libp2p host
+func ToLibp2p(key *ecdsa.PrivateKey) (crypto.PrivKey, error) {
+	priv, _, err := crypto.ECDSAKeyPairFromKey(key)
+	return priv, err
+}
+
+// FromLibp2p converts a libp2p ECDSA private key to a relay key
+func FromLibp2p(key crypto.PrivKey) (*ecdsa.PrivateKey, error) {
+	if key.Type() != pb.KeyType_ECDSA {
+		return nil, ErrNotECDSAKey
+	}
+	raw, err := key.Raw()
+	if err != nil {
+		return nil, err
+	}
+	priv, err := x509.ParseECPrivateKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	if priv.Curve != ec.P256() {
+		return nil, ErrNotECDSAKey
+	}
+	return priv, nil
+}
+
+// ExportLibp2p encodes a relay key in the libp2p protobuf private key format
+// (the format expected by libp2p's crypto.UnmarshalPrivateKey)
+func ExportLibp2p(key *ecdsa.PrivateKey) ([]byte, error) {
+	priv, err := ToLibp2p(key)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.MarshalPrivateKey(priv)
+}
+
+// ImportLibp2p decodes a relay key from the libp2p protobuf private key format
+func ImportLibp2p(raw []byte) (*ecdsa.PrivateKey, error) {
+	priv, err := crypto.UnmarshalPrivateKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	return FromLibp2p(priv)
+}
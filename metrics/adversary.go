@@ -0,0 +1,244 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// NodeKind distinguishes clients from relays
+type NodeKind int
+
+const (
+	Client NodeKind = iota
+	Relay
+)
+
+type Node struct {
+	Kind  NodeKind
+	Index int
+}
+
+func (n Node) String() string {
+	if n.Kind == Client {
+		return fmt.Sprintf("client-%d", n.Index)
+	}
+	return fmt.Sprintf("relay-%d", n.Index)
+}
+
+// Transmission is a packet sent over a link, as observed by a global passive
+// adversary. Message is the ground truth and is not visible to the adversary.
+type Transmission struct {
+	ID      int
+	Time    time.Duration
+	From    Node
+	To      Node
+	Message int
+}
+
+// Mapping records that the packet received by a relay in transmission In was
+// forwarded in transmission Out. Mappings are only visible to the adversary
+// for compromised relays.
+type Mapping struct {
+	Relay int
+	In    int
+	Out   int
+}
+
+// Trace is the record of the packets sent through a mixnet. Transmissions
+// must be ordered by ID.
+type Trace struct {
+	Transmissions []Transmission
+	Mappings      []Mapping
+}
+
+// DelayModel returns the (relative) likelihood of a relay delaying a packet by
+// d before forwarding it
+type DelayModel interface {
+	Weight(d time.Duration) float64
+}
+
+// Adversary models an adversary which observes all the links of the network
+// (global passive adversary) and, optionally, controls a set of relays
+type Adversary struct {
+	// delay model of the relays, known by the adversary
+	Delays DelayModel
+
+	// latency of the links. the adversary knows when a packet arrives at a
+	// relay
+	LinkLatency time.Duration
+
+	// relays controlled by the adversary. the adversary knows which input
+	// became which output at these relays
+	Compromised map[int]bool
+}
+
+// MessageReport contains the anonymity metrics of a delivered message
+type MessageReport struct {
+	Message  int
+	Sender   int
+	Receiver int
+
+	// distribution of the sender as estimated by the adversary
+	Senders Distribution
+
+	Entropy    float64
+	MinEntropy float64
+
+	// probability assigned by the adversary to the true sender
+	SenderProbability float64
+}
+
+// Report contains the anonymity metrics of all messages in a trace
+type Report struct {
+	Messages []MessageReport
+
+	MeanEntropy    float64
+	MinEntropy     float64
+	MeanMinEntropy float64
+
+	// expected probability of the adversary linking a delivered message to its
+	// sender (i.e. mean probability assigned to the true senders)
+	Linkability float64
+
+	// fraction of messages for which the most likely sender is the true sender
+	LinkedFraction float64
+}
+
+// CompromiseFraction selects a fraction of the relays uniformly at random.
+// The fraction is clamped to [0, 1].
+func CompromiseFraction(r *rand.Rand, numRelays int, fraction float64) map[int]bool {
+	if !(fraction > 0) {
+		fraction = 0
+	} else if fraction > 1 {
+		fraction = 1
+	}
+	n := int(math.Round(fraction * float64(numRelays)))
+	compromised := map[int]bool{}
+	for _, i := range r.Perm(numRelays)[:n] {
+		compromised[i] = true
+	}
+	return compromised
+}
+
+// SenderDistributions estimates, for every transmission, the probability
+// distribution over the clients that may have sent the packet. A relay output
+// may correspond to any packet that arrived at the relay before the output was
+// sent, weighted by the likelihood of the corresponding delay. Outputs of
+// compromised relays are linked to their inputs.
+func (a Adversary) SenderDistributions(trace Trace) map[int]Distribution {
+	inputs := map[int][]Transmission{}
+	for _, t := range trace.Transmissions {
+		if t.To.Kind == Relay {
+			inputs[t.To.Index] = append(inputs[t.To.Index], t)
+		}
+	}
+
+	known := map[int]int{}
+	for _, m := range trace.Mappings {
+		if a.Compromised[m.Relay] {
+			known[m.Out] = m.In
+		}
+	}
+
+	// transmissions are sorted by time, so the distributions of all candidate
+	// inputs are known when an output is processed
+	txs := append([]Transmission{}, trace.Transmissions...)
+	sort.SliceStable(txs, func(i, j int) bool { return txs[i].Time < txs[j].Time })
+
+	dists := map[int]Distribution{}
+	for _, t := range txs {
+		if t.From.Kind == Client {
+			dists[t.ID] = Distribution{t.From.Index: 1}
+			continue
+		}
+		if in, ok := known[t.ID]; ok {
+			dists[t.ID] = dists[in]
+			continue
+		}
+
+		dist := Distribution{}
+		for _, in := range inputs[t.From.Index] {
+			w := a.Delays.Weight(t.Time - (in.Time + a.LinkLatency))
+			if w == 0 || dists[in.ID] == nil {
+				continue
+			}
+			for _, sender := range dists[in.ID].keys() {
+				dist[sender] += w * dists[in.ID][sender]
+			}
+		}
+		dist.Normalize()
+		dists[t.ID] = dist
+	}
+	return dists
+}
+
+// Analyze computes the anonymity metrics of all messages delivered to clients
+// in the trace
+func (a Adversary) Analyze(trace Trace) *Report {
+	dists := a.SenderDistributions(trace)
+
+	senders := map[int]int{}
+	for _, t := range trace.Transmissions {
+		if t.From.Kind == Client {
+			senders[t.Message] = t.From.Index
+		}
+	}
+
+	r := &Report{MinEntropy: math.Inf(1)}
+	for _, t := range trace.Transmissions {
+		if t.From.Kind != Relay || t.To.Kind != Client {
+			continue
+		}
+
+		d := dists[t.ID]
+		m := MessageReport{
+			Message:           t.Message,
+			Sender:            senders[t.Message],
+			Receiver:          t.To.Index,
+			Senders:           d,
+			Entropy:           ShannonEntropy(d),
+			MinEntropy:        MinEntropy(d),
+			SenderProbability: d[senders[t.Message]],
+		}
+		r.Messages = append(r.Messages, m)
+
+		r.MeanEntropy += m.Entropy
+		r.MeanMinEntropy += m.MinEntropy
+		r.Linkability += m.SenderProbability
+		if d.MostLikely() == m.Sender {
+			r.LinkedFraction++
+		}
+		if m.Entropy < r.MinEntropy {
+			r.MinEntropy = m.Entropy
+		}
+	}
+
+	n := float64(len(r.Messages))
+	if n == 0 {
+		r.MinEntropy = 0
+		return r
+	}
+	r.MeanEntropy /= n
+	r.MeanMinEntropy /= n
+	r.Linkability /= n
+	r.LinkedFraction /= n
+	return r
+}
+
+// CheckRegression compares the report with a baseline and returns an error if
+// the mean entropy decreased or the linkability increased by more than
+// tolerance. It is meant to be used in tests to catch privacy regressions.
+func (r *Report) CheckRegression(baseline *Report, tolerance float64) error {
+	if r.MeanEntropy < baseline.MeanEntropy-tolerance {
+		return fmt.Errorf("metrics: mean entropy regressed from %.4f to %.4f bits",
+			baseline.MeanEntropy, r.MeanEntropy)
+	}
+	if r.Linkability > baseline.Linkability+tolerance {
+		return fmt.Errorf("metrics: linkability regressed from %.4f to %.4f",
+			baseline.Linkability, r.Linkability)
+	}
+	return nil
+}
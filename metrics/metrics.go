@@ -0,0 +1,105 @@
+// Package metrics implements anonymity metrics for mixnets and onion routing
+// circuits. It computes the entropy of anonymity sets and estimates how well
+// an adversary links senders to the messages delivered to receivers, given a
+// trace of the packets observed on the wire (e.g. produced by the sphinx relay
+// pipeline or by the simulator package).
+package metrics
+
+import (
+	"math"
+	"sort"
+)
+
+// Distribution is a probability distribution over the members of an anonymity
+// set (e.g. the senders which may have sent a message)
+type Distribution map[int]float64
+
+// ShannonEntropy returns the entropy (in bits) of the distribution. The
+// probabilities are summed in a fixed order, so that results are
+// deterministic.
+func ShannonEntropy(d Distribution) float64 {
+	var h float64
+	for _, k := range d.keys() {
+		if p := d[k]; p > 0 {
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
+
+// MinEntropy returns the min-entropy (in bits) of the distribution, i.e. the
+// uncertainty of an adversary which guesses the most likely member of the
+// anonymity set
+func MinEntropy(d Distribution) float64 {
+	max := d.max()
+	if max == 0 {
+		return 0
+	}
+	return -math.Log2(max)
+}
+
+// DegreeOfAnonymity returns the Shannon entropy of the distribution normalized
+// by the maximum entropy of an anonymity set of size n. It is 1 when all
+// members are equally likely and 0 when the adversary knows the member.
+func DegreeOfAnonymity(d Distribution, n int) float64 {
+	if n <= 1 {
+		return 0
+	}
+	return ShannonEntropy(d) / math.Log2(float64(n))
+}
+
+// AnonymitySetSize returns the number of members with non-zero probability
+func AnonymitySetSize(d Distribution) int {
+	n := 0
+	for _, p := range d {
+		if p > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// Normalize scales the probabilities of the distribution so that they sum to 1
+func (d Distribution) Normalize() {
+	var total float64
+	for _, k := range d.keys() {
+		total += d[k]
+	}
+	if total == 0 {
+		return
+	}
+	for k := range d {
+		d[k] /= total
+	}
+}
+
+// MostLikely returns the member with the highest probability. Ties are broken
+// by the lowest member.
+func (d Distribution) MostLikely() int {
+	best, bestP := -1, -1.0
+	for _, k := range d.keys() {
+		if d[k] > bestP {
+			best, bestP = k, d[k]
+		}
+	}
+	return best
+}
+
+func (d Distribution) max() float64 {
+	var max float64
+	for _, p := range d {
+		if p > max {
+			max = p
+		}
+	}
+	return max
+}
+
+func (d Distribution) keys() []int {
+	keys := make([]int, 0, len(d))
+	for k := range d {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
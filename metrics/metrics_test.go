@@ -0,0 +1,227 @@
+package metrics
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	ec "crypto/elliptic"
+	crand "crypto/rand"
+	"fmt"
+	sphinx "github.com/hashmatter/p3lib/sphinx"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestEntropy(t *testing.T) {
+	uniform := Distribution{0: 0.25, 1: 0.25, 2: 0.25, 3: 0.25}
+	if h := ShannonEntropy(uniform); h != 2 {
+		t.Errorf("Shannon entropy of uniform distribution over 4 should be 2, got %v", h)
+	}
+	if h := MinEntropy(uniform); h != 2 {
+		t.Errorf("Min-entropy of uniform distribution over 4 should be 2, got %v", h)
+	}
+	if d := DegreeOfAnonymity(uniform, 4); d != 1 {
+		t.Errorf("Degree of anonymity should be 1, got %v", d)
+	}
+
+	skewed := Distribution{0: 0.5, 1: 0.25, 2: 0.25}
+	if h := ShannonEntropy(skewed); h != 1.5 {
+		t.Errorf("Shannon entropy should be 1.5, got %v", h)
+	}
+	if h := MinEntropy(skewed); h != 1 {
+		t.Errorf("Min-entropy should be 1, got %v", h)
+	}
+	if n := AnonymitySetSize(skewed); n != 3 {
+		t.Errorf("Anonymity set size should be 3, got %v", n)
+	}
+	if s := skewed.MostLikely(); s != 0 {
+		t.Errorf("Most likely member should be 0, got %v", s)
+	}
+
+	known := Distribution{3: 1}
+	if ShannonEntropy(known) != 0 || MinEntropy(known) != 0 {
+		t.Error("Entropy of a known member should be 0")
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	d := Distribution{0: 2, 1: 6}
+	d.Normalize()
+	if d[0] != 0.25 || d[1] != 0.75 {
+		t.Errorf("Unexpected normalized distribution %v", d)
+	}
+}
+
+// uniform delay model: any input received before the output is equally likely
+type uniformDelays struct{}
+
+func (u uniformDelays) Weight(d time.Duration) float64 {
+	if d < 0 {
+		return 0
+	}
+	return 1
+}
+
+// two clients send one message each through the same relay (threshold mix)
+func mixTrace() Trace {
+	c0, c1 := Node{Kind: Client, Index: 0}, Node{Kind: Client, Index: 1}
+	r0 := Node{Kind: Relay, Index: 0}
+	return Trace{
+		Transmissions: []Transmission{
+			{ID: 0, Time: 0, From: c0, To: r0, Message: 0},
+			{ID: 1, Time: 1, From: c1, To: r0, Message: 1},
+			{ID: 2, Time: 5, From: r0, To: c1, Message: 1},
+			{ID: 3, Time: 5, From: r0, To: c0, Message: 0},
+		},
+		Mappings: []Mapping{
+			{Relay: 0, In: 1, Out: 2},
+			{Relay: 0, In: 0, Out: 3},
+		},
+	}
+}
+
+func TestGlobalPassiveAdversary(t *testing.T) {
+	adv := Adversary{Delays: uniformDelays{}}
+	r := adv.Analyze(mixTrace())
+
+	if len(r.Messages) != 2 {
+		t.Fatalf("Expected 2 delivered messages, got %v", len(r.Messages))
+	}
+	if r.MeanEntropy != 1 || r.MinEntropy != 1 || r.MeanMinEntropy != 1 {
+		t.Errorf("Both messages should have 1 bit of entropy, got %+v", r)
+	}
+	if r.Linkability != 0.5 {
+		t.Errorf("Linkability should be 0.5, got %v", r.Linkability)
+	}
+}
+
+func TestCompromisedRelays(t *testing.T) {
+	adv := Adversary{Delays: uniformDelays{}, Compromised: map[int]bool{0: true}}
+	r := adv.Analyze(mixTrace())
+
+	if r.MeanEntropy != 0 || r.Linkability != 1 || r.LinkedFraction != 1 {
+		t.Errorf("Compromised mix must link all messages, got %+v", r)
+	}
+
+	baseline := Adversary{Delays: uniformDelays{}}.Analyze(mixTrace())
+	if err := r.CheckRegression(baseline, 0.1); err == nil {
+		t.Error("Regression from compromised relay should be detected")
+	}
+	if err := baseline.CheckRegression(baseline, 0); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCompromiseFraction(t *testing.T) {
+	c := CompromiseFraction(rand.New(rand.NewSource(1)), 10, 0.3)
+	if len(c) != 3 {
+		t.Errorf("Expected 3 compromised relays, got %v", len(c))
+	}
+	if len(CompromiseFraction(rand.New(rand.NewSource(1)), 10, 0)) != 0 {
+		t.Error("No relays should be compromised")
+	}
+
+	// fractions out of [0, 1] are clamped
+	if len(CompromiseFraction(rand.New(rand.NewSource(1)), 10, 1.5)) != 10 {
+		t.Error("All relays should be compromised")
+	}
+	if len(CompromiseFraction(rand.New(rand.NewSource(1)), 10, -0.5)) != 0 {
+		t.Error("No relays should be compromised")
+	}
+}
+
+// records the trace of packets processed by sphinx relays: four clients send
+// one message each through a circuit of three threshold mixes
+func TestRecorder(t *testing.T) {
+	numClients, numRelays := 4, 3
+	rec := NewRecorder()
+
+	relays := make([]*sphinx.RelayerCtx, numRelays)
+	pubKeys := make([]ecdsa.PublicKey, numRelays)
+	addrs := make([][]byte, numRelays)
+	for i := range relays {
+		priv, _ := ecdsa.GenerateKey(ec.P256(), crand.Reader)
+		relays[i] = sphinx.NewRelayerCtx(priv)
+		relays[i].SetObserver(rec.Observer(i))
+		pubKeys[i] = priv.PublicKey
+		addrs[i] = []byte(fmt.Sprintf("relay%d", i))
+	}
+
+	var batch []*sphinx.Packet
+	for c := 0; c < numClients; c++ {
+		sessionKey, _ := ecdsa.GenerateKey(ec.P256(), crand.Reader)
+		dest := []byte(fmt.Sprintf("client%d", (c+1)%numClients))
+		p, err := sphinx.NewPacket(sessionKey, pubKeys, dest, addrs,
+			[sphinx.PayloadSize]byte{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec.Transmit(time.Duration(c), Node{Kind: Client, Index: c},
+			Node{Kind: Relay, Index: 0}, p)
+		batch = append(batch, p)
+	}
+
+	// every relay processes the whole batch before forwarding it in a random
+	// order
+	r := rand.New(rand.NewSource(1))
+	for i, relay := range relays {
+		var next []*sphinx.Packet
+		var to []Node
+		for _, p := range batch {
+			addr, out, err := relay.ProcessPacket(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			next = append(next, out)
+			to = append(to, addrNode(addr[:]))
+		}
+		batch = make([]*sphinx.Packet, len(next))
+		for j, k := range r.Perm(len(next)) {
+			batch[j] = next[k]
+			rec.Transmit(time.Duration(10*(i+1)), Node{Kind: Relay, Index: i},
+				to[k], next[k])
+		}
+	}
+
+	trace := rec.Trace()
+	if len(trace.Transmissions) != numClients*(numRelays+1) {
+		t.Fatalf("Expected %v transmissions, got %v", numClients*(numRelays+1),
+			len(trace.Transmissions))
+	}
+	if len(trace.Mappings) != numClients*numRelays {
+		t.Fatalf("Expected %v mappings, got %v", numClients*numRelays,
+			len(trace.Mappings))
+	}
+
+	report := Adversary{Delays: uniformDelays{}}.Analyze(trace)
+	if len(report.Messages) != numClients {
+		t.Fatalf("Expected %v delivered messages, got %v", numClients, len(report.Messages))
+	}
+	for _, m := range report.Messages {
+		if m.Receiver != (m.Sender+1)%numClients {
+			t.Errorf("Message of client %v delivered to client %v", m.Sender, m.Receiver)
+		}
+	}
+	if report.MeanEntropy != 2 || report.Linkability != 0.25 {
+		t.Errorf("Threshold mixes should hide senders among 4 clients, got %+v", report)
+	}
+
+	// the adversary links all the messages when it controls all the relays
+	all := map[int]bool{0: true, 1: true, 2: true}
+	report = Adversary{Delays: uniformDelays{}, Compromised: all}.Analyze(trace)
+	if report.MeanEntropy != 0 || report.Linkability != 1 {
+		t.Errorf("Compromised circuit must link all messages, got %+v", report)
+	}
+}
+
+func addrNode(addr []byte) Node {
+	var n Node
+	addr = bytes.TrimRight(addr, "\x00")
+	if _, err := fmt.Sscanf(string(addr), "relay%d", &n.Index); err == nil {
+		n.Kind = Relay
+		return n
+	}
+	fmt.Sscanf(string(addr), "client%d", &n.Index)
+	n.Kind = Client
+	return n
+}
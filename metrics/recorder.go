@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"crypto/sha256"
+	sphinx "github.com/hashmatter/p3lib/sphinx"
+	"sync"
+	"time"
+)
+
+// Recorder builds a trace from a running sphinx relay pipeline. The networking
+// layer records every packet sent over a link with Transmit, and the relayer
+// context of every relay reports which input became which output through the
+// observer returned by Observer. A packet is identified by its header, which
+// changes at every hop.
+type Recorder struct {
+	mu    sync.Mutex
+	trace Trace
+
+	// message and ID of the last transmission of each packet
+	received map[[sha256.Size]byte]recorded
+
+	// outputs of relays which have not been transmitted yet
+	outputs map[[sha256.Size]byte]output
+
+	nextMessage int
+}
+
+type recorded struct {
+	id      int
+	message int
+}
+
+type output struct {
+	relay int
+	in    recorded
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{
+		received: map[[sha256.Size]byte]recorded{},
+		outputs:  map[[sha256.Size]byte]output{},
+	}
+}
+
+// Transmit records that packet was sent from one node to another at time t
+// and returns the ID of the transmission. Packets sent by clients are new
+// messages, while packets sent by relays belong to the message of the input
+// they were processed from.
+func (r *Recorder) Transmit(t time.Duration, from, to Node, packet *sphinx.Packet) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	digest := packetDigest(packet)
+	tx := Transmission{ID: len(r.trace.Transmissions), Time: t, From: from, To: to}
+	if out, ok := r.outputs[digest]; ok && from.Kind == Relay {
+		delete(r.outputs, digest)
+		tx.Message = out.in.message
+		r.trace.Mappings = append(r.trace.Mappings,
+			Mapping{Relay: out.relay, In: out.in.id, Out: tx.ID})
+	} else {
+		tx.Message = r.nextMessage
+		r.nextMessage++
+	}
+
+	r.trace.Transmissions = append(r.trace.Transmissions, tx)
+	r.received[digest] = recorded{id: tx.ID, message: tx.Message}
+	return tx.ID
+}
+
+// Observer returns the observer of the relayer context of the relay with the
+// given index (see sphinx.RelayerCtx.SetObserver). Inputs which have not been
+// recorded with Transmit are ignored.
+func (r *Recorder) Observer(relay int) sphinx.Observer {
+	return func(in *sphinx.Packet, next [sphinx.AddrSize]byte, out *sphinx.Packet) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		digest := packetDigest(in)
+		rec, ok := r.received[digest]
+		if !ok {
+			return
+		}
+		delete(r.received, digest)
+		r.outputs[packetDigest(out)] = output{relay: relay, in: rec}
+	}
+}
+
+// Trace returns a copy of the trace recorded so far
+func (r *Recorder) Trace() Trace {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return Trace{
+		Transmissions: append([]Transmission{}, r.trace.Transmissions...),
+		Mappings:      append([]Mapping{}, r.trace.Mappings...),
+	}
+}
+
+func packetDigest(p *sphinx.Packet) [sha256.Size]byte {
+	h := sha256.New()
+	if p.Header != nil {
+		h.Write(p.GroupElement)
+		h.Write(p.RoutingInfoMac[:])
+	}
+	h.Write(p.Payload[:])
+	var d [sha256.Size]byte
+	copy(d[:], h.Sum(nil))
+	return d
+}
@@ -0,0 +1,373 @@
+// Package simulator implements an in-process, discrete-event mixnet simulator
+// to evaluate circuit and mixing configurations before deploying them. The
+// simulator runs a set of sphinx relays and clients sending messages through
+// them and records what a global passive adversary observes on the wire, as
+// well as the ground truth of which input packet became which output packet at
+// each relay. Runs are deterministic given a seed.
+package simulator
+
+import (
+	"container/heap"
+	"crypto/ecdsa"
+	ec "crypto/elliptic"
+	"errors"
+	"fmt"
+	metrics "github.com/hashmatter/p3lib/metrics"
+	sphinx "github.com/hashmatter/p3lib/sphinx"
+	"math"
+	"math/big"
+	"math/rand"
+	"time"
+)
+
+// PathSelector selects the relays (by index) of a circuit of a given length
+type PathSelector func(r *rand.Rand, numRelays, length int) []int
+
+// UniformPaths selects distinct relays uniformly at random
+func UniformPaths(r *rand.Rand, numRelays, length int) []int {
+	return r.Perm(numRelays)[:length]
+}
+
+// Mixing defines the delay introduced by relays before forwarding a packet.
+// Weight returns the (relative) likelihood of a packet being delayed by d and
+// is used to estimate the anonymity provided by the mixing strategy.
+type Mixing interface {
+	Delay(r *rand.Rand) time.Duration
+	Weight(d time.Duration) float64
+}
+
+// ExponentialMixing delays each packet independently by an exponentially
+// distributed amount of time (i.e. continuous time, or Poisson, mixing)
+type ExponentialMixing struct {
+	Mean time.Duration
+}
+
+func (m ExponentialMixing) Delay(r *rand.Rand) time.Duration {
+	return time.Duration(r.ExpFloat64() * float64(m.Mean))
+}
+
+func (m ExponentialMixing) Weight(d time.Duration) float64 {
+	if d < 0 {
+		return 0
+	}
+	return math.Exp(-float64(d) / float64(m.Mean))
+}
+
+// NoMixing forwards packets as soon as they are processed
+type NoMixing struct{}
+
+func (m NoMixing) Delay(r *rand.Rand) time.Duration { return 0 }
+
+func (m NoMixing) Weight(d time.Duration) float64 {
+	if d == 0 {
+		return 1
+	}
+	return 0
+}
+
+type Config struct {
+	// seed of the simulation. runs with the same configuration and seed
+	// produce the same results
+	Seed int64
+
+	NumRelays         int
+	NumClients        int
+	MessagesPerClient int
+	PathLength        int
+
+	// mean of the exponentially distributed time between two messages sent
+	// by the same client
+	SendInterval time.Duration
+
+	// latency of every link between clients and relays
+	LinkLatency time.Duration
+
+	Mixing        Mixing
+	PathSelection PathSelector
+}
+
+// the trace types are shared with the metrics package, which analyzes the
+// traces produced by simulations
+type (
+	NodeKind     = metrics.NodeKind
+	Node         = metrics.Node
+	Transmission = metrics.Transmission
+	Mapping      = metrics.Mapping
+	Trace        = metrics.Trace
+)
+
+const (
+	Client = metrics.Client
+	Relay  = metrics.Relay
+)
+
+type Message struct {
+	ID          int
+	Sender      int
+	Receiver    int
+	Path        []int
+	SentAt      time.Duration
+	DeliveredAt time.Duration
+}
+
+func (m Message) Latency() time.Duration {
+	return m.DeliveredAt - m.SentAt
+}
+
+type Result struct {
+	Trace    Trace
+	Messages []Message
+
+	MeanLatency time.Duration
+	MaxLatency  time.Duration
+
+	// entropy (in bits) of the sender distribution of delivered messages, as
+	// estimated by a global passive adversary
+	MeanEntropy float64
+	MinEntropy  float64
+}
+
+type eventKind int
+
+const (
+	evSend eventKind = iota
+	evArrive
+	evDepart
+)
+
+type event struct {
+	time   time.Duration
+	seq    int
+	kind   eventKind
+	node   int
+	msg    int
+	tx     int
+	packet *sphinx.Packet
+	next   string
+}
+
+type eventQueue []*event
+
+func (q eventQueue) Len() int { return len(q) }
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].time == q[j].time {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].time < q[j].time
+}
+func (q eventQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *eventQueue) Push(x interface{}) { *q = append(*q, x.(*event)) }
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+type simulation struct {
+	cfg     Config
+	rand    *rand.Rand
+	queue   eventQueue
+	seq     int
+	relays  []*sphinx.RelayerCtx
+	pubKeys []ecdsa.PublicKey
+	addrs   map[string]Node
+	sent    []int
+	result  *Result
+}
+
+// Run runs a simulation until all messages are delivered
+func Run(cfg Config) (*Result, error) {
+	err := validateConfig(&cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &simulation{
+		cfg:    cfg,
+		rand:   rand.New(rand.NewSource(cfg.Seed)),
+		addrs:  map[string]Node{},
+		sent:   make([]int, cfg.NumClients),
+		result: &Result{},
+	}
+
+	for i := 0; i < cfg.NumRelays; i++ {
+		priv := s.generateKey()
+		s.relays = append(s.relays, sphinx.NewRelayerCtx(priv))
+		s.pubKeys = append(s.pubKeys, priv.PublicKey)
+		n := Node{Kind: Relay, Index: i}
+		s.addrs[n.String()] = n
+	}
+	for i := 0; i < cfg.NumClients; i++ {
+		n := Node{Kind: Client, Index: i}
+		s.addrs[n.String()] = n
+		s.schedule(&event{time: s.interval(), kind: evSend, node: i})
+	}
+
+	for s.queue.Len() > 0 {
+		e := heap.Pop(&s.queue).(*event)
+		var err error
+		switch e.kind {
+		case evSend:
+			err = s.send(e)
+		case evArrive:
+			err = s.arrive(e)
+		case evDepart:
+			err = s.depart(e)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.summarize()
+	return s.result, nil
+}
+
+func validateConfig(cfg *Config) error {
+	if cfg.NumRelays <= 0 || cfg.NumClients <= 0 || cfg.MessagesPerClient <= 0 {
+		return errors.New("simulator: number of relays, clients and messages must be positive")
+	}
+	if cfg.PathLength <= 0 || cfg.PathLength > cfg.NumRelays {
+		return fmt.Errorf("simulator: invalid path length %v for %v relays",
+			cfg.PathLength, cfg.NumRelays)
+	}
+	if cfg.Mixing == nil {
+		cfg.Mixing = NoMixing{}
+	}
+	if cfg.PathSelection == nil {
+		cfg.PathSelection = UniformPaths
+	}
+	if cfg.SendInterval <= 0 {
+		cfg.SendInterval = time.Second
+	}
+	return nil
+}
+
+// generates a key pair from the simulation's PRNG, so that runs are
+// deterministic. must not be used outside simulations
+func (s *simulation) generateKey() *ecdsa.PrivateKey {
+	curve := ec.P256()
+	n := new(big.Int).Sub(curve.Params().N, big.NewInt(1))
+	d := new(big.Int).Rand(s.rand, n)
+	d.Add(d, big.NewInt(1))
+
+	priv := &ecdsa.PrivateKey{D: d}
+	priv.PublicKey.Curve = curve
+	priv.PublicKey.X, priv.PublicKey.Y = curve.ScalarBaseMult(d.Bytes())
+	return priv
+}
+
+func (s *simulation) schedule(e *event) {
+	e.seq = s.seq
+	s.seq++
+	heap.Push(&s.queue, e)
+}
+
+func (s *simulation) interval() time.Duration {
+	return time.Duration(s.rand.ExpFloat64() * float64(s.cfg.SendInterval))
+}
+
+func (s *simulation) transmit(t time.Duration, from, to Node, msg int) int {
+	id := len(s.result.Trace.Transmissions)
+	s.result.Trace.Transmissions = append(s.result.Trace.Transmissions,
+		Transmission{ID: id, Time: t, From: from, To: to, Message: msg})
+	return id
+}
+
+func (s *simulation) send(e *event) error {
+	client := e.node
+	path := s.cfg.PathSelection(s.rand, s.cfg.NumRelays, s.cfg.PathLength)
+	receiver := s.rand.Intn(s.cfg.NumClients)
+
+	pubKeys := make([]ecdsa.PublicKey, len(path))
+	addrs := make([][]byte, len(path))
+	for i, r := range path {
+		pubKeys[i] = s.pubKeys[r]
+		addrs[i] = []byte(Node{Kind: Relay, Index: r}.String())
+	}
+
+	msg := Message{
+		ID:       len(s.result.Messages),
+		Sender:   client,
+		Receiver: receiver,
+		Path:     path,
+		SentAt:   e.time,
+	}
+	s.result.Messages = append(s.result.Messages, msg)
+
+	var payload [sphinx.PayloadSize]byte
+	copy(payload[:], fmt.Sprintf("message %d", msg.ID))
+	packet, err := sphinx.NewPacket(s.generateKey(), pubKeys,
+		[]byte(Node{Kind: Client, Index: receiver}.String()), addrs, payload)
+	if err != nil {
+		return err
+	}
+
+	tx := s.transmit(e.time, Node{Kind: Client, Index: client},
+		Node{Kind: Relay, Index: path[0]}, msg.ID)
+	s.schedule(&event{time: e.time + s.cfg.LinkLatency, kind: evArrive,
+		node: path[0], msg: msg.ID, tx: tx, packet: packet})
+
+	s.sent[client]++
+	if s.sent[client] < s.cfg.MessagesPerClient {
+		s.schedule(&event{time: e.time + s.interval(), kind: evSend, node: client})
+	}
+	return nil
+}
+
+func (s *simulation) arrive(e *event) error {
+	nextAddr, next, err := s.relays[e.node].ProcessPacket(e.packet)
+	if err != nil {
+		return fmt.Errorf("simulator: relay %v: %v", e.node, err)
+	}
+	s.schedule(&event{time: e.time + s.cfg.Mixing.Delay(s.rand), kind: evDepart,
+		node: e.node, msg: e.msg, tx: e.tx, packet: next, next: trimAddr(nextAddr[:])})
+	return nil
+}
+
+func (s *simulation) depart(e *event) error {
+	to, ok := s.addrs[e.next]
+	if !ok {
+		return fmt.Errorf("simulator: unknown address %v", e.next)
+	}
+
+	tx := s.transmit(e.time, Node{Kind: Relay, Index: e.node}, to, e.msg)
+	s.result.Trace.Mappings = append(s.result.Trace.Mappings,
+		Mapping{Relay: e.node, In: e.tx, Out: tx})
+
+	arrival := e.time + s.cfg.LinkLatency
+	if e.packet.IsLast() {
+		s.result.Messages[e.msg].DeliveredAt = arrival
+		return nil
+	}
+	s.schedule(&event{time: arrival, kind: evArrive, node: to.Index,
+		msg: e.msg, tx: tx, packet: e.packet})
+	return nil
+}
+
+func (s *simulation) summarize() {
+	r := s.result
+	var total time.Duration
+	for _, m := range r.Messages {
+		l := m.Latency()
+		total += l
+		if l > r.MaxLatency {
+			r.MaxLatency = l
+		}
+	}
+	r.MeanLatency = total / time.Duration(len(r.Messages))
+
+	adv := metrics.Adversary{Delays: s.cfg.Mixing, LinkLatency: s.cfg.LinkLatency}
+	report := adv.Analyze(r.Trace)
+	r.MeanEntropy = report.MeanEntropy
+	r.MinEntropy = report.MinEntropy
+}
+
+func trimAddr(addr []byte) string {
+	n := len(addr)
+	for n > 0 && addr[n-1] == 0 {
+		n--
+	}
+	return string(addr[:n])
+}
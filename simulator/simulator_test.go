@@ -0,0 +1,150 @@
+package simulator
+
+import (
+	metrics "github.com/hashmatter/p3lib/metrics"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testConfig(seed int64, mixing Mixing) Config {
+	return Config{
+		Seed:              seed,
+		NumRelays:         6,
+		NumClients:        8,
+		MessagesPerClient: 5,
+		PathLength:        3,
+		SendInterval:      100 * time.Millisecond,
+		LinkLatency:       10 * time.Millisecond,
+		Mixing:            mixing,
+	}
+}
+
+func TestDeterministicRuns(t *testing.T) {
+	cfg := testConfig(42, ExponentialMixing{Mean: 50 * time.Millisecond})
+
+	r1, err := Run(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := Run(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(r1, r2) {
+		t.Error("Runs with the same seed must produce the same results")
+	}
+
+	r3, err := Run(testConfig(43, cfg.Mixing))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(r1.Trace, r3.Trace) {
+		t.Error("Runs with different seeds should produce different traces")
+	}
+}
+
+func TestTraceAndLatency(t *testing.T) {
+	cfg := testConfig(1, NoMixing{})
+	r, err := Run(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	numMsgs := cfg.NumClients * cfg.MessagesPerClient
+	if len(r.Messages) != numMsgs {
+		t.Fatalf("Expected %v messages, got %v", numMsgs, len(r.Messages))
+	}
+
+	// each message is sent once by the client and forwarded once per hop
+	expTxs := numMsgs * (cfg.PathLength + 1)
+	if len(r.Trace.Transmissions) != expTxs {
+		t.Errorf("Expected %v transmissions, got %v", expTxs, len(r.Trace.Transmissions))
+	}
+	if len(r.Trace.Mappings) != numMsgs*cfg.PathLength {
+		t.Errorf("Expected %v mappings, got %v", numMsgs*cfg.PathLength,
+			len(r.Trace.Mappings))
+	}
+
+	// mappings must link transmissions of the same message
+	for _, m := range r.Trace.Mappings {
+		in, out := r.Trace.Transmissions[m.In], r.Trace.Transmissions[m.Out]
+		if in.Message != out.Message || in.To != out.From {
+			t.Errorf("Invalid mapping %v: %v -> %v", m, in, out)
+		}
+	}
+
+	// without mixing, the latency is the sum of the link latencies
+	expLatency := time.Duration(cfg.PathLength+1) * cfg.LinkLatency
+	for _, m := range r.Messages {
+		if m.Latency() != expLatency {
+			t.Errorf("Message %v latency %v, expected %v", m.ID, m.Latency(), expLatency)
+		}
+	}
+	if r.MeanLatency != expLatency || r.MaxLatency != expLatency {
+		t.Errorf("Unexpected latency summary: mean %v, max %v", r.MeanLatency, r.MaxLatency)
+	}
+
+	// without mixing, the global passive adversary links every message
+	if r.MeanEntropy != 0 {
+		t.Errorf("Entropy without mixing should be 0, got %v", r.MeanEntropy)
+	}
+}
+
+func TestMixingIncreasesEntropy(t *testing.T) {
+	cfg := testConfig(7, ExponentialMixing{Mean: 500 * time.Millisecond})
+	r, err := Run(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.MeanEntropy <= 1 {
+		t.Errorf("Exponential mixing should provide anonymity, mean entropy %v",
+			r.MeanEntropy)
+	}
+	if r.MeanLatency <= time.Duration(cfg.PathLength+1)*cfg.LinkLatency {
+		t.Errorf("Mixing should add latency, got %v", r.MeanLatency)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	cfg := testConfig(1, nil)
+	cfg.PathLength = cfg.NumRelays + 1
+	if _, err := Run(cfg); err == nil {
+		t.Error("Path longer than the number of relays must be rejected")
+	}
+}
+
+// privacy regression check: compromising relays must not increase the
+// anonymity of the messages, and a fully compromised network links them all
+func TestCompromisedRelaysLinkability(t *testing.T) {
+	cfg := testConfig(3, ExponentialMixing{Mean: 500 * time.Millisecond})
+	r, err := Run(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adv := metrics.Adversary{Delays: cfg.Mixing, LinkLatency: cfg.LinkLatency}
+	baseline := adv.Analyze(r.Trace)
+	if baseline.MeanEntropy != r.MeanEntropy {
+		t.Errorf("Simulator and metrics entropy mismatch: %v != %v",
+			r.MeanEntropy, baseline.MeanEntropy)
+	}
+
+	adv.Compromised = metrics.CompromiseFraction(rand.New(rand.NewSource(1)),
+		cfg.NumRelays, 0.5)
+	partial := adv.Analyze(r.Trace)
+	if err := baseline.CheckRegression(partial, 0); err != nil {
+		t.Error(err)
+	}
+
+	adv.Compromised = metrics.CompromiseFraction(rand.New(rand.NewSource(1)),
+		cfg.NumRelays, 1)
+	full := adv.Analyze(r.Trace)
+	if full.MeanEntropy != 0 || full.LinkedFraction != 1 {
+		t.Errorf("All messages should be linked with all relays compromised: %v %v",
+			full.MeanEntropy, full.LinkedFraction)
+	}
+}
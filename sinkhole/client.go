@@ -0,0 +1,184 @@
+package sinkhole
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	hcrypto "github.com/hashmatter/p3lib/sinkhole/crypto"
+	"math/big"
+)
+
+// ErrNotFound is returned when decoding the response to a query for a key
+// which is not stored by the sinkhole provider
+var ErrNotFound = errors.New("sinkhole: no value stored for key")
+
+// Client builds CPIR queries for the keys stored by a sinkhole provider and
+// decodes the responses. The address space parameters must be the same as
+// the provider's.
+type Client struct {
+	suffixLen int
+	privLen   int
+	tailLen   int
+	dims      int
+	sk        hcrypto.PrivateKey
+}
+
+// Query is an encrypted query for a key. Only the suffix of the key is
+// disclosed to the provider; the position of the key in the private space is
+// encrypted in a one-hot vector under the client's key. Recursive queries
+// have one one-hot vector per dimension, which are concatenated in Vector.
+type Query struct {
+	Suffix     string
+	Dimensions int
+	Vector     [][]byte
+	PubKey     hcrypto.PublicKey
+
+	// row and tail of the queried key, which are never sent to the provider
+	index int
+	tail  []byte
+}
+
+// NewClient creates a client for a provider with the given suffix, private
+// and tail space lengths. Queries are encrypted under the homomorphic scheme of
+// sk (e.g. Paillier or Damgård–Jurik).
+func NewClient(suffixLen, privLen, tailLen int, sk hcrypto.PrivateKey) *Client {
+	return NewRecursiveClient(suffixLen, privLen, tailLen, 1, sk)
+}
+
+// NewRecursiveClient creates a client which arranges the rows of the buckets
+// as a hypercube of dims dimensions. Queries have dims·2^(8·privLen/dims)
+// ciphertexts instead of 2^(8·privLen), while answers grow with the ciphertext
+// expansion of the scheme for every dimension but the first.
+func NewRecursiveClient(suffixLen, privLen, tailLen, dims int, sk hcrypto.PrivateKey) *Client {
+	return &Client{
+		suffixLen: suffixLen,
+		privLen:   privLen,
+		tailLen:   tailLen,
+		dims:      dims,
+		sk:        sk,
+	}
+}
+
+// NewQuery builds the encrypted query for a key
+func (c *Client) NewQuery(key []byte) (*Query, error) {
+	return c.NewQueryContext(context.Background(), key)
+}
+
+// NewQueryContext is like NewQuery, but stops encrypting the query vector and
+// returns the context error once the context is done
+func (c *Client) NewQueryContext(ctx context.Context, key []byte) (*Query, error) {
+	if c.dims < 1 || c.dims > maxDimensions {
+		return nil, fmt.Errorf("Query must have between 1 and %v dimensions, got %v",
+			maxDimensions, c.dims)
+	}
+	spaceLen := c.suffixLen + c.privLen + c.tailLen
+	index, err := calculateIndex(spaceLen, c.suffixLen, c.privLen, key)
+	if err != nil {
+		return nil, err
+	}
+
+	side := hypercubeSide(numRows(c.privLen), c.dims)
+	q := &Query{
+		Suffix:     string(key[:c.suffixLen]),
+		Dimensions: c.dims,
+		Vector:     make([][]byte, c.dims*side),
+		PubKey:     c.sk.Public(),
+		index:      int(index.Int64()),
+		tail:       append([]byte{}, keyTail(c.suffixLen, c.privLen, c.tailLen, key)...),
+	}
+
+	// every element is encrypted, so that the provider can not tell the
+	// selected coordinates apart
+	coords := hypercubeCoords(q.index, side, c.dims)
+	zero, one := big.NewInt(0).Bytes(), big.NewInt(1).Bytes()
+	for i := range q.Vector {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		v := zero
+		if i%side == coords[i/side] {
+			v = one
+		}
+		q.Vector[i], err = hcrypto.Encrypt(q.PubKey, rand.Reader, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// Decode decrypts the answer of the provider to the query and returns the
+// value stored for the queried key, or ErrNotFound if there is none. The
+// answer holds all the entries of the row of the key, and the value is picked
+// by the tail of the key.
+func (c *Client) Decode(q *Query, answer [][]byte) ([]byte, error) {
+	answer, err := unfold(c.sk, q.Dimensions, answer)
+	if err != nil {
+		return nil, err
+	}
+	row, err := decryptRow(c.sk, answer)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := decodeRow(row)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := findEntry(entries, q.tail)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return v, nil
+}
+
+// decrypts the blocks of the answer and returns the selected row. Every block
+// of the answer is the sum of the products of the block of each row by the
+// query vector. All the rows but the selected one are multiplied by zero.
+func decryptRow(sk hcrypto.PrivateKey, answer [][]byte) ([]byte, error) {
+	blocks := make([][]byte, len(answer))
+	for i, c := range answer {
+		var err error
+		if blocks[i], err = hcrypto.Decrypt(sk, c); err != nil {
+			return nil, err
+		}
+	}
+	return joinBlocks(blocks, blockSize(sk.Public()))
+}
+
+// Provider is the API of a sinkhole provider, as served over HTTP or streams
+type Provider interface {
+	Info(ctx context.Context) (*Info, error)
+	Status(ctx context.Context) (*Status, error)
+	Query(ctx context.Context, q *Query) ([][]byte, error)
+}
+
+// Lookup runs the full CPIR exchange with the provider: it fetches the address
+// spaces of the provider, queries the key encrypted under sk and decodes the
+// answer. It returns ErrNotFound if the provider does not store a value for
+// the key.
+func Lookup(ctx context.Context, p Provider, sk hcrypto.PrivateKey, key []byte) ([]byte, error) {
+	return LookupRecursive(ctx, p, sk, 1, key)
+}
+
+// LookupRecursive is like Lookup, but queries the key with a recursive query
+// of dims dimensions
+func LookupRecursive(ctx context.Context, p Provider, sk hcrypto.PrivateKey, dims int,
+	key []byte) ([]byte, error) {
+
+	info, err := p.Info(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c := NewRecursiveClient(info.SuffixLen, info.P, info.T, dims, sk)
+	q, err := c.NewQueryContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	answer, err := p.Query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return c.Decode(q, answer)
+}
@@ -0,0 +1,184 @@
+package sinkhole
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	hcrypto "github.com/hashmatter/p3lib/sinkhole/crypto"
+	"testing"
+)
+
+func TestClientQuery(t *testing.T) {
+	suffixLen, privLen, tailLen := 4, 1, 11
+
+	sinkhole := NewProvider(suffixLen+privLen+tailLen, suffixLen, privLen)
+	err := sinkhole.Add("1dfe", []byte("1dfe9a3ab24b22"), []byte("value1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cliPrivKey, _ := hcrypto.Paillier.GenerateKey(crand.Reader, 128)
+	client := NewClient(suffixLen, privLen, tailLen, cliPrivKey)
+
+	key := []byte("1dfe9a3ab24b22")
+	q, err := client.NewQuery(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Suffix != "1dfe" {
+		t.Errorf("Query should only disclose the suffix, got %v", q.Suffix)
+	}
+	if len(q.Vector) != 256 {
+		t.Errorf("Query should have 256 rows, got %v", len(q.Vector))
+	}
+	if string(key) != "1dfe9a3ab24b22" {
+		t.Errorf("Query construction must not modify the key, got %s", key)
+	}
+
+	res, err := sinkhole.Query(q.Suffix, q.Vector, q.PubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := client.Decode(q, res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "value1" {
+		t.Errorf("Wrong value decoded: %s", v)
+	}
+
+	// key in a stored suffix space, but with no value
+	q, _ = client.NewQuery([]byte("1dfe8a3ab24b22"))
+	res, err = sinkhole.Query(q.Suffix, q.Vector, q.PubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Decode(q, res); err != ErrNotFound {
+		t.Errorf("Expected %v, got %v", ErrNotFound, err)
+	}
+
+	// suffix space not stored by the provider
+	q, _ = client.NewQuery([]byte("2dfe9a3ab24b22"))
+	res, err = sinkhole.Query(q.Suffix, q.Vector, q.PubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Decode(q, res); err != ErrNotFound {
+		t.Errorf("Expected %v, got %v", ErrNotFound, err)
+	}
+
+	// answers are re-randomized, so that empty rows and suffix spaces not
+	// stored by the provider can not be told apart
+	a1, _ := sinkhole.Query(q.Suffix, q.Vector, q.PubKey)
+	a2, _ := sinkhole.Query(q.Suffix, q.Vector, q.PubKey)
+	if bytes.Equal(a1[0], a2[0]) {
+		t.Error("Answers to the same query should be re-randomized")
+	}
+
+	// keys which share the private space are stored in the same row and do not
+	// overwrite each other
+	if err := sinkhole.Add("1dfe", []byte("1dfe9a3ab24b23"), []byte("value2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sinkhole.Add("1dfe", []byte("1dfe9a3ab24b22"), []byte("value3")); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]string{
+		"1dfe9a3ab24b22": "value3",
+		"1dfe9a3ab24b23": "value2",
+	} {
+		q, _ = client.NewQuery([]byte(key))
+		res, err = sinkhole.Query(q.Suffix, q.Vector, q.PubKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, err := client.Decode(q, res); string(v) != value {
+			t.Errorf("%v: expected %v, got %s (%v)", key, value, v, err)
+		}
+	}
+	if st := sinkhole.Status(); st.Tuples != 2 {
+		t.Errorf("Expected 2 tuples, got %v", st.Tuples)
+	}
+
+	// values larger than the modulus are answered in several blocks
+	large := make([]byte, 1000)
+	for i := range large {
+		large[i] = byte(i)
+	}
+	if err := sinkhole.Add("1dfe", []byte("1dfe9a3ab24b24"), large); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string][]byte{
+		"1dfe9a3ab24b24": large,
+		"1dfe9a3ab24b23": []byte("value2"),
+	} {
+		q, _ = client.NewQuery([]byte(key))
+		res, err = sinkhole.Query(q.Suffix, q.Vector, q.PubKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) < 1000/blockSize(q.PubKey) {
+			t.Errorf("%v: expected an answer in several blocks, got %v", key, len(res))
+		}
+		if v, err := client.Decode(q, res); !bytes.Equal(v, value) {
+			t.Errorf("%v: large row was not recovered (%v)", key, err)
+		}
+	}
+
+	if _, err := client.NewQuery([]byte("1df")); err == nil {
+		t.Error("Keys shorter than the private space should not be queried")
+	}
+}
+
+func TestClientQuerySchemes(t *testing.T) {
+	sinkhole := NewProvider(16, 4, 1)
+	large := make([]byte, 1000)
+	for i := range large {
+		large[i] = byte(i)
+	}
+	if err := sinkhole.Add("1dfe", []byte("1dfe9a3ab24b22"), large); err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := map[string]int{}
+	for _, scheme := range []hcrypto.HomomorphicScheme{
+		hcrypto.Paillier,
+		hcrypto.DamgardJurik(1),
+		hcrypto.DamgardJurik(3),
+	} {
+		sk, err := scheme.GenerateKey(crand.Reader, 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := NewClient(4, 1, 11, sk)
+		q, err := client.NewQuery([]byte("1dfe9a3ab24b22"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the provider selects the scheme by the public key of the query
+		raw, err := q.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dec Query
+		if err := dec.UnmarshalBinary(raw); err != nil {
+			t.Fatal(err)
+		}
+		res, err := sinkhole.Query(dec.Suffix, dec.Vector, dec.PubKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, err := client.Decode(q, res); !bytes.Equal(v, large) {
+			t.Errorf("%v: value was not recovered (%v)", scheme.Name(), err)
+		}
+		blocks[scheme.Name()] = len(res)
+	}
+
+	// larger expansion factors answer the row in fewer blocks
+	if blocks["Damgard-Jurik-3"] >= blocks["Damgard-Jurik-1"] {
+		t.Errorf("Expected fewer blocks with a larger expansion factor, got %v", blocks)
+	}
+	if blocks["Damgard-Jurik-1"] != blocks["Paillier"] {
+		t.Errorf("Damgård–Jurik with s = 1 should answer as Paillier, got %v", blocks)
+	}
+}
@@ -0,0 +1,265 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// The Damgård–Jurik scheme generalizes Paillier to plaintexts modulo N^s and
+// ciphertexts modulo N^(s+1), for an expansion factor s >= 1. With s = 1, it
+// is the Paillier scheme. Larger expansion factors encrypt larger plaintexts
+// under the same key with a smaller ciphertext expansion, (s+1)/s, so large
+// values are answered in fewer blocks.
+//
+//   encryption: c = (1+N)^m * r^(N^s) mod N^(s+1)
+//   decryption: c^d = (1+N)^m mod N^(s+1), where d = 1 mod N^s and d = 0 mod
+//               lcm(p-1, q-1), and m is recovered from (1+N)^m
+//
+// See I. Damgård and M. Jurik, "A Generalisation, a Simplification and Some
+// Applications of Paillier's Probabilistic Public-Key System", PKC 2001.
+
+// max expansion factor accepted in public keys
+const maxExpansionFactor = 16
+
+var one = big.NewInt(1)
+
+// DamgardJurik returns the Damgård–Jurik scheme which generates keys with the
+// expansion factor s. Keys of any expansion factor are used by all the
+// Damgård–Jurik schemes, since keys carry their expansion factor.
+func DamgardJurik(s int) HomomorphicScheme {
+	return damgardJurik{s: s}
+}
+
+// DamgardJurikPublicKey is a Damgård–Jurik public key with the expansion
+// factor S
+type DamgardJurikPublicKey struct {
+	N *big.Int
+	S int
+
+	ns  *big.Int // N^s, the plaintext modulus
+	ns1 *big.Int // N^(s+1), the ciphertext modulus
+}
+
+func (pk *DamgardJurikPublicKey) Scheme() HomomorphicScheme { return damgardJurik{s: pk.S} }
+
+// DamgardJurikPrivateKey is a Damgård–Jurik private key
+type DamgardJurikPrivateKey struct {
+	DamgardJurikPublicKey
+	d *big.Int
+}
+
+func (sk *DamgardJurikPrivateKey) Public() PublicKey {
+	return &sk.DamgardJurikPublicKey
+}
+
+type damgardJurik struct {
+	s int
+}
+
+func (damgardJurik) ID() SchemeID { return SchemeDamgardJurik }
+
+func (dj damgardJurik) Name() string { return fmt.Sprintf("Damgard-Jurik-%v", dj.s) }
+
+func (dj damgardJurik) GenerateKey(random io.Reader, bits int) (PrivateKey, error) {
+	if dj.s < 1 || dj.s > maxExpansionFactor {
+		return nil, fmt.Errorf("Expansion factor must be between 1 and %v, got %v",
+			maxExpansionFactor, dj.s)
+	}
+
+	var p, q, n *big.Int
+	for {
+		var err error
+		if p, err = rand.Prime(random, bits/2); err != nil {
+			return nil, err
+		}
+		if q, err = rand.Prime(random, bits-bits/2); err != nil {
+			return nil, err
+		}
+		n = new(big.Int).Mul(p, q)
+		if p.Cmp(q) != 0 && n.BitLen() == bits {
+			break
+		}
+	}
+	pk := newDamgardJurikPublicKey(n, dj.s)
+
+	// lambda = lcm(p-1, q-1), and d = lambda * (lambda^-1 mod N^s), so that
+	// d = 0 mod lambda and d = 1 mod N^s
+	p1 := new(big.Int).Sub(p, one)
+	q1 := new(big.Int).Sub(q, one)
+	gcd := new(big.Int).GCD(nil, nil, p1, q1)
+	lambda := new(big.Int).Div(new(big.Int).Mul(p1, q1), gcd)
+	inv := new(big.Int).ModInverse(lambda, pk.ns)
+	if inv == nil {
+		return nil, errors.New("Invalid Damgård–Jurik primes")
+	}
+
+	return &DamgardJurikPrivateKey{
+		DamgardJurikPublicKey: *pk,
+		d:                     new(big.Int).Mul(lambda, inv),
+	}, nil
+}
+
+func newDamgardJurikPublicKey(n *big.Int, s int) *DamgardJurikPublicKey {
+	ns := new(big.Int).Exp(n, big.NewInt(int64(s)), nil)
+	return &DamgardJurikPublicKey{
+		N:   n,
+		S:   s,
+		ns:  ns,
+		ns1: new(big.Int).Mul(ns, n),
+	}
+}
+
+func (damgardJurik) PlaintextSize(pk PublicKey) int {
+	k, ok := pk.(*DamgardJurikPublicKey)
+	if !ok {
+		return 0
+	}
+	return (k.ns.BitLen() - 1) / 8
+}
+
+func (damgardJurik) CiphertextSize(pk PublicKey) int {
+	k, ok := pk.(*DamgardJurikPublicKey)
+	if !ok {
+		return 0
+	}
+	return len(k.ns1.Bytes())
+}
+
+func (dj damgardJurik) Encrypt(pk PublicKey, random io.Reader, m []byte) ([]byte, error) {
+	k, ok := pk.(*DamgardJurikPublicKey)
+	if !ok {
+		return nil, ErrKeyType
+	}
+	x, err := parsePlaintext(m, k.ns)
+	if err != nil {
+		return nil, err
+	}
+	if random == nil {
+		random = rand.Reader
+	}
+
+	// r must be a unit of Z_N
+	var r *big.Int
+	for {
+		if r, err = rand.Int(random, k.N); err != nil {
+			return nil, err
+		}
+		if r.Sign() > 0 && new(big.Int).GCD(nil, nil, r, k.N).Cmp(one) == 0 {
+			break
+		}
+	}
+
+	g := new(big.Int).Add(k.N, one)
+	c := new(big.Int).Exp(g, x, k.ns1)
+	c.Mul(c, new(big.Int).Exp(r, k.ns, k.ns1))
+	return serialize(c.Mod(c, k.ns1), dj.CiphertextSize(pk)), nil
+}
+
+func (damgardJurik) Decrypt(sk PrivateKey, c []byte) ([]byte, error) {
+	k, ok := sk.(*DamgardJurikPrivateKey)
+	if !ok {
+		return nil, ErrKeyType
+	}
+	x, err := parseCiphertext(c, k.ns1)
+	if err != nil {
+		return nil, err
+	}
+	a := x.Exp(x, k.d, k.ns1)
+	return djLog(a, k.N, k.S).Bytes(), nil
+}
+
+// returns m, given a = (1+N)^m mod N^(s+1). m is recovered modulo N^j for
+// j = 1..s, with the algorithm of section 3 of the paper
+func djLog(a, n *big.Int, s int) *big.Int {
+	i := new(big.Int)
+	nj := new(big.Int).Set(n) // N^j
+	for j := 1; j <= s; j++ {
+		nj1 := new(big.Int).Mul(nj, n) // N^(j+1)
+
+		// t1 = L(a mod N^(j+1)), where L(u) = (u-1)/N
+		t1 := new(big.Int).Mod(a, nj1)
+		t1.Sub(t1, one)
+		t1.Div(t1, n)
+
+		t2 := new(big.Int).Set(i)
+		fact := big.NewInt(1)
+		nk := big.NewInt(1) // N^(k-1)
+		for k := 2; k <= j; k++ {
+			i.Sub(i, one)
+			t2.Mul(t2, i)
+			t2.Mod(t2, nj)
+			fact.Mul(fact, big.NewInt(int64(k)))
+			nk.Mul(nk, n)
+
+			// t1 = t1 - t2 * N^(k-1) / k! mod N^j
+			t := new(big.Int).Mul(t2, nk)
+			t.Mul(t, new(big.Int).ModInverse(fact, nj))
+			t1.Sub(t1, t)
+			t1.Mod(t1, nj)
+		}
+		i = t1
+		nj = nj1
+	}
+	return i
+}
+
+func (dj damgardJurik) Add(pk PublicKey, a, b []byte) ([]byte, error) {
+	k, ok := pk.(*DamgardJurikPublicKey)
+	if !ok {
+		return nil, ErrKeyType
+	}
+	x, err := parseCiphertext(a, k.ns1)
+	if err != nil {
+		return nil, err
+	}
+	y, err := parseCiphertext(b, k.ns1)
+	if err != nil {
+		return nil, err
+	}
+	c := x.Mul(x, y)
+	return serialize(c.Mod(c, k.ns1), dj.CiphertextSize(pk)), nil
+}
+
+func (dj damgardJurik) ScalarMul(pk PublicKey, c, scalar []byte) ([]byte, error) {
+	k, ok := pk.(*DamgardJurikPublicKey)
+	if !ok {
+		return nil, ErrKeyType
+	}
+	x, err := parseCiphertext(c, k.ns1)
+	if err != nil {
+		return nil, err
+	}
+	e, err := parsePlaintext(scalar, k.ns)
+	if err != nil {
+		return nil, err
+	}
+	return serialize(x.Exp(x, e, k.ns1), dj.CiphertextSize(pk)), nil
+}
+
+// Damgård–Jurik public keys are encoded as s (1) | N
+func (damgardJurik) MarshalPublicKey(pk PublicKey) ([]byte, error) {
+	k, ok := pk.(*DamgardJurikPublicKey)
+	if !ok {
+		return nil, ErrKeyType
+	}
+	return append([]byte{byte(k.S)}, k.N.Bytes()...), nil
+}
+
+func (damgardJurik) UnmarshalPublicKey(raw []byte) (PublicKey, error) {
+	if len(raw) < 2 {
+		return nil, errors.New("Damgård–Jurik public key is truncated")
+	}
+	s := int(raw[0])
+	if s < 1 || s > maxExpansionFactor {
+		return nil, fmt.Errorf("Expansion factor must be between 1 and %v, got %v",
+			maxExpansionFactor, s)
+	}
+	n := new(big.Int).SetBytes(raw[1:])
+	if n.Cmp(one) <= 0 {
+		return nil, errors.New("Invalid Damgård–Jurik modulus")
+	}
+	return newDamgardJurikPublicKey(n, s), nil
+}
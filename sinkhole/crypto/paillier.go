@@ -1 +1,140 @@
-package paillier
+package crypto
+
+import (
+	"crypto/rand"
+	"errors"
+	paillier "github.com/Roasbeef/go-go-gadget-paillier"
+	"io"
+	"math/big"
+)
+
+// Paillier is the Paillier scheme. Ciphertexts are twice as large as the
+// modulus, and plaintexts must be smaller than the modulus.
+var Paillier HomomorphicScheme = paillierScheme{}
+
+// PaillierPublicKey is a Paillier public key
+type PaillierPublicKey struct {
+	paillier.PublicKey
+}
+
+func (pk *PaillierPublicKey) Scheme() HomomorphicScheme { return Paillier }
+
+// PaillierPrivateKey is a Paillier private key
+type PaillierPrivateKey struct {
+	*paillier.PrivateKey
+}
+
+func (sk *PaillierPrivateKey) Public() PublicKey {
+	return &PaillierPublicKey{sk.PrivateKey.PublicKey}
+}
+
+type paillierScheme struct{}
+
+func (paillierScheme) ID() SchemeID { return SchemePaillier }
+func (paillierScheme) Name() string { return "Paillier" }
+
+func (paillierScheme) GenerateKey(rand io.Reader, bits int) (PrivateKey, error) {
+	sk, err := paillier.GenerateKey(rand, bits)
+	if err != nil {
+		return nil, err
+	}
+	return &PaillierPrivateKey{sk}, nil
+}
+
+func (paillierScheme) PlaintextSize(pk PublicKey) int {
+	k, ok := pk.(*PaillierPublicKey)
+	if !ok || k.N == nil {
+		return 0
+	}
+	return (k.N.BitLen() - 1) / 8
+}
+
+func (paillierScheme) CiphertextSize(pk PublicKey) int {
+	k, ok := pk.(*PaillierPublicKey)
+	if !ok || k.NSquared == nil {
+		return 0
+	}
+	return len(k.NSquared.Bytes())
+}
+
+func (s paillierScheme) Encrypt(pk PublicKey, random io.Reader, m []byte) ([]byte, error) {
+	k, ok := pk.(*PaillierPublicKey)
+	if !ok {
+		return nil, ErrKeyType
+	}
+	if random == nil {
+		random = rand.Reader
+	}
+	r, err := rand.Int(random, k.N)
+	if err != nil {
+		return nil, err
+	}
+	c, err := paillier.EncryptWithNonce(&k.PublicKey, r, m)
+	if err != nil {
+		return nil, err
+	}
+	return serialize(c, s.CiphertextSize(pk)), nil
+}
+
+func (paillierScheme) Decrypt(sk PrivateKey, c []byte) ([]byte, error) {
+	k, ok := sk.(*PaillierPrivateKey)
+	if !ok {
+		return nil, ErrKeyType
+	}
+	return paillier.Decrypt(k.PrivateKey, c)
+}
+
+func (s paillierScheme) Add(pk PublicKey, a, b []byte) ([]byte, error) {
+	k, ok := pk.(*PaillierPublicKey)
+	if !ok {
+		return nil, ErrKeyType
+	}
+	x, err := parseCiphertext(a, k.NSquared)
+	if err != nil {
+		return nil, err
+	}
+	y, err := parseCiphertext(b, k.NSquared)
+	if err != nil {
+		return nil, err
+	}
+	c := x.Mul(x, y)
+	return serialize(c.Mod(c, k.NSquared), s.CiphertextSize(pk)), nil
+}
+
+func (s paillierScheme) ScalarMul(pk PublicKey, c, scalar []byte) ([]byte, error) {
+	k, ok := pk.(*PaillierPublicKey)
+	if !ok {
+		return nil, ErrKeyType
+	}
+	x, err := parseCiphertext(c, k.NSquared)
+	if err != nil {
+		return nil, err
+	}
+	e, err := parsePlaintext(scalar, k.N)
+	if err != nil {
+		return nil, err
+	}
+	return serialize(x.Exp(x, e, k.NSquared), s.CiphertextSize(pk)), nil
+}
+
+// Paillier public keys are encoded by their modulus N, since the generator is
+// always N+1
+func (paillierScheme) MarshalPublicKey(pk PublicKey) ([]byte, error) {
+	k, ok := pk.(*PaillierPublicKey)
+	if !ok {
+		return nil, ErrKeyType
+	}
+	return k.N.Bytes(), nil
+}
+
+func (paillierScheme) UnmarshalPublicKey(raw []byte) (PublicKey, error) {
+	N := new(big.Int).SetBytes(raw)
+	if N.Cmp(big.NewInt(1)) <= 0 {
+		return nil, errors.New("Invalid Paillier modulus")
+	}
+	return &PaillierPublicKey{paillier.PublicKey{
+		N:        N,
+		G:        new(big.Int).Add(N, big.NewInt(1)),
+		NSquared: new(big.Int).Mul(N, N),
+	}}, nil
+}
@@ -0,0 +1,111 @@
+// Package crypto defines the additively homomorphic encryption schemes used by
+// sinkhole queries, and ships the Paillier and Damgård–Jurik schemes.
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// SchemeID identifies a homomorphic scheme. It is carried in the encoding of
+// public keys so that providers select the scheme used to encrypt a query.
+type SchemeID byte
+
+const (
+	SchemePaillier     SchemeID = 1
+	SchemeDamgardJurik SchemeID = 2
+)
+
+var ErrKeyType = errors.New("sinkhole/crypto: key does not belong to the scheme")
+
+// HomomorphicScheme is an additively homomorphic encryption scheme. Plaintexts
+// and scalars are encoded as big endian integers. Ciphertexts are serialized
+// as big endian integers padded to the ciphertext size of the key.
+type HomomorphicScheme interface {
+	ID() SchemeID
+	Name() string
+
+	GenerateKey(rand io.Reader, bits int) (PrivateKey, error)
+
+	// max size in bytes of the plaintexts and scalars under the key, which
+	// are smaller than the plaintext modulus
+	PlaintextSize(pk PublicKey) int
+
+	// size in bytes of a serialized ciphertext under the key
+	CiphertextSize(pk PublicKey) int
+
+	Encrypt(pk PublicKey, rand io.Reader, m []byte) ([]byte, error)
+	Decrypt(sk PrivateKey, c []byte) ([]byte, error)
+
+	// returns the encryption of the sum of the plaintexts of a and b
+	Add(pk PublicKey, a, b []byte) ([]byte, error)
+
+	// returns the encryption of the product of the plaintext of c and k
+	ScalarMul(pk PublicKey, c, k []byte) ([]byte, error)
+
+	MarshalPublicKey(pk PublicKey) ([]byte, error)
+	UnmarshalPublicKey(raw []byte) (PublicKey, error)
+}
+
+// PublicKey is the public key of a homomorphic scheme
+type PublicKey interface {
+	Scheme() HomomorphicScheme
+}
+
+// PrivateKey is the private key of a homomorphic scheme
+type PrivateKey interface {
+	Public() PublicKey
+}
+
+var schemes = map[SchemeID]HomomorphicScheme{
+	SchemePaillier:     Paillier,
+	SchemeDamgardJurik: DamgardJurik(1),
+}
+
+// SchemeByID returns the homomorphic scheme with the given ID. The keys of the
+// Damgård–Jurik scheme carry their expansion factor, so any Damgård–Jurik
+// scheme unmarshals keys of any expansion factor.
+func SchemeByID(id SchemeID) (HomomorphicScheme, error) {
+	s, ok := schemes[id]
+	if !ok {
+		return nil, fmt.Errorf("Unknown homomorphic scheme %v", id)
+	}
+	return s, nil
+}
+
+// Encrypt encrypts m under the public key with the scheme of the key
+func Encrypt(pk PublicKey, rand io.Reader, m []byte) ([]byte, error) {
+	return pk.Scheme().Encrypt(pk, rand, m)
+}
+
+// Decrypt decrypts c with the private key with the scheme of the key
+func Decrypt(sk PrivateKey, c []byte) ([]byte, error) {
+	return sk.Public().Scheme().Decrypt(sk, c)
+}
+
+// serializes the ciphertext c, left padded with zeroes to size bytes
+func serialize(c *big.Int, size int) []byte {
+	b := c.Bytes()
+	buf := make([]byte, size-len(b), size)
+	return append(buf, b...)
+}
+
+// parses a serialized ciphertext, which must be smaller than the modulus
+func parseCiphertext(c []byte, modulus *big.Int) (*big.Int, error) {
+	x := new(big.Int).SetBytes(c)
+	if x.Cmp(modulus) >= 0 {
+		return nil, errors.New("Ciphertext is larger than the modulus")
+	}
+	return x, nil
+}
+
+// parses a plaintext or a scalar, which must be smaller than the modulus
+func parsePlaintext(m []byte, modulus *big.Int) (*big.Int, error) {
+	x := new(big.Int).SetBytes(m)
+	if x.Cmp(modulus) >= 0 {
+		return nil, errors.New("Plaintext is larger than the modulus")
+	}
+	return x, nil
+}
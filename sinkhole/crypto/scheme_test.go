@@ -0,0 +1,128 @@
+package crypto
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"math/big"
+	"math/rand"
+	"testing"
+)
+
+var testSchemes = []HomomorphicScheme{Paillier, DamgardJurik(1), DamgardJurik(2),
+	DamgardJurik(3)}
+
+func TestHomomorphicSchemes(t *testing.T) {
+	for _, scheme := range testSchemes {
+		random := rand.New(rand.NewSource(1))
+		sk, err := scheme.GenerateKey(crand.Reader, 256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pk := sk.Public()
+		if pk.Scheme().ID() != scheme.ID() || pk.Scheme().Name() != scheme.Name() {
+			t.Errorf("%v: key should belong to the scheme, got %v", scheme.Name(),
+				pk.Scheme().Name())
+		}
+
+		size := scheme.PlaintextSize(pk)
+		a, b := make([]byte, size), make([]byte, size/2)
+		random.Read(a)
+		random.Read(b)
+		ca, err := scheme.Encrypt(pk, random, a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cb, err := scheme.Encrypt(pk, random, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ca) != scheme.CiphertextSize(pk) {
+			t.Errorf("%v: ciphertext should have %v bytes, got %v", scheme.Name(),
+				scheme.CiphertextSize(pk), len(ca))
+		}
+
+		if m, err := Decrypt(sk, ca); err != nil || !bytes.Equal(m, trim(a)) {
+			t.Errorf("%v: plaintext was not decrypted (%v)", scheme.Name(), err)
+		}
+
+		// the plaintexts are smaller than the plaintext modulus, so their sum
+		// and products do not wrap if b is small enough
+		sum, _ := scheme.Add(pk, ca, cb)
+		expected := new(big.Int).Add(new(big.Int).SetBytes(a), new(big.Int).SetBytes(b))
+		if m, _ := Decrypt(sk, sum); new(big.Int).SetBytes(m).Cmp(expected) != 0 {
+			t.Errorf("%v: sum was not decrypted", scheme.Name())
+		}
+		prod, _ := scheme.ScalarMul(pk, cb, []byte{0, 3})
+		expected = new(big.Int).Mul(new(big.Int).SetBytes(b), big.NewInt(3))
+		if m, _ := Decrypt(sk, prod); new(big.Int).SetBytes(m).Cmp(expected) != 0 {
+			t.Errorf("%v: product was not decrypted", scheme.Name())
+		}
+		zero, _ := scheme.ScalarMul(pk, ca, []byte{0})
+		if m, _ := Decrypt(sk, zero); len(m) != 0 {
+			t.Errorf("%v: product by zero should decrypt to zero, got %v", scheme.Name(), m)
+		}
+
+		raw, err := scheme.MarshalPublicKey(pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec, err := scheme.UnmarshalPublicKey(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c, err := scheme.Encrypt(dec, random, b); err != nil {
+			t.Error(err)
+		} else if m, _ := Decrypt(sk, c); !bytes.Equal(m, trim(b)) {
+			t.Errorf("%v: unmarshalled key does not encrypt under the private key",
+				scheme.Name())
+		}
+
+		if _, err := scheme.Encrypt(pk, random, append([]byte{0xff}, a...)); err == nil {
+			t.Errorf("%v: plaintexts larger than the modulus should not be encrypted",
+				scheme.Name())
+		}
+	}
+}
+
+func TestDamgardJurikExpansion(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	p, _ := Paillier.GenerateKey(crand.Reader, 256)
+	dj, _ := DamgardJurik(3).GenerateKey(crand.Reader, 256)
+
+	// the plaintexts of a Damgård–Jurik key with expansion factor 3 are three
+	// times as large as the Paillier ones, with ciphertexts twice as large
+	if Paillier.PlaintextSize(p.Public())*3 > DamgardJurik(3).PlaintextSize(dj.Public())+2 {
+		t.Errorf("Expected plaintexts of %v bytes, got %v",
+			3*Paillier.PlaintextSize(p.Public()), DamgardJurik(3).PlaintextSize(dj.Public()))
+	}
+	if DamgardJurik(3).CiphertextSize(dj.Public()) != 2*Paillier.CiphertextSize(p.Public()) {
+		t.Errorf("Expected ciphertexts of %v bytes, got %v",
+			2*Paillier.CiphertextSize(p.Public()), DamgardJurik(3).CiphertextSize(dj.Public()))
+	}
+
+	// keys carry their expansion factor
+	raw, _ := DamgardJurik(3).MarshalPublicKey(dj.Public())
+	s, err := SchemeByID(SchemeDamgardJurik)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := s.UnmarshalPublicKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pk.(*DamgardJurikPublicKey).S != 3 {
+		t.Errorf("Expected expansion factor 3, got %v", pk.(*DamgardJurikPublicKey).S)
+	}
+
+	if _, err := Paillier.Encrypt(dj.Public(), random, []byte{1}); err != ErrKeyType {
+		t.Errorf("Expected %v, got %v", ErrKeyType, err)
+	}
+	if _, err := SchemeByID(42); err == nil {
+		t.Error("Unknown schemes should not be returned")
+	}
+}
+
+// plaintexts are decrypted without their leading zero bytes
+func trim(b []byte) []byte {
+	return bytes.TrimLeft(b, "\x00")
+}
@@ -0,0 +1,63 @@
+// This example runs the sinkhole protocol `/p3lib/sinkhole/1.0` between two
+// libp2p hosts connected over mocknet. `provider` stores a key-value tuple and
+// serves the sinkhole provider API on its stream handler. `user` opens streams
+// to `provider` to learn its address spaces and to run the CPIR query for the
+// key, without disclosing the key to the provider.
+package main
+
+import (
+	"context"
+	crand "crypto/rand"
+	"github.com/hashmatter/p3lib/sinkhole"
+	hcrypto "github.com/hashmatter/p3lib/sinkhole/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"io"
+	"log"
+)
+
+// serve sets the handler of the sinkhole protocol on the host
+func serve(h host.Host, s *sinkhole.Sinkhole) {
+	handler := sinkhole.NewHandler(s)
+	h.SetStreamHandler(protocol.ID(sinkhole.ProtocolID), func(s network.Stream) {
+		handler.HandleStream(s)
+	})
+}
+
+// provider returns a client of the sinkhole provider `p`, which opens a new
+// libp2p stream for each request
+func provider(h host.Host, p peer.ID) *sinkhole.StreamClient {
+	return sinkhole.NewStreamClient(func(ctx context.Context) (io.ReadWriteCloser, error) {
+		return h.NewStream(ctx, p, protocol.ID(sinkhole.ProtocolID))
+	})
+}
+
+func main() {
+	ctx := context.Background()
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		log.Fatal(err)
+	}
+	provHost, userHost := mn.Hosts()[0], mn.Hosts()[1]
+
+	// the provider serves keys with a suffix space of 4 bytes and a private
+	// space of 1 byte
+	s := sinkhole.NewProvider(16, 4, 1)
+	if err := s.Add("1dfe", []byte("1dfe9a3ab24b22"), []byte("value1")); err != nil {
+		log.Fatal(err)
+	}
+	serve(provHost, &s)
+	log.Println("==Provider== | serving", sinkhole.ProtocolID)
+
+	// the user learns the address spaces of the provider and queries the key
+	userKey, _ := hcrypto.Paillier.GenerateKey(crand.Reader, 128)
+	v, err := sinkhole.Lookup(ctx, provider(userHost, provHost.ID()), userKey,
+		[]byte("1dfe9a3ab24b22"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("**User** | value of 1dfe9a3ab24b22: %s", v)
+}
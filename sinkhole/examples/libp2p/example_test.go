@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	crand "crypto/rand"
+	"github.com/hashmatter/p3lib/sinkhole"
+	hcrypto "github.com/hashmatter/p3lib/sinkhole/crypto"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"testing"
+)
+
+func TestLookupOverMocknet(t *testing.T) {
+	// the mock network is shut down once the context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provHost, userHost := mn.Hosts()[0], mn.Hosts()[1]
+
+	s := sinkhole.NewProvider(16, 4, 1)
+	if err := s.Add("1dfe", []byte("1dfe9a3ab24b22"), []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+	serve(provHost, &s)
+
+	p := provider(userHost, provHost.ID())
+	userKey, _ := hcrypto.Paillier.GenerateKey(crand.Reader, 128)
+	v, err := sinkhole.Lookup(ctx, p, userKey, []byte("1dfe9a3ab24b22"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "value1" {
+		t.Errorf("Wrong value: %s", v)
+	}
+	if _, err := sinkhole.Lookup(ctx, p, userKey, []byte("1dfe8a3ab24b22")); err != sinkhole.ErrNotFound {
+		t.Errorf("Expected %v, got %v", sinkhole.ErrNotFound, err)
+	}
+
+	st, err := p.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Tuples != 1 {
+		t.Errorf("Expected 1 tuple, got %v", st.Tuples)
+	}
+}
@@ -0,0 +1,11 @@
+module ex
+
+go 1.15
+
+require (
+	github.com/hashmatter/p3lib v0.0.0-00010101000000-000000000000
+	github.com/libp2p/go-libp2p v0.15.1
+	github.com/libp2p/go-libp2p-core v0.9.0
+)
+
+replace github.com/hashmatter/p3lib => ../../../
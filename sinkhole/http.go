@@ -0,0 +1,363 @@
+package sinkhole
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	QueryPath  = "/sinkhole/1/query"
+	InfoPath   = "/sinkhole/1/info"
+	StatusPath = "/sinkhole/1/status"
+
+	HintPath     = "/sinkhole/1/lwe/hint"
+	LWEQueryPath = "/sinkhole/1/lwe/query"
+
+	ShareQueryPath = "/sinkhole/1/share/query"
+
+	// DefaultMaxQuerySize fits a query for a private space of 2 bytes under a
+	// 2048 bit Paillier key
+	DefaultMaxQuerySize = 64 << 20
+
+	// max size of the error messages read from a provider
+	maxErrorSize = 512
+)
+
+// Handler serves the sinkhole provider API over HTTP and over streams
+type Handler struct {
+	sinkhole *Sinkhole
+
+	// MaxQuerySize is the max size of the body of a query, in bytes. Larger
+	// queries are rejected before being read.
+	MaxQuerySize int64
+}
+
+// NewHandler returns an HTTP handler of the provider API of the sinkhole
+func NewHandler(s *Sinkhole) *Handler {
+	return &Handler{sinkhole: s, MaxQuerySize: DefaultMaxQuerySize}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case QueryPath:
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		h.serveQuery(w, r, h.answer)
+	case LWEQueryPath:
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		h.serveQuery(w, r, h.answerLWE)
+	case ShareQueryPath:
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		h.serveQuery(w, r, h.answerShare)
+	case HintPath:
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		h.serveHint(w, r)
+	case InfoPath:
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		writeJSON(w, h.sinkhole.Info())
+	case StatusPath:
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		writeJSON(w, h.sinkhole.Status())
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *Handler) serveQuery(w http.ResponseWriter, r *http.Request,
+	answer func(context.Context, []byte) ([]byte, error)) {
+
+	if r.ContentLength > h.MaxQuerySize {
+		http.Error(w, "Query is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	raw, err := ioutil.ReadAll(io.LimitReader(r.Body, h.MaxQuerySize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if int64(len(raw)) > h.MaxQuerySize {
+		http.Error(w, "Query is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// the query is processed until the client goes away
+	res, err := answer(r.Context(), raw)
+	if err != nil {
+		if r.Context().Err() != nil {
+			return
+		}
+		if err == ErrStaleHint {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(res)
+}
+
+func (h *Handler) serveHint(w http.ResponseWriter, r *http.Request) {
+	res, err := h.hint(r.URL.Query().Get("suffix"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(res)
+}
+
+// decodes the query, runs it and returns the encoded answer
+func (h *Handler) answer(ctx context.Context, raw []byte) ([]byte, error) {
+	var q Query
+	if err := q.UnmarshalBinary(raw); err != nil {
+		return nil, err
+	}
+	answer, err := h.sinkhole.QueryRecursiveContext(ctx, q.Suffix, q.Dimensions, q.Vector,
+		q.PubKey)
+	if err != nil {
+		return nil, err
+	}
+	return encodeAnswer(q.PubKey, answer)
+}
+
+// decodes the LWE query, runs it and returns the encoded answer
+func (h *Handler) answerLWE(ctx context.Context, raw []byte) ([]byte, error) {
+	var q LWEQuery
+	if err := q.UnmarshalBinary(raw); err != nil {
+		return nil, err
+	}
+	answer, err := h.sinkhole.QueryLWEContext(ctx, q.Suffix, q.Epoch, q.Vector)
+	if err != nil {
+		return nil, err
+	}
+	return encodeLWEAnswer(answer), nil
+}
+
+// decodes the share query, runs it and returns the encoded answer
+func (h *Handler) answerShare(ctx context.Context, raw []byte) ([]byte, error) {
+	var q ShareQuery
+	if err := q.UnmarshalBinary(raw); err != nil {
+		return nil, err
+	}
+	answer, err := h.sinkhole.QueryShareContext(ctx, q.Suffix, q.Vector)
+	if err != nil {
+		return nil, err
+	}
+	return encodeShareAnswer(answer), nil
+}
+
+// returns the encoded hint of the suffix space
+func (h *Handler) hint(suffix string) ([]byte, error) {
+	hint, err := h.sinkhole.Hint(suffix)
+	if err != nil {
+		return nil, err
+	}
+	return hint.MarshalBinary()
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// HTTPClient sends queries to a sinkhole provider over HTTP
+type HTTPClient struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPClient returns a client of the provider API served at url. If client
+// is nil, http.DefaultClient is used.
+func NewHTTPClient(url string, client *http.Client) *HTTPClient {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPClient{url: strings.TrimSuffix(url, "/"), client: client}
+}
+
+// Info returns the address spaces served by the provider
+func (c *HTTPClient) Info(ctx context.Context) (*Info, error) {
+	var info Info
+	if err := c.getJSON(ctx, InfoPath, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Status returns the status of the provider
+func (c *HTTPClient) Status(ctx context.Context) (*Status, error) {
+	var st Status
+	if err := c.getJSON(ctx, StatusPath, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// Query sends the query to the provider and returns the encrypted answer,
+// which is decoded with Client.Decode
+func (c *HTTPClient) Query(ctx context.Context, q *Query) ([][]byte, error) {
+	raw, err := q.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.url+QueryPath, bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	res, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxAnswerSize(q.PubKey)+1))
+	if err != nil {
+		return nil, err
+	}
+	return decodeAnswer(q.PubKey, res)
+}
+
+// Hint downloads the hint of the suffix space from the provider
+func (c *HTTPClient) Hint(ctx context.Context, suffix string) (*Hint, error) {
+	u := c.url + HintPath + "?" + url.Values{"suffix": {suffix}}.Encode()
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	raw, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHintSize+1024))
+	if err != nil {
+		return nil, err
+	}
+	var h Hint
+	if err := h.UnmarshalBinary(raw); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// QueryLWE sends the LWE query to the provider and returns the answer, which
+// is decoded with LWEClient.Decode. It returns ErrStaleHint if the hint of
+// the query is stale.
+func (c *HTTPClient) QueryLWE(ctx context.Context, q *LWEQuery) ([]uint32, error) {
+	if q.hint == nil {
+		return nil, errNoHint
+	}
+	raw, err := q.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.url+LWEQueryPath, bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	res, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxLWEAnswerSize(q.hint)+1))
+	if err != nil {
+		return nil, err
+	}
+	return decodeLWEAnswer(res)
+}
+
+// QueryShare sends the share of a multi-server query to the provider and
+// returns its answer, which is decoded with MultiClient.Decode
+func (c *HTTPClient) QueryShare(ctx context.Context, q *ShareQuery) ([]byte, error) {
+	raw, err := q.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.url+ShareQueryPath, bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	res, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxShareAnswerSize+1))
+	if err != nil {
+		return nil, err
+	}
+	return decodeShareAnswer(res)
+}
+
+func (c *HTTPClient) getJSON(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, c.url+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(io.LimitReader(resp.Body, maxDocumentSize)).Decode(v)
+}
+
+// sends the request and returns an error if the provider does not reply with
+// 200 OK, or ErrStaleHint if it replies with 409 Conflict
+func (c *HTTPClient) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusConflict {
+		resp.Body.Close()
+		return nil, ErrStaleHint
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorSize))
+		resp.Body.Close()
+		return nil, fmt.Errorf("Sinkhole provider replied %v: %s", resp.Status,
+			strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
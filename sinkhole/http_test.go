@@ -0,0 +1,138 @@
+package sinkhole
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	hcrypto "github.com/hashmatter/p3lib/sinkhole/crypto"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestProvider(t *testing.T) (*Sinkhole, *httptest.Server) {
+	s := NewProvider(16, 4, 1)
+	if err := s.Add("1dfe", []byte("1dfe9a3ab24b22"), []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+	return &s, httptest.NewServer(NewHandler(&s))
+}
+
+func TestHTTPQuery(t *testing.T) {
+	_, srv := newTestProvider(t)
+	defer srv.Close()
+
+	ctx := context.Background()
+	provider := NewHTTPClient(srv.URL, srv.Client())
+
+	info, err := provider.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Info{Version: WireVersion, SuffixSpaces: []string{"1dfe"},
+		SuffixLen: 4, P: 1, T: 11}
+	if !reflect.DeepEqual(*info, expected) {
+		t.Errorf("Expected info %+v, got %+v", expected, *info)
+	}
+
+	st, err := provider.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Buckets != 1 || st.Tuples != 1 {
+		t.Errorf("Expected 1 bucket and 1 tuple, got %+v", *st)
+	}
+
+	// the client is configured from the info of the provider
+	cliPrivKey, _ := hcrypto.Paillier.GenerateKey(crand.Reader, 128)
+	client := NewClient(info.SuffixLen, info.P, info.T, cliPrivKey)
+
+	for key, value := range map[string]string{
+		"1dfe9a3ab24b22": "value1",
+		"1dfe8a3ab24b22": "",
+		"2dfe9a3ab24b22": "",
+	} {
+		q, err := client.NewQuery([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		answer, err := provider.Query(ctx, q)
+		if err != nil {
+			t.Fatalf("%v: %v", key, err)
+		}
+		v, err := client.Decode(q, answer)
+		if value == "" && err != ErrNotFound {
+			t.Errorf("%v: expected %v, got %v", key, ErrNotFound, err)
+		}
+		if value != "" && string(v) != value {
+			t.Errorf("%v: expected %v, got %s (%v)", key, value, v, err)
+		}
+	}
+}
+
+func TestHTTPErrors(t *testing.T) {
+	s, srv := newTestProvider(t)
+	defer srv.Close()
+
+	cliPrivKey, _ := hcrypto.Paillier.GenerateKey(crand.Reader, 128)
+	q, err := NewClient(4, 1, 11, cliPrivKey).NewQuery([]byte("1dfe9a3ab24b22"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := q.MarshalBinary()
+
+	// queries larger than the limit are rejected
+	h := NewHandler(s)
+	h.MaxQuerySize = int64(len(raw) - 1)
+	limited := httptest.NewServer(h)
+	defer limited.Close()
+	_, err = NewHTTPClient(limited.URL, nil).Query(context.Background(), q)
+	if err == nil || !strings.Contains(err.Error(), "413") {
+		t.Errorf("Query larger than the limit should be rejected, got %v", err)
+	}
+
+	// queries with a wrong number of rows are rejected
+	short := *q
+	short.Vector = q.Vector[:10]
+	_, err = NewHTTPClient(srv.URL, nil).Query(context.Background(), &short)
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("Query with a wrong number of rows should be rejected, got %v", err)
+	}
+
+	for _, c := range []struct {
+		method, path string
+		body         []byte
+		status       int
+	}{
+		{http.MethodGet, QueryPath, nil, http.StatusMethodNotAllowed},
+		{http.MethodPost, InfoPath, nil, http.StatusMethodNotAllowed},
+		{http.MethodGet, "/sinkhole/2/info", nil, http.StatusNotFound},
+		{http.MethodPost, QueryPath, append([]byte{WireVersion + 1}, raw[1:]...),
+			http.StatusBadRequest},
+		{http.MethodPost, QueryPath, raw[:len(raw)-1], http.StatusBadRequest},
+	} {
+		req, _ := http.NewRequest(c.method, srv.URL+c.path, bytes.NewReader(c.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%v %v: expected status %v, got %v", c.method, c.path, c.status,
+				resp.StatusCode)
+		}
+	}
+
+	// documents larger than the limit are not read
+	huge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"suffix_spaces": ["`))
+		w.Write(bytes.Repeat([]byte("a"), maxDocumentSize))
+		w.Write([]byte(`"]}`))
+	}))
+	defer huge.Close()
+	if _, err := NewHTTPClient(huge.URL, nil).Info(context.Background()); err == nil {
+		t.Error("Document larger than the limit should not be decoded")
+	}
+}
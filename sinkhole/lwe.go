@@ -0,0 +1,456 @@
+package sinkhole
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"sync"
+)
+
+// The LWE backend answers queries with SimplePIR-style PIR based on learning
+// with errors, instead of Paillier. The bucket of a suffix space is a matrix D
+// of bytes where column j is row j of the bucket, prefixed by its length (4
+// bytes) as rows answered in blocks, and zero padded to the largest row.
+//
+//   offline: the provider publishes a seed of the public matrix A (num rows x
+//            n, expanded with AES-CTR) and the hint H = D·A (mod 2^32), which
+//            the client downloads once per suffix space
+//   query:   the client samples a secret s and a noise vector e, and sends
+//            q = A·s + e + Δ·u_j (mod 2^32) for the row j of the key
+//   answer:  the provider returns D·q (mod 2^32), a single pass over the bytes
+//            of the bucket with no modular exponentiations
+//   decode:  D·q - H·s = D·e + Δ·D[:,j], so the client recovers every byte of
+//            row j by rounding to multiples of Δ
+//
+// with n = 1024, Δ = 2^24 and a centered binomial noise of variance 44.
+//
+// The hint depends on the bucket, so it is updated on Add and identified by an
+// epoch. Queries built with the hint of another epoch are rejected with
+// ErrStaleHint, and the client downloads the hint again.
+
+const (
+	// dimension of the LWE secret
+	lweN = 1024
+
+	// scaling factor of the selection vector, q/p for q = 2^32 and p = 2^8
+	lweDelta = 1 << 24
+
+	lweSeedSize = 16
+
+	// the noise is the difference of the number of bits set in two strings of
+	// lweNoiseBytes random bytes
+	lweNoiseBytes = 11
+
+	// max number of rows of a bucket answered with LWE, which bounds the
+	// noise of the answers
+	maxLWERows = 1 << 16
+
+	// max size of the encoding of a hint
+	maxHintSize = 64 << 20
+)
+
+// ErrStaleHint is returned when a LWE query is built with a hint which does
+// not match the bucket of the provider, which changed since the hint was
+// downloaded
+var ErrStaleHint = errors.New("sinkhole: stale LWE hint")
+
+var errNoHint = errors.New("LWE query was not built with a hint")
+
+// Hint is the offline hint of a suffix space, which clients download before
+// building LWE queries for its keys
+type Hint struct {
+	Suffix string
+	Epoch  uint64
+	Seed   [lweSeedSize]byte
+
+	// size of the matrix D: Rows is the size of the largest row of the
+	// bucket with its length prefix, and Cols the number of rows
+	Rows int
+	Cols int
+
+	// H = D·A, Rows x lweN
+	Matrix []uint32
+}
+
+// LWE state of a bucket, which is computed on the first hint request and
+// updated on Add
+type lweDB struct {
+	seed   [lweSeedSize]byte
+	a      *lweMatrix
+	epoch  uint64
+	rows   int
+	matrix []uint32
+}
+
+func newLWEDB(store [][]byte) (*lweDB, error) {
+	db := &lweDB{}
+	var epoch [8]byte
+	if _, err := io.ReadFull(rand.Reader, db.seed[:]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(rand.Reader, epoch[:]); err != nil {
+		return nil, err
+	}
+	db.epoch = binary.BigEndian.Uint64(epoch[:])
+
+	var err error
+	if db.a, err = newLWEMatrix(db.seed); err != nil {
+		return nil, err
+	}
+	for j, row := range store {
+		if len(row) > 0 {
+			db.update(j, nil, frameRow(row))
+		}
+	}
+	return db, nil
+}
+
+// updates the hint for column j of D, which changes from old to new, and
+// moves to the next epoch
+func (db *lweDB) update(j int, old, new []byte) {
+	if len(new) > db.rows {
+		db.matrix = append(db.matrix, make([]uint32, (len(new)-db.rows)*lweN)...)
+		db.rows = len(new)
+	}
+
+	a := make([]uint32, lweN)
+	db.a.row(j, a)
+	for k := 0; k < len(old) || k < len(new); k++ {
+		diff := uint32(byteAt(new, k)) - uint32(byteAt(old, k))
+		if diff == 0 {
+			continue
+		}
+		h := db.matrix[k*lweN : (k+1)*lweN]
+		for i := range h {
+			h[i] += diff * a[i]
+		}
+	}
+	db.epoch++
+}
+
+func byteAt(b []byte, i int) byte {
+	if i < len(b) {
+		return b[i]
+	}
+	return 0
+}
+
+// Hint returns the hint of the suffix space. The hint of a suffix space which
+// is not stored is empty, and queries built with it are answered with an
+// empty answer.
+func (s *Sinkhole) Hint(ss string) (*Hint, error) {
+	cols := numRows(s.private_space_len)
+	if cols > maxLWERows {
+		return nil, fmt.Errorf("LWE queries support at most %v rows, got %v",
+			maxLWERows, cols)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, exists := s.buckets[ss]
+	if !exists {
+		return &Hint{Suffix: ss, Cols: cols}, nil
+	}
+	if b.lwe == nil {
+		db, err := newLWEDB(b.store)
+		if err != nil {
+			return nil, err
+		}
+		b.lwe = db
+		s.buckets[ss] = b
+	}
+	if 4*len(b.lwe.matrix) > maxHintSize {
+		return nil, fmt.Errorf("Hint of suffix space %v is too large", ss)
+	}
+
+	return &Hint{
+		Suffix: ss,
+		Epoch:  b.lwe.epoch,
+		Seed:   b.lwe.seed,
+		Rows:   b.lwe.rows,
+		Cols:   cols,
+		Matrix: append([]uint32{}, b.lwe.matrix...),
+	}, nil
+}
+
+func (s *Sinkhole) QueryLWE(ss string, epoch uint64, q []uint32) ([]uint32, error) {
+	return s.QueryLWEContext(context.Background(), ss, epoch, q)
+}
+
+// QueryLWEContext answers the LWE query q built with the hint of the given
+// epoch. The answer is the product of D by q, one element per byte of the
+// largest row of the bucket.
+func (s *Sinkhole) QueryLWEContext(ctx context.Context, ss string, epoch uint64,
+	q []uint32) ([]uint32, error) {
+
+	if err := ctx.Err(); err != nil {
+		return []uint32{}, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b, exists := s.buckets[ss]
+	if !exists {
+		return []uint32{}, nil
+	}
+	if b.lwe == nil || b.lwe.epoch != epoch {
+		return []uint32{}, ErrStaleHint
+	}
+	if len(q) != len(b.store) {
+		return []uint32{}, fmt.Errorf("Query must have %v rows, got %v",
+			len(b.store), len(q))
+	}
+
+	answer := make([]uint32, b.lwe.rows)
+	for j, row := range b.store {
+		if len(row) == 0 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return []uint32{}, err
+		}
+		for k, v := range frameRow(row) {
+			answer[k] += uint32(v) * q[j]
+		}
+	}
+	return answer, nil
+}
+
+// LWEClient builds LWE queries for the keys stored by a sinkhole provider and
+// decodes the answers. It keeps the hints of the suffix spaces it queried.
+type LWEClient struct {
+	suffixLen int
+	privLen   int
+	tailLen   int
+
+	mu    sync.Mutex
+	hints map[string]*Hint
+}
+
+// LWEQuery is a LWE query for a key. Only the suffix of the key is disclosed
+// to the provider.
+type LWEQuery struct {
+	Suffix string
+	Epoch  uint64
+	Vector []uint32
+
+	// hint, secret, and tail of the queried key, which are never sent to the
+	// provider
+	hint   *Hint
+	secret []uint32
+	tail   []byte
+}
+
+// NewLWEClient creates a LWE client for a provider with the given suffix,
+// private and tail space lengths
+func NewLWEClient(suffixLen, privLen, tailLen int) *LWEClient {
+	return &LWEClient{
+		suffixLen: suffixLen,
+		privLen:   privLen,
+		tailLen:   tailLen,
+		hints:     map[string]*Hint{},
+	}
+}
+
+// NewQuery builds the LWE query for a key with the hint of its suffix space
+func (c *LWEClient) NewQuery(h *Hint, key []byte) (*LWEQuery, error) {
+	return c.NewQueryContext(context.Background(), h, key)
+}
+
+// NewQueryContext is like NewQuery, but stops building the query vector and
+// returns the context error once the context is done
+func (c *LWEClient) NewQueryContext(ctx context.Context, h *Hint, key []byte) (*LWEQuery, error) {
+	spaceLen := c.suffixLen + c.privLen + c.tailLen
+	index, err := calculateIndex(spaceLen, c.suffixLen, c.privLen, key)
+	if err != nil {
+		return nil, err
+	}
+	if h.Suffix != string(key[:c.suffixLen]) {
+		return nil, fmt.Errorf("Hint of suffix space %v does not match the key", h.Suffix)
+	}
+	if h.Cols != numRows(c.privLen) {
+		return nil, fmt.Errorf("Hint must have %v columns, got %v", numRows(c.privLen), h.Cols)
+	}
+
+	a, err := newLWEMatrix(h.Seed)
+	if err != nil {
+		return nil, err
+	}
+	secret := make([]uint32, lweN)
+	if err := binary.Read(rand.Reader, binary.LittleEndian, secret); err != nil {
+		return nil, err
+	}
+	noise, err := sampleNoise(rand.Reader, h.Cols)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &LWEQuery{
+		Suffix: h.Suffix,
+		Epoch:  h.Epoch,
+		Vector: make([]uint32, h.Cols),
+		hint:   h,
+		secret: secret,
+		tail:   append([]byte{}, keyTail(c.suffixLen, c.privLen, c.tailLen, key)...),
+	}
+
+	row := make([]uint32, lweN)
+	for j := range q.Vector {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		a.row(j, row)
+		q.Vector[j] = dot(row, secret) + noise[j]
+	}
+	q.Vector[index.Int64()] += lweDelta
+	return q, nil
+}
+
+// Decode decodes the answer of the provider to the LWE query and returns the
+// value stored for the queried key, or ErrNotFound if there is none
+func (c *LWEClient) Decode(q *LWEQuery, answer []uint32) ([]byte, error) {
+	if len(answer) == 0 {
+		return nil, ErrNotFound
+	}
+	if len(answer) != q.hint.Rows {
+		return nil, fmt.Errorf("Answer must have %v elements, got %v",
+			q.hint.Rows, len(answer))
+	}
+
+	// every byte is rounded to the closest multiple of Δ, and the noise is
+	// dropped
+	framed := make([]byte, len(answer))
+	for k, v := range answer {
+		d := v - dot(q.hint.Matrix[k*lweN:(k+1)*lweN], q.secret)
+		framed[k] = byte((d + lweDelta/2) >> 24)
+	}
+
+	row, err := joinBlocks([][]byte{framed}, len(framed))
+	if err != nil {
+		return nil, err
+	}
+	entries, err := decodeRow(row)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := findEntry(entries, q.tail)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return v, nil
+}
+
+// LWEProvider is the LWE API of a sinkhole provider, as served over HTTP or
+// streams
+type LWEProvider interface {
+	Hint(ctx context.Context, suffix string) (*Hint, error)
+	QueryLWE(ctx context.Context, q *LWEQuery) ([]uint32, error)
+}
+
+// Lookup runs the LWE exchange with the provider. The hint of the suffix space
+// of the key is downloaded on the first lookup, and again when the provider
+// rejects it as stale. It returns ErrNotFound if the provider does not store a
+// value for the key.
+func (c *LWEClient) Lookup(ctx context.Context, p LWEProvider, key []byte) ([]byte, error) {
+	if len(key) < c.suffixLen {
+		return nil, fmt.Errorf("Key must have at least %v bytes, got %v",
+			c.suffixLen, len(key))
+	}
+	suffix := string(key[:c.suffixLen])
+
+	c.mu.Lock()
+	h, cached := c.hints[suffix]
+	c.mu.Unlock()
+
+	for i := 0; i < 2; i++ {
+		if !cached || i > 0 {
+			var err error
+			if h, err = p.Hint(ctx, suffix); err != nil {
+				return nil, err
+			}
+			c.mu.Lock()
+			c.hints[suffix] = h
+			c.mu.Unlock()
+		}
+
+		q, err := c.NewQueryContext(ctx, h, key)
+		if err != nil {
+			return nil, err
+		}
+		answer, err := p.QueryLWE(ctx, q)
+		if err == ErrStaleHint {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return c.Decode(q, answer)
+	}
+	return nil, ErrStaleHint
+}
+
+// public matrix A, expanded from a seed with AES-CTR
+type lweMatrix struct {
+	block cipher.Block
+	buf   []byte
+}
+
+func newLWEMatrix(seed [lweSeedSize]byte) (*lweMatrix, error) {
+	block, err := aes.NewCipher(seed[:])
+	if err != nil {
+		return nil, err
+	}
+	return &lweMatrix{block: block, buf: make([]byte, 4*lweN)}, nil
+}
+
+// writes row j of the matrix to dst. The keystream of row j starts at the
+// counter j·2^64, so rows do not overlap.
+func (m *lweMatrix) row(j int, dst []uint32) {
+	var iv [aes.BlockSize]byte
+	binary.BigEndian.PutUint64(iv[:8], uint64(j))
+	for i := range m.buf {
+		m.buf[i] = 0
+	}
+	cipher.NewCTR(m.block, iv[:]).XORKeyStream(m.buf, m.buf)
+	for i := range dst {
+		dst[i] = binary.LittleEndian.Uint32(m.buf[4*i:])
+	}
+}
+
+// samples n elements of a centered binomial distribution of variance
+// 4*lweNoiseBytes, reduced mod 2^32
+func sampleNoise(random io.Reader, n int) ([]uint32, error) {
+	buf := make([]byte, 2*lweNoiseBytes*n)
+	if _, err := io.ReadFull(random, buf); err != nil {
+		return nil, err
+	}
+	noise := make([]uint32, n)
+	for i := range noise {
+		var e int
+		for _, b := range buf[2*lweNoiseBytes*i : 2*lweNoiseBytes*i+lweNoiseBytes] {
+			e += bits.OnesCount8(b)
+		}
+		for _, b := range buf[2*lweNoiseBytes*i+lweNoiseBytes : 2*lweNoiseBytes*(i+1)] {
+			e -= bits.OnesCount8(b)
+		}
+		noise[i] = uint32(int32(e))
+	}
+	return noise, nil
+}
+
+// returns the inner product of a and b mod 2^32
+func dot(a, b []uint32) uint32 {
+	var sum uint32
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
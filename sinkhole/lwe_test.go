@@ -0,0 +1,266 @@
+package sinkhole
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"fmt"
+	hcrypto "github.com/hashmatter/p3lib/sinkhole/crypto"
+	"reflect"
+	"testing"
+)
+
+var (
+	_ LWEProvider = (*HTTPClient)(nil)
+	_ LWEProvider = (*StreamClient)(nil)
+)
+
+func TestLWEQuery(t *testing.T) {
+	sinkhole := NewProvider(16, 4, 1)
+	large := make([]byte, 1000)
+	for i := range large {
+		large[i] = byte(i)
+	}
+	values := map[string][]byte{
+		"1dfe9a3ab24b22": []byte("value1"),
+		"1dfe9a3ab24b23": []byte("value2"),
+		"1dfe8a3ab24b22": large,
+	}
+	for k, v := range values {
+		if err := sinkhole.Add("1dfe", []byte(k), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h, err := sinkhole.Hint("1dfe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Cols != 256 || h.Rows != rowLenSize+len(encodeTestRow(t, "a3ab24b22", large)) {
+		t.Errorf("Unexpected hint of %v x %v", h.Rows, h.Cols)
+	}
+
+	client := NewLWEClient(4, 1, 11)
+	for k, v := range values {
+		q, err := client.NewQuery(h, []byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		answer, err := sinkhole.QueryLWE(q.Suffix, q.Epoch, q.Vector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res, err := client.Decode(q, answer); !bytes.Equal(res, v) {
+			t.Errorf("%v: value was not recovered (%v)", k, err)
+		}
+	}
+
+	q, _ := client.NewQuery(h, []byte("1dfe7a3ab24b22"))
+	answer, _ := sinkhole.QueryLWE(q.Suffix, q.Epoch, q.Vector)
+	if _, err := client.Decode(q, answer); err != ErrNotFound {
+		t.Errorf("Expected %v, got %v", ErrNotFound, err)
+	}
+
+	// suffix space not stored by the provider
+	empty, err := sinkhole.Hint("2dfe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, _ = client.NewQuery(empty, []byte("2dfe9a3ab24b22"))
+	answer, _ = sinkhole.QueryLWE(q.Suffix, q.Epoch, q.Vector)
+	if _, err := client.Decode(q, answer); err != ErrNotFound {
+		t.Errorf("Expected %v, got %v", ErrNotFound, err)
+	}
+	if _, err := client.NewQuery(empty, []byte("1dfe9a3ab24b22")); err == nil {
+		t.Error("Hint of another suffix space should not be used")
+	}
+
+	// the hint is stale once the bucket changes
+	if err := sinkhole.Add("1dfe", []byte("1dfe9a3ab24b22"), []byte("value3")); err != nil {
+		t.Fatal(err)
+	}
+	q, _ = client.NewQuery(h, []byte("1dfe9a3ab24b22"))
+	if _, err := sinkhole.QueryLWE(q.Suffix, q.Epoch, q.Vector); err != ErrStaleHint {
+		t.Errorf("Expected %v, got %v", ErrStaleHint, err)
+	}
+}
+
+func encodeTestRow(t *testing.T, tail string, value []byte) []byte {
+	row, err := encodeRow([]entry{{tail: []byte(tail), value: value}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return row
+}
+
+func TestLWEHintUpdate(t *testing.T) {
+	sinkhole := NewProvider(16, 4, 1)
+	if err := sinkhole.Add("1dfe", []byte("1dfe9a3ab24b22"), []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+	h1, err := sinkhole.Hint("1dfe")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rows which grow, shrink and are added update the hint
+	for k, v := range map[string]string{
+		"1dfe9a3ab24b22": "a longer value1",
+		"1dfe9a3ab24b23": "value2",
+		"1dfe5a3ab24b22": "value3",
+	} {
+		if err := sinkhole.Add("1dfe", []byte(k), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sinkhole.Add("1dfe", []byte("1dfe9a3ab24b22"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	h2, err := sinkhole.Hint("1dfe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h1.Epoch == h2.Epoch || h1.Seed != h2.Seed {
+		t.Error("Updated hint should have a new epoch and the same seed")
+	}
+
+	// the updated hint is the hint computed from the bucket
+	a, _ := newLWEMatrix(h2.Seed)
+	db := &lweDB{seed: h2.Seed, a: a, rows: h2.Rows, matrix: make([]uint32, h2.Rows*lweN)}
+	for j, row := range sinkhole.buckets["1dfe"].store {
+		db.update(j, nil, frameRow(row))
+	}
+	if !reflect.DeepEqual(db.matrix, h2.Matrix) {
+		t.Error("Updated hint does not match the bucket")
+	}
+}
+
+func TestLWELookup(t *testing.T) {
+	s, srv := newTestProvider(t)
+	defer srv.Close()
+
+	ctx := context.Background()
+	for name, provider := range map[string]LWEProvider{
+		"http":   NewHTTPClient(srv.URL, srv.Client()),
+		"stream": NewStreamClient(pipeOpener(NewHandler(s))),
+	} {
+		client := NewLWEClient(4, 1, 11)
+		v, err := client.Lookup(ctx, provider, []byte("1dfe9a3ab24b22"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(v) != "value1" {
+			t.Errorf("%v: wrong value: %s", name, v)
+		}
+
+		// the cached hint is downloaded again once it is stale
+		if err := s.Add("1dfe", []byte("1dfe9a3ab24b23"), []byte("value2")); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := client.Lookup(ctx, provider, []byte("1dfe9a3ab24b23")); string(v) != "value2" {
+			t.Errorf("%v: wrong value after update: %s (%v)", name, v, err)
+		}
+		if _, err := client.Lookup(ctx, provider, []byte("2dfe9a3ab24b22")); err != ErrNotFound {
+			t.Errorf("%v: expected %v, got %v", name, ErrNotFound, err)
+		}
+
+		h := client.hints["1dfe"]
+		q, _ := client.NewQuery(h, []byte("1dfe9a3ab24b22"))
+		if err := s.Add("1dfe", []byte("1dfe9a3ab24b24"), []byte("value3")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := provider.QueryLWE(ctx, q); err != ErrStaleHint {
+			t.Errorf("%v: expected %v, got %v", name, ErrStaleHint, err)
+		}
+	}
+}
+
+// fills n rows of a bucket of 256 rows with values of size bytes
+func newBenchSinkhole(n, size int) *Sinkhole {
+	s := NewProvider(16, 4, 1)
+	if err := s.Add("1dfe", []byte("1dfe0a3ab24b22"), nil); err != nil {
+		panic(err)
+	}
+	store := s.buckets["1dfe"].store
+	value := make([]byte, size)
+	for j := 0; j < n; j++ {
+		row, _ := encodeRow([]entry{{tail: []byte("a3ab24b22"), value: value}})
+		store[j] = row
+	}
+	return &s
+}
+
+// BenchmarkAnswer compares the cost of answering a query with the Paillier
+// and the LWE backends, for buckets of the same size
+func BenchmarkAnswer(b *testing.B) {
+	ctx := context.Background()
+	key := []byte("1dfe9a3ab24b22")
+	for _, rows := range []int{16, 256} {
+		s := newBenchSinkhole(rows, 64)
+
+		for _, bits := range []int{1024, 2048} {
+			sk, _ := hcrypto.Paillier.GenerateKey(crand.Reader, bits)
+			q, err := NewClient(4, 1, 11, sk).NewQuery(key)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Run(fmt.Sprintf("paillier-%v/rows=%v", bits, rows), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, err := s.QueryContext(ctx, q.Suffix, q.Vector, q.PubKey); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+
+		h, err := s.Hint("1dfe")
+		if err != nil {
+			b.Fatal(err)
+		}
+		q, err := NewLWEClient(4, 1, 11).NewQuery(h, key)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(fmt.Sprintf("lwe/rows=%v", rows), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := s.QueryLWEContext(ctx, q.Suffix, q.Epoch, q.Vector); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkLWEClient measures the offline hint computation of the provider and
+// the online query construction and decoding of the client
+func BenchmarkLWEClient(b *testing.B) {
+	key := []byte("1dfe9a3ab24b22")
+	s := newBenchSinkhole(256, 64)
+	b.Run("hint", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := newLWEDB(s.buckets["1dfe"].store); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	h, _ := s.Hint("1dfe")
+	client := NewLWEClient(4, 1, 11)
+	b.Run("query", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := client.NewQuery(h, key); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	q, _ := client.NewQuery(h, key)
+	answer, _ := s.QueryLWE(q.Suffix, q.Epoch, q.Vector)
+	b.Run("decode", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := client.Decode(q, answer); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,424 @@
+package sinkhole
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Multi-server queries use information-theoretic PIR across several providers
+// which store the same buckets and do not collude. The client secret-shares
+// the one-hot selection vector of the key across the providers, one share per
+// provider, and every provider answers its share over the bucket with no
+// cryptographic operations:
+//
+//   answer = sum of share[j] · D[j] over GF(2^8)
+//
+// where D[j] is row j prefixed by its length, as rows answered in blocks, and
+// zero padded to the largest row of the bucket. Addition in GF(2^8) is XOR.
+//
+// XOR queries share the selection vector in k random bit vectors which XOR to
+// the selection vector, so providers only XOR the rows selected by their
+// share. The client XORs the k answers together, which yields the selected
+// row. Any k-1 providers learn nothing about the key, and all the k answers
+// are needed.
+//
+// Threshold queries share every element of the selection vector with a random
+// polynomial of degree t over GF(2^8) (Shamir), and provider i gets the
+// evaluation of the polynomials at i+1. Any t providers learn nothing about
+// the key, and the client interpolates the selected row from any t+1 answers.
+// Additional answers are checked against the interpolated row.
+
+// max number of providers of a multi-server query, which is bounded by the
+// number of evaluation points in GF(2^8)
+const maxProviders = 255
+
+// max size of the encoding of an answer to a share query
+const maxShareAnswerSize = 16 << 20
+
+var errInconsistentAnswers = errors.New("Answers of the providers are inconsistent")
+
+// ShareQuery is the share of a multi-server query sent to a single provider
+type ShareQuery struct {
+	Suffix string
+	Vector []byte
+}
+
+func (s *Sinkhole) QueryShare(ss string, q []byte) ([]byte, error) {
+	return s.QueryShareContext(context.Background(), ss, q)
+}
+
+// QueryShareContext answers a share of a multi-server query. The answer has
+// one byte per byte of the largest row of the bucket. Suffix spaces which are
+// not stored are answered with an empty answer.
+func (s *Sinkhole) QueryShareContext(ctx context.Context, ss string, q []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return []byte{}, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b, exists := s.buckets[ss]
+	if !exists {
+		return []byte{}, nil
+	}
+	if len(q) != len(b.store) {
+		return []byte{}, fmt.Errorf("Query must have %v rows, got %v",
+			len(b.store), len(q))
+	}
+
+	size := 0
+	for _, row := range b.store {
+		if len(row) > 0 && rowLenSize+len(row) > size {
+			size = rowLenSize + len(row)
+		}
+	}
+
+	answer := make([]byte, size)
+	for j, row := range b.store {
+		if len(row) == 0 || q[j] == 0 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return []byte{}, err
+		}
+
+		// shares of XOR queries are bits, so the row is XORed
+		if q[j] == 1 {
+			for k, v := range frameRow(row) {
+				answer[k] ^= v
+			}
+			continue
+		}
+		for k, v := range frameRow(row) {
+			answer[k] ^= gfMul(q[j], v)
+		}
+	}
+	return answer, nil
+}
+
+// MultiClient builds multi-server queries for the keys stored by several
+// sinkhole providers, and decodes their answers
+type MultiClient struct {
+	suffixLen int
+	privLen   int
+	tailLen   int
+
+	providers int
+	threshold int // degree of the sharing polynomials, 0 for XOR queries
+}
+
+// MultiQuery is a multi-server query for a key. Shares[i] is sent to the
+// provider i, and only the suffix of the key is disclosed to the providers.
+type MultiQuery struct {
+	Suffix string
+	Shares [][]byte
+
+	// tail of the queried key, which is never sent to the providers
+	tail []byte
+}
+
+// NewXORClient creates a client of XOR queries across the given number of
+// providers. Queries are private unless all the providers collude.
+func NewXORClient(suffixLen, privLen, tailLen, providers int) *MultiClient {
+	return &MultiClient{
+		suffixLen: suffixLen,
+		privLen:   privLen,
+		tailLen:   tailLen,
+		providers: providers,
+	}
+}
+
+// NewThresholdClient creates a client of t-private queries across the given
+// number of providers: queries are private unless more than t providers
+// collude, and are answered with the answers of any t+1 providers
+func NewThresholdClient(suffixLen, privLen, tailLen, providers, t int) *MultiClient {
+	c := NewXORClient(suffixLen, privLen, tailLen, providers)
+	c.threshold = t
+	return c
+}
+
+// Share returns the query sent to the provider i
+func (q *MultiQuery) Share(i int) *ShareQuery {
+	return &ShareQuery{Suffix: q.Suffix, Vector: q.Shares[i]}
+}
+
+// NewQuery builds the shares of the multi-server query for a key
+func (c *MultiClient) NewQuery(key []byte) (*MultiQuery, error) {
+	if c.providers < 2 || c.providers > maxProviders {
+		return nil, fmt.Errorf("Query must have between 2 and %v providers, got %v",
+			maxProviders, c.providers)
+	}
+	if c.threshold < 0 || c.threshold >= c.providers {
+		return nil, fmt.Errorf("Threshold must be smaller than the number of providers, got %v",
+			c.threshold)
+	}
+
+	spaceLen := c.suffixLen + c.privLen + c.tailLen
+	index, err := calculateIndex(spaceLen, c.suffixLen, c.privLen, key)
+	if err != nil {
+		return nil, err
+	}
+	sel := make([]byte, numRows(c.privLen))
+	sel[index.Int64()] = 1
+
+	var shares [][]byte
+	if c.threshold == 0 {
+		shares, err = xorShares(rand.Reader, sel, c.providers)
+	} else {
+		shares, err = shamirShares(rand.Reader, sel, c.providers, c.threshold)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &MultiQuery{
+		Suffix: string(key[:c.suffixLen]),
+		Shares: shares,
+		tail:   append([]byte{}, keyTail(c.suffixLen, c.privLen, c.tailLen, key)...),
+	}, nil
+}
+
+// Decode combines the answers of the providers to the query and returns the
+// value stored for the queried key, or ErrNotFound if there is none.
+// answers[i] is the answer of provider i, or nil if it did not answer.
+func (c *MultiClient) Decode(q *MultiQuery, answers [][]byte) ([]byte, error) {
+	if len(answers) != len(q.Shares) {
+		return nil, fmt.Errorf("Expected %v answers, got %v", len(q.Shares), len(answers))
+	}
+
+	var framed []byte
+	var err error
+	if c.threshold == 0 {
+		framed, err = xorAnswers(answers)
+	} else {
+		framed, err = interpolateAnswers(answers, c.threshold)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(framed) == 0 {
+		return nil, ErrNotFound
+	}
+
+	row, err := joinBlocks([][]byte{framed}, len(framed))
+	if err != nil {
+		return nil, err
+	}
+	entries, err := decodeRow(row)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := findEntry(entries, q.tail)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return v, nil
+}
+
+// MultiProvider is the multi-server API of a sinkhole provider, as served over
+// HTTP or streams
+type MultiProvider interface {
+	QueryShare(ctx context.Context, q *ShareQuery) ([]byte, error)
+}
+
+// Lookup sends the shares of the query for the key to the providers, which
+// must store the same buckets, and decodes their answers. Threshold queries
+// succeed as long as t+1 providers answer. It returns ErrNotFound if the
+// providers do not store a value for the key.
+func (c *MultiClient) Lookup(ctx context.Context, providers []MultiProvider, key []byte) ([]byte, error) {
+	if len(providers) != c.providers {
+		return nil, fmt.Errorf("Expected %v providers, got %v", c.providers, len(providers))
+	}
+	q, err := c.NewQuery(key)
+	if err != nil {
+		return nil, err
+	}
+
+	answers := make([][]byte, len(providers))
+	errs := make([]error, len(providers))
+	var wg sync.WaitGroup
+	for i, p := range providers {
+		wg.Add(1)
+		go func(i int, p MultiProvider) {
+			defer wg.Done()
+			answers[i], errs[i] = p.QueryShare(ctx, q.Share(i))
+		}(i, p)
+	}
+	wg.Wait()
+
+	// XOR queries need all the answers, and threshold queries t+1
+	required := c.threshold + 1
+	if c.threshold == 0 {
+		required = len(providers)
+	}
+	var failed error
+	n := 0
+	for i := range answers {
+		if errs[i] != nil {
+			answers[i], failed = nil, errs[i]
+			continue
+		}
+		n++
+	}
+	if n < required {
+		return nil, failed
+	}
+	return c.Decode(q, answers)
+}
+
+// shares sel in n random bit vectors which XOR to sel
+func xorShares(random io.Reader, sel []byte, n int) ([][]byte, error) {
+	shares := make([][]byte, n)
+	last := append([]byte{}, sel...)
+	for i := 0; i < n-1; i++ {
+		shares[i] = make([]byte, len(sel))
+		if _, err := io.ReadFull(random, shares[i]); err != nil {
+			return nil, err
+		}
+		for j := range shares[i] {
+			shares[i][j] &= 1
+			last[j] ^= shares[i][j]
+		}
+	}
+	shares[n-1] = last
+	return shares, nil
+}
+
+// shares every element of sel with a random polynomial of degree t, evaluated
+// at 1..n
+func shamirShares(random io.Reader, sel []byte, n, t int) ([][]byte, error) {
+	coeffs := make([]byte, t*len(sel))
+	if _, err := io.ReadFull(random, coeffs); err != nil {
+		return nil, err
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		x := byte(i + 1)
+		shares[i] = make([]byte, len(sel))
+		for j := range sel {
+			// Horner's rule, from the coefficient of degree t to sel[j]
+			var y byte
+			for m := t - 1; m >= 0; m-- {
+				y = gfMul(y, x) ^ coeffs[m*len(sel)+j]
+			}
+			shares[i][j] = gfMul(y, x) ^ sel[j]
+		}
+	}
+	return shares, nil
+}
+
+// XORs all the answers, which must be of the same size
+func xorAnswers(answers [][]byte) ([]byte, error) {
+	var res []byte
+	for i, a := range answers {
+		if a == nil {
+			return nil, fmt.Errorf("Provider %v did not answer", i)
+		}
+		if i == 0 {
+			res = append([]byte{}, a...)
+			continue
+		}
+		if len(a) != len(res) {
+			return nil, errInconsistentAnswers
+		}
+		for k := range a {
+			res[k] ^= a[k]
+		}
+	}
+	return res, nil
+}
+
+// interpolates the answers at 0 from the first t+1 answers, and checks the
+// other answers against the interpolated polynomial
+func interpolateAnswers(answers [][]byte, t int) ([]byte, error) {
+	var xs []byte
+	var ys [][]byte
+	for i, a := range answers {
+		if a != nil {
+			xs = append(xs, byte(i+1))
+			ys = append(ys, a)
+		}
+	}
+	if len(ys) < t+1 {
+		return nil, fmt.Errorf("Threshold queries need %v answers, got %v", t+1, len(ys))
+	}
+	for _, y := range ys {
+		if len(y) != len(ys[0]) {
+			return nil, errInconsistentAnswers
+		}
+	}
+
+	// the answers are evaluations of a polynomial of degree t, which is
+	// evaluated at 0 and at the points of the other answers
+	res := interpolate(xs[:t+1], ys[:t+1], 0)
+	for i := t + 1; i < len(ys); i++ {
+		if y := interpolate(xs[:t+1], ys[:t+1], xs[i]); string(y) != string(ys[i]) {
+			return nil, errInconsistentAnswers
+		}
+	}
+	return res, nil
+}
+
+// evaluates at x the polynomials through the points (xs[i], ys[i][k]) with
+// Lagrange interpolation
+func interpolate(xs []byte, ys [][]byte, x byte) []byte {
+	res := make([]byte, len(ys[0]))
+	for i := range xs {
+		// l = prod of (x - xs[m]) / (xs[i] - xs[m]), for m != i
+		l := byte(1)
+		for m := range xs {
+			if m != i {
+				l = gfMul(l, gfDiv(x^xs[m], xs[i]^xs[m]))
+			}
+		}
+		if l == 0 {
+			continue
+		}
+		for k, v := range ys[i] {
+			res[k] ^= gfMul(l, v)
+		}
+	}
+	return res
+}
+
+// GF(2^8) with the AES polynomial x^8 + x^4 + x^3 + x + 1, and generator 3
+var gfExp, gfLog = gfTables()
+
+func gfTables() ([510]byte, [256]byte) {
+	var exp [510]byte
+	var log [256]byte
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		exp[i+255] = byte(x)
+		log[x] = byte(i)
+
+		// x *= 3
+		x ^= x << 1
+		if x&0x100 != 0 {
+			x ^= 0x11b
+		}
+	}
+	return exp, log
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+// returns a / b, for b != 0
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
@@ -0,0 +1,215 @@
+package sinkhole
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+var (
+	_ MultiProvider = (*HTTPClient)(nil)
+	_ MultiProvider = (*StreamClient)(nil)
+)
+
+func TestGF256(t *testing.T) {
+	// FIPS-197, section 4.2
+	if p := gfMul(0x57, 0x83); p != 0xc1 {
+		t.Errorf("Expected 0x57 * 0x83 = 0xc1, got %#x", p)
+	}
+	if p := gfMul(0x57, 0x13); p != 0xfe {
+		t.Errorf("Expected 0x57 * 0x13 = 0xfe, got %#x", p)
+	}
+	for a := 0; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			if q := gfDiv(gfMul(byte(a), byte(b)), byte(b)); q != byte(a) {
+				t.Fatalf("Expected %v * %v / %v = %v, got %v", a, b, b, a, q)
+			}
+		}
+	}
+}
+
+func newMultiTestSinkhole(t *testing.T) *Sinkhole {
+	s := NewProvider(16, 4, 1)
+	large := bytes.Repeat([]byte("large"), 200)
+	for k, v := range map[string][]byte{
+		"1dfe9a3ab24b22": []byte("value1"),
+		"1dfe9a3ab24b23": []byte("value2"),
+		"1dfe0a3ab24b22": large,
+	} {
+		if err := s.Add("1dfe", []byte(k), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &s
+}
+
+// answers the shares of the query with the sinkhole, as every provider does
+func answerShares(t *testing.T, s *Sinkhole, q *MultiQuery) [][]byte {
+	answers := make([][]byte, len(q.Shares))
+	for i, share := range q.Shares {
+		var err error
+		if answers[i], err = s.QueryShare(q.Suffix, share); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return answers
+}
+
+func TestXORQuery(t *testing.T) {
+	s := newMultiTestSinkhole(t)
+	client := NewXORClient(4, 1, 11, 3)
+
+	q, err := client.NewQuery([]byte("1dfe9a3ab24b22"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(q.Shares) != 3 || q.Suffix != "1dfe" {
+		t.Fatalf("Expected 3 shares of suffix 1dfe, got %v of %v", len(q.Shares), q.Suffix)
+	}
+	for i, share := range q.Shares {
+		if len(share) != 256 {
+			t.Errorf("Share %v should have 256 rows, got %v", i, len(share))
+		}
+		for _, b := range share {
+			if b > 1 {
+				t.Fatalf("Shares of XOR queries should be bits, got %v", b)
+			}
+		}
+	}
+
+	answers := answerShares(t, s, q)
+	if v, err := client.Decode(q, answers); string(v) != "value1" {
+		t.Errorf("Wrong value: %s (%v)", v, err)
+	}
+
+	// all the answers are needed
+	answers[1] = nil
+	if _, err := client.Decode(q, answers); err == nil {
+		t.Error("XOR query should not be decoded with a missing answer")
+	}
+
+	for key, value := range map[string]string{
+		"1dfe9a3ab24b23": "value2",
+		"1dfe0a3ab24b22": string(bytes.Repeat([]byte("large"), 200)),
+		"1dfe8a3ab24b22": "",
+		"2dfe9a3ab24b22": "",
+	} {
+		q, _ := client.NewQuery([]byte(key))
+		v, err := client.Decode(q, answerShares(t, s, q))
+		if value == "" && err != ErrNotFound {
+			t.Errorf("%v: expected %v, got %v", key, ErrNotFound, err)
+		}
+		if value != "" && string(v) != value {
+			t.Errorf("%v: wrong value (%v)", key, err)
+		}
+	}
+}
+
+func TestThresholdQuery(t *testing.T) {
+	s := newMultiTestSinkhole(t)
+	client := NewThresholdClient(4, 1, 11, 5, 2)
+
+	q, err := client.NewQuery([]byte("1dfe9a3ab24b22"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	answers := answerShares(t, s, q)
+	if v, err := client.Decode(q, answers); string(v) != "value1" {
+		t.Errorf("Wrong value: %s (%v)", v, err)
+	}
+
+	// any t+1 answers are enough
+	partial := [][]byte{nil, answers[1], nil, answers[3], answers[4]}
+	if v, err := client.Decode(q, partial); string(v) != "value1" {
+		t.Errorf("Wrong value with t+1 answers: %s (%v)", v, err)
+	}
+	partial[3] = nil
+	if _, err := client.Decode(q, partial); err == nil {
+		t.Error("Threshold query should not be decoded with t answers")
+	}
+
+	// answers beyond t+1 are checked
+	answers[4] = append([]byte{}, answers[4]...)
+	answers[4][0] ^= 1
+	if _, err := client.Decode(q, answers); err != errInconsistentAnswers {
+		t.Errorf("Expected %v, got %v", errInconsistentAnswers, err)
+	}
+
+	q, _ = client.NewQuery([]byte("2dfe9a3ab24b22"))
+	if _, err := client.Decode(q, answerShares(t, s, q)); err != ErrNotFound {
+		t.Errorf("Expected %v, got %v", ErrNotFound, err)
+	}
+
+	for _, c := range []*MultiClient{
+		NewXORClient(4, 1, 11, 1),
+		NewThresholdClient(4, 1, 11, 3, 3),
+		NewThresholdClient(4, 1, 11, 256, 2),
+	} {
+		if _, err := c.NewQuery([]byte("1dfe9a3ab24b22")); err == nil {
+			t.Errorf("Query for %v providers and threshold %v should not be built",
+				c.providers, c.threshold)
+		}
+	}
+}
+
+func TestMultiLookup(t *testing.T) {
+	s := newMultiTestSinkhole(t)
+	srv := httptest.NewServer(NewHandler(s))
+	defer srv.Close()
+	down := httptest.NewServer(NewHandler(s))
+	down.Close()
+
+	ctx := context.Background()
+	providers := []MultiProvider{
+		NewHTTPClient(srv.URL, srv.Client()),
+		NewStreamClient(pipeOpener(NewHandler(s))),
+		NewHTTPClient(down.URL, nil),
+	}
+
+	// threshold queries tolerate providers which do not answer
+	v, err := NewThresholdClient(4, 1, 11, 3, 1).Lookup(ctx, providers, []byte("1dfe9a3ab24b22"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "value1" {
+		t.Errorf("Wrong value: %s", v)
+	}
+	if _, err := NewXORClient(4, 1, 11, 3).Lookup(ctx, providers, []byte("1dfe9a3ab24b22")); err == nil {
+		t.Error("XOR lookup should fail when a provider does not answer")
+	}
+
+	v, err = NewXORClient(4, 1, 11, 2).Lookup(ctx, providers[:2], []byte("1dfe9a3ab24b23"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "value2" {
+		t.Errorf("Wrong value: %s", v)
+	}
+}
+
+// BenchmarkShareAnswer measures the cost of answering a share of a XOR and of
+// a threshold query, for the buckets of BenchmarkAnswer
+func BenchmarkShareAnswer(b *testing.B) {
+	key := []byte("1dfe9a3ab24b22")
+	for _, rows := range []int{16, 256} {
+		s := newBenchSinkhole(rows, 64)
+		for name, client := range map[string]*MultiClient{
+			"xor":       NewXORClient(4, 1, 11, 2),
+			"threshold": NewThresholdClient(4, 1, 11, 3, 1),
+		} {
+			q, err := client.NewQuery(key)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Run(fmt.Sprintf("%v/rows=%v", name, rows), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, err := s.QueryShare(q.Suffix, q.Shares[0]); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package sinkhole
+
+import (
+	"context"
+	"errors"
+	hcrypto "github.com/hashmatter/p3lib/sinkhole/crypto"
+	"math"
+)
+
+// Recursive queries arrange the n rows of a bucket as a hypercube of d
+// dimensions of side n^(1/d), so that the query has d·n^(1/d) ciphertexts
+// instead of n. Row i is at the coordinates of i in base side, most
+// significant first, and rows past the end of the bucket are empty.
+//
+// The provider folds the dimensions in turn. Folding the first dimension with
+// the first query vector answers every row of the remaining hypercube as a
+// one dimensional query does. The ciphertexts of each answer are then split in
+// blocks, as plaintexts, and folded with the next query vector. The client
+// decrypts the answer once per dimension: every decryption yields the
+// ciphertexts of the previous dimension.
+//
+// Every fold multiplies the size of the answer by about the ciphertext
+// expansion of the scheme: 3 with Paillier, and 2 with Damgård–Jurik for
+// expansion factors of 2 or more.
+
+// max number of dimensions of a query
+const maxDimensions = 8
+
+// returns the smallest side of a hypercube of dims dimensions with n elements
+func hypercubeSide(n, dims int) int {
+	side := int(math.Pow(float64(n), 1/float64(dims)))
+	if side < 1 {
+		side = 1
+	}
+	for !fits(side, dims, n) {
+		side++
+	}
+	for side > 1 && fits(side-1, dims, n) {
+		side--
+	}
+	return side
+}
+
+// returns whether side^dims >= n
+func fits(side, dims, n int) bool {
+	p := 1
+	for i := 0; i < dims; i++ {
+		if p *= side; p >= n {
+			return true
+		}
+	}
+	return p >= n
+}
+
+// returns the coordinates of the element i of a hypercube, most significant
+// first
+func hypercubeCoords(i, side, dims int) []int {
+	coords := make([]int, dims)
+	for k := dims - 1; k >= 0; k-- {
+		coords[k] = i % side
+		i /= side
+	}
+	return coords
+}
+
+// folds the hypercube of rows of the store with the query vectors, one per
+// dimension. Every element of a folded hypercube starts from fresh encryptions
+// of zero, so that the ciphertexts decrypted by the client at each dimension
+// do not disclose the other rows of the bucket.
+func fold(ctx context.Context, pubkey hcrypto.PublicKey, store [][]byte, side, dims int,
+	q [][]byte) ([][]byte, error) {
+
+	scheme := pubkey.Scheme()
+	bs := blockSize(pubkey)
+	cs := ciphertextSize(pubkey)
+
+	size := 1
+	for i := 0; i < dims; i++ {
+		size *= side
+	}
+	elems := make([][][]byte, size)
+	width := 1
+	for i, row := range store {
+		if elems[i] = rowBlocks(row, bs); len(elems[i]) > width {
+			width = len(elems[i])
+		}
+	}
+
+	for k := 0; k < dims; k++ {
+		v := q[k*side : (k+1)*side]
+		rest := len(elems) / side
+		folded := make([][][]byte, rest)
+		for r := range folded {
+			answer, err := newAnswer(pubkey, width)
+			if err != nil {
+				return [][]byte{}, err
+			}
+
+			// empty elements would add an encryption of zero, so they are
+			// skipped
+			for c := 0; c < side; c++ {
+				if err := ctx.Err(); err != nil {
+					return [][]byte{}, err
+				}
+				for j, block := range elems[c*rest+r] {
+					prod, err := scheme.ScalarMul(pubkey, v[c], block)
+					if err != nil {
+						return [][]byte{}, err
+					}
+					if answer[j], err = scheme.Add(pubkey, answer[j], prod); err != nil {
+						return [][]byte{}, err
+					}
+				}
+			}
+			folded[r] = answer
+		}
+
+		if k == dims-1 {
+			return folded[0], nil
+		}
+		for r := range folded {
+			folded[r] = splitCiphertexts(folded[r], cs, bs)
+		}
+		elems = folded
+		width = len(elems[0])
+	}
+	return [][]byte{}, nil
+}
+
+// splits the ciphertexts of size cs in blocks of size bs. The last block is
+// padded with zeroes.
+func splitCiphertexts(cts [][]byte, cs, bs int) [][]byte {
+	buf := make([]byte, 0, len(cts)*cs+bs)
+	for _, c := range cts {
+		buf = appendPadded(buf, c, cs)
+	}
+	if r := len(buf) % bs; r != 0 {
+		buf = append(buf, make([]byte, bs-r)...)
+	}
+	blocks := make([][]byte, len(buf)/bs)
+	for i := range blocks {
+		blocks[i] = buf[i*bs : (i+1)*bs]
+	}
+	return blocks
+}
+
+// joins the decrypted blocks of size bs and returns the ciphertexts of size cs
+// which were split in them. The padding is smaller than a ciphertext, since
+// blocks are smaller than ciphertexts.
+func joinCiphertexts(blocks [][]byte, cs, bs int) ([][]byte, error) {
+	buf := make([]byte, 0, len(blocks)*bs)
+	for _, b := range blocks {
+		if len(b) > bs {
+			return nil, errors.New("Block is larger than the block size")
+		}
+		buf = appendPadded(buf, b, bs)
+	}
+	cts := make([][]byte, len(buf)/cs)
+	if len(cts) == 0 {
+		return nil, errors.New("Answer is truncated")
+	}
+	for i := range cts {
+		cts[i] = buf[i*cs : (i+1)*cs]
+	}
+	return cts, nil
+}
+
+// decrypts the answer to a query of dims dimensions once per folded dimension
+// but the first, and returns the ciphertexts of the first dimension
+func unfold(sk hcrypto.PrivateKey, dims int, answer [][]byte) ([][]byte, error) {
+	pk := sk.Public()
+	for k := 1; k < dims; k++ {
+		blocks := make([][]byte, len(answer))
+		for i, c := range answer {
+			var err error
+			if blocks[i], err = hcrypto.Decrypt(sk, c); err != nil {
+				return nil, err
+			}
+		}
+		var err error
+		if answer, err = joinCiphertexts(blocks, ciphertextSize(pk), blockSize(pk)); err != nil {
+			return nil, err
+		}
+	}
+	return answer, nil
+}
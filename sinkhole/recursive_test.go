@@ -0,0 +1,150 @@
+package sinkhole
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	hcrypto "github.com/hashmatter/p3lib/sinkhole/crypto"
+	"reflect"
+	"testing"
+)
+
+func TestHypercube(t *testing.T) {
+	for _, c := range []struct{ n, dims, side int }{
+		{256, 1, 256},
+		{256, 2, 16},
+		{256, 3, 7},
+		{256, 4, 4},
+		{256, 8, 2},
+		{65536, 3, 41},
+		{1, 2, 1},
+	} {
+		if side := hypercubeSide(c.n, c.dims); side != c.side {
+			t.Errorf("Expected side %v for %v elements in %v dimensions, got %v",
+				c.side, c.n, c.dims, side)
+		}
+	}
+
+	if coords := hypercubeCoords(0x9a, 16, 2); !reflect.DeepEqual(coords, []int{9, 10}) {
+		t.Errorf("Wrong coordinates %v", coords)
+	}
+	if coords := hypercubeCoords(200, 7, 3); !reflect.DeepEqual(coords, []int{4, 0, 4}) {
+		t.Errorf("Wrong coordinates %v", coords)
+	}
+}
+
+func TestSplitCiphertexts(t *testing.T) {
+	cts := [][]byte{
+		bytes.Repeat([]byte{1}, 32),
+		append([]byte{0, 0}, bytes.Repeat([]byte{2}, 30)...),
+	}
+	blocks := splitCiphertexts(cts, 32, 15)
+	if len(blocks) != 5 {
+		t.Fatalf("Expected 5 blocks, got %v", len(blocks))
+	}
+
+	// leading zeroes of the blocks are lost when they are decrypted
+	for i := range blocks {
+		blocks[i] = bytes.TrimLeft(blocks[i], "\x00")
+	}
+	res, err := joinCiphertexts(blocks, 32, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, cts) {
+		t.Errorf("Ciphertexts were not joined: %v", res)
+	}
+}
+
+func TestRecursiveQuery(t *testing.T) {
+	sinkhole := NewProvider(16, 4, 1)
+	large := make([]byte, 100)
+	for i := range large {
+		large[i] = byte(i)
+	}
+	values := map[string][]byte{
+		"1dfe9a3ab24b22": []byte("value1"),
+		"1dfe9a3ab24b23": []byte("value2"),
+		"1dfe0a3ab24b22": large,
+	}
+	for k, v := range values {
+		if err := sinkhole.Add("1dfe", []byte(k), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, scheme := range []hcrypto.HomomorphicScheme{hcrypto.Paillier, hcrypto.DamgardJurik(2)} {
+		sk, err := scheme.GenerateKey(crand.Reader, 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for dims, size := range map[int]int{1: 256, 2: 32, 3: 21, 4: 16} {
+			client := NewRecursiveClient(4, 1, 11, dims, sk)
+			for k, v := range values {
+				q, err := client.NewQuery([]byte(k))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(q.Vector) != size {
+					t.Errorf("%v: expected %v ciphertexts in %v dimensions, got %v",
+						scheme.Name(), size, dims, len(q.Vector))
+				}
+
+				// the dimensions of the query are encoded
+				raw, err := q.MarshalBinary()
+				if err != nil {
+					t.Fatal(err)
+				}
+				var dec Query
+				if err := dec.UnmarshalBinary(raw); err != nil {
+					t.Fatal(err)
+				}
+				res, err := sinkhole.QueryRecursive(dec.Suffix, dec.Dimensions, dec.Vector, dec.PubKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v2, err := client.Decode(q, res); !bytes.Equal(v2, v) {
+					t.Errorf("%v: %v was not recovered in %v dimensions (%v)",
+						scheme.Name(), k, dims, err)
+				}
+			}
+
+			for _, k := range []string{"1dfe8a3ab24b22", "2dfe9a3ab24b22"} {
+				q, _ := client.NewQuery([]byte(k))
+				res, err := sinkhole.QueryRecursive(q.Suffix, q.Dimensions, q.Vector, q.PubKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := client.Decode(q, res); err != ErrNotFound {
+					t.Errorf("%v: expected %v in %v dimensions, got %v",
+						scheme.Name(), ErrNotFound, dims, err)
+				}
+			}
+		}
+	}
+
+	sk, _ := hcrypto.Paillier.GenerateKey(crand.Reader, 128)
+	q, _ := NewRecursiveClient(4, 1, 11, 2, sk).NewQuery([]byte("1dfe9a3ab24b22"))
+	if _, err := sinkhole.QueryRecursive(q.Suffix, 3, q.Vector, q.PubKey); err == nil {
+		t.Error("Query with the wrong number of dimensions should be rejected")
+	}
+	if _, err := NewRecursiveClient(4, 1, 11, maxDimensions+1, sk).NewQuery([]byte("1dfe9a3ab24b22")); err == nil {
+		t.Error("Query with too many dimensions should not be built")
+	}
+}
+
+func TestLookupRecursive(t *testing.T) {
+	_, srv := newTestProvider(t)
+	defer srv.Close()
+
+	sk, _ := hcrypto.DamgardJurik(2).GenerateKey(crand.Reader, 128)
+	v, err := LookupRecursive(context.Background(), NewHTTPClient(srv.URL, srv.Client()),
+		sk, 2, []byte("1dfe9a3ab24b22"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "value1" {
+		t.Errorf("Wrong value: %s", v)
+	}
+}
@@ -0,0 +1,177 @@
+package sinkhole
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	hcrypto "github.com/hashmatter/p3lib/sinkhole/crypto"
+)
+
+// Keys which share the private space of a bucket are stored in the same row,
+// identified by their tail space. Rows are encoded as:
+//
+//   row:   version (1) | entry * n
+//   entry: tail len (1) | tail | value len (2) | value
+//
+// The whole row is returned to the client, which picks its own entry by tail.
+//
+// Rows may be larger than the plaintexts of the client's key, so they are
+// answered in blocks of the plaintext size of the key. A row is prefixed by
+// its length (4 bytes), padded with zeroes to a multiple of the block size and
+// split in blocks of the block size. The client pads every decrypted block
+// back to the block size, since the leading zero bytes of a block are lost
+// when it is encrypted as an integer, and strips the padding of the row by
+// its length.
+
+const (
+	rowVersion = 1
+
+	maxTailSize  = 255
+	maxValueSize = 65535
+
+	rowLenSize = 4
+)
+
+type entry struct {
+	tail  []byte
+	value []byte
+}
+
+func encodeRow(entries []entry) ([]byte, error) {
+	row := []byte{rowVersion}
+	for _, e := range entries {
+		if len(e.tail) > maxTailSize {
+			return nil, fmt.Errorf("Tail must have at most %v bytes, got %v",
+				maxTailSize, len(e.tail))
+		}
+		if len(e.value) > maxValueSize {
+			return nil, fmt.Errorf("Value must have at most %v bytes, got %v",
+				maxValueSize, len(e.value))
+		}
+
+		var l [2]byte
+		binary.BigEndian.PutUint16(l[:], uint16(len(e.value)))
+		row = append(row, byte(len(e.tail)))
+		row = append(row, e.tail...)
+		row = append(row, l[:]...)
+		row = append(row, e.value...)
+	}
+	return row, nil
+}
+
+func decodeRow(row []byte) ([]entry, error) {
+	if len(row) == 0 {
+		return nil, nil
+	}
+	if row[0] != rowVersion {
+		return nil, errors.New("Unsupported row encoding")
+	}
+	row = row[1:]
+
+	var entries []entry
+	for len(row) > 0 {
+		tl := int(row[0])
+		if len(row) < 1+tl+2 {
+			return nil, errors.New("Row is truncated")
+		}
+		tail := row[1 : 1+tl]
+		vl := int(binary.BigEndian.Uint16(row[1+tl:]))
+		row = row[1+tl+2:]
+		if len(row) < vl {
+			return nil, errors.New("Row is truncated")
+		}
+		entries = append(entries, entry{tail: tail, value: row[:vl]})
+		row = row[vl:]
+	}
+	return entries, nil
+}
+
+// returns the entries of the row with the entry for the tail set to value
+func setEntry(entries []entry, tail, value []byte) []entry {
+	for i := range entries {
+		if bytes.Equal(entries[i].tail, tail) {
+			entries[i].value = value
+			return entries
+		}
+	}
+	return append(entries, entry{tail: tail, value: value})
+}
+
+// returns the value of the entry for the tail, if any
+func findEntry(entries []entry, tail []byte) ([]byte, bool) {
+	for _, e := range entries {
+		if bytes.Equal(e.tail, tail) {
+			return e.value, true
+		}
+	}
+	return nil, false
+}
+
+// returns the tail space of the key, which may be shorter than tailLen
+func keyTail(suffixLen, privLen, tailLen int, key []byte) []byte {
+	start := suffixLen + privLen
+	if len(key) <= start {
+		return []byte{}
+	}
+	end := start + tailLen
+	if end > len(key) {
+		end = len(key)
+	}
+	return key[start:end]
+}
+
+// returns the size of the blocks of rows answered under the public key, which
+// is the plaintext size of the key
+func blockSize(pubkey hcrypto.PublicKey) int {
+	return pubkey.Scheme().PlaintextSize(pubkey)
+}
+
+// returns the row prefixed by its length. Empty rows are not framed.
+func frameRow(row []byte) []byte {
+	if len(row) == 0 {
+		return nil
+	}
+	framed := make([]byte, rowLenSize+len(row))
+	binary.BigEndian.PutUint32(framed, uint32(len(row)))
+	copy(framed[rowLenSize:], row)
+	return framed
+}
+
+// splits the row in blocks of size bs. Empty rows have no blocks.
+func rowBlocks(row []byte, bs int) [][]byte {
+	if len(row) == 0 {
+		return nil
+	}
+
+	framed := frameRow(row)
+	if r := len(framed) % bs; r != 0 {
+		framed = append(framed, make([]byte, bs-r)...)
+	}
+
+	blocks := make([][]byte, len(framed)/bs)
+	for i := range blocks {
+		blocks[i] = framed[i*bs : (i+1)*bs]
+	}
+	return blocks
+}
+
+// joins the decrypted blocks of a row of size bs and returns the row
+func joinBlocks(blocks [][]byte, bs int) ([]byte, error) {
+	framed := make([]byte, 0, len(blocks)*bs)
+	for _, b := range blocks {
+		if len(b) > bs {
+			return nil, errors.New("Block is larger than the block size")
+		}
+		framed = appendPadded(framed, b, bs)
+	}
+
+	if len(framed) < rowLenSize {
+		return nil, errors.New("Row is truncated")
+	}
+	l := binary.BigEndian.Uint32(framed)
+	if uint64(l) > uint64(len(framed)-rowLenSize) {
+		return nil, errors.New("Row is truncated")
+	}
+	return framed[rowLenSize : rowLenSize+int(l)], nil
+}
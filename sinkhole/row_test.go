@@ -0,0 +1,79 @@
+package sinkhole
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRowEncoding(t *testing.T) {
+	entries := []entry{
+		{tail: []byte("3ab24b22"), value: []byte("value1")},
+		{tail: []byte{}, value: []byte{0, 0, 1}},
+		{tail: []byte("3ab24b23"), value: []byte{}},
+	}
+	row, err := encodeRow(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := decodeRow(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dec) != len(entries) {
+		t.Fatalf("Expected %v entries, got %v", len(entries), len(dec))
+	}
+	for i := range entries {
+		if !bytes.Equal(dec[i].tail, entries[i].tail) ||
+			!bytes.Equal(dec[i].value, entries[i].value) {
+			t.Errorf("Entry %v was not decoded: %v", i, dec[i])
+		}
+	}
+
+	// truncations at the boundary of an entry are valid rows
+	boundaries := map[int]bool{1: true, 18: true, 24: true}
+	for i := 1; i < len(row); i++ {
+		if _, err := decodeRow(row[:i]); err == nil && !boundaries[i] {
+			t.Errorf("Row truncated to %v bytes should not be decoded", i)
+		}
+	}
+
+	if _, err := encodeRow([]entry{{value: make([]byte, maxValueSize+1)}}); err == nil {
+		t.Error("Values larger than the max size should not be encoded")
+	}
+}
+
+func TestRowBlocks(t *testing.T) {
+	for _, size := range []int{1, 10, 11, 15, 100} {
+		row := make([]byte, size)
+		row[size-1] = 1
+
+		blocks := rowBlocks(row, 15)
+		if (size+rowLenSize)%15 == 0 && len(blocks) != (size+rowLenSize)/15 {
+			t.Errorf("Row of %v bytes should not be padded, got %v blocks", size, len(blocks))
+		}
+
+		// blocks lose their leading zero bytes when encrypted as integers
+		decrypted := make([][]byte, len(blocks))
+		for i, b := range blocks {
+			decrypted[i] = bytes.TrimLeft(b, "\x00")
+		}
+		res, err := joinBlocks(decrypted, 15)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(res, row) {
+			t.Errorf("Row of %v bytes was not recovered: %v", size, res)
+		}
+	}
+
+	if len(rowBlocks(nil, 15)) != 0 {
+		t.Error("Empty rows should have no blocks")
+	}
+	if res, err := joinBlocks([][]byte{{}}, 15); err != nil || len(res) != 0 {
+		t.Errorf("Zero blocks should decode to an empty row, got %v (%v)", res, err)
+	}
+	long := append([]byte{0, 0, 0, 200}, make([]byte, 11)...)
+	if _, err := joinBlocks([][]byte{long}, 15); err == nil {
+		t.Error("Rows longer than their blocks should not be decoded")
+	}
+}
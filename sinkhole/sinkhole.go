@@ -1,12 +1,16 @@
 package sinkhole
 
 import (
+	"context"
 	"crypto"
+	"crypto/rand"
 	"errors"
 	"fmt"
-	paillier "github.com/Roasbeef/go-go-gadget-paillier"
+	hcrypto "github.com/hashmatter/p3lib/sinkhole/crypto"
 	"math"
 	"math/big"
+	"sort"
+	"sync"
 )
 
 type Sinkhole struct {
@@ -14,76 +18,224 @@ type Sinkhole struct {
 	suffix_space_len  int
 	private_space_len int
 	buckets           map[string]bucket
-	pk                crypto.PublicKey
-	sk                crypto.PrivateKey
+
+	// guards the buckets, so that queries can be served concurrently with Add
+	mu *sync.RWMutex
 }
 
 type bucket struct {
 	suffix_space string
 	store        [][]byte
+
+	// LWE hint of the bucket, computed on the first hint request
+	lwe *lweDB
 }
 
-func New(s_len, ss_len, ps_len int, sk crypto.PrivateKey, pk crypto.PublicKey) Sinkhole {
+// NewProvider creates a sinkhole provider with the given space, suffix space
+// and private space lengths. The provider holds no keys: queries are answered
+// under the public key of the client, with the homomorphic scheme of the key.
+func NewProvider(s_len, ss_len, ps_len int) Sinkhole {
 	buckets := map[string]bucket{}
-	return Sinkhole{s_len, ss_len, ps_len, buckets, pk, sk}
-}
-
-func (s *Sinkhole) Query(ss string, q [][]byte, pubkey paillier.PublicKey) ([][]byte, error) {
-	// select bucket
-	var buck bucket
-	exists := false
-	for k, b := range s.buckets {
-		if k == ss {
-			buck = b
-			exists = true
-			break
-		}
+	return Sinkhole{s_len, ss_len, ps_len, buckets, &sync.RWMutex{}}
+}
+
+// New creates a sinkhole provider with the given space, suffix space and
+// private space lengths. The keys are not used by the provider.
+//
+// Deprecated: use NewProvider, since queries are answered under the public key
+// of the client.
+func New(s_len, ss_len, ps_len int, sk crypto.PrivateKey, pk crypto.PublicKey) Sinkhole {
+	return NewProvider(s_len, ss_len, ps_len)
+}
+
+// Info describes the address spaces served by a sinkhole provider. The lengths
+// of the spaces are in bytes of the key.
+type Info struct {
+	Version      int      `json:"version"`
+	SuffixSpaces []string `json:"suffix_spaces"`
+	SuffixLen    int      `json:"suffix_len"`
+	P            int      `json:"p"`
+	T            int      `json:"t"`
+}
+
+// Status describes the key-value tuples stored by a sinkhole provider
+type Status struct {
+	Buckets int `json:"buckets"`
+	Tuples  int `json:"tuples"`
+}
+
+// Info returns the address spaces served by the sinkhole
+func (s *Sinkhole) Info() Info {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	suffixes := make([]string, 0, len(s.buckets))
+	for k := range s.buckets {
+		suffixes = append(suffixes, k)
 	}
-	if !exists {
-		return [][]byte{}, nil
+	sort.Strings(suffixes)
+
+	return Info{
+		Version:      WireVersion,
+		SuffixSpaces: suffixes,
+		SuffixLen:    s.suffix_space_len,
+		P:            s.private_space_len,
+		T:            s.tailLen(),
 	}
+}
 
-	// go through bucket rowns and multiply homomorphically
-	for i, row := range buck.store {
+// Status returns the number of buckets and key-value tuples stored by the
+// sinkhole
+func (s *Sinkhole) Status() Status {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-		// TODO: init this before ??
-		if len(row) == 0 {
-			row = []byte{0}
+	st := Status{Buckets: len(s.buckets)}
+	for _, b := range s.buckets {
+		for _, row := range b.store {
+			entries, _ := decodeRow(row)
+			st.Tuples += len(entries)
 		}
+	}
+	return st
+}
+
+func (s *Sinkhole) Query(ss string, q [][]byte, pubkey hcrypto.PublicKey) ([][]byte, error) {
+	return s.QueryContext(context.Background(), ss, q, pubkey)
+}
+
+// QueryContext is like Query, but stops processing the query and returns the
+// context error once the context is done. The homomorphic multiplication of
+// each row is expensive, so the context is checked before each row.
+//
+// Rows are split in blocks which fit in the plaintexts of the client's key,
+// and every block is answered with the same query vector: the products of
+// each query element and the block of its row are added homomorphically, so
+// that only the block of the selected row remains. The answer has one
+// ciphertext per block of the largest row of the bucket, so it does not
+// disclose the size of the selected row. Every ciphertext is re-randomized
+// with a fresh encryption of zero, so the answer does not disclose which rows
+// are empty. The size of the answer does disclose the size of the largest row,
+// and whether the suffix space is stored, which is public in Info anyway.
+func (s *Sinkhole) QueryContext(ctx context.Context, ss string, q [][]byte,
+	pubkey hcrypto.PublicKey) ([][]byte, error) {
+	return s.QueryRecursiveContext(ctx, ss, 1, q, pubkey)
+}
+
+func (s *Sinkhole) QueryRecursive(ss string, dims int, q [][]byte,
+	pubkey hcrypto.PublicKey) ([][]byte, error) {
+	return s.QueryRecursiveContext(context.Background(), ss, dims, q, pubkey)
+}
+
+// QueryRecursiveContext answers a query over the rows of the bucket arranged
+// as a hypercube of dims dimensions. The query holds one vector per dimension,
+// and the dimensions are folded in turn, as described in fold. With one
+// dimension, it is QueryContext.
+func (s *Sinkhole) QueryRecursiveContext(ctx context.Context, ss string, dims int,
+	q [][]byte, pubkey hcrypto.PublicKey) ([][]byte, error) {
+
+	if err := ctx.Err(); err != nil {
+		return [][]byte{}, err
+	}
+	if err := checkPublicKey(pubkey); err != nil {
+		return [][]byte{}, err
+	}
+	if dims < 1 || dims > maxDimensions {
+		return [][]byte{}, fmt.Errorf("Query must have between 1 and %v dimensions, got %v",
+			maxDimensions, dims)
+	}
 
-		q[i] = paillier.Mul(&pubkey, q[i], row)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// select bucket. Suffix spaces which are not stored are answered as empty
+	// buckets, with fresh encryptions of zero. The answer is smaller than the
+	// answer of a stored space, so it is not padded: the stored spaces are
+	// listed in Info.
+	rows := numRows(s.private_space_len)
+	buck, exists := s.buckets[ss]
+	if !exists && dims == 1 {
+		return newAnswer(pubkey, 1)
 	}
 
-	return q, nil
+	side := hypercubeSide(rows, dims)
+	if len(q) != dims*side {
+		return [][]byte{}, fmt.Errorf("Query of %v rows must have %v ciphertexts, got %v",
+			rows, dims*side, len(q))
+	}
+	return fold(ctx, pubkey, buck.store, side, dims, q)
+}
+
+// returns an answer of n fresh encryptions of zero
+func newAnswer(pubkey hcrypto.PublicKey, n int) ([][]byte, error) {
+	answer := make([][]byte, n)
+	for i := range answer {
+		var err error
+		answer[i], err = hcrypto.Encrypt(pubkey, rand.Reader, []byte{0})
+		if err != nil {
+			return [][]byte{}, err
+		}
+	}
+	return answer, nil
 }
 
-// TODO: feature more than one entry per row!
+// Add stores the value of the key. Keys which share the private space are
+// stored in the same row, one entry per tail space, so that they do not
+// overwrite each other. Adding a key which is already stored replaces its
+// value.
 func (s *Sinkhole) Add(suffix string, key []byte, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	index, err := calculateIndex(s.space_len, s.suffix_space_len, s.private_space_len, key)
+	if err != nil {
+		return err
+	}
+
 	b, exists := s.buckets[suffix]
 
 	// if bucket for suffix space of the new key value does not exit yet, create it
 	if exists == false {
-		num_rows := math.Pow(2, float64(8*s.private_space_len)) // num bits private space == num bucket entries
 		s.buckets[suffix] = bucket{
 			suffix_space: suffix,
-			store:        make([][]byte, int(num_rows)),
+			store:        make([][]byte, numRows(s.private_space_len)),
 		}
 		b = s.buckets[suffix]
 	}
 
-	index, err := calculateIndex(s.space_len, s.suffix_space_len, s.private_space_len, key)
+	entries, err := decodeRow(b.store[index.Int64()])
+	if err != nil {
+		return err
+	}
+	tail := keyTail(s.suffix_space_len, s.private_space_len, s.tailLen(), key)
+	row, err := encodeRow(setEntry(entries, append([]byte{}, tail...), value))
 	if err != nil {
 		return err
 	}
 
-	b.store[index.Int64()] = value
+	if b.lwe != nil {
+		b.lwe.update(int(index.Int64()), frameRow(b.store[index.Int64()]), frameRow(row))
+	}
+	b.store[index.Int64()] = row
 	return nil
 }
 
+// returns the length of the tail space
+func (s *Sinkhole) tailLen() int {
+	return s.space_len - (s.suffix_space_len + s.private_space_len)
+}
+
 func (s *Sinkhole) route(sufx string) (bucket, error) {
 	return bucket{}, nil
 }
 
+// returns the number of rows of a bucket, which is also the size of the query
+// vectors
+func numRows(privLen int) int {
+	// num bits private space == num bucket entries
+	return int(math.Pow(2, float64(8*privLen)))
+}
+
 func getIndex(k []byte) *big.Int {
 	return big.NewInt(0).SetBytes(k)
 }
@@ -92,7 +244,13 @@ func getIndex(k []byte) *big.Int {
 // TODO: refactor, add checks for boundaries, etc..
 func calculateIndex(spaceLen, suffixLen, privLen int, key []byte) (*big.Int, error) {
 	tailSpace := spaceLen - (suffixLen + privLen)
-	privSpaceKey := key[suffixLen : spaceLen-tailSpace]
+	if len(key) < suffixLen+privLen {
+		return big.NewInt(0), fmt.Errorf("Key must have at least %v bytes, got %v",
+			suffixLen+privLen, len(key))
+	}
+
+	// the private space is decoded in a copy, so that the key is not modified
+	privSpaceKey := append([]byte{}, key[suffixLen:spaceLen-tailSpace]...)
 
 	for i, _ := range privSpaceKey {
 		b, err := hexByte(privSpaceKey[i])
@@ -113,5 +271,3 @@ func hexByte(b byte) (byte, error) {
 	}
 	return 0, errors.New("out of hex boudaries")
 }
-
-var _ = fmt.Sprintf("remove me")
@@ -1,12 +1,13 @@
 package sinkhole
 
 import (
+	"context"
+	crand "crypto/rand"
 	"fmt"
-	paillier "github.com/Roasbeef/go-go-gadget-paillier"
+	hcrypto "github.com/hashmatter/p3lib/sinkhole/crypto"
 	"log"
 	"math"
 	"math/big"
-	"math/rand"
 	"reflect"
 	"testing"
 )
@@ -47,8 +48,7 @@ func TestQueryPaillier(t *testing.T) {
 	private_space_len := 2
 
 	// bootstrap server
-	privKey, _ := paillier.GenerateKey(rand.New(rand.NewSource(1)), 128)
-	sinkhole := New(space_len, suffix_space_len, private_space_len, privKey, privKey.PublicKey)
+	sinkhole := NewProvider(space_len, suffix_space_len, private_space_len)
 
 	// add entry to provider
 	// 1dfe003ab24b2213 == value1
@@ -62,7 +62,7 @@ func TestQueryPaillier(t *testing.T) {
 	}
 
 	// bootstrap client
-	cliPrivKey, _ := paillier.GenerateKey(rand.New(rand.NewSource(2)), 128)
+	cliPrivKey, _ := hcrypto.Paillier.GenerateKey(crand.Reader, 128)
 
 	// query
 	// TODO: Refactor!
@@ -76,37 +76,70 @@ func TestQueryPaillier(t *testing.T) {
 			v = new(big.Int).SetInt64(1).Bytes()
 		}
 
-		el, err := paillier.Encrypt(&cliPrivKey.PublicKey, v)
+		el, err := hcrypto.Encrypt(cliPrivKey.Public(), nil, v)
 		if err != nil {
 			log.Fatal(err)
 		}
 		q[i] = el
 	}
 
-	array_result, err := sinkhole.Query(kv_suffix_space, q, cliPrivKey.PublicKey)
+	answer, err := sinkhole.Query(kv_suffix_space, q, cliPrivKey.Public())
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	// check result
-	var res [][]byte
-	for _, row := range array_result {
-		dec, err := paillier.Decrypt(cliPrivKey, row)
-		if err != nil {
-			t.Error(err)
-			return
-		}
+	row, err := decryptRow(cliPrivKey, answer)
+	if err != nil {
+		t.Error(err)
+		return
+	}
 
-		if len(dec) != 0 {
-			res = append(res, dec)
-		}
+	entries, err := decodeRow(row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _ := findEntry(entries, []byte("3ab24b22"))
+	if string(res) != v {
+		t.Error("wrong result: ", string(res))
 	}
 
-	if len(res) != 1 {
-		t.Error("there should be one result, got ", len(res))
+	// the answer has one ciphertext per block of the row, regardless of the
+	// number of rows
+	if n := len(rowBlocks(sinkhole.buckets[kv_suffix_space].store[q_position.Int64()],
+		blockSize(cliPrivKey.Public()))); len(answer) != n {
+		t.Errorf("answer should have %v ciphertexts, got %v", n, len(answer))
 	}
+}
 
-	if string(res[0]) != v {
-		t.Error("wrong result: ", v)
+func TestQueryContext(t *testing.T) {
+	privKey, _ := hcrypto.Paillier.GenerateKey(crand.Reader, 128)
+	sinkhole := NewProvider(16, 4, 1)
+	err := sinkhole.Add("1dfe", []byte("1dfe9a3ab24b22"), []byte("value1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := make([][]byte, 256)
+	for i := range q {
+		q[i], _ = hcrypto.Encrypt(privKey.Public(), nil, []byte{0})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := sinkhole.QueryContext(ctx, "1dfe", q, privKey.Public()); err != context.Canceled {
+		t.Errorf("Query should be cancelled, got %v", err)
+	}
+}
+
+func TestDeprecatedNew(t *testing.T) {
+	// the keys of the deprecated constructor are ignored
+	privKey, _ := hcrypto.Paillier.GenerateKey(crand.Reader, 128)
+	sinkhole := New(16, 4, 1, privKey, privKey.Public())
+	if err := sinkhole.Add("1dfe", []byte("1dfe9a3ab24b22"), []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+	if info := sinkhole.Info(); info.SuffixLen != 4 || info.P != 1 || info.T != 11 {
+		t.Errorf("Unexpected spaces: %+v", info)
 	}
 }
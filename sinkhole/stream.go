@@ -0,0 +1,259 @@
+package sinkhole
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The provider API is served over streams, such as libp2p streams, with the
+// protocol ProtocolID. Every stream carries a single request and its response:
+//
+//   request:  type (1) | body len (4) | body
+//   response: code (1) | body len (4) | body
+//
+// where the body of a query and of its answer use the wire encoding of the
+// HTTP API, and info and status are encoded in JSON. The body of a hint
+// request is the suffix space. If the response code is not ok, the body is an
+// error message.
+
+// ProtocolID is the libp2p protocol ID of the provider API
+const ProtocolID = "/p3lib/sinkhole/1.0"
+
+const (
+	streamQuery  byte = 1
+	streamInfo   byte = 2
+	streamStatus byte = 3
+	streamHint   byte = 4
+	streamLWE    byte = 5
+	streamShare  byte = 6
+
+	streamOK    byte = 0
+	streamError byte = 1
+	streamStale byte = 2
+
+	// max size of the info and status documents read from a provider
+	maxDocumentSize = 1 << 20
+)
+
+// HandleStream reads a request from the stream, writes the response and
+// closes the stream. It can be set as the libp2p stream handler of ProtocolID.
+func (h *Handler) HandleStream(s io.ReadWriteCloser) {
+	defer s.Close()
+	h.ServeStream(context.Background(), s)
+}
+
+// ServeStream reads a request from rw and writes the response. The query is
+// processed until the context is done. Requests larger than MaxQuerySize are
+// not read.
+func (h *Handler) ServeStream(ctx context.Context, rw io.ReadWriter) error {
+	// requests which can not be read are not answered, since the client may
+	// still be writing them. The stream is closed instead.
+	typ, body, err := readMessage(rw, h.MaxQuerySize)
+	if err != nil {
+		return err
+	}
+
+	var res []byte
+	switch typ {
+	case streamQuery:
+		res, err = h.answer(ctx, body)
+	case streamInfo:
+		res, err = json.Marshal(h.sinkhole.Info())
+	case streamStatus:
+		res, err = json.Marshal(h.sinkhole.Status())
+	case streamHint:
+		res, err = h.hint(string(body))
+	case streamLWE:
+		res, err = h.answerLWE(ctx, body)
+	case streamShare:
+		res, err = h.answerShare(ctx, body)
+	default:
+		err = fmt.Errorf("Unknown request type %v", typ)
+	}
+
+	if err == ErrStaleHint {
+		return writeMessage(rw, streamStale, []byte(err.Error()))
+	}
+	if err != nil {
+		return writeMessage(rw, streamError, []byte(err.Error()))
+	}
+	return writeMessage(rw, streamOK, res)
+}
+
+// StreamOpener opens a new stream to a provider. With libp2p, it opens a
+// stream to the provider peer with ProtocolID.
+type StreamOpener func(ctx context.Context) (io.ReadWriteCloser, error)
+
+// StreamClient sends queries to a sinkhole provider over streams, one stream
+// per request
+type StreamClient struct {
+	open StreamOpener
+}
+
+// NewStreamClient returns a client of the provider reached by the streams
+// opened by open
+func NewStreamClient(open StreamOpener) *StreamClient {
+	return &StreamClient{open: open}
+}
+
+// Info returns the address spaces served by the provider
+func (c *StreamClient) Info(ctx context.Context) (*Info, error) {
+	res, err := c.request(ctx, streamInfo, nil, maxDocumentSize)
+	if err != nil {
+		return nil, err
+	}
+	var info Info
+	if err := json.Unmarshal(res, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Status returns the status of the provider
+func (c *StreamClient) Status(ctx context.Context) (*Status, error) {
+	res, err := c.request(ctx, streamStatus, nil, maxDocumentSize)
+	if err != nil {
+		return nil, err
+	}
+	var st Status
+	if err := json.Unmarshal(res, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// Query sends the query to the provider and returns the encrypted answer,
+// which is decoded with Client.Decode
+func (c *StreamClient) Query(ctx context.Context, q *Query) ([][]byte, error) {
+	raw, err := q.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.request(ctx, streamQuery, raw, maxAnswerSize(q.PubKey))
+	if err != nil {
+		return nil, err
+	}
+	return decodeAnswer(q.PubKey, res)
+}
+
+// Hint downloads the hint of the suffix space from the provider
+func (c *StreamClient) Hint(ctx context.Context, suffix string) (*Hint, error) {
+	res, err := c.request(ctx, streamHint, []byte(suffix), maxHintSize+1024)
+	if err != nil {
+		return nil, err
+	}
+	var h Hint
+	if err := h.UnmarshalBinary(res); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// QueryLWE sends the LWE query to the provider and returns the answer, which
+// is decoded with LWEClient.Decode. It returns ErrStaleHint if the hint of
+// the query is stale.
+func (c *StreamClient) QueryLWE(ctx context.Context, q *LWEQuery) ([]uint32, error) {
+	if q.hint == nil {
+		return nil, errNoHint
+	}
+	raw, err := q.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.request(ctx, streamLWE, raw, maxLWEAnswerSize(q.hint))
+	if err != nil {
+		return nil, err
+	}
+	return decodeLWEAnswer(res)
+}
+
+// QueryShare sends the share of a multi-server query to the provider and
+// returns its answer, which is decoded with MultiClient.Decode
+func (c *StreamClient) QueryShare(ctx context.Context, q *ShareQuery) ([]byte, error) {
+	raw, err := q.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.request(ctx, streamShare, raw, maxShareAnswerSize)
+	if err != nil {
+		return nil, err
+	}
+	return decodeShareAnswer(res)
+}
+
+// opens a stream, sends the request and reads a response of at most maxSize
+// bytes. The stream is closed once the context is done.
+func (c *StreamClient) request(ctx context.Context, typ byte, body []byte,
+	maxSize int64) ([]byte, error) {
+
+	s, err := c.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-done:
+		}
+	}()
+
+	if err := writeMessage(s, typ, body); err != nil {
+		return nil, contextError(ctx, err)
+	}
+	code, res, err := readMessage(s, maxSize)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	if code == streamStale {
+		return nil, ErrStaleHint
+	}
+	if code != streamOK {
+		return nil, fmt.Errorf("Sinkhole provider replied with error: %s", res)
+	}
+	return res, nil
+}
+
+// returns the context error if the context is done, since it is the cause of
+// errors on closed streams
+func contextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func writeMessage(w io.Writer, typ byte, body []byte) error {
+	var hdr [5]byte
+	hdr[0] = typ
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(body)))
+	if _, err := w.Write(append(hdr[:], body...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// reads a message with a body of at most maxSize bytes
+func readMessage(r io.Reader, maxSize int64) (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	size := int64(binary.BigEndian.Uint32(hdr[1:]))
+	if size > maxSize {
+		return 0, nil, errors.New("Message is too large")
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], body, nil
+}
@@ -0,0 +1,97 @@
+package sinkhole
+
+import (
+	"context"
+	crand "crypto/rand"
+	hcrypto "github.com/hashmatter/p3lib/sinkhole/crypto"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	_ Provider = (*HTTPClient)(nil)
+	_ Provider = (*StreamClient)(nil)
+)
+
+// returns an opener of in-memory streams served by the handler
+func pipeOpener(h *Handler) StreamOpener {
+	return func(ctx context.Context) (io.ReadWriteCloser, error) {
+		c, s := net.Pipe()
+		go h.HandleStream(s)
+		return c, nil
+	}
+}
+
+func TestStreamLookup(t *testing.T) {
+	s := NewProvider(16, 4, 1)
+	if err := s.Add("1dfe", []byte("1dfe9a3ab24b22"), []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+	provider := NewStreamClient(pipeOpener(NewHandler(&s)))
+
+	ctx := context.Background()
+	cliPrivKey, _ := hcrypto.Paillier.GenerateKey(crand.Reader, 128)
+	v, err := Lookup(ctx, provider, cliPrivKey, []byte("1dfe9a3ab24b22"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "value1" {
+		t.Errorf("Wrong value: %s", v)
+	}
+	if _, err := Lookup(ctx, provider, cliPrivKey, []byte("1dfe8a3ab24b22")); err != ErrNotFound {
+		t.Errorf("Expected %v, got %v", ErrNotFound, err)
+	}
+
+	st, err := provider.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Buckets != 1 || st.Tuples != 1 {
+		t.Errorf("Expected 1 bucket and 1 tuple, got %+v", *st)
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	s := NewProvider(16, 4, 1)
+	if err := s.Add("1dfe", []byte("1dfe9a3ab24b22"), []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(&s)
+	cliPrivKey, _ := hcrypto.Paillier.GenerateKey(crand.Reader, 128)
+	q, _ := NewClient(4, 1, 11, cliPrivKey).NewQuery([]byte("1dfe9a3ab24b22"))
+
+	// queries with a wrong number of rows are rejected by the provider
+	short := *q
+	short.Vector = q.Vector[:10]
+	_, err := NewStreamClient(pipeOpener(h)).Query(context.Background(), &short)
+	if err == nil || !strings.Contains(err.Error(), "rows") {
+		t.Errorf("Query with a wrong number of rows should be rejected, got %v", err)
+	}
+	_, err = NewStreamClient(pipeOpener(h)).request(context.Background(), 42, nil, 1024)
+	if err == nil || !strings.Contains(err.Error(), "Unknown request type") {
+		t.Errorf("Unknown requests should be rejected, got %v", err)
+	}
+
+	// queries larger than the limit are not read
+	h.MaxQuerySize = 10
+	if _, err := NewStreamClient(pipeOpener(h)).Query(context.Background(), q); err == nil {
+		t.Error("Query larger than the limit should be rejected")
+	}
+
+	// the stream is closed once the context is done, even if the provider does
+	// not reply
+	silent := func(ctx context.Context) (io.ReadWriteCloser, error) {
+		c, s := net.Pipe()
+		go io.Copy(ioutil.Discard, s)
+		return c, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := NewStreamClient(silent).Info(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
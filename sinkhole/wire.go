@@ -0,0 +1,484 @@
+package sinkhole
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	hcrypto "github.com/hashmatter/p3lib/sinkhole/crypto"
+)
+
+// Queries and answers are encoded as:
+//
+//   query:  version | suffix len (1) | suffix | scheme (1) | key len (2) |
+//           key | dimensions (1) | num rows (4) | ciphertext * num rows
+//   answer: version | num blocks (2) | ciphertext * num blocks
+//
+// where the public key is encoded by the homomorphic scheme of the query, and
+// every ciphertext is padded to the ciphertext size of the key. Integers are
+// encoded big endian.
+//
+// The hints, queries and answers of the LWE backend are encoded as:
+//
+//   hint:       version | suffix len (1) | suffix | epoch (8) | seed (16) |
+//               rows (4) | cols (4) | element * rows * 1024
+//   LWE query:  version | suffix len (1) | suffix | epoch (8) | num rows (4) |
+//               element * num rows
+//   LWE answer: version | num elements (4) | element * num elements
+//
+// where every element is an integer mod 2^32 (4 bytes).
+//
+// The shares of multi-server queries and their answers are encoded as:
+//
+//   share query:  version | suffix len (1) | suffix | num rows (4) |
+//                 share * num rows
+//   share answer: version | answer len (4) | answer
+//
+// where every share is an element of GF(2^8) (1 byte).
+
+const (
+	// WireVersion is the version of the wire encoding of queries and answers
+	WireVersion = 1
+
+	// min size of the blocks of rows, which is the plaintext size of the key
+	minBlockSize = 8
+
+	// max size of the ciphertexts of a query, in bytes
+	maxCiphertextSize = 4096
+
+	// max number of blocks of an answer
+	maxAnswerBlocks = 65535
+)
+
+var ErrUnsupportedVersion = errors.New("sinkhole: unsupported wire encoding version")
+
+// MarshalBinary encodes the query to be sent to the provider. The selected row
+// is not encoded.
+func (q *Query) MarshalBinary() ([]byte, error) {
+	if len(q.Suffix) > 255 {
+		return nil, fmt.Errorf("Suffix must have at most 255 bytes, got %v", len(q.Suffix))
+	}
+	if err := checkPublicKey(q.PubKey); err != nil {
+		return nil, err
+	}
+	scheme := q.PubKey.Scheme()
+	key, err := scheme.MarshalPublicKey(q.PubKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) > 65535 {
+		return nil, fmt.Errorf("Public key must have at most 65535 bytes, got %v", len(key))
+	}
+
+	if q.Dimensions < 1 || q.Dimensions > maxDimensions {
+		return nil, fmt.Errorf("Query must have between 1 and %v dimensions, got %v",
+			maxDimensions, q.Dimensions)
+	}
+
+	width := scheme.CiphertextSize(q.PubKey)
+	buf := make([]byte, 0, 1+1+len(q.Suffix)+1+2+len(key)+1+4+len(q.Vector)*width)
+
+	buf = append(buf, WireVersion, byte(len(q.Suffix)))
+	buf = append(buf, q.Suffix...)
+	buf = append(buf, byte(scheme.ID()), byte(len(key)>>8), byte(len(key)))
+	buf = append(buf, key...)
+	buf = append(buf, byte(q.Dimensions))
+
+	var rows [4]byte
+	binary.BigEndian.PutUint32(rows[:], uint32(len(q.Vector)))
+	buf = append(buf, rows[:]...)
+	for i, c := range q.Vector {
+		if len(c) > width {
+			return nil, fmt.Errorf("Ciphertext of row %v is larger than the ciphertext size", i)
+		}
+		buf = appendPadded(buf, c, width)
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a query received by the provider
+func (q *Query) UnmarshalBinary(raw []byte) error {
+	if len(raw) == 0 {
+		return errors.New("Empty query")
+	}
+	if raw[0] != WireVersion {
+		return ErrUnsupportedVersion
+	}
+	raw = raw[1:]
+
+	suffix, raw, err := readField(raw, 1)
+	if err != nil {
+		return err
+	}
+	if len(raw) < 1 {
+		return errors.New("Query is truncated")
+	}
+	id := hcrypto.SchemeID(raw[0])
+	key, raw, err := readField(raw[1:], 2)
+	if err != nil {
+		return err
+	}
+	pubkey, err := decodePublicKey(id, key)
+	if err != nil {
+		return err
+	}
+
+	if len(raw) < 1+4 {
+		return errors.New("Query is truncated")
+	}
+	dims := int(raw[0])
+	if dims < 1 || dims > maxDimensions {
+		return fmt.Errorf("Query must have between 1 and %v dimensions, got %v",
+			maxDimensions, dims)
+	}
+	rows := int(binary.BigEndian.Uint32(raw[1:]))
+	raw = raw[5:]
+
+	// the number of rows is checked against the size of the query before
+	// allocating the vector
+	width := ciphertextSize(pubkey)
+	if len(raw)%width != 0 || len(raw)/width != rows {
+		return fmt.Errorf("Query must have %v ciphertexts of %v bytes, got %v bytes",
+			rows, width, len(raw))
+	}
+
+	q.Suffix = string(suffix)
+	q.Dimensions = dims
+	q.PubKey = pubkey
+	q.Vector = make([][]byte, rows)
+	for i := range q.Vector {
+		q.Vector[i] = raw[i*width : (i+1)*width]
+	}
+	q.index = 0
+	return nil
+}
+
+// encodes the answer to a query encrypted under the public key
+func encodeAnswer(pubkey hcrypto.PublicKey, answer [][]byte) ([]byte, error) {
+	if len(answer) > maxAnswerBlocks {
+		return nil, fmt.Errorf("Answer must have at most %v blocks, got %v",
+			maxAnswerBlocks, len(answer))
+	}
+
+	width := ciphertextSize(pubkey)
+	buf := make([]byte, 0, 3+len(answer)*width)
+	buf = append(buf, WireVersion, byte(len(answer)>>8), byte(len(answer)))
+	for _, c := range answer {
+		if len(c) > width {
+			return nil, errors.New("Answer is larger than the ciphertext size")
+		}
+		buf = appendPadded(buf, c, width)
+	}
+	return buf, nil
+}
+
+// decodes the answer to a query encrypted under the public key
+func decodeAnswer(pubkey hcrypto.PublicKey, raw []byte) ([][]byte, error) {
+	if len(raw) == 0 {
+		return nil, errors.New("Empty answer")
+	}
+	if raw[0] != WireVersion {
+		return nil, ErrUnsupportedVersion
+	}
+	if len(raw) < 3 {
+		return nil, errors.New("Answer is truncated")
+	}
+	n := int(raw[1])<<8 | int(raw[2])
+	raw = raw[3:]
+
+	width := ciphertextSize(pubkey)
+	if n == 0 || len(raw) != n*width {
+		return nil, fmt.Errorf("Answer must have %v ciphertexts of %v bytes, got %v bytes",
+			n, width, len(raw))
+	}
+	answer := make([][]byte, n)
+	for i := range answer {
+		answer[i] = raw[i*width : (i+1)*width]
+	}
+	return answer, nil
+}
+
+// returns the max size of the encoding of an answer under the public key
+func maxAnswerSize(pubkey hcrypto.PublicKey) int64 {
+	return int64(3 + maxAnswerBlocks*ciphertextSize(pubkey))
+}
+
+// decodes a public key of the homomorphic scheme with the given ID
+func decodePublicKey(id hcrypto.SchemeID, raw []byte) (hcrypto.PublicKey, error) {
+	scheme, err := hcrypto.SchemeByID(id)
+	if err != nil {
+		return nil, err
+	}
+	pubkey, err := scheme.UnmarshalPublicKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPublicKey(pubkey); err != nil {
+		return nil, err
+	}
+	return pubkey, nil
+}
+
+// checks that the blocks of rows and the ciphertexts under the public key
+// have a supported size
+func checkPublicKey(pubkey hcrypto.PublicKey) error {
+	if pubkey == nil {
+		return errors.New("Missing public key")
+	}
+	scheme := pubkey.Scheme()
+	if bs := scheme.PlaintextSize(pubkey); bs < minBlockSize {
+		return fmt.Errorf("Plaintexts of %v must have at least %v bytes, got %v",
+			scheme.Name(), minBlockSize, bs)
+	}
+	if cs := scheme.CiphertextSize(pubkey); cs > maxCiphertextSize {
+		return fmt.Errorf("Ciphertexts of %v must have at most %v bytes, got %v",
+			scheme.Name(), maxCiphertextSize, cs)
+	}
+	return nil
+}
+
+// returns the size of the encoding of a ciphertext under the public key
+func ciphertextSize(pubkey hcrypto.PublicKey) int {
+	return pubkey.Scheme().CiphertextSize(pubkey)
+}
+
+// reads a field prefixed by its length, encoded in lenSize bytes
+func readField(raw []byte, lenSize int) ([]byte, []byte, error) {
+	if len(raw) < lenSize {
+		return nil, nil, errors.New("Query is truncated")
+	}
+	l := 0
+	for _, b := range raw[:lenSize] {
+		l = l<<8 | int(b)
+	}
+	raw = raw[lenSize:]
+	if len(raw) < l {
+		return nil, nil, errors.New("Query is truncated")
+	}
+	return raw[:l], raw[l:], nil
+}
+
+// appends b to buf, left padded with zeroes to size bytes
+func appendPadded(buf, b []byte, size int) []byte {
+	buf = append(buf, make([]byte, size-len(b))...)
+	return append(buf, b...)
+}
+
+// MarshalBinary encodes the hint to be sent to the client
+func (h *Hint) MarshalBinary() ([]byte, error) {
+	if len(h.Suffix) > 255 {
+		return nil, fmt.Errorf("Suffix must have at most 255 bytes, got %v", len(h.Suffix))
+	}
+	if len(h.Matrix) != h.Rows*lweN {
+		return nil, fmt.Errorf("Hint must have %v elements, got %v", h.Rows*lweN, len(h.Matrix))
+	}
+
+	buf := make([]byte, 0, 1+1+len(h.Suffix)+8+lweSeedSize+4+4+4*len(h.Matrix))
+	buf = append(buf, WireVersion, byte(len(h.Suffix)))
+	buf = append(buf, h.Suffix...)
+	buf = appendUint64(buf, h.Epoch)
+	buf = append(buf, h.Seed[:]...)
+	buf = appendUint32(buf, uint32(h.Rows))
+	buf = appendUint32(buf, uint32(h.Cols))
+	return appendElements(buf, h.Matrix), nil
+}
+
+// UnmarshalBinary decodes a hint received by the client
+func (h *Hint) UnmarshalBinary(raw []byte) error {
+	if len(raw) == 0 {
+		return errors.New("Empty hint")
+	}
+	if raw[0] != WireVersion {
+		return ErrUnsupportedVersion
+	}
+	suffix, raw, err := readField(raw[1:], 1)
+	if err != nil {
+		return err
+	}
+	if len(raw) < 8+lweSeedSize+4+4 {
+		return errors.New("Hint is truncated")
+	}
+	epoch := binary.BigEndian.Uint64(raw)
+	raw = raw[8:]
+	var seed [lweSeedSize]byte
+	copy(seed[:], raw)
+	raw = raw[lweSeedSize:]
+	rows := int64(binary.BigEndian.Uint32(raw))
+	cols := int(binary.BigEndian.Uint32(raw[4:]))
+	raw = raw[8:]
+
+	if cols > maxLWERows {
+		return fmt.Errorf("Hint must have at most %v columns, got %v", maxLWERows, cols)
+	}
+	if int64(len(raw)) != 4*lweN*rows {
+		return fmt.Errorf("Hint must have %v rows of %v elements, got %v bytes",
+			rows, lweN, len(raw))
+	}
+
+	h.Suffix = string(suffix)
+	h.Epoch = epoch
+	h.Seed = seed
+	h.Rows = int(rows)
+	h.Cols = cols
+	h.Matrix = readElements(raw)
+	return nil
+}
+
+// MarshalBinary encodes the LWE query to be sent to the provider
+func (q *LWEQuery) MarshalBinary() ([]byte, error) {
+	if len(q.Suffix) > 255 {
+		return nil, fmt.Errorf("Suffix must have at most 255 bytes, got %v", len(q.Suffix))
+	}
+	buf := make([]byte, 0, 1+1+len(q.Suffix)+8+4+4*len(q.Vector))
+	buf = append(buf, WireVersion, byte(len(q.Suffix)))
+	buf = append(buf, q.Suffix...)
+	buf = appendUint64(buf, q.Epoch)
+	buf = appendUint32(buf, uint32(len(q.Vector)))
+	return appendElements(buf, q.Vector), nil
+}
+
+// UnmarshalBinary decodes a LWE query received by the provider
+func (q *LWEQuery) UnmarshalBinary(raw []byte) error {
+	if len(raw) == 0 {
+		return errors.New("Empty query")
+	}
+	if raw[0] != WireVersion {
+		return ErrUnsupportedVersion
+	}
+	suffix, raw, err := readField(raw[1:], 1)
+	if err != nil {
+		return err
+	}
+	if len(raw) < 8+4 {
+		return errors.New("Query is truncated")
+	}
+	epoch := binary.BigEndian.Uint64(raw)
+	rows := int64(binary.BigEndian.Uint32(raw[8:]))
+	raw = raw[12:]
+	if int64(len(raw)) != 4*rows {
+		return fmt.Errorf("Query must have %v elements, got %v bytes", rows, len(raw))
+	}
+
+	q.Suffix = string(suffix)
+	q.Epoch = epoch
+	q.Vector = readElements(raw)
+	q.hint, q.secret, q.tail = nil, nil, nil
+	return nil
+}
+
+func encodeLWEAnswer(answer []uint32) []byte {
+	buf := make([]byte, 0, 1+4+4*len(answer))
+	buf = append(buf, WireVersion)
+	buf = appendUint32(buf, uint32(len(answer)))
+	return appendElements(buf, answer)
+}
+
+func decodeLWEAnswer(raw []byte) ([]uint32, error) {
+	if len(raw) == 0 {
+		return nil, errors.New("Empty answer")
+	}
+	if raw[0] != WireVersion {
+		return nil, ErrUnsupportedVersion
+	}
+	if len(raw) < 5 {
+		return nil, errors.New("Answer is truncated")
+	}
+	n := int64(binary.BigEndian.Uint32(raw[1:]))
+	raw = raw[5:]
+	if int64(len(raw)) != 4*n {
+		return nil, fmt.Errorf("Answer must have %v elements, got %v bytes", n, len(raw))
+	}
+	return readElements(raw), nil
+}
+
+// returns the max size of the encoding of the answer to a query built with the
+// hint
+func maxLWEAnswerSize(h *Hint) int64 {
+	return int64(5 + 4*h.Rows)
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendElements(buf []byte, elems []uint32) []byte {
+	for _, e := range elems {
+		buf = appendUint32(buf, e)
+	}
+	return buf
+}
+
+func readElements(raw []byte) []uint32 {
+	elems := make([]uint32, len(raw)/4)
+	for i := range elems {
+		elems[i] = binary.BigEndian.Uint32(raw[4*i:])
+	}
+	return elems
+}
+
+// MarshalBinary encodes the share query to be sent to a provider
+func (q *ShareQuery) MarshalBinary() ([]byte, error) {
+	if len(q.Suffix) > 255 {
+		return nil, fmt.Errorf("Suffix must have at most 255 bytes, got %v", len(q.Suffix))
+	}
+	buf := make([]byte, 0, 1+1+len(q.Suffix)+4+len(q.Vector))
+	buf = append(buf, WireVersion, byte(len(q.Suffix)))
+	buf = append(buf, q.Suffix...)
+	buf = appendUint32(buf, uint32(len(q.Vector)))
+	return append(buf, q.Vector...), nil
+}
+
+// UnmarshalBinary decodes a share query received by a provider
+func (q *ShareQuery) UnmarshalBinary(raw []byte) error {
+	if len(raw) == 0 {
+		return errors.New("Empty query")
+	}
+	if raw[0] != WireVersion {
+		return ErrUnsupportedVersion
+	}
+	suffix, raw, err := readField(raw[1:], 1)
+	if err != nil {
+		return err
+	}
+	vector, raw, err := readField(raw, 4)
+	if err != nil {
+		return err
+	}
+	if len(raw) != 0 {
+		return errors.New("Query has trailing bytes")
+	}
+	q.Suffix = string(suffix)
+	q.Vector = vector
+	return nil
+}
+
+func encodeShareAnswer(answer []byte) []byte {
+	buf := make([]byte, 0, 1+4+len(answer))
+	buf = append(buf, WireVersion)
+	buf = appendUint32(buf, uint32(len(answer)))
+	return append(buf, answer...)
+}
+
+func decodeShareAnswer(raw []byte) ([]byte, error) {
+	if len(raw) == 0 {
+		return nil, errors.New("Empty answer")
+	}
+	if raw[0] != WireVersion {
+		return nil, ErrUnsupportedVersion
+	}
+	answer, raw, err := readField(raw[1:], 4)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != 0 {
+		return nil, errors.New("Answer has trailing bytes")
+	}
+	return answer, nil
+}
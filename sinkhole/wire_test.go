@@ -0,0 +1,162 @@
+package sinkhole
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	hcrypto "github.com/hashmatter/p3lib/sinkhole/crypto"
+	"reflect"
+	"testing"
+)
+
+func TestQueryEncoding(t *testing.T) {
+	privKey, _ := hcrypto.Paillier.GenerateKey(crand.Reader, 128)
+	q, err := NewClient(4, 1, 11, privKey).NewQuery([]byte("1dfe9a3ab24b22"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := q.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dec Query
+	if err := dec.UnmarshalBinary(raw); err != nil {
+		t.Fatal(err)
+	}
+
+	if dec.Suffix != q.Suffix || !reflect.DeepEqual(dec.PubKey, q.PubKey) {
+		t.Errorf("Suffix and public key were not decoded: %v %v", dec.Suffix, dec.PubKey)
+	}
+	if len(dec.Vector) != len(q.Vector) {
+		t.Fatalf("Expected %v rows, got %v", len(q.Vector), len(dec.Vector))
+	}
+
+	// ciphertexts are padded, so they decrypt to the same plaintexts
+	for i := range q.Vector {
+		a, _ := hcrypto.Decrypt(privKey, q.Vector[i])
+		b, _ := hcrypto.Decrypt(privKey, dec.Vector[i])
+		if string(a) != string(b) {
+			t.Fatalf("Row %v was not decoded", i)
+		}
+	}
+
+	for i := 0; i < len(raw); i++ {
+		if err := dec.UnmarshalBinary(raw[:i]); err == nil {
+			t.Fatalf("Query truncated to %v bytes should not be decoded", i)
+		}
+	}
+	raw[0] = WireVersion + 1
+	if err := dec.UnmarshalBinary(raw); err != ErrUnsupportedVersion {
+		t.Errorf("Expected %v, got %v", ErrUnsupportedVersion, err)
+	}
+}
+
+func TestAnswerEncoding(t *testing.T) {
+	privKey, _ := hcrypto.Paillier.GenerateKey(crand.Reader, 128)
+	answer, err := newAnswer(privKey.Public(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := encodeAnswer(privKey.Public(), answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := decodeAnswer(privKey.Public(), raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dec) != 3 {
+		t.Fatalf("Expected 3 blocks, got %v", len(dec))
+	}
+
+	if _, err := decodeAnswer(privKey.Public(), raw[:len(raw)-1]); err == nil {
+		t.Error("Truncated answer should not be decoded")
+	}
+	if _, err := decodeAnswer(privKey.Public(), raw[:3]); err == nil {
+		t.Error("Answer without blocks should not be decoded")
+	}
+}
+
+func TestLWEEncoding(t *testing.T) {
+	s := NewProvider(16, 4, 1)
+	if err := s.Add("1dfe", []byte("1dfe9a3ab24b22"), []byte("value1")); err != nil {
+		t.Fatal(err)
+	}
+	h, err := s.Hint("1dfe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hint Hint
+	if err := hint.UnmarshalBinary(raw); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hint, *h) {
+		t.Error("Hint was not decoded")
+	}
+	for _, i := range []int{0, 1, 5, 20, len(raw) - 1} {
+		if err := hint.UnmarshalBinary(raw[:i]); err == nil {
+			t.Fatalf("Hint truncated to %v bytes should not be decoded", i)
+		}
+	}
+
+	q, err := NewLWEClient(4, 1, 11).NewQuery(h, []byte("1dfe9a3ab24b22"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err = q.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dec LWEQuery
+	if err := dec.UnmarshalBinary(raw); err != nil {
+		t.Fatal(err)
+	}
+	if dec.Suffix != q.Suffix || dec.Epoch != q.Epoch || !reflect.DeepEqual(dec.Vector, q.Vector) {
+		t.Error("LWE query was not decoded")
+	}
+	if err := dec.UnmarshalBinary(raw[:len(raw)-1]); err == nil {
+		t.Error("Truncated LWE query should not be decoded")
+	}
+
+	answer := []uint32{1, 2, 1 << 31}
+	res, err := decodeLWEAnswer(encodeLWEAnswer(answer))
+	if err != nil || !reflect.DeepEqual(res, answer) {
+		t.Errorf("LWE answer was not decoded: %v (%v)", res, err)
+	}
+	if _, err := decodeLWEAnswer(encodeLWEAnswer(answer)[:8]); err == nil {
+		t.Error("Truncated LWE answer should not be decoded")
+	}
+}
+
+func TestShareEncoding(t *testing.T) {
+	q := &ShareQuery{Suffix: "1dfe", Vector: []byte{0, 1, 1, 0, 42}}
+	raw, err := q.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dec ShareQuery
+	if err := dec.UnmarshalBinary(raw); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(dec, *q) {
+		t.Errorf("Share query was not decoded: %+v", dec)
+	}
+	for i := 0; i < len(raw); i++ {
+		if err := dec.UnmarshalBinary(raw[:i]); err == nil {
+			t.Fatalf("Query truncated to %v bytes should not be decoded", i)
+		}
+	}
+
+	answer := []byte("answer")
+	res, err := decodeShareAnswer(encodeShareAnswer(answer))
+	if err != nil || !bytes.Equal(res, answer) {
+		t.Errorf("Share answer was not decoded: %s (%v)", res, err)
+	}
+	if _, err := decodeShareAnswer(encodeShareAnswer(answer)[:6]); err == nil {
+		t.Error("Truncated share answer should not be decoded")
+	}
+}
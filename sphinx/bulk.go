@@ -0,0 +1,413 @@
+package sphinx
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	scrypto "github.com/hashmatter/p3lib/sphinx/crypto"
+	"io"
+)
+
+// In the header-only mode, the packet carries no payload and the header is
+// used to set up the keys of an out-of-band payload stream of arbitrary length
+// (e.g. sent over the same connection after the header). The stream is split
+// in frames of up to BulkChunkSize bytes, which the initiator encrypts with an
+// AEAD keyed for the exit relay and then with the key stream of every hop. Each
+// relay removes its key stream layer from the frames before forwarding them,
+// so the frames received and forwarded by a relay are not linkable by their
+// content. The exit relay removes the last layer and verifies and decrypts the
+// frames with the AEAD. The AEAD nonce and the key stream of each frame depend
+// on the frame sequence number, so that frames can not be reordered, and the
+// last frame of the stream is marked so that truncation is detected.
+//
+// All the frames have the same size: the last frame is padded with zeroes and
+// the length of its data is encrypted with it, so that its size does not link
+// the stream across hops. The number of frames, and their timing, are still
+// the same on both sides of a relay: streams which must not be linked by their
+// length should be padded by the application.
+//
+// Note that relays do not verify the integrity of the frames they forward:
+// a frame modified on the path is only detected (and the stream dropped) by the
+// exit relay. Since the key streams are malleable, this enables tagging
+// attacks: an adversary which controls the entry relay can flip bits of the
+// frames, and an adversary which controls the exit relay learns that the
+// stream was tagged when it fails to decrypt, linking both ends of the
+// circuit.
+
+const (
+	// max size in bytes of the plaintext carried by a frame of a stream
+	bulkChunkSize = 16 * 1024
+
+	// size in bytes of the flag which marks the last frame of a stream, of the
+	// length of the data of the frame and of the AEAD tag
+	bulkFrameOverhead = 1 + 2 + 16
+
+	// size in bytes of every frame of a stream
+	bulkFrameSize = bulkChunkSize + bulkFrameOverhead
+
+	// size in bytes of the length prefix of each frame
+	bulkLenSize = 4
+
+	bulkFinalFrame = byte(1)
+)
+
+// BulkChunkSize is the max size in bytes of the plaintext carried by a frame of
+// a payload stream
+const BulkChunkSize = bulkChunkSize
+
+// BulkKeys are kept by the initiator of a header-only packet and are used to
+// encrypt the payload stream
+type BulkKeys struct {
+	suite   scrypto.CipherSuite
+	streams [][]byte
+	aeadKey []byte
+	used    bool
+}
+
+// NewBulkHeader creates the header of a header-only packet and the keys used to
+// encrypt its payload stream. The parameters are the same as in NewPacket, and
+// the session key should be wiped by the caller with scrypto.WipeECDSAKey.
+func NewBulkHeader(sessionKey *ecdsa.PrivateKey, circuitPubKeys []ecdsa.PublicKey,
+	finalAddr []byte, relayAddrs [][]byte, opts ...HeaderOption) (*Header, *BulkKeys, error) {
+
+	return NewBulkHeaderContext(context.Background(), sessionKey, circuitPubKeys,
+		finalAddr, relayAddrs, opts...)
+}
+
+// NewBulkHeaderContext is like NewBulkHeader, but stops constructing the header
+// and returns the context error once the context is done
+func NewBulkHeaderContext(ctx context.Context, sessionKey *ecdsa.PrivateKey,
+	circuitPubKeys []ecdsa.PublicKey, finalAddr []byte, relayAddrs [][]byte,
+	opts ...HeaderOption) (*Header, *BulkKeys, error) {
+
+	sk := scrypto.P256PrivateKey(sessionKey)
+	defer scrypto.Wipe(sk)
+
+	return NewBulkHeaderWithSuiteContext(ctx, scrypto.DefaultSuite, sk,
+		p256PublicKeys(circuitPubKeys), finalAddr, relayAddrs, opts...)
+}
+
+// NewBulkHeaderWithSuite creates the header of a header-only packet using the
+// given cipher suite. The parameters are the same as in NewPacketWithSuite.
+func NewBulkHeaderWithSuite(suite scrypto.CipherSuite, sessionKey []byte,
+	circuitPubKeys [][]byte, finalAddr []byte, relayAddrs [][]byte,
+	opts ...HeaderOption) (*Header, *BulkKeys, error) {
+
+	return NewBulkHeaderWithSuiteContext(context.Background(), suite, sessionKey,
+		circuitPubKeys, finalAddr, relayAddrs, opts...)
+}
+
+// NewBulkHeaderWithSuiteContext is like NewBulkHeaderWithSuite, but stops
+// constructing the header and returns the context error once the context is
+// done
+func NewBulkHeaderWithSuiteContext(ctx context.Context, suite scrypto.CipherSuite,
+	sessionKey []byte, circuitPubKeys [][]byte, finalAddr []byte, relayAddrs [][]byte,
+	opts ...HeaderOption) (*Header, *BulkKeys, error) {
+
+	header, sharedSecrets, err := newHeader(ctx, suite, sessionKey, circuitPubKeys,
+		finalAddr, relayAddrs, opts)
+	if err != nil {
+		return &Header{}, &BulkKeys{}, err
+	}
+	defer scrypto.WipeHashes(sharedSecrets)
+
+	keys := &BulkKeys{suite: suite}
+	for i, s := range sharedSecrets {
+		hk := scrypto.DeriveHopKeys(suite, s)
+		keys.streams = append(keys.streams, append([]byte{}, hk.BulkStream...))
+		if i == len(sharedSecrets)-1 {
+			keys.aeadKey = append([]byte{}, hk.BulkAEAD...)
+		}
+		hk.Wipe()
+	}
+	return header, keys, nil
+}
+
+// NewWriter returns a writer which encrypts the payload stream and writes the
+// frames to w. The keys can be used to encrypt a single stream. The writer must
+// be closed to mark the end of the stream.
+func (k *BulkKeys) NewWriter(w io.Writer) (*BulkWriter, error) {
+	if k.used {
+		return nil, errors.New("Bulk keys have already been used to encrypt a stream")
+	}
+	aead, err := k.suite.AEAD(k.aeadKey)
+	if err != nil {
+		return nil, err
+	}
+	k.used = true
+	return &BulkWriter{w: w, keys: k, aead: aead}, nil
+}
+
+// Wipe overwrites the bulk keys with zeroes
+func (k *BulkKeys) Wipe() {
+	for _, s := range k.streams {
+		scrypto.Wipe(s)
+	}
+	scrypto.Wipe(k.aeadKey)
+}
+
+// BulkWriter encrypts a payload stream in frames
+type BulkWriter struct {
+	w      io.Writer
+	keys   *BulkKeys
+	aead   cipher.AEAD
+	buf    []byte
+	seq    uint64
+	closed bool
+	err    error
+}
+
+func (w *BulkWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("Bulk stream is closed")
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	// the last chunk is buffered until more data is written or the writer is
+	// closed, since the last frame of the stream is marked
+	w.buf = append(w.buf, p...)
+	for len(w.buf) > bulkChunkSize {
+		if err := w.writeFrame(w.buf[:bulkChunkSize], false); err != nil {
+			w.err = err
+			return 0, err
+		}
+		w.buf = append(w.buf[:0], w.buf[bulkChunkSize:]...)
+	}
+	return len(p), nil
+}
+
+// Close writes the last frame of the stream. It does not close the underlying
+// writer.
+func (w *BulkWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	if w.err != nil {
+		return w.err
+	}
+	w.closed = true
+	err := w.writeFrame(w.buf, true)
+	scrypto.Wipe(w.buf)
+	w.buf = nil
+	return err
+}
+
+// writes a frame of the stream. the data is padded with zeroes to the chunk
+// size, so that all the frames have the same size
+func (w *BulkWriter) writeFrame(data []byte, final bool) error {
+	pt := make([]byte, 3+bulkChunkSize)
+	if final {
+		pt[0] = bulkFinalFrame
+	}
+	binary.BigEndian.PutUint16(pt[1:3], uint16(len(data)))
+	copy(pt[3:], data)
+	frame := w.aead.Seal(nil, bulkNonce(w.aead.NonceSize(), w.seq), pt, nil)
+	scrypto.Wipe(pt)
+
+	for _, key := range w.keys.streams {
+		var err error
+		frame, err = xorKeyStream(w.keys.suite, key, w.seq, frame)
+		if err != nil {
+			return err
+		}
+	}
+	w.seq++
+	return writeBulkFrame(w.w, frame)
+}
+
+// BulkLayer is the layer of the payload stream of a header-only packet which is
+// removed by a relay. It is returned by RelayerCtx.ProcessHeader.
+type BulkLayer struct {
+	suite   scrypto.CipherSuite
+	stream  []byte
+	aeadKey []byte
+}
+
+// copies the bulk keys of a hop. the AEAD key is only kept by the exit relay
+func newBulkLayer(suite scrypto.CipherSuite, keys scrypto.HopKeys, last bool) *BulkLayer {
+	l := &BulkLayer{
+		suite:  suite,
+		stream: append([]byte{}, keys.BulkStream...),
+	}
+	if last {
+		l.aeadKey = append([]byte{}, keys.BulkAEAD...)
+	}
+	return l
+}
+
+// IsLast returns whether the relay is the exit of the stream, in which case the
+// stream is decrypted with NewReader instead of forwarded
+func (l *BulkLayer) IsLast() bool {
+	return l.aeadKey != nil
+}
+
+// Forward reads the frames of the stream from src, removes the layer of the
+// relay and writes them to dst until src returns io.EOF
+func (l *BulkLayer) Forward(dst io.Writer, src io.Reader) error {
+	return l.ForwardContext(context.Background(), dst, src)
+}
+
+// ForwardContext is like Forward, but stops forwarding the stream and returns
+// the context error once the context is done. Blocking reads and writes are
+// not interrupted; network connections should have deadlines set from the
+// context deadline.
+func (l *BulkLayer) ForwardContext(ctx context.Context, dst io.Writer, src io.Reader) error {
+	if l.IsLast() {
+		return errors.New("Exit relay must read the stream with NewReader")
+	}
+
+	for seq := uint64(0); ; seq++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		frame, err := readBulkFrame(src)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		frame, err = xorKeyStream(l.suite, l.stream, seq, frame)
+		if err != nil {
+			return err
+		}
+		if err := writeBulkFrame(dst, frame); err != nil {
+			return err
+		}
+	}
+}
+
+// NewReader returns a reader which decrypts the stream read from src. It can
+// only be used by the exit relay.
+func (l *BulkLayer) NewReader(src io.Reader) (*BulkReader, error) {
+	if !l.IsLast() {
+		return nil, errors.New("Only the exit relay can decrypt the stream")
+	}
+	aead, err := l.suite.AEAD(l.aeadKey)
+	if err != nil {
+		return nil, err
+	}
+	return &BulkReader{r: src, layer: l, aead: aead}, nil
+}
+
+// Wipe overwrites the keys of the layer with zeroes
+func (l *BulkLayer) Wipe() {
+	scrypto.Wipe(l.stream)
+	scrypto.Wipe(l.aeadKey)
+}
+
+// BulkReader decrypts a payload stream at the exit relay. Read returns an
+// error if a frame is not authentic or if the stream ends before its last
+// frame.
+type BulkReader struct {
+	r     io.Reader
+	layer *BulkLayer
+	aead  cipher.AEAD
+	buf   []byte
+	seq   uint64
+	done  bool
+	err   error
+}
+
+func (r *BulkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.readFrame()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *BulkReader) readFrame() error {
+	frame, err := readBulkFrame(r.r)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+
+	frame, err = xorKeyStream(r.layer.suite, r.layer.stream, r.seq, frame)
+	if err != nil {
+		return err
+	}
+	pt, err := r.aead.Open(nil, bulkNonce(r.aead.NonceSize(), r.seq), frame, nil)
+	if err != nil {
+		return fmt.Errorf("Frame %v of the stream is not valid: %v", r.seq, err)
+	}
+	if len(pt) != 3+bulkChunkSize {
+		return fmt.Errorf("Frame %v of the stream has an invalid size", r.seq)
+	}
+	n := int(binary.BigEndian.Uint16(pt[1:3]))
+	if n > bulkChunkSize {
+		return fmt.Errorf("Frame %v of the stream has an invalid length %v", r.seq, n)
+	}
+	r.seq++
+	r.done = pt[0] == bulkFinalFrame
+	r.buf = pt[3 : 3+n]
+	return nil
+}
+
+// removes (or adds) the key stream layer of a hop from a frame
+func xorKeyStream(suite scrypto.CipherSuite, key []byte, seq uint64,
+	frame []byte) ([]byte, error) {
+
+	ks, err := suite.Stream().KeyStream(key, bulkNonce(suite.Stream().NonceSize(), seq),
+		len(frame))
+	if err != nil {
+		return nil, err
+	}
+	res, _ := xor(frame, ks)
+	return res, nil
+}
+
+// returns the nonce of a frame. the sequence number fills the first bytes of
+// the nonce, so that the counter of AES-CTR (which increments the last bytes of
+// the nonce) does not overlap between frames
+func bulkNonce(size int, seq uint64) []byte {
+	nonce := make([]byte, size)
+	binary.BigEndian.PutUint64(nonce, seq)
+	return nonce
+}
+
+func writeBulkFrame(w io.Writer, frame []byte) error {
+	var l [bulkLenSize]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(frame)))
+	if _, err := w.Write(l[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// reads a frame. returns io.EOF only if the stream ends before a frame
+func readBulkFrame(r io.Reader) ([]byte, error) {
+	var l [bulkLenSize]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(l[:])
+	if size != bulkFrameSize {
+		return nil, fmt.Errorf("Invalid frame size %v", size)
+	}
+
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return frame, nil
+}
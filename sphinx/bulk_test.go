@@ -0,0 +1,197 @@
+package sphinx
+
+import (
+	"bytes"
+	"crypto/rand"
+	scrypto "github.com/hashmatter/p3lib/sphinx/crypto"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// bulkCircuit sets up a header-only packet over a circuit and returns the
+// header, the initiator keys and the relayer contexts of the circuit
+func bulkCircuit(t *testing.T, suite scrypto.CipherSuite, numRelays int) (*Header,
+	*BulkKeys, []*RelayerCtx) {
+
+	relayAddrs := make([][]byte, numRelays)
+	pubKeys := make([][]byte, numRelays)
+	relayers := make([]*RelayerCtx, numRelays)
+	for i := range relayers {
+		priv, pub, err := scrypto.GenerateKey(suite, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubKeys[i] = pub
+		relayAddrs[i] = []byte("/ip4/127.0.0.1/udp/1235")
+		relayers[i] = NewRelayerCtxWithKeys(SuiteKey{Suite: suite, PrivKey: priv})
+	}
+	sessionKey, _, _ := suite.Group().GenerateKey(rand.Reader)
+
+	header, keys, err := NewBulkHeaderWithSuite(suite, sessionKey, pubKeys,
+		[]byte("/ip4/127.0.0.1/udp/1234"), relayAddrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header, keys, relayers
+}
+
+// encrypts the data as a payload stream
+func bulkEncrypt(t *testing.T, keys *BulkKeys, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := keys.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// processes the header and forwards the stream through the circuit until the
+// exit relay, which returns a reader of the decrypted stream
+func bulkForward(t *testing.T, header *Header, relayers []*RelayerCtx,
+	stream []byte) (*BulkReader, [][]byte) {
+
+	forwarded := [][]byte{stream}
+	for i, r := range relayers {
+		// every hop receives the encoded header from the network
+		raw, err := header.GobEncode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var received Header
+		if err := received.GobDecode(raw); err != nil {
+			t.Fatal(err)
+		}
+
+		var layer *BulkLayer
+		_, header, layer, err = r.ProcessHeader(&received)
+		if err != nil {
+			t.Fatalf("Hop %v: %v", i, err)
+		}
+		if layer.IsLast() != (i == len(relayers)-1) {
+			t.Fatalf("Hop %v: only the last hop should be the exit of the stream", i)
+		}
+
+		if layer.IsLast() {
+			reader, err := layer.NewReader(bytes.NewReader(stream))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return reader, forwarded
+		}
+
+		var next bytes.Buffer
+		if err := layer.Forward(&next, bytes.NewReader(stream)); err != nil {
+			t.Fatalf("Hop %v: %v", i, err)
+		}
+		stream = next.Bytes()
+		forwarded = append(forwarded, stream)
+	}
+	t.Fatal("Stream did not reach the exit relay")
+	return nil, nil
+}
+
+func TestBulkEndToEnd(t *testing.T) {
+	for _, suite := range []scrypto.CipherSuite{scrypto.P256SHA256ChaCha20,
+		scrypto.X25519BLAKE2bAESCTR} {
+
+		for _, size := range []int{0, 100, bulkChunkSize, 5*bulkChunkSize + 7} {
+			data := make([]byte, size)
+			rand.Read(data)
+
+			header, keys, relayers := bulkCircuit(t, suite, 3)
+			stream := bulkEncrypt(t, keys, data)
+			reader, forwarded := bulkForward(t, header, relayers, stream)
+
+			// all the frames have the same size, including the last one
+			frames := (size + bulkChunkSize - 1) / bulkChunkSize
+			if frames == 0 {
+				frames = 1
+			}
+			if len(stream) != frames*(bulkLenSize+bulkFrameSize) {
+				t.Errorf("%v: stream of %v bytes should have %v full frames, got %v bytes",
+					suite.Name(), size, frames, len(stream))
+			}
+
+			// the stream keeps its size and changes at every hop
+			for i := 1; i < len(forwarded); i++ {
+				if len(forwarded[i]) != len(stream) {
+					t.Errorf("%v: stream size changed at hop %v", suite.Name(), i-1)
+				}
+				if size > 0 && bytes.Equal(forwarded[i][bulkLenSize:],
+					forwarded[i-1][bulkLenSize:]) {
+					t.Errorf("%v: stream was not re-encrypted by hop %v", suite.Name(), i-1)
+				}
+			}
+
+			res, err := ioutil.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("%v: %v", suite.Name(), err)
+			}
+			if !bytes.Equal(res, data) {
+				t.Errorf("%v: stream of %v bytes was not recovered by the exit relay",
+					suite.Name(), size)
+			}
+		}
+	}
+}
+
+func TestBulkTamperedStream(t *testing.T) {
+	data := make([]byte, 3*bulkChunkSize)
+	rand.Read(data)
+
+	header, keys, relayers := bulkCircuit(t, scrypto.DefaultSuite, 3)
+	stream := bulkEncrypt(t, keys, data)
+	frameSize := bulkLenSize + bulkFrameSize
+
+	tampered := append([]byte{}, stream...)
+	tampered[frameSize+bulkLenSize+10] ^= 1
+	reader, _ := bulkForward(t, header, relayers, tampered)
+	if _, err := ioutil.ReadAll(reader); err == nil {
+		t.Error("Modified frame should not be decrypted")
+	}
+
+	// frames can not be reordered
+	header, keys, relayers = bulkCircuit(t, scrypto.DefaultSuite, 3)
+	stream = bulkEncrypt(t, keys, data)
+	reordered := append(append([]byte{}, stream[frameSize:2*frameSize]...),
+		stream[:frameSize]...)
+	reordered = append(reordered, stream[2*frameSize:]...)
+	reader, _ = bulkForward(t, header, relayers, reordered)
+	if _, err := ioutil.ReadAll(reader); err == nil {
+		t.Error("Reordered frames should not be decrypted")
+	}
+
+	// truncated streams are detected
+	header, keys, relayers = bulkCircuit(t, scrypto.DefaultSuite, 3)
+	stream = bulkEncrypt(t, keys, data)
+	reader, _ = bulkForward(t, header, relayers, stream[:2*frameSize])
+	if _, err := ioutil.ReadAll(reader); err != io.ErrUnexpectedEOF {
+		t.Errorf("Truncated stream should fail with %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+func TestBulkHeaderReplay(t *testing.T) {
+	header, keys, relayers := bulkCircuit(t, scrypto.DefaultSuite, 2)
+	defer keys.Wipe()
+
+	if _, _, _, err := relayers[0].ProcessHeader(header); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := relayers[0].ProcessHeader(header); err == nil {
+		t.Error("Replayed header should not be processed")
+	}
+
+	if _, err := keys.NewWriter(ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.NewWriter(ioutil.Discard); err == nil {
+		t.Error("Bulk keys should not encrypt more than one stream")
+	}
+}
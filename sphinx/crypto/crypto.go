@@ -8,8 +8,8 @@ import (
 	"github.com/aead/chacha20"
 )
 
-// TODO: initially, this implementation is using SHA256 as hashing function.
-// implement for other digests
+// the functions in this file implement the primitives of the default cipher
+// suite (P-256, SHA-256 and ChaCha20). other suites are defined in suite.go
 
 type Hash256 [sha256.Size]byte
 
@@ -27,6 +27,8 @@ func GenerateECDHSharedSecret(pub *ecdsa.PublicKey, priv *ecdsa.PrivateKey) Hash
 // hop. The blinding factor is computed by hashing the concatenation of the the
 // hop's public key and the secret key derived between the sender and the hop
 // blinding_factor := sha256(hopPubKey || sharedSecret)
+//
+// Deprecated: sphinx packets use the HKDF based BlindingFactor.
 func ComputeBlindingFactor(pubKey *ecdsa.PublicKey, secret Hash256) Hash256 {
 	mPubKey := serializePubKey(pubKey)
 	sha := sha256.New()
@@ -61,8 +63,7 @@ func CheckMAC(message, messageMAC []byte, key Hash256) bool {
 	return hmac.Equal(messageMAC, expectedMAC)
 }
 
-// generates cipher stream of size numBytes from a given PRG. TODO: generalize
-// to other ciphers
+// generates cipher stream of size numBytes using ChaCha20
 func GenerateCipherStream(key, nonce []byte, numBytes int) ([]byte, error) {
 	c, err := chacha20.NewCipher(nonce, key)
 	if err != nil {
@@ -0,0 +1,239 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	ec "crypto/elliptic"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/curve25519"
+	"io"
+	"math/big"
+)
+
+const (
+	// size in bytes of P-256 scalars
+	p256ScalarSize = 32
+
+	// size in bytes of X25519 scalars and elements
+	x25519Size = 32
+)
+
+var ErrInvalidElement = errors.New("Group element is not valid for the cipher suite")
+
+// P-256 group. elements are encoded as compressed points (SEC 1, section
+// 2.3.3): a prefix byte with the parity of y followed by the x coordinate
+type p256Group struct{}
+
+func (g p256Group) ElementSize() int { return 1 + p256ScalarSize }
+
+func (g p256Group) GenerateKey(rand io.Reader) ([]byte, []byte, error) {
+	priv, err := ecdsa.GenerateKey(ec.P256(), rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer WipeECDSAKey(priv)
+	return P256PrivateKey(priv), P256PublicKey(&priv.PublicKey), nil
+}
+
+func (g p256Group) ScalarBaseMult(scalar []byte) ([]byte, error) {
+	x, y := ec.P256().ScalarBaseMult(scalar)
+	return marshalCompressed(x, y), nil
+}
+
+func (g p256Group) ScalarMult(scalar, element []byte) ([]byte, error) {
+	x, y, err := unmarshalCompressed(element)
+	if err != nil {
+		return nil, err
+	}
+	rx, ry := ec.P256().ScalarMult(x, y, scalar)
+	if rx.Sign() == 0 && ry.Sign() == 0 {
+		return nil, ErrInvalidElement
+	}
+	return marshalCompressed(rx, ry), nil
+}
+
+func (g p256Group) SharedBytes(element []byte) []byte {
+	if len(element) != g.ElementSize() {
+		return []byte{}
+	}
+	// same encoding as GenerateECDHSharedSecret (x coordinate, without
+	// leading zeros)
+	return new(big.Int).SetBytes(element[1:]).Bytes()
+}
+
+func (g p256Group) Validate(element []byte) error {
+	_, _, err := unmarshalCompressed(element)
+	return err
+}
+
+func marshalCompressed(x, y *big.Int) []byte {
+	element := make([]byte, 1+p256ScalarSize)
+	element[0] = byte(2 + y.Bit(0))
+	xb := x.Bytes()
+	copy(element[1+p256ScalarSize-len(xb):], xb)
+	return element
+}
+
+// decodes a compressed point and checks that it is a valid element of the
+// group. this is very important to avoid ECC twist and invalid curve attacks.
+// P-256 has prime order (cofactor 1), so every point on the curve other than
+// the point at infinity (which has no compressed encoding) is in the group
+func unmarshalCompressed(element []byte) (*big.Int, *big.Int, error) {
+	params := ec.P256().Params()
+	if len(element) != 1+p256ScalarSize || (element[0] != 2 && element[0] != 3) {
+		return nil, nil, ErrInvalidElement
+	}
+
+	x := new(big.Int).SetBytes(element[1:])
+	if x.Cmp(params.P) >= 0 {
+		return nil, nil, ErrInvalidElement
+	}
+
+	// y² = x³ - 3x + b
+	y := new(big.Int).Mul(x, x)
+	y.Mul(y, x)
+	threeX := new(big.Int).Lsh(x, 1)
+	threeX.Add(threeX, x)
+	y.Sub(y, threeX)
+	y.Add(y, params.B)
+	y.Mod(y, params.P)
+
+	if y.ModSqrt(y, params.P) == nil {
+		return nil, nil, ErrInvalidElement
+	}
+	if y.Bit(0) != uint(element[0]&1) {
+		y.Sub(params.P, y)
+	}
+
+	if !params.IsOnCurve(x, y) {
+		return nil, nil, ErrInvalidElement
+	}
+	return x, y, nil
+}
+
+// P256PrivateKey encodes an ECDSA private key as a P-256 group scalar
+func P256PrivateKey(priv *ecdsa.PrivateKey) []byte {
+	scalar := make([]byte, p256ScalarSize)
+	d := priv.D.Bytes()
+	copy(scalar[p256ScalarSize-len(d):], d)
+	Wipe(d)
+	return scalar
+}
+
+// P256PublicKey encodes an ECDSA public key as a P-256 group element
+func P256PublicKey(pub *ecdsa.PublicKey) []byte {
+	return marshalCompressed(pub.X, pub.Y)
+}
+
+// P256ParsePublicKey decodes and validates a P-256 group element into an ECDSA
+// public key
+func P256ParsePublicKey(element []byte) (*ecdsa.PublicKey, error) {
+	x, y, err := unmarshalCompressed(element)
+	if err != nil {
+		return nil, err
+	}
+	return &ecdsa.PublicKey{Curve: ec.P256(), X: x, Y: y}, nil
+}
+
+// X25519 group. scalars are clamped by the X25519 function and elements are
+// encoded as u-coordinates
+type x25519Group struct{}
+
+func (g x25519Group) ElementSize() int { return x25519Size }
+
+func (g x25519Group) GenerateKey(rand io.Reader) ([]byte, []byte, error) {
+	priv := make([]byte, x25519Size)
+	_, err := io.ReadFull(rand, priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	pub, err := g.ScalarBaseMult(priv)
+	return priv, pub, err
+}
+
+func (g x25519Group) ScalarBaseMult(scalar []byte) ([]byte, error) {
+	if len(scalar) != x25519Size {
+		return nil, fmt.Errorf("X25519 scalar must have %v bytes, got %v",
+			x25519Size, len(scalar))
+	}
+	var dst, s [x25519Size]byte
+	copy(s[:], scalar)
+	defer Wipe(s[:])
+	curve25519.ScalarBaseMult(&dst, &s)
+	return dst[:], nil
+}
+
+func (g x25519Group) ScalarMult(scalar, element []byte) ([]byte, error) {
+	if len(scalar) != x25519Size {
+		return nil, fmt.Errorf("X25519 scalar must have %v bytes, got %v",
+			x25519Size, len(scalar))
+	}
+	if err := g.Validate(element); err != nil {
+		return nil, err
+	}
+	var dst, s, e [x25519Size]byte
+	copy(s[:], scalar)
+	defer Wipe(s[:])
+	copy(e[:], element)
+	curve25519.ScalarMult(&dst, &s, &e)
+
+	// low order elements result in the all-zero output
+	var zero [x25519Size]byte
+	if subtle.ConstantTimeCompare(dst[:], zero[:]) == 1 {
+		return nil, ErrInvalidElement
+	}
+	return dst[:], nil
+}
+
+func (g x25519Group) SharedBytes(element []byte) []byte {
+	return element
+}
+
+// validates that the element is a canonical u-coordinate and that it is not
+// one of the points of small order, which would let an attacker force the
+// shared secret to a known value
+func (g x25519Group) Validate(element []byte) error {
+	if len(element) != x25519Size {
+		return ErrInvalidElement
+	}
+
+	// elements are little-endian encoded. the most significant bit is unused
+	// and must not be set
+	if element[x25519Size-1]&0x80 != 0 {
+		return ErrInvalidElement
+	}
+	be := make([]byte, x25519Size)
+	for i := range element {
+		be[i] = element[x25519Size-1-i]
+	}
+	u := new(big.Int).SetBytes(be)
+	if u.Cmp(x25519P) >= 0 {
+		return ErrInvalidElement
+	}
+
+	for _, lo := range x25519LowOrder {
+		if u.Cmp(lo) == 0 {
+			return ErrInvalidElement
+		}
+	}
+	return nil
+}
+
+// field prime of Curve25519, 2^255 - 19
+var x25519P = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// u-coordinates of the points of small order of Curve25519 which are
+// canonically encoded
+var x25519LowOrder = []*big.Int{
+	big.NewInt(0),
+	big.NewInt(1),
+	new(big.Int).Sub(x25519P, big.NewInt(1)),
+	bigFromString("325606250916557431795983626356110631294008115727848805560023387167927233504"),
+	bigFromString("39382357235489614581723060781553021112529911719440698176882885853963445705823"),
+}
+
+func bigFromString(s string) *big.Int {
+	n, _ := new(big.Int).SetString(s, 10)
+	return n
+}
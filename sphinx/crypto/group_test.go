@@ -0,0 +1,109 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	ec "crypto/elliptic"
+	"crypto/rand"
+	"golang.org/x/crypto/curve25519"
+	"math/big"
+	"testing"
+)
+
+func TestP256CompressedEncoding(t *testing.T) {
+	for i := 0; i < 16; i++ {
+		priv, _ := ecdsa.GenerateKey(ec.P256(), rand.Reader)
+		element := P256PublicKey(&priv.PublicKey)
+		if len(element) != 33 {
+			t.Fatalf("Compressed element should have 33 bytes, got %v", len(element))
+		}
+
+		pub, err := P256ParsePublicKey(element)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pub.X.Cmp(priv.X) != 0 || pub.Y.Cmp(priv.Y) != 0 {
+			t.Error("Decoded point does not match the encoded point")
+		}
+	}
+}
+
+func TestP256InvalidElements(t *testing.T) {
+	g := p256Group{}
+	_, pub, _ := g.GenerateKey(rand.Reader)
+
+	// x coordinate which is not on the curve (x³ - 3x + b is not a square)
+	notOnCurve := make([]byte, 33)
+	notOnCurve[0] = 2
+	for i := byte(1); ; i++ {
+		notOnCurve[32] = i
+		if _, _, err := unmarshalCompressed(notOnCurve); err != nil {
+			break
+		}
+	}
+
+	invalid := map[string][]byte{
+		"empty":        {},
+		"uncompressed": append([]byte{4}, make([]byte, 64)...),
+		"bad prefix":   append([]byte{5}, pub[1:]...),
+		"truncated":    pub[:32],
+		"x >= p":       append([]byte{2}, ec.P256().Params().P.Bytes()...),
+		"not on curve": notOnCurve,
+	}
+
+	for name, el := range invalid {
+		if err := g.Validate(el); err == nil {
+			t.Errorf("Element should be invalid (%v): %x", name, el)
+		}
+		if _, err := g.ScalarMult(pub, el); err == nil {
+			t.Errorf("Scalar multiplication with invalid element (%v) should fail", name)
+		}
+	}
+}
+
+func TestX25519LowOrderElements(t *testing.T) {
+	g := x25519Group{}
+	scalar, _, _ := g.GenerateKey(rand.Reader)
+
+	for _, lo := range x25519LowOrder {
+		el := littleEndian(lo)
+		if err := g.Validate(el); err == nil {
+			t.Errorf("Low order element should be invalid: %x", el)
+		}
+
+		// the result of the multiplication by a (clamped) scalar must be the
+		// identity, otherwise the element is not of small order
+		var dst, s, e [x25519Size]byte
+		copy(s[:], scalar)
+		copy(e[:], el)
+		curve25519.ScalarMult(&dst, &s, &e)
+		if dst != [x25519Size]byte{} {
+			t.Errorf("Element is not of small order: %x", el)
+		}
+	}
+
+	// non canonical encodings
+	p := littleEndian(x25519P)
+	if err := g.Validate(p); err == nil {
+		t.Error("Element u = p should be invalid")
+	}
+	high := make([]byte, x25519Size)
+	high[0] = 9
+	high[x25519Size-1] = 0x80
+	if err := g.Validate(high); err == nil {
+		t.Error("Element with high bit set should be invalid")
+	}
+
+	_, pub, _ := g.GenerateKey(rand.Reader)
+	if err := g.Validate(pub); err != nil {
+		t.Errorf("Valid element should be accepted: %v", err)
+	}
+}
+
+func littleEndian(n *big.Int) []byte {
+	b := n.Bytes()
+	res := make([]byte, x25519Size)
+	for i := range b {
+		res[i] = b[len(b)-1-i]
+	}
+	return res
+}
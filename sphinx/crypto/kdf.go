@@ -0,0 +1,76 @@
+package crypto
+
+import (
+	"golang.org/x/crypto/hkdf"
+	"hash"
+	"io"
+)
+
+// labels used to derive domain separated keys from the shared secret of each
+// hop. each key is used for a single purpose, so that the shared secret is
+// never used directly as a key.
+const (
+	LabelHeaderStream = "p3lib-sphinx-v1 header-stream"
+	LabelHeaderNonce  = "p3lib-sphinx-v1 header-nonce"
+	LabelHeaderMAC    = "p3lib-sphinx-v1 header-mac"
+	LabelPayload      = "p3lib-sphinx-v1 payload"
+	LabelBlinding     = "p3lib-sphinx-v1 blinding"
+	LabelReplayTag    = "p3lib-sphinx-v1 replay-tag"
+	LabelBulkStream   = "p3lib-sphinx-v1 bulk-stream"
+	LabelBulkAEAD     = "p3lib-sphinx-v1 bulk-aead"
+)
+
+// size in bytes of the derived keys
+const KeySize = 32
+
+// HopKeys are the keys derived from the shared secret between the initiator
+// and a hop
+type HopKeys struct {
+	HeaderStream []byte
+	HeaderNonce  []byte
+	HeaderMAC    []byte
+	Payload      []byte
+	ReplayTag    Hash256
+
+	// keys of the out-of-band payload stream of header-only packets
+	BulkStream []byte
+	BulkAEAD   []byte
+}
+
+// DeriveHopKeys derives all the keys used by a hop to process a packet from
+// the hop's shared secret
+func DeriveHopKeys(s CipherSuite, secret Hash256) HopKeys {
+	kdf := s.KDF()
+	var tag Hash256
+	copy(tag[:], kdf.Derive(secret[:], nil, LabelReplayTag, len(tag)))
+
+	return HopKeys{
+		HeaderStream: kdf.Derive(secret[:], nil, LabelHeaderStream, KeySize),
+		HeaderNonce:  kdf.Derive(secret[:], nil, LabelHeaderNonce, s.Stream().NonceSize()),
+		HeaderMAC:    kdf.Derive(secret[:], nil, LabelHeaderMAC, KeySize),
+		Payload:      kdf.Derive(secret[:], nil, LabelPayload, KeySize),
+		ReplayTag:    tag,
+		BulkStream:   kdf.Derive(secret[:], nil, LabelBulkStream, KeySize),
+		BulkAEAD:     kdf.Derive(secret[:], nil, LabelBulkAEAD, KeySize),
+	}
+}
+
+// BlindingFactor computes the blinding factor used to blind the group element
+// at each hop. The group element received by the hop is used as HKDF salt:
+// blinding_factor := HKDF(salt=element, ikm=sharedSecret, info=LabelBlinding)
+func BlindingFactor(s CipherSuite, element []byte, secret Hash256) Hash256 {
+	var b Hash256
+	copy(b[:], s.KDF().Derive(secret[:], element, LabelBlinding, len(b)))
+	return b
+}
+
+// hkdfDerive implements HKDF (RFC 5869) with an arbitrary hash function
+func hkdfDerive(h func() hash.Hash, secret, salt []byte, label string, size int) []byte {
+	out := make([]byte, size)
+	r := hkdf.New(h, secret, salt, []byte(label))
+	if _, err := io.ReadFull(r, out); err != nil {
+		// only happens if size is larger than 255 times the hash size
+		panic(err)
+	}
+	return out
+}
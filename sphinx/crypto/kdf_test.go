@@ -0,0 +1,80 @@
+package crypto
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// RFC 5869, test case 1
+func TestHKDFSHA256Vector(t *testing.T) {
+	ikm, _ := hex.DecodeString("0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b")
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	exp := "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865"
+
+	okm := sha256KDF{}.Derive(ikm, salt, string(info), 42)
+	if hex.EncodeToString(okm) != exp {
+		t.Errorf("HKDF-SHA256 output mismatch:\n >> %x\n >> %v", okm, exp)
+	}
+}
+
+func TestDeriveHopKeysVectors(t *testing.T) {
+	var secret Hash256
+	for i := range secret {
+		secret[i] = byte(i)
+	}
+
+	vectors := []struct {
+		suite                                                 CipherSuite
+		headerStream, headerNonce, headerMAC, payload, replay string
+		blinding                                              string
+	}{
+		{
+			suite:        P256SHA256ChaCha20,
+			headerStream: "5098bcaa122fc48b9248f943b34c92a6bff4be2caf58ef82711086931353da86",
+			headerNonce:  "ba8534a85680f7b423f8f83a339153cb85c6a60146508b51",
+			headerMAC:    "e4c21903b4452d9f00f823dedf6bfed118ebe138425765eb8847f5c358cc5a9d",
+			payload:      "2c89476d7703bb17ba9d5d4a615be80e36bdb6823bc287fd450f63ff9f8234a5",
+			replay:       "71f27ed32f4be4c525a4e1017584b72dad1ad6decfa12c298d6c3f65cda7535a",
+			blinding:     "39491dfdf20c9e352647ae37fd74c207241ee4df627331f237c2562a35198088",
+		},
+		{
+			suite:        X25519BLAKE2bAESCTR,
+			headerStream: "5b734abd2e3362aee1f74270275b7dc27dc981222a4bd6d02413ffd42aeb9481",
+			headerNonce:  "835b468440605cab8ce98a0bd599a140",
+			headerMAC:    "8fd45a5b413c3fa5b2cd26440d5adcef7f500c5d9729a3c7cdea71f704e4ed0a",
+			payload:      "cadb76a1de2fc7e6d36bff98117ce1280ff58d4362e7eee8f0843a8d0c45c403",
+			replay:       "11aef1768805ddad9ba7ad853344c54508c2be2728b859f7ed124aca5131e070",
+			blinding:     "c0827ab7c64c2a900420ac6c1a9376a2a55f6634de66167a0b99480d00f97fc7",
+		},
+	}
+
+	for _, v := range vectors {
+		k := DeriveHopKeys(v.suite, secret)
+		got := []string{
+			hex.EncodeToString(k.HeaderStream),
+			hex.EncodeToString(k.HeaderNonce),
+			hex.EncodeToString(k.HeaderMAC),
+			hex.EncodeToString(k.Payload),
+			hex.EncodeToString(k.ReplayTag[:]),
+		}
+		exp := []string{v.headerStream, v.headerNonce, v.headerMAC, v.payload, v.replay}
+		for i := range exp {
+			if got[i] != exp[i] {
+				t.Errorf("%v: derived key %v mismatch:\n >> %v\n >> %v",
+					v.suite.Name(), i, got[i], exp[i])
+			}
+		}
+
+		b := BlindingFactor(v.suite, []byte("element"), secret)
+		if hex.EncodeToString(b[:]) != v.blinding {
+			t.Errorf("%v: blinding factor mismatch:\n >> %x\n >> %v",
+				v.suite.Name(), b, v.blinding)
+		}
+
+		if len(k.HeaderNonce) != v.suite.Stream().NonceSize() {
+			t.Errorf("%v: header nonce should have %v bytes, got %v", v.suite.Name(),
+				v.suite.Stream().NonceSize(), len(k.HeaderNonce))
+		}
+	}
+}
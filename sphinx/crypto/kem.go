@@ -0,0 +1,85 @@
+package crypto
+
+import (
+	"fmt"
+	"io"
+)
+
+// labels used to derive the keys of the hybrid mode
+const (
+	LabelKEMStream = "p3lib-sphinx-v1 kem-stream"
+	LabelKEMNonce  = "p3lib-sphinx-v1 kem-nonce"
+	LabelHybrid    = "p3lib-sphinx-v1 hybrid"
+)
+
+// KEM is a key encapsulation mechanism. In hybrid suites, the initiator
+// encapsulates a key to each hop and the hop shared secret is derived from both
+// the group key agreement and the encapsulated key, so that it stays secret as
+// long as either primitive is secure.
+type KEM interface {
+	Name() string
+	PublicKeySize() int
+	PrivateKeySize() int
+	CiphertextSize() int
+
+	GenerateKey(rand io.Reader) (priv, pub []byte, err error)
+	Encapsulate(pub []byte) (shared, ciphertext []byte, err error)
+	Decapsulate(priv, ciphertext []byte) ([]byte, error)
+}
+
+// GenerateKey generates a relay key pair for the suite. For hybrid suites, the
+// private key is the group scalar followed by the KEM private key and the
+// public key is the group element followed by the KEM public key.
+func GenerateKey(s CipherSuite, rand io.Reader) ([]byte, []byte, error) {
+	priv, pub, err := s.Group().GenerateKey(rand)
+	if err != nil || s.KEM() == nil {
+		return priv, pub, err
+	}
+
+	kemPriv, kemPub, err := s.KEM().GenerateKey(rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(priv, kemPriv...), append(pub, kemPub...), nil
+}
+
+// SplitPublicKey returns the group element and the KEM public key of a relay
+// public key. The KEM public key is nil if the suite is not hybrid.
+func SplitPublicKey(s CipherSuite, pub []byte) ([]byte, []byte, error) {
+	if s.KEM() == nil {
+		return pub, nil, nil
+	}
+	n := s.Group().ElementSize()
+	if len(pub) != n+s.KEM().PublicKeySize() {
+		return nil, nil, fmt.Errorf("%v public key must have %v bytes, got %v",
+			s.Name(), n+s.KEM().PublicKeySize(), len(pub))
+	}
+	return pub[:n], pub[n:], nil
+}
+
+// SplitPrivateKey returns the group scalar and the KEM private key of a relay
+// private key. The KEM private key is nil if the suite is not hybrid.
+func SplitPrivateKey(s CipherSuite, priv []byte) ([]byte, []byte, error) {
+	if s.KEM() == nil {
+		return priv, nil, nil
+	}
+	n := len(priv) - s.KEM().PrivateKeySize()
+	if n <= 0 {
+		return nil, nil, fmt.Errorf("%v private key is too short", s.Name())
+	}
+	return priv[:n], priv[n:], nil
+}
+
+// HybridSecret combines the shared secret of the group key agreement with the
+// key encapsulated to the hop. The ciphertext is used as HKDF salt:
+// hybrid := HKDF(salt=ciphertext, ikm=sharedSecret || kemKey, info=LabelHybrid)
+func HybridSecret(s CipherSuite, secret Hash256, kemKey, ciphertext []byte) Hash256 {
+	ikm := make([]byte, 0, len(secret)+len(kemKey))
+	ikm = append(ikm, secret[:]...)
+	ikm = append(ikm, kemKey...)
+	defer Wipe(ikm)
+
+	var h Hash256
+	copy(h[:], s.KDF().Derive(ikm, ciphertext, LabelHybrid, len(h)))
+	return h
+}
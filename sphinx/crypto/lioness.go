@@ -0,0 +1,115 @@
+package crypto
+
+import (
+	"fmt"
+)
+
+// size in bytes of the left side of a LIONESS block, which is also the size
+// of the stream cipher keys and of the MAC output
+const lionessKeySize = 32
+
+// lioness is the LIONESS wide-block cipher [1], built from a stream cipher
+// and a keyed hash. It is used as the payload SPRP of the cipher suites.
+//
+// [1] Anderson, Biham - Two Practical and Provably Secure Block Ciphers: BEAR
+// and LION
+type lioness struct {
+	kdf    KDF
+	mac    MAC
+	stream StreamCipher
+}
+
+func (l *lioness) Encrypt(key, block []byte) ([]byte, error) {
+	k, err := l.subkeys(key, block)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeSubkeys(k)
+	left, right := split(block)
+
+	right, err = l.streamRound(k[0], left, right)
+	if err != nil {
+		return nil, err
+	}
+	left = l.hashRound(k[1], left, right)
+	right, err = l.streamRound(k[2], left, right)
+	if err != nil {
+		return nil, err
+	}
+	left = l.hashRound(k[3], left, right)
+
+	return append(left, right...), nil
+}
+
+func (l *lioness) Decrypt(key, block []byte) ([]byte, error) {
+	k, err := l.subkeys(key, block)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeSubkeys(k)
+	left, right := split(block)
+
+	left = l.hashRound(k[3], left, right)
+	right, err = l.streamRound(k[2], left, right)
+	if err != nil {
+		return nil, err
+	}
+	left = l.hashRound(k[1], left, right)
+	right, err = l.streamRound(k[0], left, right)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(left, right...), nil
+}
+
+func (l *lioness) subkeys(key, block []byte) ([4][]byte, error) {
+	var k [4][]byte
+	if len(block) <= lionessKeySize {
+		return k, fmt.Errorf("LIONESS block must be larger than %v bytes, got %v",
+			lionessKeySize, len(block))
+	}
+	for i := range k {
+		k[i] = l.kdf.Derive(key, nil, fmt.Sprintf("p3lib-sphinx-v1 lioness-%d", i),
+			lionessKeySize)
+	}
+	return k, nil
+}
+
+func wipeSubkeys(k [4][]byte) {
+	for i := range k {
+		Wipe(k[i])
+	}
+}
+
+// right ^= stream(left ^ key)
+func (l *lioness) streamRound(key, left, right []byte) ([]byte, error) {
+	k := make([]byte, lionessKeySize)
+	defer Wipe(k)
+	for i := range k {
+		k[i] = left[i] ^ key[i]
+	}
+	nonce := make([]byte, l.stream.NonceSize())
+	s, err := l.stream.KeyStream(k, nonce, len(right))
+	if err != nil {
+		return nil, err
+	}
+	for i := range right {
+		right[i] ^= s[i]
+	}
+	return right, nil
+}
+
+// left ^= mac(key, right)
+func (l *lioness) hashRound(key, left, right []byte) []byte {
+	h := l.mac.Sum(key, right)
+	for i := range left {
+		left[i] ^= h[i]
+	}
+	return left
+}
+
+func split(block []byte) ([]byte, []byte) {
+	b := append([]byte{}, block...)
+	return b[:lionessKeySize], b[lionessKeySize:]
+}
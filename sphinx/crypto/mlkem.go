@@ -0,0 +1,98 @@
+//go:build go1.24
+// +build go1.24
+
+package crypto
+
+import (
+	"crypto/mlkem"
+	"io"
+)
+
+// X25519MLKEM768BLAKE2bAESCTR combines X25519 with ML-KEM-768
+var X25519MLKEM768BLAKE2bAESCTR CipherSuite = newHybridSuite(
+	SuiteX25519MLKEM768BLAKE2bAESCTR, "X25519-MLKEM768-BLAKE2b-AESCTR",
+	X25519BLAKE2bAESCTR.(*suite), mlkem768{})
+
+// P256MLKEM1024SHA256ChaCha20 combines P-256 with ML-KEM-1024
+var P256MLKEM1024SHA256ChaCha20 CipherSuite = newHybridSuite(
+	SuiteP256MLKEM1024SHA256ChaCha20, "P256-MLKEM1024-SHA256-ChaCha20",
+	P256SHA256ChaCha20.(*suite), mlkem1024{})
+
+func init() {
+	suites[SuiteX25519MLKEM768BLAKE2bAESCTR] = X25519MLKEM768BLAKE2bAESCTR
+	suites[SuiteP256MLKEM1024SHA256ChaCha20] = P256MLKEM1024SHA256ChaCha20
+}
+
+// ML-KEM-768 (FIPS 203). private keys are encoded as 64 bytes seeds
+type mlkem768 struct{}
+
+func (k mlkem768) Name() string        { return "ML-KEM-768" }
+func (k mlkem768) PublicKeySize() int  { return mlkem.EncapsulationKeySize768 }
+func (k mlkem768) PrivateKeySize() int { return mlkem.SeedSize }
+func (k mlkem768) CiphertextSize() int { return mlkem.CiphertextSize768 }
+
+func (k mlkem768) GenerateKey(rand io.Reader) ([]byte, []byte, error) {
+	seed := make([]byte, mlkem.SeedSize)
+	if _, err := io.ReadFull(rand, seed); err != nil {
+		return nil, nil, err
+	}
+	dk, err := mlkem.NewDecapsulationKey768(seed)
+	if err != nil {
+		return nil, nil, err
+	}
+	return seed, dk.EncapsulationKey().Bytes(), nil
+}
+
+func (k mlkem768) Encapsulate(pub []byte) ([]byte, []byte, error) {
+	ek, err := mlkem.NewEncapsulationKey768(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, ct := ek.Encapsulate()
+	return shared, ct, nil
+}
+
+func (k mlkem768) Decapsulate(priv, ciphertext []byte) ([]byte, error) {
+	dk, err := mlkem.NewDecapsulationKey768(priv)
+	if err != nil {
+		return nil, err
+	}
+	return dk.Decapsulate(ciphertext)
+}
+
+// ML-KEM-1024 (FIPS 203). private keys are encoded as 64 bytes seeds
+type mlkem1024 struct{}
+
+func (k mlkem1024) Name() string        { return "ML-KEM-1024" }
+func (k mlkem1024) PublicKeySize() int  { return mlkem.EncapsulationKeySize1024 }
+func (k mlkem1024) PrivateKeySize() int { return mlkem.SeedSize }
+func (k mlkem1024) CiphertextSize() int { return mlkem.CiphertextSize1024 }
+
+func (k mlkem1024) GenerateKey(rand io.Reader) ([]byte, []byte, error) {
+	seed := make([]byte, mlkem.SeedSize)
+	if _, err := io.ReadFull(rand, seed); err != nil {
+		return nil, nil, err
+	}
+	dk, err := mlkem.NewDecapsulationKey1024(seed)
+	if err != nil {
+		return nil, nil, err
+	}
+	return seed, dk.EncapsulationKey().Bytes(), nil
+}
+
+func (k mlkem1024) Encapsulate(pub []byte) ([]byte, []byte, error) {
+	ek, err := mlkem.NewEncapsulationKey1024(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, ct := ek.Encapsulate()
+	return shared, ct, nil
+}
+
+func (k mlkem1024) Decapsulate(priv, ciphertext []byte) ([]byte, error) {
+	dk, err := mlkem.NewDecapsulationKey1024(priv)
+	if err != nil {
+		return nil, err
+	}
+	return dk.Decapsulate(ciphertext)
+}
@@ -0,0 +1,67 @@
+//go:build go1.24
+// +build go1.24
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestHybridSuites(t *testing.T) {
+	for _, s := range []CipherSuite{X25519MLKEM768BLAKE2bAESCTR, P256MLKEM1024SHA256ChaCha20} {
+		res, err := SuiteByID(s.ID())
+		if err != nil || res != s {
+			t.Fatalf("Hybrid suite %v is not registered", s.Name())
+		}
+
+		priv, pub, err := GenerateKey(s, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		el, kemPub, err := SplitPublicKey(s, pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(el) != s.Group().ElementSize() || len(kemPub) != s.KEM().PublicKeySize() {
+			t.Errorf("%v: unexpected public key sizes %v %v", s.Name(), len(el), len(kemPub))
+		}
+		if _, _, err := SplitPublicKey(s, pub[1:]); err == nil {
+			t.Errorf("%v: truncated public key should not be split", s.Name())
+		}
+
+		_, kemPriv, err := SplitPrivateKey(s, priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		shared, ct, err := s.KEM().Encapsulate(kemPub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ct) != s.KEM().CiphertextSize() {
+			t.Errorf("%v: ciphertext should have %v bytes, got %v", s.Name(),
+				s.KEM().CiphertextSize(), len(ct))
+		}
+		dec, err := s.KEM().Decapsulate(kemPriv, ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(shared, dec) {
+			t.Errorf("%v: decapsulated key mismatch", s.Name())
+		}
+
+		// the hybrid secret depends on both secrets
+		var secret, other Hash256
+		rand.Read(secret[:])
+		rand.Read(other[:])
+		h := HybridSecret(s, secret, shared, ct)
+		if h == HybridSecret(s, other, shared, ct) {
+			t.Errorf("%v: hybrid secret must depend on the group secret", s.Name())
+		}
+		if h == HybridSecret(s, secret, make([]byte, len(shared)), ct) {
+			t.Errorf("%v: hybrid secret must depend on the KEM secret", s.Name())
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"runtime"
+)
+
+// secrets (session keys, shared secrets and the keys derived from them) are
+// wiped as soon as they are not needed anymore, so that a memory dump of a
+// compromised host does not reveal the keys of past circuits. Note that copies
+// made by the Go runtime (e.g. when a slice grows) and by the standard library
+// (e.g. the big.Int arithmetic of crypto/elliptic) can not be wiped.
+
+// Wipe overwrites a secret buffer with zeroes
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+	// prevents the compiler from considering the writes as dead stores
+	runtime.KeepAlive(b)
+}
+
+// Wipe overwrites the hash with zeroes
+func (h *Hash256) Wipe() {
+	Wipe(h[:])
+}
+
+// WipeHashes overwrites all hashes with zeroes
+func WipeHashes(hs []Hash256) {
+	for i := range hs {
+		hs[i].Wipe()
+	}
+}
+
+// Wipe overwrites all the keys derived for a hop with zeroes
+func (k *HopKeys) Wipe() {
+	Wipe(k.HeaderStream)
+	Wipe(k.HeaderNonce)
+	Wipe(k.HeaderMAC)
+	Wipe(k.Payload)
+	k.ReplayTag.Wipe()
+	Wipe(k.BulkStream)
+	Wipe(k.BulkAEAD)
+}
+
+// WipeECDSAKey overwrites the private scalar of an ECDSA key. The key is not
+// usable after being wiped.
+func WipeECDSAKey(priv *ecdsa.PrivateKey) {
+	if priv == nil || priv.D == nil {
+		return
+	}
+	words := priv.D.Bits()
+	for i := range words {
+		words[i] = 0
+	}
+	priv.D.SetInt64(0)
+}
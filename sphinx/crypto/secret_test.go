@@ -0,0 +1,79 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	ec "crypto/elliptic"
+	"crypto/rand"
+	"testing"
+)
+
+func TestWipe(t *testing.T) {
+	buf := make([]byte, 64)
+	rand.Read(buf)
+	Wipe(buf)
+	if !isZero(buf) {
+		t.Errorf("Buffer was not wiped: %x", buf)
+	}
+
+	var secret Hash256
+	rand.Read(secret[:])
+	keys := DeriveHopKeys(P256SHA256ChaCha20, secret)
+	secret.Wipe()
+	keys.Wipe()
+
+	for _, b := range [][]byte{secret[:], keys.HeaderStream, keys.HeaderNonce,
+		keys.HeaderMAC, keys.Payload, keys.ReplayTag[:]} {
+		if !isZero(b) {
+			t.Errorf("Secret was not wiped: %x", b)
+		}
+	}
+}
+
+func TestWipeECDSAKey(t *testing.T) {
+	priv, _ := ecdsa.GenerateKey(ec.P256(), rand.Reader)
+	words := priv.D.Bits()
+
+	scalar := P256PrivateKey(priv)
+	if isZero(scalar) {
+		t.Fatal("Scalar should be a copy of the private key")
+	}
+
+	WipeECDSAKey(priv)
+	if priv.D.Sign() != 0 {
+		t.Error("Private scalar was not wiped")
+	}
+	for _, w := range words {
+		if w != 0 {
+			t.Error("Private scalar memory was not wiped")
+		}
+	}
+
+	// the copy is owned by the caller
+	if isZero(scalar) {
+		t.Error("Wiping the ECDSA key must not wipe copies of the scalar")
+	}
+}
+
+// SPRP must not wipe or modify the key and the block of the caller
+func TestLionessDoesNotModifyInput(t *testing.T) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	keyCopy := append([]byte{}, key...)
+	block := make([]byte, 256)
+	rand.Read(block)
+	blockCopy := append([]byte{}, block...)
+
+	P256SHA256ChaCha20.SPRP().Encrypt(key, block)
+	if string(key) != string(keyCopy) || string(block) != string(blockCopy) {
+		t.Error("SPRP modified its inputs")
+	}
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,274 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"github.com/aead/chacha20/chacha"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+	"hash"
+	"io"
+)
+
+// SuiteID identifies a cipher suite. It is carried in the packet header so
+// that relays select the suite used to construct the packet.
+type SuiteID byte
+
+const (
+	SuiteP256SHA256ChaCha20  SuiteID = 1
+	SuiteX25519BLAKE2bAESCTR SuiteID = 2
+
+	// hybrid suites, which combine the group key agreement with ML-KEM. they
+	// are only available when built with Go 1.24 or newer (see mlkem.go)
+	SuiteX25519MLKEM768BLAKE2bAESCTR SuiteID = 3
+	SuiteP256MLKEM1024SHA256ChaCha20 SuiteID = 4
+)
+
+// CipherSuite bundles the cryptographic primitives used to construct and
+// process sphinx packets
+type CipherSuite interface {
+	ID() SuiteID
+	Name() string
+	Group() Group
+	KDF() KDF
+	MAC() MAC
+	Stream() StreamCipher
+	SPRP() SPRP
+
+	// AEAD used to encrypt the out-of-band payload streams of header-only
+	// packets
+	AEAD(key []byte) (cipher.AEAD, error)
+
+	// post-quantum KEM combined with the group key agreement, or nil if the
+	// suite is not hybrid
+	KEM() KEM
+}
+
+// Group is the cyclic group used for key agreement and for blinding the group
+// element at each hop. Scalars and elements are encoded as byte slices.
+type Group interface {
+	// size in bytes of an encoded element
+	ElementSize() int
+
+	GenerateKey(rand io.Reader) (priv, pub []byte, err error)
+	ScalarBaseMult(scalar []byte) ([]byte, error)
+	ScalarMult(scalar, element []byte) ([]byte, error)
+
+	// returns the bytes of an element used as input to derive shared secrets
+	// (e.g. the x coordinate of a point)
+	SharedBytes(element []byte) []byte
+
+	// validates an encoded element received from the network
+	Validate(element []byte) error
+}
+
+// KDF hashes and derives keys from shared secrets. Derive is HKDF (RFC 5869)
+// instantiated with the suite's hash function, where the label is the HKDF
+// info parameter.
+type KDF interface {
+	Hash(data ...[]byte) Hash256
+	Derive(secret, salt []byte, label string, size int) []byte
+}
+
+// MAC computes a message authentication code of size hmacSize
+type MAC interface {
+	Sum(key, message []byte) []byte
+}
+
+// StreamCipher generates the cipher streams used to obfuscate headers
+type StreamCipher interface {
+	NonceSize() int
+	KeyStream(key, nonce []byte, numBytes int) ([]byte, error)
+}
+
+// SPRP is a strong pseudo-random permutation used to encrypt the packet
+// payload at each hop. Any modification of the payload results in garbage
+// once decrypted.
+type SPRP interface {
+	Encrypt(key, block []byte) ([]byte, error)
+	Decrypt(key, block []byte) ([]byte, error)
+}
+
+type suite struct {
+	id     SuiteID
+	name   string
+	group  Group
+	kdf    KDF
+	mac    MAC
+	stream StreamCipher
+	sprp   SPRP
+	aead   func(key []byte) (cipher.AEAD, error)
+	kem    KEM
+}
+
+func (s *suite) ID() SuiteID          { return s.id }
+func (s *suite) Name() string         { return s.name }
+func (s *suite) Group() Group         { return s.group }
+func (s *suite) KDF() KDF             { return s.kdf }
+func (s *suite) MAC() MAC             { return s.mac }
+func (s *suite) Stream() StreamCipher { return s.stream }
+func (s *suite) SPRP() SPRP           { return s.sprp }
+func (s *suite) KEM() KEM             { return s.kem }
+
+func (s *suite) AEAD(key []byte) (cipher.AEAD, error) { return s.aead(key) }
+
+// P256SHA256ChaCha20 is the default cipher suite: ECDH over P-256, SHA-256
+// hashing, HMAC-SHA-256, ChaCha20, a LIONESS payload SPRP built from ChaCha20
+// and HMAC-SHA-256 and ChaCha20-Poly1305
+var P256SHA256ChaCha20 CipherSuite = newSuite(SuiteP256SHA256ChaCha20,
+	"P256-SHA256-ChaCha20", p256Group{}, sha256KDF{}, hmacSHA256{}, chacha20Stream{},
+	chacha20poly1305.New)
+
+// X25519BLAKE2bAESCTR uses X25519, BLAKE2b-256 hashing and keyed MAC, AES-256
+// in counter mode, a LIONESS payload SPRP built from AES-CTR and BLAKE2b and
+// AES-256-GCM
+var X25519BLAKE2bAESCTR CipherSuite = newSuite(SuiteX25519BLAKE2bAESCTR,
+	"X25519-BLAKE2b-AESCTR", x25519Group{}, blake2bKDF{}, blake2bMAC{}, aesCTRStream{},
+	newAESGCM)
+
+// DefaultSuite is the suite used by the APIs which do not take a suite
+var DefaultSuite = P256SHA256ChaCha20
+
+var suites = map[SuiteID]CipherSuite{
+	SuiteP256SHA256ChaCha20:  P256SHA256ChaCha20,
+	SuiteX25519BLAKE2bAESCTR: X25519BLAKE2bAESCTR,
+}
+
+func newSuite(id SuiteID, name string, g Group, k KDF, m MAC, s StreamCipher,
+	aead func(key []byte) (cipher.AEAD, error)) *suite {
+	return &suite{
+		id:     id,
+		name:   name,
+		group:  g,
+		kdf:    k,
+		mac:    m,
+		stream: s,
+		sprp:   &lioness{kdf: k, mac: m, stream: s},
+		aead:   aead,
+	}
+}
+
+// returns a hybrid suite with the same primitives as the base suite
+func newHybridSuite(id SuiteID, name string, base *suite, k KEM) *suite {
+	s := *base
+	s.id = id
+	s.name = name
+	s.kem = k
+	return &s
+}
+
+// SuiteByID returns the cipher suite with the given ID
+func SuiteByID(id SuiteID) (CipherSuite, error) {
+	s, ok := suites[id]
+	if !ok {
+		return nil, fmt.Errorf("Unknown cipher suite %v", id)
+	}
+	return s, nil
+}
+
+// SharedSecret derives the shared secret between a private scalar and a group
+// element
+func SharedSecret(s CipherSuite, priv, element []byte) (Hash256, error) {
+	point, err := s.Group().ScalarMult(priv, element)
+	if err != nil {
+		return Hash256{}, err
+	}
+	defer Wipe(point)
+	return s.KDF().Hash(s.Group().SharedBytes(point)), nil
+}
+
+// SHA-256 based KDF
+type sha256KDF struct{}
+
+func (k sha256KDF) Hash(data ...[]byte) Hash256 {
+	h := sha256.New()
+	for _, d := range data {
+		h.Write(d)
+	}
+	var res Hash256
+	copy(res[:], h.Sum(nil))
+	return res
+}
+
+func (k sha256KDF) Derive(secret, salt []byte, label string, size int) []byte {
+	return hkdfDerive(sha256.New, secret, salt, label, size)
+}
+
+type hmacSHA256 struct{}
+
+func (m hmacSHA256) Sum(key, message []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+type chacha20Stream struct{}
+
+func (c chacha20Stream) NonceSize() int { return chacha.XNonceSize }
+
+func (c chacha20Stream) KeyStream(key, nonce []byte, numBytes int) ([]byte, error) {
+	return GenerateCipherStream(key, nonce, numBytes)
+}
+
+// BLAKE2b-256 based KDF
+type blake2bKDF struct{}
+
+func (k blake2bKDF) Hash(data ...[]byte) Hash256 {
+	h, _ := blake2b.New256(nil)
+	for _, d := range data {
+		h.Write(d)
+	}
+	var res Hash256
+	copy(res[:], h.Sum(nil))
+	return res
+}
+
+func (k blake2bKDF) Derive(secret, salt []byte, label string, size int) []byte {
+	return hkdfDerive(newBlake2b256, secret, salt, label, size)
+}
+
+func newBlake2b256() hash.Hash {
+	h, _ := blake2b.New256(nil)
+	return h
+}
+
+type blake2bMAC struct{}
+
+func (m blake2bMAC) Sum(key, message []byte) []byte {
+	h, err := blake2b.New256(key)
+	if err != nil {
+		// only happens for keys larger than 64 bytes, which are never used
+		panic(err)
+	}
+	h.Write(message)
+	return h.Sum(nil)
+}
+
+type aesCTRStream struct{}
+
+func (c aesCTRStream) NonceSize() int { return aes.BlockSize }
+
+func (c aesCTRStream) KeyStream(key, nonce []byte, numBytes int) ([]byte, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return []byte{}, err
+	}
+	if len(nonce) != aes.BlockSize {
+		return []byte{}, fmt.Errorf("AES-CTR nonce must have %v bytes, got %v",
+			aes.BlockSize, len(nonce))
+	}
+	out := make([]byte, numBytes)
+	cipher.NewCTR(b, nonce).XORKeyStream(out, out)
+	return out, nil
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
@@ -0,0 +1,110 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+var testSuites = []CipherSuite{P256SHA256ChaCha20, X25519BLAKE2bAESCTR}
+
+func TestSuiteSharedSecret(t *testing.T) {
+	for _, s := range testSuites {
+		g := s.Group()
+		privA, pubA, err := g.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		privB, pubB, _ := g.GenerateKey(rand.Reader)
+
+		if len(pubA) != g.ElementSize() {
+			t.Errorf("%v: element size should be %v, got %v", s.Name(),
+				g.ElementSize(), len(pubA))
+		}
+
+		sA, err := SharedSecret(s, privA, pubB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sB, _ := SharedSecret(s, privB, pubA)
+		if sA != sB {
+			t.Errorf("%v: shared secrets are not the same %x %x", s.Name(), sA, sB)
+		}
+
+		if err := g.Validate(pubA[1:]); err == nil {
+			t.Errorf("%v: truncated element should not be valid", s.Name())
+		}
+	}
+}
+
+func TestSuiteByID(t *testing.T) {
+	for _, s := range testSuites {
+		res, err := SuiteByID(s.ID())
+		if err != nil || res != s {
+			t.Errorf("Suite %v not found by ID: %v", s.Name(), err)
+		}
+	}
+	if _, err := SuiteByID(0); err == nil {
+		t.Error("Unknown suite ID should return an error")
+	}
+}
+
+func TestDefaultSuiteCompatibility(t *testing.T) {
+	priv, pub, _ := P256SHA256ChaCha20.Group().GenerateKey(rand.Reader)
+	_, other, _ := P256SHA256ChaCha20.Group().GenerateKey(rand.Reader)
+
+	ecPriv, _ := P256ParsePublicKey(pub)
+	ecOther, _ := P256ParsePublicKey(other)
+	if ecPriv == nil || ecOther == nil {
+		t.Fatal("P-256 elements should be parsed as ECDSA public keys")
+	}
+
+	s, _ := SharedSecret(P256SHA256ChaCha20, priv, other)
+	point, _ := P256SHA256ChaCha20.Group().ScalarMult(priv, other)
+	exp := P256SHA256ChaCha20.KDF().Hash(P256SHA256ChaCha20.Group().SharedBytes(point))
+	if s != exp {
+		t.Errorf("Shared secret mismatch %x %x", s, exp)
+	}
+
+	// blinding factor is bound to the group element received by the hop
+	bf := BlindingFactor(P256SHA256ChaCha20, pub, s)
+	if bf == BlindingFactor(P256SHA256ChaCha20, other, s) {
+		t.Error("Blinding factors of different group elements must differ")
+	}
+}
+
+func TestLioness(t *testing.T) {
+	for _, s := range testSuites {
+		key := make([]byte, 32)
+		rand.Read(key)
+		block := make([]byte, 256)
+		copy(block, []byte("hello sphinx!"))
+
+		c, err := s.SPRP().Encrypt(key, block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(c, block) {
+			t.Errorf("%v: block was not encrypted", s.Name())
+		}
+
+		p, err := s.SPRP().Decrypt(key, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p, block) {
+			t.Errorf("%v: decrypted block mismatch", s.Name())
+		}
+
+		// any change in the ciphertext must garble the whole plaintext
+		c[len(c)-1] ^= 1
+		p, _ = s.SPRP().Decrypt(key, c)
+		if bytes.Equal(p[:13], block[:13]) {
+			t.Errorf("%v: modified ciphertext should not decrypt", s.Name())
+		}
+
+		if _, err := s.SPRP().Encrypt(key, block[:16]); err == nil {
+			t.Errorf("%v: short blocks should not be encrypted", s.Name())
+		}
+	}
+}
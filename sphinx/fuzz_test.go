@@ -0,0 +1,228 @@
+package sphinx
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	ec "crypto/elliptic"
+	"crypto/rand"
+	scrypto "github.com/hashmatter/p3lib/sphinx/crypto"
+	"testing"
+)
+
+// fuzz targets for the decoders and processors of sphinx packets. the seed
+// corpus is run as part of `go test`; run `go test -fuzz=FuzzName` to fuzz.
+
+func FuzzPacketGobDecode(f *testing.F) {
+	f.Add(fuzzPacketSeed(f))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		var p Packet
+		if err := p.GobDecode(raw); err != nil {
+			return
+		}
+
+		// decoded packets must be re-encoded to an equivalent packet
+		enc, err := p.GobEncode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p2 Packet
+		if err := p2.GobDecode(enc); err != nil {
+			t.Fatal(err)
+		}
+		if !packetsEqual(&p, &p2) {
+			t.Errorf("Packet round trip mismatch:\n >> %+v\n >> %+v", p, p2)
+		}
+	})
+}
+
+func FuzzHeaderGobDecode(f *testing.F) {
+	p := &Packet{}
+	p.GobDecode(fuzzPacketSeed(f))
+	seed, _ := p.Header.GobEncode()
+	f.Add(seed)
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		var h Header
+		if err := h.GobDecode(raw); err != nil {
+			return
+		}
+		if err := scrypto.DefaultSuite.Group().Validate(h.GroupElement); err != nil &&
+			h.Suite == scrypto.SuiteP256SHA256ChaCha20 {
+			t.Errorf("Decoded header has an invalid group element: %v", err)
+		}
+	})
+}
+
+func FuzzSURBGobDecode(f *testing.F) {
+	pub, _ := generateHopKeys()
+	privSender, _ := ecdsa.GenerateKey(ec.P256(), rand.Reader)
+	surb, _, err := NewSURB(privSender, []ecdsa.PublicKey{*pub}, []byte("dest"),
+		[][]byte{[]byte("relay0")})
+	if err != nil {
+		f.Fatal(err)
+	}
+	seed, _ := surb.GobEncode()
+	f.Add(seed)
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		var s SURB
+		if err := s.GobDecode(raw); err != nil {
+			return
+		}
+		if _, err := s.GobEncode(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// processes arbitrary packets with a random relay key. processing must fail
+// with an error and never panic
+func FuzzProcessPacket(f *testing.F) {
+	var seed Packet
+	seed.GobDecode(fuzzPacketSeed(f))
+	f.Add(byte(seed.Suite), seed.GroupElement, seed.RoutingInfo[:],
+		seed.RoutingInfoMac[:], seed.Payload[:])
+	f.Add(byte(0), []byte{}, []byte{}, []byte{}, []byte{})
+
+	priv, _ := ecdsa.GenerateKey(ec.P256(), rand.Reader)
+	_, x25519Key, _ := scrypto.X25519BLAKE2bAESCTR.Group().GenerateKey(rand.Reader)
+
+	f.Fuzz(func(t *testing.T, suite byte, ge, ri, mac, payload []byte) {
+		p := &Packet{Version: defRealm, Header: &Header{
+			Suite:        scrypto.SuiteID(suite),
+			GroupElement: ge,
+		}}
+		copy(p.RoutingInfo[:], ri)
+		copy(p.RoutingInfoMac[:], mac)
+		copy(p.Payload[:], payload)
+
+		r := NewRelayerCtxWithKeys(
+			SuiteKey{Suite: scrypto.P256SHA256ChaCha20, PrivKey: scrypto.P256PrivateKey(priv)},
+			SuiteKey{Suite: scrypto.X25519BLAKE2bAESCTR, PrivKey: x25519Key},
+		)
+		_, next, err := r.ProcessPacket(p)
+		if err == nil {
+			// a valid header MAC from random input means the MAC is broken
+			t.Errorf("Random packet should not be processed: %+v", next.Header)
+		}
+	})
+}
+
+// packets constructed with arbitrary payloads and addresses must be processed
+// by the circuit and the payload recovered by the last hop
+func FuzzPacketRoundTrip(f *testing.F) {
+	f.Add([]byte("hello sphinx!"), []byte("/ip4/127.0.0.1/udp/1234"),
+		[]byte("/ip4/127.0.0.1/udp/1235"), uint8(3))
+
+	numRelays := numMaxRelays
+	circuitPrivKeys := make([]ecdsa.PrivateKey, numRelays)
+	circuitPubKeys := make([]ecdsa.PublicKey, numRelays)
+	for i := 0; i < numRelays; i++ {
+		pub, priv := generateHopKeys()
+		circuitPrivKeys[i] = *priv
+		circuitPubKeys[i] = *pub
+	}
+
+	f.Fuzz(func(t *testing.T, data, dest, addr []byte, hops uint8) {
+		n := int(hops)%numRelays + 1
+		if len(dest) > addrSize || len(addr) > addrSize {
+			return
+		}
+
+		var payload [payloadSize]byte
+		copy(payload[:], data)
+		relayAddrs := make([][]byte, n)
+		for i := range relayAddrs {
+			relayAddrs[i] = addr
+		}
+
+		privSender, _ := ecdsa.GenerateKey(ec.P256(), rand.Reader)
+		p, err := NewPacket(privSender, circuitPubKeys[:n], dest, relayAddrs, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// every hop receives the encoded packet from the network
+		for i := 0; i < n; i++ {
+			raw, err := p.GobEncode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var received Packet
+			if err := received.GobDecode(raw); err != nil {
+				t.Fatal(err)
+			}
+			_, p, err = NewRelayerCtx(&circuitPrivKeys[i]).ProcessPacket(&received)
+			if err != nil {
+				t.Fatalf("Hop %v: %v", i, err)
+			}
+		}
+		if !p.IsLast() || p.Payload != payload {
+			t.Error("Payload was not recovered by the last hop")
+		}
+	})
+}
+
+// regression tests for the crash classes found by the fuzz targets
+func TestMalformedPackets(t *testing.T) {
+	var p Packet
+	if err := p.GobDecode(fuzzPacketSeed(t)); err != nil {
+		t.Fatal(err)
+	}
+	if p.Version != defRealm {
+		t.Errorf("Packet version should be preserved by encoding, got %v", p.Version)
+	}
+
+	// packets with invalid headers must not be decoded
+	invalid := &Packet{Version: defRealm, Header: &Header{GroupElement: []byte{1}}}
+	raw, err := invalid.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Packet
+	if err := decoded.GobDecode(raw); err == nil {
+		t.Error("Packet with invalid header should not be decoded")
+	}
+
+	if _, err := (&Packet{}).GobEncode(); err == nil {
+		t.Error("Packet without header should not be encoded")
+	}
+
+	_, priv := generateHopKeys()
+	r := NewRelayerCtx(priv)
+	if _, _, err := r.ProcessPacket(&Packet{}); err == nil {
+		t.Error("Packet without header should not be processed")
+	}
+	if _, _, err := r.ProcessPacket(nil); err == nil {
+		t.Error("Nil packet should not be processed")
+	}
+}
+
+func fuzzPacketSeed(f testing.TB) []byte {
+	pubs := make([]ecdsa.PublicKey, 2)
+	for i := range pubs {
+		pub, _ := generateHopKeys()
+		pubs[i] = *pub
+	}
+	privSender, _ := ecdsa.GenerateKey(ec.P256(), rand.Reader)
+	p, err := NewPacket(privSender, pubs, []byte("dest"),
+		[][]byte{[]byte("relay0"), []byte("relay1")}, [payloadSize]byte{})
+	if err != nil {
+		f.Fatal(err)
+	}
+	raw, err := p.GobEncode()
+	if err != nil {
+		f.Fatal(err)
+	}
+	return raw
+}
+
+func packetsEqual(a, b *Packet) bool {
+	return a.Version == b.Version && a.Suite == b.Suite &&
+		bytes.Equal(a.GroupElement, b.GroupElement) &&
+		a.RoutingInfo == b.RoutingInfo && a.RoutingInfoMac == b.RoutingInfoMac &&
+		a.Payload == b.Payload
+}
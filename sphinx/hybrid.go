@@ -0,0 +1,140 @@
+package sphinx
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	scrypto "github.com/hashmatter/p3lib/sphinx/crypto"
+)
+
+// In hybrid suites, the initiator encapsulates a key to the KEM public key of
+// each hop. The KEM ciphertexts are carried in the KEMInfo field of the header,
+// which is built and processed like the routing info: each hop removes its
+// ciphertext from the beginning of the field, shifts the rest left and pads the
+// end with pseudo-random bytes, so that the field has a fixed size and hops do
+// not learn their position in the circuit. The KEMInfo layer of each hop is
+// obfuscated with a key derived from the group shared secret, since the hop
+// needs the ciphertext to compute the hybrid secret. All the other hop keys
+// are derived from the hybrid secret and the header MAC covers both the
+// routing info and the KEMInfo.
+
+// KEMInfoSize returns the size in bytes of the KEMInfo field of the headers of
+// a suite, which is the header size overhead of the hybrid mode. It is 0 for
+// suites which are not hybrid.
+func KEMInfoSize(suite scrypto.CipherSuite) int {
+	if suite.KEM() == nil {
+		return 0
+	}
+	return numMaxRelays * suite.KEM().CiphertextSize()
+}
+
+// encapsulates a key to each hop and returns the hybrid secrets and the KEMInfo
+// of the header as received by each hop, including the dummy hops, which get
+// random ciphertexts
+func generateHybridSecrets(ctx context.Context, suite scrypto.CipherSuite,
+	secrets []scrypto.Hash256, kemPubKeys [][]byte,
+	dummies []scrypto.Hash256) ([]scrypto.Hash256, [][]byte, error) {
+
+	kem := suite.KEM()
+	hybrid := make([]scrypto.Hash256, len(secrets))
+	cts := make([][]byte, len(secrets))
+	for i := range secrets {
+		if err := ctx.Err(); err != nil {
+			scrypto.WipeHashes(hybrid)
+			return nil, nil, err
+		}
+		shared, ct, err := kem.Encapsulate(kemPubKeys[i])
+		if err != nil {
+			return nil, nil, fmt.Errorf("KEM encapsulation for relay [%v]: %v", i, err)
+		}
+		hybrid[i] = scrypto.HybridSecret(suite, secrets[i], shared, ct)
+		scrypto.Wipe(shared)
+		cts[i] = ct
+	}
+
+	for range dummies {
+		ct := make([]byte, kem.CiphertextSize())
+		if _, err := rand.Read(ct); err != nil {
+			return nil, nil, err
+		}
+		cts = append(cts, ct)
+	}
+
+	layerSecrets := append(append([]scrypto.Hash256{}, secrets...), dummies...)
+	defer scrypto.WipeHashes(layerSecrets)
+	layers, err := constructKEMInfo(suite, layerSecrets, cts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hybrid, layers, nil
+}
+
+// constructs the KEMInfo received by each hop, using the same construction as
+// the routing info
+func constructKEMInfo(suite scrypto.CipherSuite, secrets []scrypto.Hash256,
+	cts [][]byte) ([][]byte, error) {
+
+	numRelays := len(secrets)
+	ctSize := suite.KEM().CiphertextSize()
+	size := KEMInfoSize(suite)
+
+	streams := make([][]byte, numRelays)
+	for i := range secrets {
+		s, err := kemStream(suite, secrets[i], size+ctSize)
+		if err != nil {
+			return nil, err
+		}
+		streams[i] = s
+	}
+
+	// filler which results from the processing by the first numRelays-1 hops
+	var filler []byte
+	for i := 0; i < numRelays-1; i++ {
+		filler = append(filler, make([]byte, ctSize)...)
+		filler, _ = xor(filler, streams[i][len(streams[i])-len(filler):])
+	}
+
+	layers := make([][]byte, numRelays)
+	info := make([]byte, size)
+	for i := numRelays - 1; i >= 0; i-- {
+		if i != numRelays-1 {
+			info = shiftRight(info, ctSize)[:size]
+		}
+		copy(info, cts[i])
+		info, _ = xor(info, streams[i][:size])
+
+		if i == numRelays-1 {
+			copy(info[size-len(filler):], filler)
+		}
+		layers[i] = info
+	}
+	return layers, nil
+}
+
+// removes the ciphertext of the hop from the KEMInfo and returns it with the
+// KEMInfo for the next hop
+func processKEMInfo(suite scrypto.CipherSuite, secret scrypto.Hash256,
+	info []byte) ([]byte, []byte, error) {
+
+	ctSize := suite.KEM().CiphertextSize()
+	size := KEMInfoSize(suite)
+	if len(info) != size {
+		return nil, nil, fmt.Errorf("KEMInfo must have %v bytes, got %v", size, len(info))
+	}
+
+	stream, err := kemStream(suite, secret, size+ctSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	padded := append(append([]byte{}, info...), make([]byte, ctSize)...)
+	p, _ := xor(padded, stream)
+	return p[:ctSize], p[ctSize:], nil
+}
+
+func kemStream(suite scrypto.CipherSuite, secret scrypto.Hash256, n int) ([]byte, error) {
+	key := suite.KDF().Derive(secret[:], nil, scrypto.LabelKEMStream, scrypto.KeySize)
+	defer scrypto.Wipe(key)
+	nonce := suite.KDF().Derive(secret[:], nil, scrypto.LabelKEMNonce,
+		suite.Stream().NonceSize())
+	return suite.Stream().KeyStream(key, nonce, n)
+}
@@ -0,0 +1,183 @@
+package sphinx
+
+import (
+	"bytes"
+	"crypto/rand"
+	scrypto "github.com/hashmatter/p3lib/sphinx/crypto"
+	"testing"
+)
+
+func hybridSuites(t *testing.T) []scrypto.CipherSuite {
+	var suites []scrypto.CipherSuite
+	for _, id := range []scrypto.SuiteID{scrypto.SuiteX25519MLKEM768BLAKE2bAESCTR,
+		scrypto.SuiteP256MLKEM1024SHA256ChaCha20} {
+		s, err := scrypto.SuiteByID(id)
+		if err != nil {
+			t.Skip("Hybrid suites are not available: ", err)
+		}
+		suites = append(suites, s)
+	}
+	return suites
+}
+
+func TestHybridEndToEnd(t *testing.T) {
+	for _, suite := range hybridSuites(t) {
+		numRelays := 3
+		finalAddr := []byte("/ip4/127.0.0.1/udp/1234")
+		relayAddrs := [][]byte{
+			[]byte("/ip4/127.0.0.1/udp/1235"),
+			[]byte("QmPxawpH7ymXENBZcbKpV3NTxMc4fs37gmREn8e9C2kgNe"),
+			[]byte("/ip4/120.120.0.2/tcp/1222"),
+		}
+
+		privKeys := make([][]byte, numRelays)
+		pubKeys := make([][]byte, numRelays)
+		for i := range privKeys {
+			var err error
+			privKeys[i], pubKeys[i], err = scrypto.GenerateKey(suite, rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		sessionKey, _, _ := suite.Group().GenerateKey(rand.Reader)
+
+		var payload [payloadSize]byte
+		copy(payload[:], []byte("hello post-quantum sphinx!"))
+
+		packet, err := NewPacketWithSuite(suite, sessionKey, pubKeys, finalAddr,
+			relayAddrs, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(packet.KEMInfo) != KEMInfoSize(suite) {
+			t.Errorf("%v: KEMInfo should have %v bytes, got %v", suite.Name(),
+				KEMInfoSize(suite), len(packet.KEMInfo))
+		}
+
+		for i := 0; i < numRelays; i++ {
+			// every hop receives the encoded packet from the network
+			raw, err := packet.GobEncode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var received Packet
+			if err := received.GobDecode(raw); err != nil {
+				t.Fatal(err)
+			}
+			if len(received.KEMInfo) != KEMInfoSize(suite) {
+				t.Errorf("%v: KEMInfo size must not depend on the hop position",
+					suite.Name())
+			}
+
+			r := NewRelayerCtxWithKeys(SuiteKey{Suite: suite, PrivKey: privKeys[i]})
+			_, packet, err = r.ProcessPacket(&received)
+			if err != nil {
+				t.Fatalf("%v: hop %v: %v", suite.Name(), i, err)
+			}
+		}
+
+		if !packet.IsLast() || packet.Payload != payload {
+			t.Errorf("%v: payload was not recovered by the last hop", suite.Name())
+		}
+	}
+}
+
+// the KEM ciphertexts are authenticated by the header MAC
+func TestHybridTamperedKEMInfo(t *testing.T) {
+	for _, suite := range hybridSuites(t) {
+		priv, pub, _ := scrypto.GenerateKey(suite, rand.Reader)
+		_, pub2, _ := scrypto.GenerateKey(suite, rand.Reader)
+		sessionKey, _, _ := suite.Group().GenerateKey(rand.Reader)
+
+		packet, err := NewPacketWithSuite(suite, sessionKey, [][]byte{pub, pub2},
+			[]byte("dest"), [][]byte{[]byte("relay0"), []byte("relay1")},
+			[payloadSize]byte{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// tampering with the ciphertext of the next hop must be detected by the
+		// current hop
+		last := len(packet.KEMInfo) - 1
+		packet.KEMInfo[last] ^= 1
+		r := NewRelayerCtxWithKeys(SuiteKey{Suite: suite, PrivKey: priv})
+		if _, _, err := r.ProcessPacket(packet); err == nil {
+			t.Errorf("%v: tampered KEMInfo should not be processed", suite.Name())
+		}
+		packet.KEMInfo[last] ^= 1
+
+		// relays of hybrid suites must not process packets with the classical
+		// key only
+		scalar, _, _ := scrypto.SplitPrivateKey(suite, priv)
+		r = NewRelayerCtxWithKeys(SuiteKey{Suite: suite, PrivKey: append(scalar,
+			make([]byte, suite.KEM().PrivateKeySize())...)})
+		if _, _, err := r.ProcessPacket(packet); err == nil {
+			t.Errorf("%v: packet should not be processed without the KEM key",
+				suite.Name())
+		}
+	}
+}
+
+func TestHybridSURB(t *testing.T) {
+	for _, suite := range hybridSuites(t) {
+		priv, pub, _ := scrypto.GenerateKey(suite, rand.Reader)
+		sessionKey, _, _ := suite.Group().GenerateKey(rand.Reader)
+
+		surb, keys, err := NewSURBWithSuite(suite, sessionKey, [][]byte{pub},
+			[]byte("initiator"), [][]byte{[]byte("relay0")})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var payload [payloadSize]byte
+		copy(payload[:], []byte("hello back!"))
+		packet, err := surb.NewPacket(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := NewRelayerCtxWithKeys(SuiteKey{Suite: suite, PrivKey: priv})
+		_, packet, err = r.ProcessPacket(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, err := keys.Unwrap(packet.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply != payload {
+			t.Errorf("%v: reply was not recovered by the initiator", suite.Name())
+		}
+	}
+}
+
+// dummy hops of hybrid circuits get random KEM ciphertexts
+func TestHybridPathHiding(t *testing.T) {
+	for _, suite := range hybridSuites(t) {
+		priv, pub, _ := scrypto.GenerateKey(suite, rand.Reader)
+		sessionKey, _, _ := suite.Group().GenerateKey(rand.Reader)
+
+		var payload [payloadSize]byte
+		copy(payload[:], []byte("hello post-quantum sphinx!"))
+		packet, err := NewPacketWithSuite(suite, sessionKey, [][]byte{pub},
+			[]byte("dest"), [][]byte{[]byte("relay0")}, payload, WithDummyHops())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := NewRelayerCtxWithKeys(SuiteKey{Suite: suite, PrivKey: priv})
+		_, packet, err = r.ProcessPacket(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !packet.IsLast() || packet.Payload != payload {
+			t.Errorf("%v: payload was not recovered by the exit relay", suite.Name())
+		}
+
+		// the KEMInfo seen by the exit relay must not be zeroed
+		if bytes.Count(packet.KEMInfo, []byte{0}) > len(packet.KEMInfo)/64 {
+			t.Errorf("%v: KEMInfo seen by the exit relay reveals the path length",
+				suite.Name())
+		}
+	}
+}
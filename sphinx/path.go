@@ -0,0 +1,92 @@
+package sphinx
+
+import (
+	"crypto/rand"
+	scrypto "github.com/hashmatter/p3lib/sphinx/crypto"
+	"math/big"
+)
+
+// By default, the routing info of a circuit with less than numMaxRelays hops
+// is built on top of a zeroed buffer. The exit relay removes the last layer of
+// the routing info and finds those zeroes after its own routing data, which
+// reveals the length of the circuit. With path length hiding, the circuit is
+// padded with dummy hops after the exit relay. Dummy hops have random shared
+// secrets which are not known to any relay, so the routing info decrypted by
+// the exit relay is indistinguishable from random bytes, regardless of the
+// path length. The exit relay is marked by a zeroed next hop MAC, as in
+// circuits without dummy hops.
+
+// HeaderOption configures the construction of a header
+type HeaderOption func(*headerOptions)
+
+type headerOptions struct {
+	hiding pathHiding
+}
+
+type pathHiding int
+
+const (
+	noHiding pathHiding = iota
+	dummyHops
+	randomExit
+)
+
+// WithDummyHops pads the circuit with dummy hops after the exit relay up to the
+// max number of relays, so that the exit relay sits at the same position of
+// the routing info regardless of the path length
+func WithDummyHops() HeaderOption {
+	return func(o *headerOptions) {
+		o.hiding = dummyHops
+	}
+}
+
+// WithRandomExit pads the circuit with a random number of dummy hops after the
+// exit relay, so that the exit relay sits at a random position of the routing
+// info. It hides the path length from the exit relay at a lower cost than
+// WithDummyHops.
+func WithRandomExit() HeaderOption {
+	return func(o *headerOptions) {
+		o.hiding = randomExit
+	}
+}
+
+func newHeaderOptions(opts []HeaderOption) headerOptions {
+	var o headerOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// returns the number of dummy hops appended to a circuit with numRelays hops
+func (o headerOptions) numDummies(numRelays int) (int, error) {
+	if numRelays >= numMaxRelays {
+		return 0, nil
+	}
+
+	switch o.hiding {
+	case dummyHops:
+		return numMaxRelays - numRelays, nil
+	case randomExit:
+		// at least one dummy hop is needed, otherwise the exit relay sees the
+		// zeroed buffer
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(numMaxRelays-numRelays)))
+		if err != nil {
+			return 0, err
+		}
+		return int(n.Int64()) + 1, nil
+	}
+	return 0, nil
+}
+
+// generates the random shared secrets of the dummy hops
+func dummySecrets(n int) ([]scrypto.Hash256, error) {
+	secrets := make([]scrypto.Hash256, n)
+	for i := range secrets {
+		if _, err := rand.Read(secrets[i][:]); err != nil {
+			scrypto.WipeHashes(secrets)
+			return nil, err
+		}
+	}
+	return secrets, nil
+}
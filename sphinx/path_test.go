@@ -0,0 +1,154 @@
+package sphinx
+
+import (
+	"crypto/ecdsa"
+	ec "crypto/elliptic"
+	"crypto/rand"
+	"math"
+	"testing"
+)
+
+var pathHidingModes = map[string]HeaderOption{
+	"dummy hops":  WithDummyHops(),
+	"random exit": WithRandomExit(),
+}
+
+// sends a packet through a circuit of numRelays hops and returns the header
+// received by the first hop and the header output by the exit relay, which is
+// the routing info as seen by the exit relay
+func pathHidingSample(t *testing.T, numRelays int, opts ...HeaderOption) (*Header, *Header) {
+	privKeys := make([]*ecdsa.PrivateKey, numRelays)
+	pubKeys := make([]ecdsa.PublicKey, numRelays)
+	relayAddrs := make([][]byte, numRelays)
+	for i := range privKeys {
+		pub, priv := generateHopKeys()
+		privKeys[i] = priv
+		pubKeys[i] = *pub
+		relayAddrs[i] = []byte("/ip4/127.0.0.1/udp/1235")
+	}
+
+	var payload [payloadSize]byte
+	copy(payload[:], []byte("hello sphinx!"))
+	privSender, _ := ecdsa.GenerateKey(ec.P256(), rand.Reader)
+	packet, err := NewPacket(privSender, pubKeys, []byte("/ip4/127.0.0.1/udp/1234"),
+		relayAddrs, payload, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := packet.Header
+
+	for i := range privKeys {
+		if packet.IsLast() {
+			t.Fatalf("Hop %v of %v should not be the exit relay", i, numRelays)
+		}
+		_, packet, err = NewRelayerCtx(privKeys[i]).ProcessPacket(packet)
+		if err != nil {
+			t.Fatalf("Hop %v of %v: %v", i, numRelays, err)
+		}
+	}
+	if !packet.IsLast() || packet.Payload != payload {
+		t.Fatalf("Payload was not recovered by the exit relay of %v hops", numRelays)
+	}
+	return first, packet.Header
+}
+
+func TestPathHidingEndToEnd(t *testing.T) {
+	for name, opt := range pathHidingModes {
+		for n := 1; n <= numMaxRelays; n++ {
+			pathHidingSample(t, n, opt)
+		}
+
+		// SURBs and header-only packets support path length hiding as well
+		pub, priv := generateHopKeys()
+		privSender, _ := ecdsa.GenerateKey(ec.P256(), rand.Reader)
+		surb, keys, err := NewSURB(privSender, []ecdsa.PublicKey{*pub},
+			[]byte("initiator"), [][]byte{[]byte("relay0")}, opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reply [payloadSize]byte
+		copy(reply[:], []byte("reply"))
+		packet, _ := surb.NewPacket(reply)
+		_, packet, err = NewRelayerCtx(priv).ProcessPacket(packet)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if p, _ := keys.Unwrap(packet.Payload); !packet.IsLast() || p != reply {
+			t.Errorf("%v: SURB reply was not recovered", name)
+		}
+
+		_, priv = generateHopKeys()
+		header, _, err := NewBulkHeader(privSender, []ecdsa.PublicKey{priv.PublicKey},
+			[]byte("dest"), [][]byte{[]byte("relay0")}, opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, layer, err := NewRelayerCtx(priv).ProcessHeader(header)
+		if err != nil || !layer.IsLast() {
+			t.Errorf("%v: bulk header was not processed by the exit relay: %v", name, err)
+		}
+	}
+}
+
+// the bytes of the header received by the first hop and of the routing info
+// seen by the exit relay must be uniformly distributed at every position,
+// regardless of the path length. otherwise an observer (or the exit relay)
+// could tell path lengths apart.
+func TestPathLengthIndistinguishable(t *testing.T) {
+	samples := 64
+	if testing.Short() {
+		samples = 16
+	}
+
+	// the mean of uniform bytes is 127.5 with a standard deviation of 73.9.
+	// means further than 6 standard errors away are not uniform
+	maxDev := 6 * 73.9 / math.Sqrt(float64(samples))
+
+	for name, opt := range pathHidingModes {
+		for n := 1; n <= numMaxRelays; n++ {
+			wire := make([]float64, routingInfoSize+hmacSize)
+			exit := make([]float64, routingInfoSize)
+			for s := 0; s < samples; s++ {
+				first, last := pathHidingSample(t, n, opt)
+				for i, b := range append(first.RoutingInfo[:], first.RoutingInfoMac[:]...) {
+					wire[i] += float64(b)
+				}
+				for i, b := range last.RoutingInfo {
+					exit[i] += float64(b)
+				}
+			}
+
+			if pos := nonUniformPosition(wire, samples, maxDev); pos >= 0 {
+				t.Errorf("%v: header byte %v is not uniform with %v hops", name, pos, n)
+			}
+			if pos := nonUniformPosition(exit, samples, maxDev); pos >= 0 {
+				t.Errorf("%v: routing info byte %v seen by the exit is not uniform with %v hops",
+					name, pos, n)
+			}
+		}
+	}
+
+	// without path length hiding, the exit relay sees zeroes after its routing
+	// data in circuits shorter than numMaxRelays
+	exit := make([]float64, routingInfoSize)
+	for s := 0; s < samples; s++ {
+		_, last := pathHidingSample(t, 1)
+		for i, b := range last.RoutingInfo {
+			exit[i] += float64(b)
+		}
+	}
+	if nonUniformPosition(exit, samples, maxDev) < 0 {
+		t.Error("Path length should be visible to the exit relay without path hiding")
+	}
+}
+
+// returns the first position whose mean is not the mean of uniform bytes, or
+// -1 if all positions look uniform
+func nonUniformPosition(sums []float64, samples int, maxDev float64) int {
+	for i, sum := range sums {
+		if math.Abs(sum/float64(samples)-127.5) > maxDev {
+			return i
+		}
+	}
+	return -1
+}
@@ -1,108 +1,260 @@
 package sphinx
 
 import (
+	"context"
 	"crypto/ecdsa"
-	ec "crypto/elliptic"
-	"crypto/sha256"
+	"crypto/hmac"
+	"errors"
 	"fmt"
 	scrypto "github.com/hashmatter/p3lib/sphinx/crypto"
 )
 
 type RelayerCtx struct {
-	processedTags [][32]byte
-	privKey       *ecdsa.PrivateKey
+	processedTags map[[32]byte]struct{}
+	keys          map[scrypto.SuiteID]SuiteKey
+	observer      Observer
 }
 
+// Observer is called by a relayer context for every packet it processes, with
+// the packet received by the relay, the address of the next hop and the packet
+// to forward. It lets tools (e.g. the metrics package) record which input of
+// the relay became which output. Observers must not modify the packets.
+type Observer func(in *Packet, next [addrSize]byte, out *Packet)
+
+// SuiteKey is a relay private key for a given cipher suite. In hybrid suites
+// the private key is the group scalar followed by the KEM private key (see
+// scrypto.GenerateKey).
+type SuiteKey struct {
+	Suite   scrypto.CipherSuite
+	PrivKey []byte
+}
+
+// NewRelayerCtx creates a relayer context which processes packets constructed
+// with the default cipher suite
 func NewRelayerCtx(privKey *ecdsa.PrivateKey) *RelayerCtx {
-	return &RelayerCtx{
-		processedTags: [][32]byte{},
-		privKey:       privKey,
+	return NewRelayerCtxWithKeys(SuiteKey{
+		Suite:   scrypto.DefaultSuite,
+		PrivKey: scrypto.P256PrivateKey(privKey),
+	})
+}
+
+// NewRelayerCtxWithKeys creates a relayer context which processes packets
+// constructed with any of the cipher suites of the keys
+func NewRelayerCtxWithKeys(keys ...SuiteKey) *RelayerCtx {
+	r := &RelayerCtx{
+		processedTags: map[[32]byte]struct{}{},
+		keys:          map[scrypto.SuiteID]SuiteKey{},
+	}
+	for _, k := range keys {
+		r.keys[k.Suite.ID()] = k
 	}
+	return r
+}
+
+// Wipe overwrites the private keys of the relayer context with zeroes. The
+// context can not process packets after being wiped.
+func (r *RelayerCtx) Wipe() {
+	for id, k := range r.keys {
+		scrypto.Wipe(k.PrivKey)
+		delete(r.keys, id)
+	}
+}
+
+// SetObserver sets the observer called for every packet processed by the
+// relayer context. Header-only packets (see ProcessHeader) are not observed.
+func (r *RelayerCtx) SetObserver(o Observer) {
+	r.observer = o
 }
 
 // returns list tags of each of the processed packets by the current relay
-// context
+// context, in no particular order
 func (r *RelayerCtx) ListProcessedPackets() [][32]byte {
-	return r.processedTags
+	tags := make([][32]byte, 0, len(r.processedTags))
+	for tag := range r.processedTags {
+		tags = append(tags, tag)
+	}
+	return tags
 }
 
 // processes packet in a given relayer context
 func (r *RelayerCtx) ProcessPacket(packet *Packet) ([addrSize]byte, *Packet, error) {
-	var next Packet
+	return r.ProcessPacketContext(context.Background(), packet)
+}
+
+// ProcessPacketContext is like ProcessPacket, but stops processing the packet
+// and returns the context error once the context is done
+func (r *RelayerCtx) ProcessPacketContext(ctx context.Context, packet *Packet) ([addrSize]byte, *Packet, error) {
 	var emptyAddr [addrSize]byte
 
-	curve := ec.P256()
-	header := packet.Header
+	if packet == nil || packet.Header == nil {
+		return emptyAddr, &Packet{}, errors.New("Packet or packet header is empty")
+	}
 
-	// first verify if group element is part of the expected curve. this is very
-	// important to avoid ECC twist security attacks
-	gElement := &header.GroupElement
-	isOnCurve := curve.Params().IsOnCurve(gElement.X, gElement.Y)
-	if isOnCurve == false {
-		return emptyAddr, &Packet{},
-			fmt.Errorf("Potential ECC attack! Group element is not on the expected curve.")
+	nextAddr, nextHeader, keys, err := r.unwrapHeader(ctx, packet.Header)
+	if err != nil {
+		return emptyAddr, &Packet{}, err
 	}
+	defer keys.Wipe()
 
-	sessionKey := r.privKey
-	sKey := scrypto.GenerateECDHSharedSecret(gElement, sessionKey)
+	// decrypts payload
+	suite := r.keys[packet.Suite].Suite
+	decryptedPayload, err := decryptPayload(suite, packet.Payload, keys.Payload)
+	if err != nil {
+		return emptyAddr, &Packet{}, err
+	}
 
-	// checks if packet has been processed based on the derived secret key
-	tag := sha256.Sum256([]byte(sKey[:]))
-	if contains(r.processedTags, tag) {
-		return emptyAddr, &Packet{},
-			fmt.Errorf("Packet already processed, discarding. (tag: %x)", tag)
+	next := &Packet{
+		Version: packet.Version,
+		Header:  nextHeader,
+		Payload: decryptedPayload,
 	}
+	if r.observer != nil {
+		r.observer(packet, nextAddr, next)
+	}
+	return nextAddr, next, nil
+}
 
-	r.processedTags = append(r.processedTags, tag)
+// ProcessHeader processes the header of a header-only packet. It returns the
+// address of the next hop, the header to forward and the layer which the relay
+// removes from the payload stream of the packet (see bulk.go).
+func (r *RelayerCtx) ProcessHeader(header *Header) ([addrSize]byte, *Header, *BulkLayer, error) {
+	return r.ProcessHeaderContext(context.Background(), header)
+}
+
+// ProcessHeaderContext is like ProcessHeader, but stops processing the header
+// and returns the context error once the context is done
+func (r *RelayerCtx) ProcessHeaderContext(ctx context.Context, header *Header) ([addrSize]byte, *Header, *BulkLayer, error) {
+	var emptyAddr [addrSize]byte
+
+	if header == nil {
+		return emptyAddr, &Header{}, nil, errors.New("Packet header is empty")
+	}
 
-	// process header
-	nextAddr, nextHmac, nextRoutingInfo, err := processHeader(header, sessionKey, sKey)
+	nextAddr, nextHeader, keys, err := r.unwrapHeader(ctx, header)
 	if err != nil {
-		return emptyAddr, &Packet{}, err
+		return emptyAddr, &Header{}, nil, err
 	}
+	defer keys.Wipe()
 
-	// decrypts payload
-	decryptedPayload, err := decryptPayload(packet.Payload, sKey)
+	layer := newBulkLayer(r.keys[header.Suite].Suite, keys, nextHeader.IsLast())
+	return nextAddr, nextHeader, layer, nil
+}
+
+// verifies and removes one layer of the header. it returns the next address
+// and header with the keys derived for the hop, which must be wiped by the
+// caller. the context is checked before each of the expensive operations
+func (r *RelayerCtx) unwrapHeader(ctx context.Context, header *Header) ([addrSize]byte, *Header, scrypto.HopKeys, error) {
+	var emptyAddr [addrSize]byte
+	var emptyKeys scrypto.HopKeys
+
+	if err := ctx.Err(); err != nil {
+		return emptyAddr, &Header{}, emptyKeys, err
+	}
+
+	key, ok := r.keys[header.Suite]
+	if !ok {
+		return emptyAddr, &Header{}, emptyKeys,
+			fmt.Errorf("Cipher suite %v is not supported by relay", header.Suite)
+	}
+	suite := key.Suite
+
+	// first verify if group element is part of the expected group. this is very
+	// important to avoid ECC twist security attacks
+	gElement := header.GroupElement
+	err := suite.Group().Validate(gElement)
 	if err != nil {
-		return emptyAddr, &Packet{}, err
+		return emptyAddr, &Header{}, emptyKeys,
+			fmt.Errorf("Potential ECC attack! Group element is not valid: %v", err)
 	}
 
-	// blind next group element
-	var blindingF scrypto.Hash256
-	blindingF = scrypto.ComputeBlindingFactor(&header.GroupElement, sKey)
-	newGroupElement := blindGroupElement(&header.GroupElement, blindingF[:], curve)
+	scalar, kemKey, err := scrypto.SplitPrivateKey(suite, key.PrivKey)
+	if err != nil {
+		return emptyAddr, &Header{}, emptyKeys, err
+	}
 
-	// prepares next header and packet
-	var nextHeader Header
-	nextHeader.GroupElement = *newGroupElement
-	nextHeader.RoutingInfo = nextRoutingInfo
-	nextHeader.RoutingInfoMac = nextHmac
+	sKey, err := scrypto.SharedSecret(suite, scalar, gElement)
+	if err != nil {
+		return emptyAddr, &Header{}, emptyKeys, err
+	}
 
-	next.Version = packet.Version
-	next.Header = &nextHeader
-	next.Payload = decryptedPayload
+	defer sKey.Wipe()
 
-	return nextAddr, &next, nil
+	// in hybrid suites, the hop keys are derived from the hybrid secret
+	hopSecret := sKey
+	var nextKEMInfo []byte
+	if suite.KEM() != nil {
+		if err := ctx.Err(); err != nil {
+			return emptyAddr, &Header{}, emptyKeys, err
+		}
+		var ct []byte
+		ct, nextKEMInfo, err = processKEMInfo(suite, sKey, header.KEMInfo)
+		if err != nil {
+			return emptyAddr, &Header{}, emptyKeys, err
+		}
+		shared, err := suite.KEM().Decapsulate(kemKey, ct)
+		if err != nil {
+			return emptyAddr, &Header{}, emptyKeys, err
+		}
+		hopSecret = scrypto.HybridSecret(suite, sKey, shared, ct)
+		scrypto.Wipe(shared)
+		defer hopSecret.Wipe()
+	}
+
+	if err := ctx.Err(); err != nil {
+		return emptyAddr, &Header{}, emptyKeys, err
+	}
+	keys := scrypto.DeriveHopKeys(suite, hopSecret)
+
+	// process header. the header MAC is verified before the replay tag is
+	// recorded, so that forged headers do not fill the replay cache
+	nextAddr, nextHmac, nextRoutingInfo, err := processHeader(suite, header, keys)
+	if err != nil {
+		keys.Wipe()
+		return emptyAddr, &Header{}, emptyKeys, err
+	}
+
+	// checks if packet has been processed based on the replay tag derived from
+	// the secret key
+	tag := keys.ReplayTag
+	if _, ok := r.processedTags[tag]; ok {
+		keys.Wipe()
+		return emptyAddr, &Header{}, emptyKeys,
+			fmt.Errorf("Packet already processed, discarding. (tag: %x)", tag)
+	}
+
+	// blind next group element
+	blindingF := scrypto.BlindingFactor(suite, gElement, sKey)
+	defer blindingF.Wipe()
+	newGroupElement, err := blindGroupElement(suite, gElement, blindingF[:])
+	if err != nil {
+		keys.Wipe()
+		return emptyAddr, &Header{}, emptyKeys, err
+	}
+	r.processedTags[tag] = struct{}{}
+
+	// prepares next header
+	return nextAddr, &Header{
+		Suite:          header.Suite,
+		GroupElement:   newGroupElement,
+		RoutingInfo:    nextRoutingInfo,
+		RoutingInfoMac: nextHmac,
+		KEMInfo:        nextKEMInfo,
+	}, keys, nil
 }
 
-func processHeader(header *Header, sessionKey *ecdsa.PrivateKey, sKey scrypto.Hash256) ([addrSize]byte, [hmacSize]byte, [routingInfoSize]byte, error) {
+func processHeader(suite scrypto.CipherSuite, header *Header, keys scrypto.HopKeys) ([addrSize]byte, [hmacSize]byte, [routingInfoSize]byte, error) {
 
 	var nextHmac [hmacSize]byte
 	var nextAddr [addrSize]byte
 	var nextRoutingInfo [routingInfoSize]byte
 	routingInfo := header.RoutingInfo
 
-	// generate keys
-	encKey := generateEncryptionKey(sKey[:], encryptionKey)
-	macKey := generateEncryptionKey(sKey[:], hashKey)
-
 	// check hmac
 	var routingInfoMac [hmacSize]byte
-	var hKey scrypto.Hash256
-	copy(hKey[:], macKey)
-	copy(routingInfoMac[:], scrypto.ComputeMAC(hKey, routingInfo[:]))
+	copy(routingInfoMac[:], suite.MAC().Sum(keys.HeaderMAC,
+		macInput(routingInfo[:], header.KEMInfo)))
 
-	if equal(routingInfoMac[:], header.RoutingInfoMac[:]) == false {
+	if !hmac.Equal(routingInfoMac[:], header.RoutingInfoMac[:]) {
 		return [addrSize]byte{}, [hmacSize]byte{}, [routingInfoSize]byte{},
 			fmt.Errorf("HeaderMAC is not valid: \n %v\n %v\n",
 				header.RoutingInfoMac, routingInfoMac)
@@ -113,7 +265,7 @@ func processHeader(header *Header, sessionKey *ecdsa.PrivateKey, sKey scrypto.Ha
 	paddedRi := append(routingInfo[:], padding...)
 
 	// decrypts header payload using the derived shared key
-	cipher, err := scrypto.GenerateCipherStream(encKey, defaultNonce(), streamSize)
+	cipher, err := suite.Stream().KeyStream(keys.HeaderStream, keys.HeaderNonce, streamSize)
 	if err != nil {
 		return [addrSize]byte{}, [hmacSize]byte{}, [routingInfoSize]byte{}, err
 	}
@@ -132,38 +284,15 @@ func processHeader(header *Header, sessionKey *ecdsa.PrivateKey, sKey scrypto.Ha
 	return nextAddr, nextHmac, nextRoutingInfo, nil
 }
 
-func decryptPayload(p [payloadSize]byte, ss scrypto.Hash256) ([payloadSize]byte, error) {
+// removes one layer of encryption from the payload. since the payload is
+// encrypted with a SPRP, any modification of the payload by a previous hop
+// results in garbage at the destination
+func decryptPayload(suite scrypto.CipherSuite, p [payloadSize]byte, key []byte) ([payloadSize]byte, error) {
 	var resP [payloadSize]byte
-	nonce := defaultNonce()
-	cipher, err := scrypto.GenerateCipherStream(ss[:], nonce, payloadSize)
+	decrP, err := suite.SPRP().Decrypt(key, p[:])
 	if err != nil {
 		return [payloadSize]byte{}, err
 	}
-
-	decrP, _ := xor(p[:], cipher)
 	copy(resP[:], decrP[:])
 	return resP, nil
 }
-
-func contains(s [][32]byte, e [32]byte) bool {
-	for _, a := range s {
-		if a == e {
-			return true
-		}
-	}
-	return false
-}
-
-func equal(a, b []byte) bool {
-	if len(a) != len(b) {
-		return false
-	}
-
-	for i, ai := range a {
-		if ai != b[i] {
-			return false
-		}
-	}
-
-	return true
-}
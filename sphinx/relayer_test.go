@@ -1,7 +1,126 @@
 package sphinx
 
 import (
+	"context"
+	"crypto/ecdsa"
+	ec "crypto/elliptic"
+	"crypto/rand"
+	scrypto "github.com/hashmatter/p3lib/sphinx/crypto"
 	"testing"
 )
 
 func TestNewRelayerCtx(t *testing.T) {}
+
+func TestRelayerCtxWipe(t *testing.T) {
+	pub, priv := generateHopKeys()
+	privSender, _ := ecdsa.GenerateKey(ec.P256(), rand.Reader)
+	packet, err := NewPacket(privSender, []ecdsa.PublicKey{*pub}, []byte("dest"),
+		[][]byte{[]byte("relay0")}, [payloadSize]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRelayerCtx(priv)
+	key := r.keys[scrypto.SuiteP256SHA256ChaCha20].PrivKey
+	r.Wipe()
+	for _, b := range key {
+		if b != 0 {
+			t.Fatal("Relay private key was not wiped")
+		}
+	}
+
+	if _, _, err := r.ProcessPacket(packet); err == nil {
+		t.Error("Wiped relayer context should not process packets")
+	}
+}
+
+func TestProcessPacketContext(t *testing.T) {
+	pub, priv := generateHopKeys()
+	privSender, _ := ecdsa.GenerateKey(ec.P256(), rand.Reader)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := NewPacketContext(ctx, privSender, []ecdsa.PublicKey{*pub}, []byte("dest"),
+		[][]byte{[]byte("relay0")}, [payloadSize]byte{})
+	if err != context.Canceled {
+		t.Errorf("Packet construction should be cancelled, got %v", err)
+	}
+
+	packet, err := NewPacket(privSender, []ecdsa.PublicKey{*pub}, []byte("dest"),
+		[][]byte{[]byte("relay0")}, [payloadSize]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRelayerCtx(priv)
+	if _, _, err := r.ProcessPacketContext(ctx, packet); err != context.Canceled {
+		t.Errorf("Packet processing should be cancelled, got %v", err)
+	}
+	if _, _, _, err := r.ProcessHeaderContext(ctx, packet.Header); err != context.Canceled {
+		t.Errorf("Header processing should be cancelled, got %v", err)
+	}
+
+	// cancelled packets are not recorded as processed
+	if _, _, err := r.ProcessPacket(packet); err != nil {
+		t.Errorf("Packet should be processed after a cancelled attempt: %v", err)
+	}
+}
+
+func TestReplayCache(t *testing.T) {
+	pub, priv := generateHopKeys()
+	privSender, _ := ecdsa.GenerateKey(ec.P256(), rand.Reader)
+	packet, err := NewPacket(privSender, []ecdsa.PublicKey{*pub}, []byte("dest"),
+		[][]byte{[]byte("relay0")}, [payloadSize]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// headers with an invalid MAC are not recorded as processed
+	forged := *packet.Header
+	forged.RoutingInfoMac[0] ^= 1
+	r := NewRelayerCtx(priv)
+	if _, _, err := r.ProcessPacket(&Packet{Header: &forged, Payload: packet.Payload}); err == nil {
+		t.Fatal("Packet with an invalid MAC should not be processed")
+	}
+	if len(r.ListProcessedPackets()) != 0 {
+		t.Error("Forged header should not be recorded as processed")
+	}
+
+	if _, _, err := r.ProcessPacket(packet); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.ListProcessedPackets()) != 1 {
+		t.Errorf("Expected 1 processed packet, got %v", len(r.ListProcessedPackets()))
+	}
+	if _, _, err := r.ProcessPacket(packet); err == nil {
+		t.Error("Replayed packet should not be processed")
+	}
+}
+
+func TestObserver(t *testing.T) {
+	pub, priv := generateHopKeys()
+	privSender, _ := ecdsa.GenerateKey(ec.P256(), rand.Reader)
+	packet, err := NewPacket(privSender, []ecdsa.PublicKey{*pub}, []byte("dest"),
+		[][]byte{[]byte("relay0")}, [payloadSize]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var observed int
+	r := NewRelayerCtx(priv)
+	r.SetObserver(func(in *Packet, next [AddrSize]byte, out *Packet) {
+		observed++
+		if in != packet || string(next[:4]) != "dest" || !out.IsLast() {
+			t.Errorf("Unexpected observation: %v -> %q", in, next)
+		}
+	})
+
+	if _, _, err := r.ProcessPacket(packet); err != nil {
+		t.Fatal(err)
+	}
+	// packets which are not processed are not observed
+	r.ProcessPacket(packet)
+	if observed != 1 {
+		t.Errorf("Expected 1 observation, got %v", observed)
+	}
+}
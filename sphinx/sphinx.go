@@ -2,13 +2,12 @@ package sphinx
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
-	ec "crypto/elliptic"
 	"encoding/gob"
 	"errors"
 	"fmt"
 	scrypto "github.com/hashmatter/p3lib/sphinx/crypto"
-	"math/big"
 )
 
 const (
@@ -45,15 +44,13 @@ const (
 	// mnust be padded with x0 up to REAL_SIZE
 	realmSize = 1
 	defRealm  = byte(1)
+)
 
-	// key used to generate cipher stream used to obfuscate the header and
-	// payload
-	encryptionKey = "encryption"
+// PayloadSize is the size in bytes of the payload carried by every packet
+const PayloadSize = payloadSize
 
-	// key used to generate cipher stream to calculate hash signature of header
-	// and payload
-	hashKey = "hash"
-)
+// AddrSize is the size in bytes of the addresses of relays and destinations
+const AddrSize = addrSize
 
 type Packet struct {
 	Version byte
@@ -68,36 +65,61 @@ type Packet struct {
 // information (address and payload) and relay information (public keys and
 // addresses) and constructs a cryptographically secure onion packet. The packet
 // is then encoded and sent over the wire to the first relay. This is the entry
-// point function for an initiator to construct a onion circuit.
+// point function for an initiator to construct a onion circuit. The packet is
+// constructed with the default cipher suite (P-256, SHA-256 and ChaCha20).
+// The options configure the construction of the header (e.g. WithDummyHops).
+// The session key is owned by the caller, which should wipe it with
+// scrypto.WipeECDSAKey once it is not needed.
 func NewPacket(sessionKey *ecdsa.PrivateKey, circuitPubKeys []ecdsa.PublicKey,
-	finalAddr []byte, relayAddrs [][]byte, payload [payloadSize]byte) (*Packet, error) {
+	finalAddr []byte, relayAddrs [][]byte, payload [payloadSize]byte,
+	opts ...HeaderOption) (*Packet, error) {
 
-	if len(circuitPubKeys) == 0 {
-		return &Packet{}, errors.New("Err: A set of relay pulic keys must be provided")
-	}
+	return NewPacketContext(context.Background(), sessionKey, circuitPubKeys,
+		finalAddr, relayAddrs, payload, opts...)
+}
 
-	// first, verify if ALL relay group elements are part of the expected curve.
-	// this is very important tp avoid ECC twist security attacks
-	curve := ec.P256()
-	for i, ge := range circuitPubKeys {
-		isOnCurve := curve.Params().IsOnCurve(ge.X, ge.Y)
-		if isOnCurve == false {
-			return &Packet{},
-				fmt.Errorf("Potential ECC attack! Group element of relay [%v] is not on the expected curve:", i)
-		}
-	}
+// NewPacketContext is like NewPacket, but stops constructing the packet and
+// returns the context error once the context is done
+func NewPacketContext(ctx context.Context, sessionKey *ecdsa.PrivateKey,
+	circuitPubKeys []ecdsa.PublicKey, finalAddr []byte, relayAddrs [][]byte,
+	payload [payloadSize]byte, opts ...HeaderOption) (*Packet, error) {
 
-	sharedSecrets, err := generateSharedSecrets(circuitPubKeys, *sessionKey)
-	if err != nil {
-		return &Packet{}, fmt.Errorf("Shared secrets generation: %v", err)
-	}
+	sk := scrypto.P256PrivateKey(sessionKey)
+	defer scrypto.Wipe(sk)
+
+	return NewPacketWithSuiteContext(ctx, scrypto.DefaultSuite, sk,
+		p256PublicKeys(circuitPubKeys), finalAddr, relayAddrs, payload, opts...)
+}
+
+// NewPacketWithSuite creates a new packet using the given cipher suite. The
+// session key is a scalar and the relay public keys are group elements, both
+// encoded as defined by the suite's group. In hybrid suites, the relay public
+// keys are the group element followed by the KEM public key (see
+// scrypto.GenerateKey). The shared secrets derived while
+// constructing the packet are wiped before returning; the session key is owned
+// by the caller and should be wiped with scrypto.Wipe once it is not needed.
+func NewPacketWithSuite(suite scrypto.CipherSuite, sessionKey []byte,
+	circuitPubKeys [][]byte, finalAddr []byte, relayAddrs [][]byte,
+	payload [payloadSize]byte, opts ...HeaderOption) (*Packet, error) {
+
+	return NewPacketWithSuiteContext(context.Background(), suite, sessionKey,
+		circuitPubKeys, finalAddr, relayAddrs, payload, opts...)
+}
+
+// NewPacketWithSuiteContext is like NewPacketWithSuite, but stops constructing
+// the packet and returns the context error once the context is done
+func NewPacketWithSuiteContext(ctx context.Context, suite scrypto.CipherSuite,
+	sessionKey []byte, circuitPubKeys [][]byte, finalAddr []byte, relayAddrs [][]byte,
+	payload [payloadSize]byte, opts ...HeaderOption) (*Packet, error) {
 
-	header, err := constructHeader(sessionKey, finalAddr, relayAddrs, sharedSecrets)
+	header, sharedSecrets, err := newHeader(ctx, suite, sessionKey, circuitPubKeys,
+		finalAddr, relayAddrs, opts)
 	if err != nil {
 		return &Packet{}, err
 	}
+	defer scrypto.WipeHashes(sharedSecrets)
 
-	encPayload, err := encryptPayload(payload, sharedSecrets)
+	encPayload, err := encryptPayload(suite, payload, sharedSecrets)
 	if err != nil {
 		return &Packet{}, fmt.Errorf("Encrypting payload: %v", err)
 	}
@@ -109,11 +131,97 @@ func NewPacket(sessionKey *ecdsa.PrivateKey, circuitPubKeys []ecdsa.PublicKey,
 	}, nil
 }
 
+// constructs a header and returns it with the hop shared secrets used to
+// encrypt the payload. in hybrid suites the shared secrets are the hybrid
+// secrets
+func newHeader(ctx context.Context, suite scrypto.CipherSuite, sessionKey []byte,
+	circuitPubKeys [][]byte, finalAddr []byte, relayAddrs [][]byte,
+	opts []HeaderOption) (*Header, []scrypto.Hash256, error) {
+
+	if err := ctx.Err(); err != nil {
+		return &Header{}, nil, err
+	}
+
+	if len(circuitPubKeys) == 0 {
+		return &Header{}, nil, errors.New("Err: A set of relay pulic keys must be provided")
+	}
+
+	elements := make([][]byte, len(circuitPubKeys))
+	kemPubKeys := make([][]byte, len(circuitPubKeys))
+	for i, pub := range circuitPubKeys {
+		el, kemPub, err := scrypto.SplitPublicKey(suite, pub)
+		if err != nil {
+			return &Header{}, nil, fmt.Errorf("Public key of relay [%v]: %v", i, err)
+		}
+		elements[i] = el
+		kemPubKeys[i] = kemPub
+	}
+
+	// first, verify if ALL relay group elements are valid elements of the
+	// suite's group. this is very important tp avoid ECC twist security attacks
+	for i, ge := range elements {
+		err := suite.Group().Validate(ge)
+		if err != nil {
+			return &Header{}, nil,
+				fmt.Errorf("Potential ECC attack! Group element of relay [%v] is not valid: %v", i, err)
+		}
+	}
+
+	// dummy hops are appended to the circuit to hide its length (see path.go)
+	numDummies, err := newHeaderOptions(opts).numDummies(len(circuitPubKeys))
+	if err != nil {
+		return &Header{}, nil, err
+	}
+	dummies, err := dummySecrets(numDummies)
+	if err != nil {
+		return &Header{}, nil, err
+	}
+	defer scrypto.WipeHashes(dummies)
+
+	sharedSecrets, err := generateSharedSecrets(ctx, suite, elements, sessionKey)
+	if err != nil {
+		if ctx.Err() != nil {
+			return &Header{}, nil, ctx.Err()
+		}
+		return &Header{}, nil, fmt.Errorf("Shared secrets generation: %v", err)
+	}
+
+	var kemLayers [][]byte
+	if suite.KEM() != nil {
+		hybrid, layers, err := generateHybridSecrets(ctx, suite, sharedSecrets,
+			kemPubKeys, dummies)
+		scrypto.WipeHashes(sharedSecrets)
+		if err != nil {
+			return &Header{}, nil, err
+		}
+		sharedSecrets, kemLayers = hybrid, layers
+	}
+
+	// the routing data of dummy hops is never read, so their addresses are
+	// left empty
+	headerSecrets := append(append([]scrypto.Hash256{}, sharedSecrets...), dummies...)
+	defer scrypto.WipeHashes(headerSecrets)
+	addrs := append(append([][]byte{}, relayAddrs...), make([][]byte, numDummies)...)
+
+	header, err := constructHeader(suite, sessionKey, finalAddr, addrs,
+		headerSecrets, kemLayers, len(sharedSecrets)-1)
+	if err != nil {
+		scrypto.WipeHashes(sharedSecrets)
+		return &Header{}, nil, err
+	}
+	return header, sharedSecrets, nil
+}
+
 // checks if packet is last in the path. this is verified by inspecting the
 // hash of the routing information of the packet's header. if the hash is all
 // zeroes, then the current relayer is an exit relay.
 func (p *Packet) IsLast() bool {
-	hmac := p.Header.RoutingInfoMac
+	return p.Header.IsLast()
+}
+
+// checks if the header is last in the path (see Packet.IsLast)
+func (h *Header) IsLast() bool {
+	hmac := h.RoutingInfoMac
 	for _, b := range hmac {
 		if b != 0 {
 			return false
@@ -134,12 +242,16 @@ func (p *Packet) GobEncode() ([]byte, error) {
 	buf := &bytes.Buffer{}
 	enc := gob.NewEncoder(buf)
 
+	if p.Header == nil {
+		return []byte{}, errors.New("Err encoding packet: header is empty")
+	}
+
 	he, err := p.Header.GobEncode()
 	if err != nil {
 		return []byte{}, err
 	}
 
-	err = enc.Encode(P{H: he, P: p.Payload})
+	err = enc.Encode(P{V: p.Version, H: he, P: p.Payload})
 	if err != nil {
 		return []byte{}, err
 	}
@@ -156,7 +268,10 @@ func (p *Packet) GobDecode(raw []byte) error {
 	}
 
 	var header Header
-	header.GobDecode(pbuf.H)
+	err = header.GobDecode(pbuf.H)
+	if err != nil {
+		return err
+	}
 
 	var payload [payloadSize]byte
 	copy(payload[:], pbuf.P[:])
@@ -168,43 +283,66 @@ func (p *Packet) GobDecode(raw []byte) error {
 }
 
 // encrypts packet payload in multiple layers using the shared secrets derived
-//from the relayers' public keys. the payload will be "peeled" as the packet
+// from the relayers' public keys. the payload will be "peeled" as the packet
 // traversed the circuit
-func encryptPayload(payload [payloadSize]byte,
+func encryptPayload(suite scrypto.CipherSuite, payload [payloadSize]byte,
 	sharedKeys []scrypto.Hash256) ([payloadSize]byte, error) {
 
 	numRelayers := len(sharedKeys)
-	nonce := defaultNonce()
 
 	for i := numRelayers - 1; i >= 0; i-- {
-		cipher, err := scrypto.GenerateCipherStream(sharedKeys[i][:], nonce, payloadSize)
+		keys := scrypto.DeriveHopKeys(suite, sharedKeys[i])
+		p, err := suite.SPRP().Encrypt(keys.Payload, payload[:])
+		keys.Wipe()
 		if err != nil {
 			return [payloadSize]byte{}, err
 		}
-		p, _ := xor(payload[:], cipher[:])
 		copy(payload[:], p[:])
 	}
 	return payload, nil
 }
 
 type Header struct {
-	GroupElement   ecdsa.PublicKey
+	// cipher suite used to construct the packet
+	Suite scrypto.SuiteID
+
+	// blinded group element, encoded as defined by the suite's group
+	GroupElement []byte
+
 	RoutingInfo    [routingInfoSize]byte
 	RoutingInfoMac [hmacSize]byte
+
+	// KEM ciphertexts of hybrid suites, empty otherwise (see hybrid.go)
+	KEMInfo []byte
+}
+
+// returns the data authenticated by the header MAC
+func macInput(routingInfo []byte, kemInfo []byte) []byte {
+	if len(kemInfo) == 0 {
+		return routingInfo
+	}
+	return append(append([]byte{}, routingInfo...), kemInfo...)
 }
 
-func constructHeader(sessionKey *ecdsa.PrivateKey, ad []byte,
-	circuitAddrs [][]byte, sharedSecrets []scrypto.Hash256) (*Header, error) {
+// constructs the header of a circuit. the exit relay is the hop at the exit
+// position, and the hops after it are dummy hops
+func constructHeader(suite scrypto.CipherSuite, sessionKey []byte, ad []byte,
+	circuitAddrs [][]byte, sharedSecrets []scrypto.Hash256,
+	kemLayers [][]byte, exit int) (*Header, error) {
 
 	numRelays := len(circuitAddrs)
-	defNonce := defaultNonce()
 
 	validationErrs := validateHeaderInput(numRelays, ad[:])
 	if len(validationErrs) != 0 {
 		return &Header{}, fmt.Errorf("Header validation errors %v", validationErrs)
 	}
 
-	padding, err := generatePadding(sharedSecrets, defNonce)
+	padding, err := generatePadding(suite, sharedSecrets)
+	if err != nil {
+		return &Header{}, fmt.Errorf("Header construction: %v", err)
+	}
+
+	groupElement, err := suite.Group().ScalarBaseMult(sessionKey)
 	if err != nil {
 		return &Header{}, fmt.Errorf("Header construction: %v", err)
 	}
@@ -220,9 +358,16 @@ func constructHeader(sessionKey *ecdsa.PrivateKey, ad []byte,
 	copy(addr[:], ad[:])
 
 	for i := numRelays - 1; i >= 0; i-- {
+		// the exit relay gets the destination address and an empty MAC
+		if i == exit {
+			addr = [addrSize]byte{}
+			copy(addr[:], ad[:])
+			hmac = [hmacSize]byte{}
+		}
+
 		// generate keys for obfuscate routing info and for generate header HMAC
-		encKey := generateEncryptionKey(sharedSecrets[i][:], encryptionKey)
-		macKey := generateEncryptionKey(sharedSecrets[i][:], hashKey)
+		keys := scrypto.DeriveHopKeys(suite, sharedSecrets[i])
+		defer keys.Wipe()
 
 		// first iteration does not need shift right
 		if i != numRelays-1 {
@@ -237,7 +382,7 @@ func constructHeader(sessionKey *ecdsa.PrivateKey, ad []byte,
 		// add addrHmac to beginning of current routingInfo
 		copy(routingInfo[:], addrHmac[:])
 
-		cipher, err := scrypto.GenerateCipherStream(encKey, defNonce, streamSize)
+		cipher, err := suite.Stream().KeyStream(keys.HeaderStream, keys.HeaderNonce, streamSize)
 		if err != nil {
 			return &Header{}, err
 		}
@@ -253,15 +398,28 @@ func constructHeader(sessionKey *ecdsa.PrivateKey, ad []byte,
 		}
 
 		// calculate next hmac
-		var hKey scrypto.Hash256
-		copy(hKey[:], macKey)
-		copy(hmac[:], scrypto.ComputeMAC(hKey, routingInfo[:]))
+		var kemInfo []byte
+		if kemLayers != nil {
+			kemInfo = kemLayers[i]
+		}
+		copy(hmac[:], suite.MAC().Sum(keys.HeaderMAC, macInput(routingInfo[:], kemInfo)))
 
-		// set next address
+		// set next address. addresses may have different lengths, so the
+		// previous address must be cleared first
+		addr = [addrSize]byte{}
 		copy(addr[:], circuitAddrs[i][:])
 	}
 
-	return &Header{sessionKey.PublicKey, routingInfo, hmac}, nil
+	header := &Header{
+		Suite:          suite.ID(),
+		GroupElement:   groupElement,
+		RoutingInfo:    routingInfo,
+		RoutingInfoMac: hmac,
+	}
+	if kemLayers != nil {
+		header.KEMInfo = kemLayers[0]
+	}
+	return header, nil
 }
 
 func validateHeaderInput(numRelays int, addr []byte) []error {
@@ -280,18 +438,19 @@ func validateHeaderInput(numRelays int, addr []byte) []error {
 }
 
 type H struct {
+	S   scrypto.SuiteID
 	Ge  []byte
 	Ri  [routingInfoSize]byte
 	Rim [hmacSize]byte
+	Ki  []byte
 }
 
 func (h *Header) GobEncode() ([]byte, error) {
 	buf := &bytes.Buffer{}
 	enc := gob.NewEncoder(buf)
 
-	pk := h.GroupElement
-	element := ec.Marshal(pk.Curve, pk.X, pk.Y)
-	err := enc.Encode(H{Ge: element, Ri: h.RoutingInfo, Rim: h.RoutingInfoMac})
+	err := enc.Encode(H{S: h.Suite, Ge: h.GroupElement, Ri: h.RoutingInfo,
+		Rim: h.RoutingInfoMac, Ki: h.KEMInfo})
 	if err != nil {
 		return nil, fmt.Errorf("Err encoding header: %s", err)
 	}
@@ -308,21 +467,31 @@ func (h *Header) GobDecode(raw []byte) error {
 		return fmt.Errorf("Err decoding header: %s", err)
 	}
 
-	curve := ec.P256()
-	x, y := ec.Unmarshal(curve, hb.Ge)
+	suite, err := scrypto.SuiteByID(hb.S)
+	if err != nil {
+		return fmt.Errorf("Err decoding header: %s", err)
+	}
 
-	if x == big.NewInt(0) {
-		return fmt.Errorf("Err decoding header: group element not using %s curve.", curve.Params().Name)
+	err = suite.Group().Validate(hb.Ge)
+	if err != nil {
+		return fmt.Errorf("Err decoding header: %s (suite %s)", err, suite.Name())
+	}
+
+	if len(hb.Ki) != KEMInfoSize(suite) {
+		return fmt.Errorf("Err decoding header: KEMInfo must have %v bytes, got %v",
+			KEMInfoSize(suite), len(hb.Ki))
 	}
-	pubKey := ecdsa.PublicKey{Curve: curve, X: x, Y: y}
 
-	h.GroupElement = pubKey
+	h.Suite = hb.S
+	h.GroupElement = hb.Ge
 	h.RoutingInfo = hb.Ri
 	h.RoutingInfoMac = hb.Rim
+	h.KEMInfo = hb.Ki
 	return nil
 }
 
-func generatePadding(keys []scrypto.Hash256, nonce []byte) ([]byte, error) {
+func generatePadding(suite scrypto.CipherSuite, keys []scrypto.Hash256) ([]byte, error) {
+
 	numRelays := len(keys)
 	if numRelays > numMaxRelays {
 		return []byte{}, fmt.Errorf("Maximum number of relays is %v, got %v",
@@ -333,8 +502,10 @@ func generatePadding(keys []scrypto.Hash256, nonce []byte) ([]byte, error) {
 		filler := make([]byte, relayDataSize)
 		padding = append(padding, filler...)
 
-		key := generateEncryptionKey(keys[i-1][:], encryptionKey)
-		cipher, err := scrypto.GenerateCipherStream(key, nonce, streamSize)
+		hopKeys := scrypto.DeriveHopKeys(suite, keys[i-1])
+		cipher, err := suite.Stream().KeyStream(hopKeys.HeaderStream,
+			hopKeys.HeaderNonce, streamSize)
+		hopKeys.Wipe()
 		if err != nil {
 			return []byte{}, err
 		}
@@ -353,11 +524,12 @@ func (h *Header) Mac(key scrypto.Hash256) []byte {
 	return buf.Bytes()
 }
 
-// generates all shared secrets for a given path.
-func generateSharedSecrets(circuitPubKeys []ecdsa.PublicKey,
-	sessionKey ecdsa.PrivateKey) ([]scrypto.Hash256, error) {
+// generates all shared secrets for a given path. stops once the context is
+// done
+func generateSharedSecrets(ctx context.Context, suite scrypto.CipherSuite,
+	circuitPubKeys [][]byte, sessionKey []byte) ([]scrypto.Hash256, error) {
 
-	curve := scrypto.GetCurve(sessionKey)
+	group := suite.Group()
 	numHops := len(circuitPubKeys)
 	if numHops == 0 {
 		return []scrypto.Hash256{}, errors.New("Err: A set of relay pulic keys must be provided")
@@ -366,79 +538,74 @@ func generateSharedSecrets(circuitPubKeys []ecdsa.PublicKey,
 
 	// first group element, which is an ephemeral public key of the sender. The
 	// group element is blinded at each hop
-	groupElement := sessionKey.Public().(*ecdsa.PublicKey)
-
-	// derives shared secret for first hop using ECDH with the local session key
-	// and the hop's public key
-	firstHopPubKey := circuitPubKeys[0]
-	sharedSecret := scrypto.GenerateECDHSharedSecret(&firstHopPubKey, &sessionKey)
-	sharedSecrets[0] = sharedSecret
-
-	// compute blinding factor for first hop, by hashing the ephemeral pubkey of
-	// the sender and the derived shared secret with the hop
-	var blindingF scrypto.Hash256
-	blindingF = scrypto.ComputeBlindingFactor(groupElement, sharedSecret)
-
-	// used to derive next group element
-	var privElement big.Int
-	privElement.SetBytes(sessionKey.D.Bytes())
-
-	// recursively calculates group element, shared secret and blinding factor for
-	// each of the remaining hops
-	for i := 1; i < numHops; i++ {
-		// derives new group element pair. private part of the element is derived
-		// with the scalar_multiplication between the blinding factor and the
-		// private scalar of the previous group element
-		newGroupElement, nextPrivElement := deriveGroupElementPair(privElement, blindingF, curve)
-
-		// computes shared secret
-		currentHopPubKey := circuitPubKeys[i]
-		blindedPrivateKey := ecdsa.PrivateKey{
-			PublicKey: *newGroupElement,
-			D:         &nextPrivElement,
+	groupElement, err := group.ScalarBaseMult(sessionKey)
+	if err != nil {
+		return []scrypto.Hash256{}, err
+	}
+
+	// blinding factors of all previous hops. the shared secrets generated so
+	// far are wiped as well if the generation fails
+	var blindingFactors []scrypto.Hash256
+	done := false
+	defer func() {
+		scrypto.WipeHashes(blindingFactors)
+		if !done {
+			scrypto.WipeHashes(sharedSecrets)
+		}
+	}()
+
+	for i := 0; i < numHops; i++ {
+		if err := ctx.Err(); err != nil {
+			return []scrypto.Hash256{}, err
 		}
-		sharedSecret = scrypto.GenerateECDHSharedSecret(&currentHopPubKey, &blindedPrivateKey)
 
+		// derives the element shared with the hop using the local session key
+		// and the hop's public key. the element is then blinded with the
+		// blinding factors of all previous hops, which is the same as the hop
+		// multiplying its private key by the blinded group element it receives
+		sharedElement, err := group.ScalarMult(sessionKey, circuitPubKeys[i])
+		if err != nil {
+			return []scrypto.Hash256{}, err
+		}
+		for _, b := range blindingFactors {
+			blinded, err := group.ScalarMult(b[:], sharedElement)
+			scrypto.Wipe(sharedElement)
+			if err != nil {
+				return []scrypto.Hash256{}, err
+			}
+			sharedElement = blinded
+		}
+		sharedSecret := suite.KDF().Hash(group.SharedBytes(sharedElement))
+		scrypto.Wipe(sharedElement)
 		sharedSecrets[i] = sharedSecret
 
-		// computes next blinding factor
-		blindingF = scrypto.ComputeBlindingFactor(newGroupElement, sharedSecret)
+		// computes blinding factor for the hop by hashing the group element the
+		// hop receives and the shared secret, and blinds the group element for
+		// the next hop
+		blindingF := scrypto.BlindingFactor(suite, groupElement, sharedSecret)
+		blindingFactors = append(blindingFactors, blindingF)
 
-		// sets next private element
-		privElement = nextPrivElement
+		groupElement, err = group.ScalarMult(blindingF[:], groupElement)
+		if err != nil {
+			return []scrypto.Hash256{}, err
+		}
 	}
+	done = true
 	return sharedSecrets, nil
 }
 
-// blinds a group element given a blinding factor and returns both private and
-// public keys of the new element
-func deriveGroupElementPair(privElement big.Int, blindingF scrypto.Hash256, curve ec.Curve) (*ecdsa.PublicKey, big.Int) {
-	var pointBlindingF big.Int
-	pointBlindingF.SetBytes(blindingF[:])
-	privElement.Mul(&privElement, &pointBlindingF)
-	privElement.Mod(&privElement, curve.Params().N)
-
-	x, y := curve.Params().ScalarBaseMult(privElement.Bytes())
-	pubkey := ecdsa.PublicKey{Curve: curve, X: x, Y: y}
-
-	return &pubkey, privElement
-}
-
-// blinds a group element given a blinding factor but returns only the public
-// key. this is a special case of deriveGroupElementPair() which does not
-// compute the private key of the blinded element. because of that, this
-// function is more efficient and suitable for relays
-func blindGroupElement(el *ecdsa.PublicKey, blindingF []byte, curve ec.Curve) *ecdsa.PublicKey {
-	newX, newY := curve.Params().ScalarMult(el.X, el.Y, blindingF)
-	return &ecdsa.PublicKey{Curve: curve, X: newX, Y: newY}
+// blinds a group element given a blinding factor. this is used by relays to
+// compute the group element of the next hop
+func blindGroupElement(suite scrypto.CipherSuite, el []byte, blindingF []byte) ([]byte, error) {
+	return suite.Group().ScalarMult(blindingF, el)
 }
 
-func copyPublicKey(pk *ecdsa.PublicKey) *ecdsa.PublicKey {
-	newPk := ecdsa.PublicKey{}
-	newPk.Curve = pk.Curve
-	newPk.X = pk.X
-	newPk.Y = pk.Y
-	return &newPk
+func p256PublicKeys(pubKeys []ecdsa.PublicKey) [][]byte {
+	keys := make([][]byte, len(pubKeys))
+	for i := range pubKeys {
+		keys[i] = scrypto.P256PublicKey(&pubKeys[i])
+	}
+	return keys
 }
 
 func shiftRight(buf []byte, n int) []byte {
@@ -460,16 +627,3 @@ func xor(a, b []byte) ([]byte, int) {
 	}
 	return dst, n
 }
-
-// generates symmetric encryption/decryption keys used to generate the cipher
-// stream for xor'ing with plaintext.
-func generateEncryptionKey(k []byte, ktype string) []byte {
-	var key scrypto.Hash256
-	copy(key[:], k[:])
-	return scrypto.ComputeMAC(key, []byte(ktype))
-}
-
-func defaultNonce() []byte {
-	nonce := make([]byte, 24)
-	return nonce[:]
-}
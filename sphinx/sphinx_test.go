@@ -2,13 +2,13 @@ package sphinx
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	ec "crypto/elliptic"
 	"crypto/rand"
 	"encoding/gob"
 	"fmt"
 	scrypto "github.com/hashmatter/p3lib/sphinx/crypto"
-	"math/big"
 	"testing"
 )
 
@@ -219,10 +219,12 @@ func TestNewHeader(t *testing.T) {
 		circuitPubKeys[i] = *pub
 	}
 
-	sharedSecrets, err := generateSharedSecrets(circuitPubKeys, *privSender)
+	sharedSecrets, err := generateSharedSecrets(context.Background(), scrypto.DefaultSuite,
+		p256PublicKeys(circuitPubKeys), scrypto.P256PrivateKey(privSender))
 
 	header, err :=
-		constructHeader(privSender, finalAddr, relayAddrs, sharedSecrets)
+		constructHeader(scrypto.DefaultSuite, scrypto.P256PrivateKey(privSender),
+			finalAddr, relayAddrs, sharedSecrets, nil, len(relayAddrs)-1)
 	if err != nil {
 		t.Error(err)
 	}
@@ -247,7 +249,6 @@ func TestNewHeader(t *testing.T) {
 
 func TestGenSharedKeys(t *testing.T) {
 	// setup
-	curve := ec.P256()
 	numRelays := 3
 	circuitPubKeys := make([]ecdsa.PublicKey, numRelays)
 	circuitPrivKeys := make([]ecdsa.PrivateKey, numRelays)
@@ -262,7 +263,8 @@ func TestGenSharedKeys(t *testing.T) {
 	}
 
 	// generateSharedSecrets
-	sharedKeys, err := generateSharedSecrets(circuitPubKeys, *privSender)
+	sharedKeys, err := generateSharedSecrets(context.Background(), scrypto.DefaultSuite,
+		p256PublicKeys(circuitPubKeys), scrypto.P256PrivateKey(privSender))
 	if err != nil {
 		t.Error(err)
 	}
@@ -283,14 +285,21 @@ func TestGenSharedKeys(t *testing.T) {
 	}
 
 	// 2) first hop blinds group element for next hop
-	blindingF := scrypto.ComputeBlindingFactor(&pubSender, sk_1)
-	var privElement big.Int
-	privElement.SetBytes(privKey_1.D.Bytes())
-	newGroupElement := blindGroupElement(&pubSender, blindingF[:], curve)
+	senderElement := scrypto.P256PublicKey(&pubSender)
+	blindingF := scrypto.BlindingFactor(scrypto.DefaultSuite, senderElement, sk_1)
+	newGroupElement, err := blindGroupElement(scrypto.DefaultSuite,
+		senderElement, blindingF[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPub, err := scrypto.P256ParsePublicKey(newGroupElement)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	// 3) second hop derives shared key from blinded group element
 	privKey_2 := circuitPrivKeys[1]
-	sk_2 := scrypto.GenerateECDHSharedSecret(newGroupElement, &privKey_2)
+	sk_2 := scrypto.GenerateECDHSharedSecret(newPub, &privKey_2)
 	if sk_2 != sharedKeys[1] {
 		t.Error(fmt.Printf("Second shared key was not properly computed\n> %x\n> %x\n",
 			sk_2, sharedKeys[1]))
@@ -302,7 +311,11 @@ func TestEncodingDecodingHeader(t *testing.T) {
 	str := "dummy routing info"
 	ri := [routingInfoSize]byte{}
 	copy(ri[:], str[:])
-	header := &Header{RoutingInfo: ri, GroupElement: *pub}
+	header := &Header{
+		Suite:        scrypto.SuiteP256SHA256ChaCha20,
+		RoutingInfo:  ri,
+		GroupElement: scrypto.P256PublicKey(pub),
+	}
 
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
@@ -329,16 +342,42 @@ func TestEncodingDecodingHeader(t *testing.T) {
 	hGe := header.GroupElement
 	haGe := headerAfter.GroupElement
 
-	if hGe.Curve.Params().Name != haGe.Curve.Params().Name {
-		t.Error(fmt.Printf("Original and encoded/decoded group elements mismatch:\n >> %v \n >> %v\n",
-			hGe.Curve.Params().Name, haGe.Curve.Params().Name))
+	if header.Suite != headerAfter.Suite {
+		t.Error(fmt.Printf("Original and encoded/decoded cipher suites mismatch:\n >> %v \n >> %v\n",
+			header.Suite, headerAfter.Suite))
+	}
+
+	if !bytes.Equal(hGe, haGe) {
+		t.Error(fmt.Printf("Original and encoded/decoded group elements mismatch:\n >> %x \n >> %x\n",
+			hGe, haGe))
+	}
+}
+
+func TestDecodeInvalidGroupElement(t *testing.T) {
+	pub, _ := generateHopKeys()
+	element := scrypto.P256PublicKey(pub)
+	if len(element) != 33 {
+		t.Errorf("Header group element should be compressed (33 bytes), got %v",
+			len(element))
 	}
 
-	var diff big.Int
-	diff.Sub(hGe.X, haGe.X)
-	if diff.Cmp(big.NewInt(0)) != 0 {
-		t.Error(fmt.Printf("Original and encoded/decoded group elements mismatch:\n >> %v \n >> %v\n",
-			hGe.X, haGe.X))
+	// flips the last byte of x until the point is not on the curve
+	invalid := append([]byte{}, element...)
+	for scrypto.DefaultSuite.Group().Validate(invalid) == nil {
+		invalid[32]++
+	}
+
+	for _, el := range [][]byte{invalid, element[:32], {}} {
+		header := &Header{Suite: scrypto.SuiteP256SHA256ChaCha20, GroupElement: el}
+		raw, err := header.GobEncode()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var decoded Header
+		if err := decoded.GobDecode(raw); err == nil {
+			t.Errorf("Header with invalid group element should not decode: %x", el)
+		}
 	}
 }
 
@@ -356,13 +395,13 @@ func TestPaddingGeneration(t *testing.T) {
 	}
 
 	// generateSharedSecrets
-	sharedKeys, err := generateSharedSecrets(circuitPubKeys, *privSender)
+	sharedKeys, err := generateSharedSecrets(context.Background(), scrypto.DefaultSuite,
+		p256PublicKeys(circuitPubKeys), scrypto.P256PrivateKey(privSender))
 	if err != nil {
 		t.Error(err)
 	}
 
-	nonce := make([]byte, 24)
-	padding, err := generatePadding(sharedKeys, nonce)
+	padding, err := generatePadding(scrypto.DefaultSuite, sharedKeys)
 	if err != nil {
 		t.Error(err)
 	}
@@ -374,6 +413,104 @@ func TestPaddingGeneration(t *testing.T) {
 
 }
 
+// tests the construction and processing of an onion packet constructed with a
+// non-default cipher suite
+func TestEndToEndWithSuite(t *testing.T) {
+	suite := scrypto.X25519BLAKE2bAESCTR
+	numRelays := 3
+	finalAddr := []byte("/ip4/127.0.0.1/udp/1234")
+	relayAddrs := [][]byte{
+		[]byte("QmQV4LdB3jDKEZxB1EGoutUYyRSt8H8oW4B6DoBLB9z6b7"),
+		[]byte("/ip4/127.0.0.1/udp/1235"),
+		[]byte("/ip4/120.120.0.2/tcp/1222"),
+	}
+
+	circuitPrivKeys := make([][]byte, numRelays)
+	circuitPubKeys := make([][]byte, numRelays)
+	for i := 0; i < numRelays; i++ {
+		circuitPrivKeys[i], circuitPubKeys[i], _ = suite.Group().GenerateKey(rand.Reader)
+	}
+	sessionKey, _, _ := suite.Group().GenerateKey(rand.Reader)
+
+	var payload [payloadSize]byte
+	copy(payload[:], []byte("hello sphinx!"))
+
+	packet, err := NewPacketWithSuite(suite, sessionKey, circuitPubKeys,
+		finalAddr, relayAddrs, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// relays which do not support the suite must reject the packet
+	_, priv := generateHopKeys()
+	if _, _, err := NewRelayerCtx(priv).ProcessPacket(packet); err == nil {
+		t.Error("Packet with unsupported cipher suite should not be processed")
+	}
+
+	var nextAddr [addrSize]byte
+	for i := 0; i < numRelays; i++ {
+		r := NewRelayerCtxWithKeys(SuiteKey{Suite: suite, PrivKey: circuitPrivKeys[i]})
+		nextAddr, packet, err = r.ProcessPacket(packet)
+		if err != nil {
+			t.Fatalf("Err packet processing at hop %v: %v", i, err)
+		}
+	}
+
+	if string(nextAddr[:len(finalAddr)]) != string(finalAddr) {
+		t.Errorf("NextAddr (which is the last) is incorrect (%v != %v)",
+			nextAddr, finalAddr)
+	}
+	if !packet.IsLast() {
+		t.Error("Packet should be final")
+	}
+	if packet.Payload != payload {
+		t.Errorf("Payload was not successfully recovered by last relay")
+	}
+}
+
+// the payload is encrypted with a SPRP, so a relay tagging the payload must
+// result in a garbled payload at the destination
+func TestTaggedPayload(t *testing.T) {
+	numRelays := 2
+	finalAddr := []byte("/ip4/127.0.0.1/udp/1234")
+	relayAddrs := [][]byte{
+		[]byte("/ip4/127.0.0.1/udp/1235"),
+		[]byte("/ip4/127.0.0.1/udp/1236"),
+	}
+	circuitPrivKeys := make([]ecdsa.PrivateKey, numRelays)
+	circuitPubKeys := make([]ecdsa.PublicKey, numRelays)
+	for i := 0; i < numRelays; i++ {
+		pub, priv := generateHopKeys()
+		circuitPrivKeys[i] = *priv
+		circuitPubKeys[i] = *pub
+	}
+	privSender, _ := ecdsa.GenerateKey(ec.P256(), rand.Reader)
+
+	var payload [payloadSize]byte
+	copy(payload[:], []byte("hello sphinx!"))
+
+	packet, err := NewPacket(privSender, circuitPubKeys, finalAddr, relayAddrs, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// first relay flips one bit of the payload
+	_, packet, err = NewRelayerCtx(&circuitPrivKeys[0]).ProcessPacket(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet.Payload[0] ^= 1
+
+	_, packet, err = NewRelayerCtx(&circuitPrivKeys[1]).ProcessPacket(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(packet.Payload[1:13]) == string(payload[1:13]) {
+		t.Error("Tagged payload should not be recovered by last relay")
+	}
+}
+
 // helpers
 func generateHopKeys() (*ecdsa.PublicKey, *ecdsa.PrivateKey) {
 	privHop, _ := ecdsa.GenerateKey(ec.P256(), rand.Reader)
@@ -0,0 +1,859 @@
+// Package stream implements an anonymous, bidirectional and ordered byte
+// stream on top of sphinx packets. The initiator (client) reaches the
+// destination (e.g. a hidden service) through a sphinx circuit and the
+// destination replies using single use reply blocks (SURBs) provided by the
+// client, so that it never learns the client's address. A stream implements
+// net.Conn and can be used by any code written against that interface (e.g.
+// net/rpc clients).
+//
+// Frames are sealed end to end with keys derived from an ephemeral key of the
+// client and the key of the listener, so that the exit relay of the forward
+// circuit can neither read the stream (nor the SURBs sent through it) nor
+// inject frames in it. The ephemeral public key of the client identifies the
+// session.
+//
+// Packets may be dropped by the mixnet. Sequenced frames are retransmitted
+// until they are acknowledged, and a stream fails with ErrTimeout when the
+// other end does not acknowledge them within a deadline. Since the server can
+// only send frames while it holds SURBs, the client sends new SURBs when it
+// has not received replies for a while.
+package stream
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	ec "crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	sphinx "github.com/hashmatter/p3lib/sphinx"
+	scrypto "github.com/hashmatter/p3lib/sphinx/crypto"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// max number of data frames sent by the client which have not been
+	// acknowledged by the server
+	windowSize = 16
+
+	// number of SURBs the client hands over to the server when the stream is
+	// established. the server can only write when it holds SURBs
+	initialSURBs = 4
+
+	// max number of SURBs held by the server, and of outstanding SURB keys
+	// held by the client before it stops sending new SURBs
+	maxReplyKeys = 16
+
+	// time after which frames which have not been acknowledged are sent again
+	retransmitInterval = 500 * time.Millisecond
+
+	// max interval between the SURBs sent by a client which is waiting for
+	// replies which do not arrive
+	maxProbeInterval = 8 * retransmitInterval
+
+	// default time without acknowledgments after which a stream fails
+	defaultTimeout = 30 * time.Second
+)
+
+var (
+	ErrClosed  = errors.New("stream: use of closed connection")
+	ErrTimeout = errors.New("stream: frames were not acknowledged in time")
+
+	errNoSURBs = errors.New("stream: no SURBs available to reply")
+)
+
+// Transport forwards sphinx packets to relays. It is implemented by the
+// networking layer of the application.
+type Transport interface {
+	Send(addr []byte, packet *sphinx.Packet) error
+}
+
+// ContextTransport is implemented by transports which support deadlines and
+// cancellation. Streams send their packets with SendContext when the transport
+// implements it, with the write deadline of the stream as the context
+// deadline.
+type ContextTransport interface {
+	Transport
+	SendContext(ctx context.Context, addr []byte, packet *sphinx.Packet) error
+}
+
+// Circuit describes a path through the mixnet. Addrs[i] is the address of the
+// relay with public key PubKeys[i] and Dest is the final address of the
+// circuit. DestKey is the public key of the listener at the destination of a
+// forward circuit, and is not used in reply circuits.
+type Circuit struct {
+	PubKeys []ecdsa.PublicKey
+	Addrs   [][]byte
+	Dest    []byte
+	DestKey *ecdsa.PublicKey
+}
+
+// Addr is the address of one end of a stream
+type Addr []byte
+
+func (a Addr) Network() string { return "sphinx" }
+func (a Addr) String() string  { return string(a) }
+
+type timeoutError struct{}
+
+func (e timeoutError) Error() string   { return "stream: i/o timeout" }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
+// a sequenced frame which has not been acknowledged yet. frames which have
+// not been sent have a zero sentAt
+type inflightFrame struct {
+	f      *frame
+	sentAt time.Time
+}
+
+// an outstanding SURB of the client. used is set once the server has used a
+// newer SURB, which means that its reply has been lost or delayed
+type replyKey struct {
+	keys   *sphinx.SURBKeys
+	sentAt time.Time
+	used   bool
+}
+
+// the fragments of a SURB received by the server. n is the number of
+// fragments, which is known once the last one has been received
+type surbFragments struct {
+	parts map[byte][]byte
+	n     int
+}
+
+// Conn is one end of a stream. Once closed, a Conn lingers until its frames
+// have been acknowledged and the other end has closed the stream (or the
+// stream has timed out), so that the FIN is retransmitted if it is lost.
+type Conn struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	session [sessionSize]byte
+	keys    *sessionKeys
+	local   Addr
+	remote  Addr
+	t       Transport
+
+	// client side state: forward and reply circuits and the keys of the SURBs
+	// which have been handed over to the server
+	forward   Circuit
+	reply     Circuit
+	replyKeys []replyKey
+	nextSURB  uint32
+
+	// the client sends a new SURB at probeAt when it is waiting for replies.
+	// the interval between probes doubles until a reply is received
+	probeAt      time.Time
+	probeBackoff time.Duration
+
+	// server side state: SURBs received from the client and the SURBs being
+	// reassembled from frames, by SURB ID
+	surbs     []*sphinx.SURB
+	surbParts map[uint32]*surbFragments
+
+	// outgoing state. progress is the last time the other end acknowledged
+	// new frames, or the time a data frame was sent while all the previous
+	// ones had been acknowledged
+	nextSeq  uint32
+	acked    uint32
+	inflight map[uint32]*inflightFrame
+	progress time.Time
+	timeout  time.Duration
+
+	// incoming state. unacked counts the frames received since the last
+	// acknowledgment and dupRecv is set when a frame is received again,
+	// which means that its acknowledgment has been lost
+	recvNext uint32
+	pending  map[uint32]*frame
+	unacked  int
+	dupRecv  bool
+	readBuf  bytes.Buffer
+	readers  int
+	finRecv  bool
+
+	closed   bool
+	closedAt time.Time
+	err      error
+	onClose  func()
+	done     chan struct{}
+	finish   sync.Once
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+}
+
+func newConn(t Transport, session [sessionSize]byte, keys *sessionKeys) *Conn {
+	c := &Conn{
+		t:         t,
+		session:   session,
+		keys:      keys,
+		nextSeq:   1,
+		inflight:  map[uint32]*inflightFrame{},
+		timeout:   defaultTimeout,
+		recvNext:  1,
+		pending:   map[uint32]*frame{},
+		surbParts: map[uint32]*surbFragments{},
+		done:      make(chan struct{}),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Dial establishes a stream with the destination of the forward circuit. The
+// replies from the destination are routed back to local through the reply
+// circuit.
+func Dial(t Transport, forward, reply Circuit, local []byte) (*Conn, error) {
+	return DialContext(context.Background(), t, forward, reply, local)
+}
+
+// DialContext is like Dial, but the context bounds the establishment of the
+// stream: the SURBs sent to the destination are constructed and sent with the
+// context deadline. Once the stream is established, the context does not
+// affect it.
+func DialContext(ctx context.Context, t Transport, forward, reply Circuit,
+	local []byte) (*Conn, error) {
+
+	if len(forward.Addrs) == 0 || len(reply.Addrs) == 0 {
+		return nil, errors.New("stream: forward and reply circuits must not be empty")
+	}
+	if forward.DestKey == nil {
+		return nil, errors.New("stream: forward circuit must have the key of the destination")
+	}
+
+	session, keys, err := clientSession(forward.DestKey)
+	if err != nil {
+		return nil, err
+	}
+
+	c := newConn(t, session, keys)
+	c.forward = forward
+	c.reply = reply
+	c.local = Addr(local)
+	c.remote = Addr(forward.Dest)
+	c.resetProbe()
+	go c.loop()
+
+	for i := 0; i < initialSURBs; i++ {
+		err := c.sendSURB(ctx)
+		if err != nil {
+			c.terminate()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Deliver processes a packet payload received at the client's local address.
+// It must be called by the networking layer for every reply addressed to the
+// client.
+func (c *Conn) Deliver(payload [sphinx.PayloadSize]byte) error {
+	f, err := c.unwrapReply(payload)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.handleFrame(f)
+	c.resetProbe()
+	closed := c.closed
+	held := c.heldSURBs()
+	c.mu.Unlock()
+
+	// the server has used one of the SURBs, replenishes it (or the ones which
+	// have been lost, since the server reports the number of SURBs it holds
+	// in the flags of its frames). once closed, the client only acknowledges
+	// the frames of the server
+	n := initialSURBs - int(f.flags)
+	if n < 1 {
+		n = 1
+	}
+	if closed || held+n > maxReplyKeys {
+		return c.send(frameAck, 0, nil, false)
+	}
+	for i := 0; i < n; i++ {
+		if err := c.sendSURB(context.Background()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tries all outstanding SURB keys. the SURB used by the server is the one that
+// decrypts the payload into an authentic frame of the current session. the
+// server uses its SURBs in the order they were sent, so the older SURBs have
+// been used too, although their replies may still be on their way
+func (c *Conn) unwrapReply(payload [sphinx.PayloadSize]byte) (*frame, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, k := range c.replyKeys {
+		p, err := k.keys.Unwrap(payload)
+		if err != nil {
+			return nil, err
+		}
+		if frameSession(p) != c.session {
+			continue
+		}
+		f, err := decodeFrame(c.keys.open, p)
+		if err != nil {
+			continue
+		}
+		for j := range c.replyKeys[:i] {
+			c.replyKeys[j].used = true
+		}
+		c.replyKeys = append(c.replyKeys[:i], c.replyKeys[i+1:]...)
+		k.keys.Wipe()
+		return f, nil
+	}
+	return nil, errors.New("stream: reply does not match any outstanding SURB")
+}
+
+// must be called with the lock held
+func (c *Conn) resetProbe() {
+	c.probeBackoff = retransmitInterval
+	c.probeAt = time.Now().Add(c.probeBackoff)
+}
+
+// estimates the number of SURBs held by the server. must be called with the
+// lock held
+func (c *Conn) heldSURBs() int {
+	n := 0
+	for _, k := range c.replyKeys {
+		if !k.used {
+			n++
+		}
+	}
+	return n
+}
+
+// handles an incoming frame. must be called with the lock held
+func (c *Conn) handleFrame(f *frame) {
+	defer c.cond.Broadcast()
+
+	if f.ack > c.acked {
+		c.acked = f.ack
+		for seq := range c.inflight {
+			if seq <= f.ack {
+				delete(c.inflight, seq)
+			}
+		}
+		c.progress = time.Now()
+	}
+
+	switch f.kind {
+	case frameAck:
+		return
+	case frameSURB:
+		c.addSURBFragment(f)
+		return
+	}
+
+	// the acknowledgment of a frame received again has been lost
+	if _, ok := c.pending[f.seq]; ok || f.seq < c.recvNext {
+		c.dupRecv = true
+		return
+	}
+
+	// frames may arrive out of order; they are buffered until all the
+	// previous frames have been received
+	c.pending[f.seq] = f
+	for {
+		next, ok := c.pending[c.recvNext]
+		if !ok {
+			return
+		}
+		delete(c.pending, c.recvNext)
+		c.recvNext++
+		c.unacked++
+
+		switch next.kind {
+		case frameData:
+			c.readBuf.Write(next.data)
+		case frameFin:
+			c.finRecv = true
+		}
+	}
+}
+
+// server only: reassembles the SURB of a fragment. SURBs whose fragments are
+// lost are given up. must be called with the lock held
+func (c *Conn) addSURBFragment(f *frame) {
+	b, ok := c.surbParts[f.seq]
+	if !ok {
+		b = &surbFragments{parts: map[byte][]byte{}}
+		c.surbParts[f.seq] = b
+		if len(c.surbParts) > maxReplyKeys {
+			oldest := f.seq
+			for id := range c.surbParts {
+				if id < oldest {
+					oldest = id
+				}
+			}
+			delete(c.surbParts, oldest)
+		}
+	}
+	idx := f.flags >> fragmentShift
+	b.parts[idx] = f.data
+	if f.flags&flagMore == 0 {
+		b.n = int(idx) + 1
+	}
+	if b.n == 0 || len(b.parts) < b.n {
+		return
+	}
+
+	var raw []byte
+	for i := 0; i < b.n; i++ {
+		part, ok := b.parts[byte(i)]
+		if !ok {
+			return
+		}
+		raw = append(raw, part...)
+	}
+	delete(c.surbParts, f.seq)
+
+	var surb sphinx.SURB
+	if surb.GobDecode(raw) != nil {
+		return
+	}
+	c.surbs = append(c.surbs, &surb)
+	// the client sends new SURBs when it does not receive replies, the
+	// oldest ones have likely been given up
+	if len(c.surbs) > maxReplyKeys {
+		c.surbs = c.surbs[len(c.surbs)-maxReplyKeys:]
+	}
+}
+
+// server only: checks whether the server should acknowledge the received
+// frames before having any data to write. must be called with the lock held
+func (c *Conn) needsAck() bool {
+	return c.unacked >= windowSize/2 && len(c.surbs) > 0
+}
+
+// creates a new SURB, keeps its keys and sends it to the server
+func (c *Conn) sendSURB(ctx context.Context) error {
+	sessionKey, err := ecdsa.GenerateKey(ec.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	defer scrypto.WipeECDSAKey(sessionKey)
+	surb, keys, err := sphinx.NewSURBContext(ctx, sessionKey, c.reply.PubKeys,
+		c.reply.Dest, c.reply.Addrs)
+	if err != nil {
+		return err
+	}
+	raw, err := surb.GobEncode()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.replyKeys = append(c.replyKeys, replyKey{keys: keys, sentAt: time.Now()})
+	id := c.nextSURB
+	c.nextSURB++
+	c.mu.Unlock()
+
+	for idx := byte(0); len(raw) > 0; idx++ {
+		n := len(raw)
+		flags := idx << fragmentShift
+		if n > maxFrameData {
+			n = maxFrameData
+			flags |= flagMore
+		}
+		// SURB frames are not subject to flow control, otherwise the server
+		// could run out of SURBs to acknowledge the client's frames
+		f := &frame{kind: frameSURB, flags: flags, seq: id, data: raw[:n]}
+		if err := c.sendContext(ctx, f, false); err != nil {
+			return err
+		}
+		raw = raw[n:]
+	}
+	return nil
+}
+
+// waits until it is possible to send a new frame, if wait is set, and sends it
+func (c *Conn) send(kind, flags byte, data []byte, wait bool) error {
+	f := &frame{kind: kind, flags: flags, data: data}
+	return c.sendContext(context.Background(), f, wait)
+}
+
+// sends a frame. data and FIN frames are sequenced and kept until they are
+// acknowledged. the packet is constructed and sent with the earliest of the
+// context deadline and the write deadline of the stream
+func (c *Conn) sendContext(ctx context.Context, f *frame, wait bool) error {
+	c.mu.Lock()
+	if !c.writeDeadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.writeDeadline)
+		defer cancel()
+	}
+
+	var surb *sphinx.SURB
+	for {
+		if c.err != nil {
+			c.mu.Unlock()
+			return c.err
+		}
+		if c.closed && f.kind == frameData {
+			c.mu.Unlock()
+			return ErrClosed
+		}
+		if !c.writeDeadline.IsZero() && time.Now().After(c.writeDeadline) {
+			c.mu.Unlock()
+			return timeoutError{}
+		}
+		if err := ctx.Err(); err != nil {
+			c.mu.Unlock()
+			return err
+		}
+		if c.isClient() {
+			if !wait || c.nextSeq-1-c.acked < windowSize {
+				break
+			}
+		} else if len(c.surbs) > 0 {
+			surb = c.surbs[0]
+			c.surbs = c.surbs[1:]
+			break
+		} else if !wait {
+			c.mu.Unlock()
+			return errNoSURBs
+		}
+		c.cond.Wait()
+	}
+
+	f.session = c.session
+	f.ack = c.recvNext - 1
+	if !c.isClient() {
+		f.flags = surbCount(c.surbs)
+	}
+	if f.kind == frameData || f.kind == frameFin {
+		// the data is kept for retransmissions after the caller returns
+		f.data = append([]byte(nil), f.data...)
+		f.seq = c.nextSeq
+		c.nextSeq++
+		c.track(f, time.Now())
+	}
+	c.resetAcks()
+	c.mu.Unlock()
+
+	return c.transmitFrame(ctx, f, surb)
+}
+
+// keeps a sequenced frame until it is acknowledged. must be called with the
+// lock held
+func (c *Conn) track(f *frame, sentAt time.Time) {
+	if len(c.inflight) == 0 {
+		c.progress = time.Now()
+	}
+	c.inflight[f.seq] = &inflightFrame{f: f, sentAt: sentAt}
+}
+
+func surbCount(surbs []*sphinx.SURB) byte {
+	if len(surbs) > 255 {
+		return 255
+	}
+	return byte(len(surbs))
+}
+
+// all the frames carry an acknowledgment of the received frames. must be
+// called with the lock held
+func (c *Conn) resetAcks() {
+	c.unacked = 0
+	c.dupRecv = false
+}
+
+// seals a frame and sends it through the forward circuit, or through surb
+// on the server
+func (c *Conn) transmitFrame(ctx context.Context, f *frame, surb *sphinx.SURB) error {
+	payload, err := f.encode(c.keys.seal)
+	if err != nil {
+		return err
+	}
+
+	if c.isClient() {
+		sessionKey, err := ecdsa.GenerateKey(ec.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		defer scrypto.WipeECDSAKey(sessionKey)
+		packet, err := sphinx.NewPacketContext(ctx, sessionKey, c.forward.PubKeys,
+			c.forward.Dest, c.forward.Addrs, payload)
+		if err != nil {
+			return err
+		}
+		return c.transmit(ctx, c.forward.Addrs[0], packet)
+	}
+
+	packet, err := surb.NewPacket(payload)
+	if err != nil {
+		return err
+	}
+	return c.transmit(ctx, surb.FirstHop, packet)
+}
+
+// sends a sequenced frame again, with the current acknowledgment
+func (c *Conn) retransmit(seq uint32) error {
+	c.mu.Lock()
+	e, ok := c.inflight[seq]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	var surb *sphinx.SURB
+	if !c.isClient() {
+		if len(c.surbs) == 0 {
+			c.mu.Unlock()
+			return errNoSURBs
+		}
+		surb = c.surbs[0]
+		c.surbs = c.surbs[1:]
+	}
+	f := *e.f
+	f.ack = c.recvNext - 1
+	if !c.isClient() {
+		f.flags = surbCount(c.surbs)
+	}
+	e.sentAt = time.Now()
+	c.resetAcks()
+	c.mu.Unlock()
+
+	return c.transmitFrame(context.Background(), &f, surb)
+}
+
+func (c *Conn) transmit(ctx context.Context, addr []byte, packet *sphinx.Packet) error {
+	if t, ok := c.t.(ContextTransport); ok {
+		return t.SendContext(ctx, addr, packet)
+	}
+	return c.t.Send(addr, packet)
+}
+
+func (c *Conn) isClient() bool {
+	return len(c.forward.Addrs) != 0
+}
+
+// Read reads data from the stream. It returns io.EOF once the other end has
+// closed the stream and all the data has been read.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.readBuf.Len() == 0 {
+		if c.finRecv {
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.closed {
+			return 0, ErrClosed
+		}
+		if !c.readDeadline.IsZero() && time.Now().After(c.readDeadline) {
+			return 0, timeoutError{}
+		}
+		c.readers++
+		c.cond.Wait()
+		c.readers--
+	}
+	return c.readBuf.Read(b)
+}
+
+// Write writes data to the stream. The data is fragmented in frames, each of
+// them sent in its own sphinx packet. Write blocks while the flow control
+// window of the stream is full.
+func (c *Conn) Write(b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		l := len(b) - n
+		if l > maxFrameData {
+			l = maxFrameData
+		}
+		err := c.send(frameData, 0, b[n:n+l], true)
+		if err != nil {
+			return n, err
+		}
+		n += l
+	}
+	return n, nil
+}
+
+// Close closes the stream and signals the other end that no more data will be
+// written. The FIN frame is sent when possible (e.g. once the server receives
+// a SURB) and retransmitted until it is acknowledged, so Close does not fail
+// when it cannot be sent right away.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.closedAt = time.Now()
+	c.cond.Broadcast()
+
+	f := &frame{kind: frameFin, session: c.session, seq: c.nextSeq}
+	c.nextSeq++
+	c.track(f, time.Time{})
+	c.mu.Unlock()
+
+	c.retransmit(f.seq)
+	return nil
+}
+
+// retransmits the frames which have not been acknowledged, sends new SURBs
+// and acknowledgments, and terminates the stream once it is done
+func (c *Conn) loop() {
+	ticker := time.NewTicker(retransmitInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.tick()
+		}
+	}
+}
+
+func (c *Conn) tick() {
+	now := time.Now()
+
+	c.mu.Lock()
+	data := len(c.inflight) > 0
+	if data && now.Sub(c.progress) > c.timeout {
+		c.err = ErrTimeout
+		c.closed = true
+		c.cond.Broadcast()
+		c.mu.Unlock()
+		c.terminate()
+		return
+	}
+	if c.closed && !data && (c.finRecv || now.Sub(c.closedAt) > c.timeout) {
+		c.mu.Unlock()
+		c.terminate()
+		return
+	}
+
+	var resend []uint32
+	for seq, e := range c.inflight {
+		if now.Sub(e.sentAt) >= retransmitInterval {
+			resend = append(resend, seq)
+		}
+	}
+	sort.Slice(resend, func(i, j int) bool { return resend[i] < resend[j] })
+
+	var probe, ack bool
+	if c.isClient() {
+		// the replies of used SURBs which have not arrived in time have been
+		// lost
+		keys := c.replyKeys[:0]
+		for _, k := range c.replyKeys {
+			if k.used && now.Sub(k.sentAt) > c.timeout {
+				k.keys.Wipe()
+				continue
+			}
+			keys = append(keys, k)
+		}
+		c.replyKeys = keys
+
+		// the server may have run out of SURBs to reply, or the SURBs it
+		// holds may have been lost. the server keeps the newest SURBs, so the
+		// oldest one is given up when the server holds too many
+		waiting := len(resend) > 0 || len(c.pending) > 0 || c.readers > 0 ||
+			(c.closed && !c.finRecv)
+		if waiting && !now.Before(c.probeAt) {
+			probe = true
+			if c.heldSURBs() >= maxReplyKeys {
+				for i := range c.replyKeys {
+					if !c.replyKeys[i].used {
+						c.replyKeys[i].used = true
+						break
+					}
+				}
+			}
+			if c.probeBackoff *= 2; c.probeBackoff > maxProbeInterval {
+				c.probeBackoff = maxProbeInterval
+			}
+			c.probeAt = now.Add(c.probeBackoff)
+		}
+	} else {
+		ack = len(resend) == 0 && (c.unacked > 0 || c.dupRecv) && len(c.surbs) > 0
+	}
+	c.mu.Unlock()
+
+	for _, seq := range resend {
+		if err := c.retransmit(seq); err != nil {
+			break
+		}
+	}
+	if probe {
+		c.sendSURB(context.Background())
+	}
+	if ack {
+		c.send(frameAck, 0, nil, false)
+	}
+}
+
+// stops the stream and drops its outstanding SURBs
+func (c *Conn) terminate() {
+	c.finish.Do(func() {
+		c.mu.Lock()
+		close(c.done)
+		for _, k := range c.replyKeys {
+			k.keys.Wipe()
+		}
+		c.replyKeys = nil
+		c.surbs = nil
+		c.surbParts = nil
+		onClose := c.onClose
+		c.mu.Unlock()
+
+		if onClose != nil {
+			onClose()
+		}
+	})
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.local }
+func (c *Conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.readTimer = c.resetTimer(c.readTimer, t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.writeTimer = c.resetTimer(c.writeTimer, t)
+	return nil
+}
+
+// wakes up blocked readers and writers when the deadline expires
+func (c *Conn) resetTimer(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() {
+		c.mu.Lock()
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	})
+}
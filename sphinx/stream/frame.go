@@ -0,0 +1,213 @@
+package stream
+
+import (
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	sphinx "github.com/hashmatter/p3lib/sphinx"
+	scrypto "github.com/hashmatter/p3lib/sphinx/crypto"
+)
+
+const (
+	// frame carrying a chunk of the byte stream
+	frameData byte = iota + 1
+
+	// frame carrying a chunk of an encoded SURB (client to server only). SURB
+	// frames are not sequenced nor retransmitted: a SURB whose frames are lost
+	// is given up
+	frameSURB
+
+	// frame signaling that the sender will not write more data
+	frameFin
+
+	// frame only carrying an acknowledgment. ack frames are not sequenced
+	frameAck
+)
+
+const (
+	// set in all SURB frames except the last one of a SURB. the other flags
+	// of SURB frames are the index of the fragment in the SURB, and their seq
+	// is the ID of the SURB. the flags of the frames sent by the server are
+	// the number of SURBs it holds
+	flagMore      = byte(1)
+	fragmentShift = 1
+
+	// size in bytes of the session identifier, which is the ephemeral public
+	// key of the client (a compressed P-256 point)
+	sessionSize = 33
+
+	// size in bytes of the nonce and of the tag of the AEAD which seals frames
+	nonceSize = 12
+	tagSize   = 16
+
+	// kind (1) + flags (1) + seq (4) + ack (4) + data length (2)
+	frameHeaderSize = 2 + 4 + 4 + 2
+
+	// session (33) + nonce (12) + sealed header (12) + tag (16)
+	frameOverhead = sessionSize + nonceSize + frameHeaderSize + tagSize
+
+	// max number of stream bytes carried by one frame
+	maxFrameData = sphinx.PayloadSize - frameOverhead
+)
+
+// labels of the keys which seal the frames sent by each end of a stream
+const (
+	labelClientKey = "p3lib-stream-v1 client"
+	labelServerKey = "p3lib-stream-v1 server"
+)
+
+var errInvalidFrame = errors.New("stream: frame is not authentic")
+
+// a frame is the unit of data exchanged between both ends of a stream. each
+// frame fits in exactly one sphinx packet payload, in which it is sealed with
+// the key of its sender. the data is padded to maxFrameData bytes, so that all
+// the sealed frames have the same size.
+type frame struct {
+	kind    byte
+	flags   byte
+	session [sessionSize]byte
+	seq     uint32
+	ack     uint32
+	data    []byte
+}
+
+// sessionKeys seal the frames sent by one end of a stream and open the frames
+// it receives
+type sessionKeys struct {
+	seal cipher.AEAD
+	open cipher.AEAD
+}
+
+// derives the keys of a session from the shared secret of the ephemeral key of
+// the client and the key of the listener. the session is used as salt, so that
+// the keys are bound to it
+func newSessionKeys(secret scrypto.Hash256, session [sessionSize]byte,
+	client bool) (*sessionKeys, error) {
+
+	kdf := scrypto.DefaultSuite.KDF()
+	clientKey := kdf.Derive(secret[:], session[:], labelClientKey, scrypto.KeySize)
+	defer scrypto.Wipe(clientKey)
+	serverKey := kdf.Derive(secret[:], session[:], labelServerKey, scrypto.KeySize)
+	defer scrypto.Wipe(serverKey)
+
+	clientAEAD, err := scrypto.DefaultSuite.AEAD(clientKey)
+	if err != nil {
+		return nil, err
+	}
+	serverAEAD, err := scrypto.DefaultSuite.AEAD(serverKey)
+	if err != nil {
+		return nil, err
+	}
+	if client {
+		return &sessionKeys{seal: clientAEAD, open: serverAEAD}, nil
+	}
+	return &sessionKeys{seal: serverAEAD, open: clientAEAD}, nil
+}
+
+// generates the ephemeral key of a new session with the listener and returns
+// the session and the keys of the client
+func clientSession(listener *ecdsa.PublicKey) ([sessionSize]byte, *sessionKeys, error) {
+	var session [sessionSize]byte
+	suite := scrypto.DefaultSuite
+
+	scalar, element, err := suite.Group().GenerateKey(rand.Reader)
+	if err != nil {
+		return session, nil, err
+	}
+	defer scrypto.Wipe(scalar)
+	copy(session[:], element)
+
+	secret, err := scrypto.SharedSecret(suite, scalar, scrypto.P256PublicKey(listener))
+	if err != nil {
+		return session, nil, err
+	}
+	defer secret.Wipe()
+
+	keys, err := newSessionKeys(secret, session, true)
+	return session, keys, err
+}
+
+// derives the keys of the listener for a session. the session is validated as
+// a group element before it is used
+func serverSession(scalar []byte, session [sessionSize]byte) (*sessionKeys, error) {
+	suite := scrypto.DefaultSuite
+	if err := suite.Group().Validate(session[:]); err != nil {
+		return nil, fmt.Errorf("stream: invalid session: %v", err)
+	}
+
+	secret, err := scrypto.SharedSecret(suite, scalar, session[:])
+	if err != nil {
+		return nil, err
+	}
+	defer secret.Wipe()
+
+	return newSessionKeys(secret, session, false)
+}
+
+// encodes and seals the frame. the session is sent in the clear, so that the
+// listener finds the keys of the session, and is authenticated as additional
+// data
+func (f *frame) encode(aead cipher.AEAD) ([sphinx.PayloadSize]byte, error) {
+	var p [sphinx.PayloadSize]byte
+	if len(f.data) > maxFrameData {
+		return p, fmt.Errorf("Frame data too large: max %v bytes, got %v",
+			maxFrameData, len(f.data))
+	}
+
+	pt := make([]byte, frameHeaderSize+maxFrameData)
+	pt[0] = f.kind
+	pt[1] = f.flags
+	binary.BigEndian.PutUint32(pt[2:], f.seq)
+	binary.BigEndian.PutUint32(pt[6:], f.ack)
+	binary.BigEndian.PutUint16(pt[10:], uint16(len(f.data)))
+	copy(pt[frameHeaderSize:], f.data)
+	defer scrypto.Wipe(pt)
+
+	copy(p[:], f.session[:])
+	nonce := p[sessionSize : sessionSize+nonceSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return p, err
+	}
+	aead.Seal(p[sessionSize+nonceSize:sessionSize+nonceSize], nonce, pt, f.session[:])
+	return p, nil
+}
+
+// returns the session of a sealed frame
+func frameSession(p [sphinx.PayloadSize]byte) [sessionSize]byte {
+	var session [sessionSize]byte
+	copy(session[:], p[:sessionSize])
+	return session
+}
+
+// opens and decodes a sealed frame
+func decodeFrame(aead cipher.AEAD, p [sphinx.PayloadSize]byte) (*frame, error) {
+	session := frameSession(p)
+	nonce := p[sessionSize : sessionSize+nonceSize]
+	pt, err := aead.Open(nil, nonce, p[sessionSize+nonceSize:], session[:])
+	if err != nil {
+		return nil, errInvalidFrame
+	}
+	defer scrypto.Wipe(pt)
+
+	f := &frame{
+		kind:    pt[0],
+		flags:   pt[1],
+		session: session,
+		seq:     binary.BigEndian.Uint32(pt[2:]),
+		ack:     binary.BigEndian.Uint32(pt[6:]),
+	}
+	if f.kind < frameData || f.kind > frameAck {
+		return nil, fmt.Errorf("Unknown frame kind %v", f.kind)
+	}
+
+	l := int(binary.BigEndian.Uint16(pt[10:]))
+	if l > maxFrameData {
+		return nil, fmt.Errorf("Invalid frame data length %v", l)
+	}
+	f.data = make([]byte, l)
+	copy(f.data, pt[frameHeaderSize:])
+	return f, nil
+}
@@ -0,0 +1,171 @@
+package stream
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	sphinx "github.com/hashmatter/p3lib/sphinx"
+	scrypto "github.com/hashmatter/p3lib/sphinx/crypto"
+	"net"
+	"sync"
+	"time"
+)
+
+// Listener accepts streams at the destination of sphinx circuits (e.g. a
+// hidden service). It implements net.Listener.
+type Listener struct {
+	mu       sync.Mutex
+	t        Transport
+	addr     Addr
+	key      []byte
+	sessions map[[sessionSize]byte]*Conn
+	timeout  time.Duration
+	accept   chan *Conn
+	closed   chan struct{}
+	once     sync.Once
+
+	// sessions which have been terminated and the time until which they are
+	// remembered, so that late frames (e.g. retransmissions of the client) do
+	// not establish them again. replays of the packets which carried them are
+	// dropped by the relays, so they only need to be remembered for as long as
+	// the client may retransmit frames
+	ended map[[sessionSize]byte]time.Time
+}
+
+// Listen creates a stream listener for the destination address addr. Replies
+// are sent through t. Clients seal their frames for the public key of key,
+// which is copied by the listener and wiped when it is closed.
+func Listen(t Transport, addr []byte, key *ecdsa.PrivateKey) *Listener {
+	return &Listener{
+		t:        t,
+		addr:     Addr(addr),
+		key:      scrypto.P256PrivateKey(key),
+		sessions: map[[sessionSize]byte]*Conn{},
+		timeout:  defaultTimeout,
+		ended:    map[[sessionSize]byte]time.Time{},
+		accept:   make(chan *Conn, 16),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Deliver processes the payload of a packet whose final address is the
+// listener's address. It must be called by the networking layer for every
+// packet that exits the mixnet at the listener's address. Frames which are not
+// authentic are rejected before a session is established, and frames of
+// sessions which have ended are dropped.
+func (l *Listener) Deliver(payload [sphinx.PayloadSize]byte) error {
+	session := frameSession(payload)
+
+	l.mu.Lock()
+	if _, ended := l.ended[session]; ended {
+		l.mu.Unlock()
+		return nil
+	}
+	c, exists := l.sessions[session]
+	var keys *sessionKeys
+	if exists {
+		keys = c.keys
+	} else {
+		select {
+		case <-l.closed:
+			l.mu.Unlock()
+			return ErrClosed
+		default:
+		}
+		var err error
+		if keys, err = serverSession(l.key, session); err != nil {
+			l.mu.Unlock()
+			return err
+		}
+	}
+	l.mu.Unlock()
+
+	f, err := decodeFrame(keys.open, payload)
+	if err != nil {
+		return err
+	}
+
+	// the session may have been established by a concurrent frame
+	l.mu.Lock()
+	if _, ended := l.ended[session]; ended {
+		l.mu.Unlock()
+		return nil
+	}
+	if c, exists = l.sessions[session]; !exists {
+		c = newConn(l.t, session, keys)
+		c.local = l.addr
+		c.timeout = l.timeout
+		c.onClose = func() { l.remove(session) }
+		l.sessions[session] = c
+		go c.loop()
+	}
+	l.mu.Unlock()
+
+	if !exists {
+		select {
+		case l.accept <- c:
+		case <-l.closed:
+			return ErrClosed
+		}
+	}
+
+	c.mu.Lock()
+	c.handleFrame(f)
+	ack := c.needsAck()
+	c.mu.Unlock()
+
+	if ack {
+		return c.send(frameAck, 0, nil, false)
+	}
+	return nil
+}
+
+// forgets a session which has ended and the sessions which have ended long
+// ago
+func (l *Listener) remove(session [sessionSize]byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for s, until := range l.ended {
+		if now.After(until) {
+			delete(l.ended, s)
+		}
+	}
+	delete(l.sessions, session)
+	l.ended[session] = now.Add(2 * l.timeout)
+}
+
+// Accept waits for and returns the next stream established with the listener
+func (l *Listener) Accept() (net.Conn, error) {
+	return l.AcceptContext(context.Background())
+}
+
+// AcceptContext is like Accept, but returns the context error if the context
+// is done before a stream is established
+func (l *Listener) AcceptContext(ctx context.Context) (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.closed:
+		return nil, errors.New("stream: listener closed")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close stops accepting streams and wipes the key of the listener. Streams
+// which have been established are not closed.
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		l.mu.Lock()
+		close(l.closed)
+		scrypto.Wipe(l.key)
+		l.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
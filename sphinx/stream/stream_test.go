@@ -0,0 +1,595 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	ec "crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	sphinx "github.com/hashmatter/p3lib/sphinx"
+	"io"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+// in-memory mixnet. every packet is routed in its own goroutine, so packets
+// are delivered out of order. if loss is set, packets are dropped with
+// probability 1/loss
+type mixnet struct {
+	mu     sync.Mutex
+	loss   int
+	relays map[string]*sphinx.RelayerCtx
+	pubs   map[string]ecdsa.PublicKey
+	keys   map[string]*ecdsa.PrivateKey
+	dests  map[string]func([sphinx.PayloadSize]byte) error
+	errs   []error
+}
+
+func newMixnet(addrs []string) *mixnet {
+	m := &mixnet{
+		relays: map[string]*sphinx.RelayerCtx{},
+		pubs:   map[string]ecdsa.PublicKey{},
+		keys:   map[string]*ecdsa.PrivateKey{},
+		dests:  map[string]func([sphinx.PayloadSize]byte) error{},
+	}
+	for _, a := range addrs {
+		priv, _ := ecdsa.GenerateKey(ec.P256(), rand.Reader)
+		m.relays[a] = sphinx.NewRelayerCtx(priv)
+		m.pubs[a] = priv.PublicKey
+	}
+	return m
+}
+
+// listens at dest with a new key, which is used by the circuits to dest
+func (m *mixnet) listen(dest string) *Listener {
+	priv, _ := ecdsa.GenerateKey(ec.P256(), rand.Reader)
+	l := Listen(m, []byte(dest), priv)
+	m.keys[dest] = priv
+	m.dests[dest] = l.Deliver
+	return l
+}
+
+func (m *mixnet) circuit(dest string, addrs ...string) Circuit {
+	c := Circuit{Dest: []byte(dest)}
+	if k, ok := m.keys[dest]; ok {
+		c.DestKey = &k.PublicKey
+	}
+	for _, a := range addrs {
+		c.PubKeys = append(c.PubKeys, m.pubs[a])
+		c.Addrs = append(c.Addrs, []byte(a))
+	}
+	return c
+}
+
+func (m *mixnet) Send(addr []byte, packet *sphinx.Packet) error {
+	m.mu.Lock()
+	drop := m.loss > 0 && mrand(m.loss) == 0
+	m.mu.Unlock()
+	if !drop {
+		go m.route(string(addr), packet)
+	}
+	return nil
+}
+
+func (m *mixnet) route(addr string, packet *sphinx.Packet) {
+	time.Sleep(time.Duration(mrand(3)) * time.Millisecond)
+	for {
+		m.mu.Lock()
+		next, p, err := m.relays[addr].ProcessPacket(packet)
+		m.mu.Unlock()
+		if err != nil {
+			m.fail(err)
+			return
+		}
+		addr = string(bytes.TrimRight(next[:], "\x00"))
+		packet = p
+		if p.IsLast() {
+			break
+		}
+	}
+
+	m.mu.Lock()
+	deliver := m.dests[addr]
+	m.mu.Unlock()
+	if err := deliver(packet.Payload); err != nil {
+		m.fail(err)
+	}
+}
+
+func (m *mixnet) fail(err error) {
+	m.mu.Lock()
+	m.errs = append(m.errs, err)
+	m.mu.Unlock()
+}
+
+func mrand(n int) int {
+	var b [1]byte
+	rand.Read(b[:])
+	return int(b[0]) % n
+}
+
+type Arith struct{}
+
+func (a *Arith) Mul(args [2]int, res *int) error {
+	*res = args[0] * args[1]
+	return nil
+}
+
+func setup(t *testing.T) (*mixnet, *Conn, *Listener) {
+	m := newMixnet([]string{"relay0", "relay1", "relay2"})
+
+	l := m.listen("hidden-service")
+
+	forward := m.circuit("hidden-service", "relay0", "relay1", "relay2")
+	reply := m.circuit("client", "relay2", "relay0")
+
+	var conn *Conn
+	ready := make(chan struct{})
+	m.dests["client"] = func(p [sphinx.PayloadSize]byte) error {
+		<-ready
+		return conn.Deliver(p)
+	}
+
+	conn, err := Dial(m, forward, reply, []byte("client"))
+	close(ready)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, conn, l
+}
+
+func TestRPCOverStream(t *testing.T) {
+	m, conn, l := setup(t)
+
+	server := rpc.NewServer()
+	server.Register(&Arith{})
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go server.ServeConn(c)
+		}
+	}()
+	defer l.Close()
+
+	client := rpc.NewClient(conn)
+	for i := 0; i < 5; i++ {
+		var res int
+		err := client.Call("Arith.Mul", [2]int{i, 7}, &res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != i*7 {
+			t.Errorf("Wrong RPC result: %v != %v", res, i*7)
+		}
+	}
+
+	if len(m.errs) != 0 {
+		t.Error(m.errs)
+	}
+}
+
+func TestStreamFragmentationAndOrdering(t *testing.T) {
+	m, conn, l := setup(t)
+
+	// server echoes everything it reads
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(c, c)
+		c.Close()
+	}()
+
+	data := make([]byte, 20*maxFrameData+17)
+	rand.Read(data)
+
+	go func() {
+		_, err := conn.Write(data)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	res := make([]byte, len(data))
+	_, err := io.ReadFull(conn, res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(res, data) {
+		t.Error("Echoed stream does not match the original data")
+	}
+
+	if len(m.errs) != 0 {
+		t.Error(m.errs)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	_, conn, _ := setup(t)
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	if terr, ok := err.(timeoutError); !ok || !terr.Timeout() {
+		t.Errorf("Expected timeout error, got %v", err)
+	}
+}
+
+// transport which records the deadlines of the packets it sends
+type deadlineTransport struct {
+	*mixnet
+	deadlines []time.Time
+}
+
+func (d *deadlineTransport) SendContext(ctx context.Context, addr []byte,
+	packet *sphinx.Packet) error {
+
+	deadline, _ := ctx.Deadline()
+	d.deadlines = append(d.deadlines, deadline)
+	return d.Send(addr, packet)
+}
+
+func TestDialContext(t *testing.T) {
+	m := newMixnet([]string{"relay0"})
+	priv, _ := ecdsa.GenerateKey(ec.P256(), rand.Reader)
+	m.keys["hidden-service"] = priv
+	forward := m.circuit("hidden-service", "relay0")
+	reply := m.circuit("client", "relay0")
+	m.dests["hidden-service"] = func([sphinx.PayloadSize]byte) error { return nil }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := DialContext(ctx, m, forward, reply, []byte("client")); err != context.Canceled {
+		t.Errorf("Dial should be cancelled, got %v", err)
+	}
+
+	// the dial deadline is carried to the transport
+	tr := &deadlineTransport{mixnet: m}
+	deadline := time.Now().Add(time.Minute)
+	ctx, cancel = context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if _, err := DialContext(ctx, tr, forward, reply, []byte("client")); err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.deadlines) == 0 {
+		t.Fatal("Transport did not send packets with a context")
+	}
+	for _, d := range tr.deadlines {
+		if !d.Equal(deadline) {
+			t.Errorf("Packet deadline should be %v, got %v", deadline, d)
+		}
+	}
+}
+
+func TestAcceptContext(t *testing.T) {
+	l := newMixnet(nil).listen("hidden-service")
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := l.AcceptContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Accept should time out, got %v", err)
+	}
+}
+
+// outstanding SURB keys must be dropped once the stream has been closed by
+// both ends
+func TestCloseDropsSURBKeys(t *testing.T) {
+	_, conn, l := setup(t)
+	defer l.Close()
+
+	sc, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.mu.Lock()
+	n := len(conn.replyKeys)
+	conn.mu.Unlock()
+	if n == 0 {
+		t.Fatal("Connection should have outstanding SURBs")
+	}
+
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sc.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+	if err := sc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "client to drop its SURB keys", func() bool {
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+		return len(conn.replyKeys) == 0
+	})
+}
+
+// the stream must recover from lost packets
+func TestLossyMixnet(t *testing.T) {
+	m, conn, l := setup(t)
+	defer l.Close()
+	m.mu.Lock()
+	m.loss = 10
+	m.mu.Unlock()
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(c, c)
+		c.Close()
+	}()
+
+	data := make([]byte, 10*maxFrameData+17)
+	rand.Read(data)
+	go conn.Write(data)
+
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	res := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, res); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, data) {
+		t.Error("Echoed data does not match the data sent")
+	}
+}
+
+// closing the server must not fail when it holds no SURBs: the FIN is sent
+// once the client sends new SURBs
+func TestServerCloseWithoutSURBs(t *testing.T) {
+	_, conn, l := setup(t)
+	defer l.Close()
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := c.(*Conn)
+	waitFor(t, "server to receive the SURBs", func() bool {
+		sc.mu.Lock()
+		defer sc.mu.Unlock()
+		return len(sc.surbs) == initialSURBs
+	})
+	sc.mu.Lock()
+	sc.surbs = nil
+	sc.mu.Unlock()
+
+	if err := sc.Close(); err != nil {
+		t.Errorf("Close should not fail without SURBs, got %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+}
+
+// frames of sessions which have ended must not establish them again
+func TestEndedSession(t *testing.T) {
+	m, conn, l := setup(t)
+	defer l.Close()
+
+	var mu sync.Mutex
+	var exits [][sphinx.PayloadSize]byte
+	m.mu.Lock()
+	m.dests["hidden-service"] = func(p [sphinx.PayloadSize]byte) error {
+		mu.Lock()
+		exits = append(exits, p)
+		mu.Unlock()
+		return l.Deliver(p)
+	}
+	m.mu.Unlock()
+
+	sc, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	sc.Close()
+
+	waitFor(t, "session to end", func() bool {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return len(l.sessions) == 0
+	})
+
+	mu.Lock()
+	p := exits[0]
+	mu.Unlock()
+	if err := l.Deliver(p); err != nil {
+		t.Fatal(err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.sessions) != 0 {
+		t.Error("Ended session should not be established again")
+	}
+}
+
+// a stream whose frames are not acknowledged must fail
+func TestTimeout(t *testing.T) {
+	m, conn, l := setup(t)
+	defer l.Close()
+
+	conn.mu.Lock()
+	conn.timeout = time.Second
+	conn.mu.Unlock()
+	m.mu.Lock()
+	m.loss = 1
+	m.mu.Unlock()
+
+	if _, err := conn.Write([]byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != ErrTimeout {
+		t.Errorf("Expected %v, got %v", ErrTimeout, err)
+	}
+	if _, err := conn.Write([]byte("lost")); err != ErrTimeout {
+		t.Errorf("Expected %v, got %v", ErrTimeout, err)
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %v", what)
+}
+
+// frames must be sealed, so that the exit relay of the forward circuit neither
+// reads the stream nor injects frames in it
+func TestSealedFrames(t *testing.T) {
+	m, conn, l := setup(t)
+	defer l.Close()
+
+	var mu sync.Mutex
+	var exits [][sphinx.PayloadSize]byte
+	m.mu.Lock()
+	m.dests["hidden-service"] = func(p [sphinx.PayloadSize]byte) error {
+		mu.Lock()
+		exits = append(exits, p)
+		mu.Unlock()
+		return l.Deliver(p)
+	}
+	m.mu.Unlock()
+
+	secret := []byte("secret stream data")
+	if _, err := conn.Write(secret); err != nil {
+		t.Fatal(err)
+	}
+	sc, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(sc, make([]byte, len(secret))); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	p := exits[0]
+	for _, e := range exits {
+		if bytes.Contains(e[:], secret) {
+			t.Error("Exit payload contains the stream data in plaintext")
+		}
+	}
+	mu.Unlock()
+
+	// a frame injected in the session without its keys is rejected
+	forged := &frame{kind: frameData, session: frameSession(p), seq: 1, data: secret}
+	fp, _ := forged.encode(testKeys(t).seal)
+	if err := l.Deliver(fp); err != errInvalidFrame {
+		t.Errorf("Forged frame should be rejected, got %v", err)
+	}
+
+	// tampered frames are rejected
+	p[len(p)-1] ^= 1
+	if err := l.Deliver(p); err != errInvalidFrame {
+		t.Errorf("Tampered frame should be rejected, got %v", err)
+	}
+
+	// sessions which are not public keys are rejected before any session is
+	// established
+	var garbage [sphinx.PayloadSize]byte
+	rand.Read(garbage[:])
+	if err := l.Deliver(garbage); err == nil {
+		t.Error("Frame with an invalid session should be rejected")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.sessions) != 1 {
+		t.Errorf("Listener should have 1 session, got %v", len(l.sessions))
+	}
+}
+
+func TestDialWithoutDestKey(t *testing.T) {
+	m := newMixnet([]string{"relay0"})
+	forward := m.circuit("hidden-service", "relay0")
+	reply := m.circuit("client", "relay0")
+	if _, err := Dial(m, forward, reply, []byte("client")); err == nil {
+		t.Error("Dial without the key of the destination should fail")
+	}
+}
+
+// keys of a session with a random listener
+func testKeys(t testing.TB) *sessionKeys {
+	priv, _ := ecdsa.GenerateKey(ec.P256(), rand.Reader)
+	_, keys, err := clientSession(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestFrameEncoding(t *testing.T) {
+	f := &frame{
+		kind:  frameSURB,
+		flags: flagMore,
+		seq:   42,
+		ack:   41,
+		data:  []byte("hello sphinx stream!"),
+	}
+	copy(f.session[:], "session!")
+
+	keys := testKeys(t)
+	p, err := f.encode(keys.seal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	df, err := decodeFrame(keys.seal, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(df) != fmt.Sprint(f) {
+		t.Errorf("Encoded/decoded frame mismatch:\n >> %v\n >> %v", df, f)
+	}
+
+	// frames are opened only with the key of their sender
+	if _, err := decodeFrame(keys.open, p); err != errInvalidFrame {
+		t.Errorf("Frame should not be opened with another key, got %v", err)
+	}
+
+	f.data = make([]byte, maxFrameData+1)
+	if _, err := f.encode(keys.seal); err == nil {
+		t.Error("Frame with data larger than maxFrameData must not be encoded")
+	}
+}
+
+func FuzzDecodeFrame(f *testing.F) {
+	keys := testKeys(f)
+	seed, _ := (&frame{kind: frameData, seq: 1, data: []byte("hello")}).encode(keys.seal)
+	f.Add(seed[:])
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		var p [sphinx.PayloadSize]byte
+		copy(p[:], raw)
+		df, err := decodeFrame(keys.seal, p)
+		if err != nil {
+			return
+		}
+
+		// decoded frames must be re-encoded to the same payload
+		enc, err := df.encode(keys.seal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		df2, err := decodeFrame(keys.seal, enc)
+		if err != nil || fmt.Sprint(df) != fmt.Sprint(df2) {
+			t.Errorf("Frame round trip mismatch:\n >> %v\n >> %v", df, df2)
+		}
+	})
+}
@@ -0,0 +1,204 @@
+package sphinx
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	scrypto "github.com/hashmatter/p3lib/sphinx/crypto"
+)
+
+// SURB is a single use reply block. It is constructed by the initiator of a
+// circuit and handed over to the other end of the communication so that it can
+// reply without learning the path (or the address) of the initiator. A SURB
+// must be used only once, otherwise the replies become linkable.
+type SURB struct {
+	// address of the first relay of the reply circuit
+	FirstHop []byte
+
+	// pre-computed header which routes the reply back to the initiator
+	Header *Header
+
+	// key used by the replier to encrypt the reply payload
+	Key [sharedSecretSize]byte
+}
+
+// SURBKeys are kept by the initiator of the SURB and are used to decrypt the
+// reply payload once it reaches the initiator
+type SURBKeys struct {
+	suite         scrypto.CipherSuite
+	sharedSecrets []scrypto.Hash256
+	payloadKey    [sharedSecretSize]byte
+}
+
+// NewSURB creates a single use reply block and the keys necessary to decrypt
+// the reply. The parameters are the same as in NewPacket, where finalAddr is
+// the address of the initiator of the SURB. As in NewPacket, the session key
+// should be wiped by the caller with scrypto.WipeECDSAKey.
+func NewSURB(sessionKey *ecdsa.PrivateKey, circuitPubKeys []ecdsa.PublicKey,
+	finalAddr []byte, relayAddrs [][]byte, opts ...HeaderOption) (*SURB, *SURBKeys, error) {
+
+	return NewSURBContext(context.Background(), sessionKey, circuitPubKeys,
+		finalAddr, relayAddrs, opts...)
+}
+
+// NewSURBContext is like NewSURB, but stops constructing the SURB and returns
+// the context error once the context is done
+func NewSURBContext(ctx context.Context, sessionKey *ecdsa.PrivateKey,
+	circuitPubKeys []ecdsa.PublicKey, finalAddr []byte, relayAddrs [][]byte,
+	opts ...HeaderOption) (*SURB, *SURBKeys, error) {
+
+	sk := scrypto.P256PrivateKey(sessionKey)
+	defer scrypto.Wipe(sk)
+
+	return NewSURBWithSuiteContext(ctx, scrypto.DefaultSuite, sk,
+		p256PublicKeys(circuitPubKeys), finalAddr, relayAddrs, opts...)
+}
+
+// NewSURBWithSuite creates a single use reply block using the given cipher
+// suite. The parameters are the same as in NewPacketWithSuite.
+func NewSURBWithSuite(suite scrypto.CipherSuite, sessionKey []byte,
+	circuitPubKeys [][]byte, finalAddr []byte, relayAddrs [][]byte,
+	opts ...HeaderOption) (*SURB, *SURBKeys, error) {
+
+	return NewSURBWithSuiteContext(context.Background(), suite, sessionKey,
+		circuitPubKeys, finalAddr, relayAddrs, opts...)
+}
+
+// NewSURBWithSuiteContext is like NewSURBWithSuite, but stops constructing the
+// SURB and returns the context error once the context is done
+func NewSURBWithSuiteContext(ctx context.Context, suite scrypto.CipherSuite,
+	sessionKey []byte, circuitPubKeys [][]byte, finalAddr []byte, relayAddrs [][]byte,
+	opts ...HeaderOption) (*SURB, *SURBKeys, error) {
+
+	if len(circuitPubKeys) == 0 || len(relayAddrs) == 0 {
+		return &SURB{}, &SURBKeys{},
+			errors.New("Err: A set of relay pulic keys and addresses must be provided")
+	}
+
+	header, sharedSecrets, err := newHeader(ctx, suite, sessionKey, circuitPubKeys,
+		finalAddr, relayAddrs, opts)
+	if err != nil {
+		return &SURB{}, &SURBKeys{}, err
+	}
+
+	var key [sharedSecretSize]byte
+	_, err = rand.Read(key[:])
+	if err != nil {
+		return &SURB{}, &SURBKeys{}, err
+	}
+
+	surb := &SURB{
+		FirstHop: relayAddrs[0],
+		Header:   header,
+		Key:      key,
+	}
+	keys := &SURBKeys{
+		suite:         suite,
+		sharedSecrets: sharedSecrets,
+		payloadKey:    key,
+	}
+	return surb, keys, nil
+}
+
+// NewPacket wraps the reply payload in a packet that can be forwarded to the
+// first hop of the reply circuit
+func (s *SURB) NewPacket(payload [payloadSize]byte) (*Packet, error) {
+	suite, err := scrypto.SuiteByID(s.Header.Suite)
+	if err != nil {
+		return &Packet{}, err
+	}
+
+	p, err := suite.SPRP().Encrypt(s.Key[:], payload[:])
+	if err != nil {
+		return &Packet{}, err
+	}
+
+	var encPayload [payloadSize]byte
+	copy(encPayload[:], p)
+
+	return &Packet{
+		Version: defRealm,
+		Header:  s.Header,
+		Payload: encPayload,
+	}, nil
+}
+
+// Unwrap decrypts the payload of a reply that has traversed the whole reply
+// circuit. Each relay decrypted the payload with its shared secret, so the
+// initiator re-encrypts it with all shared secrets before removing the layer
+// added by the replier.
+func (k *SURBKeys) Unwrap(payload [payloadSize]byte) ([payloadSize]byte, error) {
+	p, err := encryptPayload(k.suite, payload, k.sharedSecrets)
+	if err != nil {
+		return [payloadSize]byte{}, err
+	}
+
+	d, err := k.suite.SPRP().Decrypt(k.payloadKey[:], p[:])
+	if err != nil {
+		return [payloadSize]byte{}, err
+	}
+
+	var res [payloadSize]byte
+	copy(res[:], d)
+	return res, nil
+}
+
+// Wipe overwrites the SURB keys with zeroes. It should be called once the reply
+// has been received, or once the SURB is discarded.
+func (k *SURBKeys) Wipe() {
+	scrypto.WipeHashes(k.sharedSecrets)
+	scrypto.Wipe(k.payloadKey[:])
+}
+
+// SURB encoding auxiliar data structure and logic
+type S struct {
+	F []byte
+	H []byte
+	K [sharedSecretSize]byte
+}
+
+func (s *SURB) GobEncode() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	enc := gob.NewEncoder(buf)
+
+	if s.Header == nil {
+		return []byte{}, errors.New("Err encoding SURB: header is empty")
+	}
+
+	he, err := s.Header.GobEncode()
+	if err != nil {
+		return []byte{}, err
+	}
+
+	err = enc.Encode(S{F: s.FirstHop, H: he, K: s.Key})
+	if err != nil {
+		return []byte{}, fmt.Errorf("Err encoding SURB: %s", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *SURB) GobDecode(raw []byte) error {
+	r := bytes.NewReader(raw)
+	dec := gob.NewDecoder(r)
+
+	var sbuf S
+	err := dec.Decode(&sbuf)
+	if err != nil {
+		return fmt.Errorf("Err decoding SURB: %s", err)
+	}
+
+	var header Header
+	err = header.GobDecode(sbuf.H)
+	if err != nil {
+		return err
+	}
+
+	s.FirstHop = sbuf.F
+	s.Header = &header
+	s.Key = sbuf.K
+	return nil
+}
@@ -0,0 +1,112 @@
+package sphinx
+
+import (
+	"crypto/ecdsa"
+	ec "crypto/elliptic"
+	"crypto/rand"
+	scrypto "github.com/hashmatter/p3lib/sphinx/crypto"
+	"testing"
+)
+
+// tests the construction of a SURB, the reply packet construction by the
+// replier and the payload decryption by the SURB initiator
+func TestSURBEndToEnd(t *testing.T) {
+	numRelays := 3
+	initiatorAddr := []byte("/ip4/127.0.0.1/udp/1234")
+	relayAddrs := [][]byte{
+		[]byte("/ip4/127.0.0.1/udp/1235"),
+		[]byte("QmPxawpH7ymXENBZcbKpV3NTxMc4fs37gmREn8e9C2kgNe"),
+		[]byte("/ip4/120.120.0.2/tcp/1222"),
+	}
+
+	circuitPrivKeys := make([]ecdsa.PrivateKey, numRelays)
+	circuitPubKeys := make([]ecdsa.PublicKey, numRelays)
+	for i := 0; i < numRelays; i++ {
+		pub, priv := generateHopKeys()
+		circuitPrivKeys[i] = *priv
+		circuitPubKeys[i] = *pub
+	}
+
+	privSender, _ := ecdsa.GenerateKey(ec.P256(), rand.Reader)
+	surb, keys, err := NewSURB(privSender, circuitPubKeys, initiatorAddr, relayAddrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// SURB is sent to the replier
+	raw, err := surb.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rsurb SURB
+	err = rsurb.GobDecode(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(rsurb.FirstHop) != string(relayAddrs[0]) {
+		t.Errorf("SURB first hop mismatch: %v != %v", rsurb.FirstHop, relayAddrs[0])
+	}
+
+	var payload [payloadSize]byte
+	copy(payload[:], []byte("hello back!"))
+	packet, err := rsurb.NewPacket(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var nextAddr [addrSize]byte
+	for i := 0; i < numRelays; i++ {
+		if string(packet.Payload[:]) == string(payload[:]) {
+			t.Errorf("Reply payload is not encrypted at hop %v", i)
+		}
+		r := NewRelayerCtx(&circuitPrivKeys[i])
+		nextAddr, packet, err = r.ProcessPacket(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !packet.IsLast() {
+		t.Error("Reply packet should be last after traversing the circuit")
+	}
+
+	var expAddr [addrSize]byte
+	copy(expAddr[:], initiatorAddr)
+	if nextAddr != expAddr {
+		t.Errorf("Reply is not routed to initiator: %v != %v", nextAddr, expAddr)
+	}
+
+	// exit relay must not learn the reply payload
+	if string(packet.Payload[:]) == string(payload[:]) {
+		t.Error("Reply payload is not encrypted at the exit relay")
+	}
+
+	res, err := keys.Unwrap(packet.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != payload {
+		t.Errorf("Reply payload was not recovered: %v != %v", res, payload)
+	}
+}
+
+func TestSURBKeysWipe(t *testing.T) {
+	pub, _ := generateHopKeys()
+	privSender, _ := ecdsa.GenerateKey(ec.P256(), rand.Reader)
+	_, keys, err := NewSURB(privSender, []ecdsa.PublicKey{*pub},
+		[]byte("initiator"), [][]byte{[]byte("relay0")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys.Wipe()
+	if keys.payloadKey != [sharedSecretSize]byte{} {
+		t.Error("SURB payload key was not wiped")
+	}
+	for _, s := range keys.sharedSecrets {
+		if s != (scrypto.Hash256{}) {
+			t.Error("SURB shared secret was not wiped")
+		}
+	}
+}
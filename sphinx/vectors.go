@@ -0,0 +1,120 @@
+package sphinx
+
+import (
+	"encoding/hex"
+	"fmt"
+	scrypto "github.com/hashmatter/p3lib/sphinx/crypto"
+)
+
+// TestVector describes the construction of a packet and its processing by
+// every hop of the circuit. Test vectors are used to check other
+// implementations against p3lib and to catch changes of the packet format. All
+// byte fields are hex encoded.
+type TestVector struct {
+	Suite       string `json:"suite"`
+	SuiteID     byte   `json:"suite_id"`
+	SessionKey  string `json:"session_key"`
+	Destination string `json:"destination"`
+	Payload     string `json:"payload"`
+
+	// packet constructed by the initiator
+	Packet VectorPacket `json:"packet"`
+
+	Hops []VectorHop `json:"hops"`
+}
+
+// VectorHop is a hop of a test vector circuit
+type VectorHop struct {
+	PrivKey      string `json:"priv_key"`
+	PubKey       string `json:"pub_key"`
+	Addr         string `json:"addr"`
+	SharedSecret string `json:"shared_secret"`
+
+	// address and packet output by the hop after processing the packet
+	NextAddr string       `json:"next_addr"`
+	Output   VectorPacket `json:"output"`
+}
+
+// VectorPacket is the hex encoding of the fields of a packet
+type VectorPacket struct {
+	GroupElement   string `json:"group_element"`
+	RoutingInfo    string `json:"routing_info"`
+	RoutingInfoMac string `json:"routing_info_mac"`
+	Payload        string `json:"payload"`
+}
+
+// NewTestVector constructs a packet with the given session key, hop private
+// keys, addresses and payload and records every intermediate state of the
+// packet while it is processed by the circuit.
+func NewTestVector(suite scrypto.CipherSuite, sessionKey []byte, hopKeys [][]byte,
+	finalAddr []byte, relayAddrs [][]byte, payload [payloadSize]byte) (*TestVector, error) {
+
+	// KEM encapsulation is randomized, so packets of hybrid suites can not be
+	// reproduced from the inputs
+	if suite.KEM() != nil {
+		return nil, fmt.Errorf("Test vectors are not supported for hybrid suite %v",
+			suite.Name())
+	}
+
+	if len(hopKeys) != len(relayAddrs) {
+		return nil, fmt.Errorf("Expected %v relay addresses, got %v", len(hopKeys),
+			len(relayAddrs))
+	}
+
+	pubKeys := make([][]byte, len(hopKeys))
+	for i, k := range hopKeys {
+		pub, err := suite.Group().ScalarBaseMult(k)
+		if err != nil {
+			return nil, err
+		}
+		pubKeys[i] = pub
+	}
+
+	packet, err := NewPacketWithSuite(suite, sessionKey, pubKeys, finalAddr,
+		relayAddrs, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &TestVector{
+		Suite:       suite.Name(),
+		SuiteID:     byte(suite.ID()),
+		SessionKey:  hex.EncodeToString(sessionKey),
+		Destination: hex.EncodeToString(finalAddr),
+		Payload:     hex.EncodeToString(payload[:]),
+		Packet:      newVectorPacket(packet),
+	}
+
+	for i, k := range hopKeys {
+		secret, err := scrypto.SharedSecret(suite, k, packet.GroupElement)
+		if err != nil {
+			return nil, err
+		}
+
+		r := NewRelayerCtxWithKeys(SuiteKey{Suite: suite, PrivKey: k})
+		nextAddr, next, err := r.ProcessPacket(packet)
+		if err != nil {
+			return nil, fmt.Errorf("Processing packet at hop %v: %v", i, err)
+		}
+
+		v.Hops = append(v.Hops, VectorHop{
+			PrivKey:      hex.EncodeToString(k),
+			PubKey:       hex.EncodeToString(pubKeys[i]),
+			Addr:         hex.EncodeToString(relayAddrs[i]),
+			SharedSecret: hex.EncodeToString(secret[:]),
+			NextAddr:     hex.EncodeToString(nextAddr[:]),
+			Output:       newVectorPacket(next),
+		})
+		packet = next
+	}
+	return v, nil
+}
+
+func newVectorPacket(p *Packet) VectorPacket {
+	return VectorPacket{
+		GroupElement:   hex.EncodeToString(p.GroupElement),
+		RoutingInfo:    hex.EncodeToString(p.RoutingInfo[:]),
+		RoutingInfoMac: hex.EncodeToString(p.RoutingInfoMac[:]),
+		Payload:        hex.EncodeToString(p.Payload[:]),
+	}
+}
@@ -0,0 +1,94 @@
+package sphinx
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	scrypto "github.com/hashmatter/p3lib/sphinx/crypto"
+	"io/ioutil"
+	"testing"
+)
+
+// replays the published test vectors (generated by `p3lib vectors`) against
+// NewPacket and ProcessPacket. A failure means that the packet format changed,
+// in which case the vectors must be regenerated and the change documented.
+func TestConformanceVectors(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []TestVector
+	err = json.Unmarshal(raw, &vectors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vectors) == 0 {
+		t.Fatal("No test vectors found")
+	}
+
+	for i, v := range vectors {
+		suite, err := scrypto.SuiteByID(scrypto.SuiteID(v.SuiteID))
+		if err != nil {
+			t.Fatalf("Vector %v: %v", i, err)
+		}
+
+		hopKeys := make([][]byte, len(v.Hops))
+		pubKeys := make([][]byte, len(v.Hops))
+		relayAddrs := make([][]byte, len(v.Hops))
+		for j, h := range v.Hops {
+			hopKeys[j] = mustHex(t, h.PrivKey)
+			pubKeys[j] = mustHex(t, h.PubKey)
+			relayAddrs[j] = mustHex(t, h.Addr)
+		}
+		var payload [payloadSize]byte
+		copy(payload[:], mustHex(t, v.Payload))
+
+		packet, err := NewPacketWithSuite(suite, mustHex(t, v.SessionKey), pubKeys,
+			mustHex(t, v.Destination), relayAddrs, payload)
+		if err != nil {
+			t.Fatalf("Vector %v: %v", i, err)
+		}
+		checkVectorPacket(t, i, -1, v.Packet, packet)
+
+		for j, h := range v.Hops {
+			secret, err := scrypto.SharedSecret(suite, hopKeys[j], packet.GroupElement)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hex.EncodeToString(secret[:]) != h.SharedSecret {
+				t.Errorf("Vector %v hop %v: shared secret mismatch:\n >> %x\n >> %v",
+					i, j, secret, h.SharedSecret)
+			}
+
+			r := NewRelayerCtxWithKeys(SuiteKey{Suite: suite, PrivKey: hopKeys[j]})
+			nextAddr, next, err := r.ProcessPacket(packet)
+			if err != nil {
+				t.Fatalf("Vector %v hop %v: %v", i, j, err)
+			}
+			if hex.EncodeToString(nextAddr[:]) != h.NextAddr {
+				t.Errorf("Vector %v hop %v: next address mismatch", i, j)
+			}
+			checkVectorPacket(t, i, j, h.Output, next)
+			packet = next
+		}
+
+		if !packet.IsLast() || packet.Payload != payload {
+			t.Errorf("Vector %v: payload was not recovered by the last hop", i)
+		}
+	}
+}
+
+func checkVectorPacket(t *testing.T, vector, hop int, exp VectorPacket, p *Packet) {
+	got := newVectorPacket(p)
+	if got != exp {
+		t.Errorf("Vector %v hop %v: packet mismatch:\n >> %+v\n >> %+v",
+			vector, hop, got, exp)
+	}
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}